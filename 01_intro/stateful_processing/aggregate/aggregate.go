@@ -0,0 +1,194 @@
+// Package aggregate computes configurable aggregations (count, sum, min,
+// max, average, distinct count and top-K) over the fields of JSON events,
+// grouped by a field or the message key. A Pipeline plugs into the
+// windowing package as its Aggregator.
+package aggregate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Kind string
+
+const (
+	Count         Kind = "count"
+	Sum           Kind = "sum"
+	Min           Kind = "min"
+	Max           Kind = "max"
+	Avg           Kind = "avg"
+	DistinctCount Kind = "distinct_count"
+	TopK          Kind = "top_k"
+)
+
+const (
+	// DefaultK is how many values top_k reports when k is not set
+	DefaultK = 3
+	// DefaultPrecision of distinct_count: 2^10 registers, about 3% error
+	DefaultPrecision = 10
+	// DefaultKeyOutput is the output field of the group key
+	DefaultKeyOutput = "user_id"
+)
+
+var ErrInvalidConfig = errors.New("invalid aggregation config")
+
+// Spec is one aggregation of the config.
+type Spec struct {
+	Type Kind `json:"type"`
+	// Field is the JSON field aggregated, dots go into nested objects. A
+	// count without field counts the events.
+	Field string `json:"field,omitempty"`
+	// Output is the field of the result, <type>_<field> by default
+	Output string `json:"output,omitempty"`
+	// K is how many values top_k reports
+	K int `json:"k,omitempty"`
+	// Precision of distinct_count, 4 to 16: the error is about 1.04/sqrt(2^precision)
+	Precision int `json:"precision,omitempty"`
+}
+
+// Config tells what to aggregate and how the results are named.
+type Config struct {
+	// GroupBy is the JSON field the events are grouped by, the message key when empty
+	GroupBy string `json:"group_by,omitempty"`
+	// KeyOutput is the output field of the group
+	KeyOutput    string `json:"key_output,omitempty"`
+	Aggregations []Spec `json:"aggregations"`
+}
+
+// Default counts the events of every message key, like the click counter
+// always did.
+func Default() Config {
+	return Config{
+		KeyOutput:    DefaultKeyOutput,
+		Aggregations: []Spec{{Type: Count, Output: "click_count"}},
+	}
+}
+
+// Load reads a JSON config, the defaults when path is empty.
+func Load(path string) (Config, error) {
+	if path == "" {
+		return Default(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+	cfg.setDefaults()
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) setDefaults() {
+	if c.KeyOutput == "" {
+		c.KeyOutput = DefaultKeyOutput
+	}
+	for i := range c.Aggregations {
+		spec := &c.Aggregations[i]
+		if spec.Output == "" {
+			spec.Output = string(spec.Type)
+			if spec.Field != "" {
+				spec.Output += "_" + strings.ReplaceAll(spec.Field, ".", "_")
+			}
+		}
+		if spec.Type == TopK && spec.K == 0 {
+			spec.K = DefaultK
+		}
+		if spec.Type == DistinctCount && spec.Precision == 0 {
+			spec.Precision = DefaultPrecision
+		}
+	}
+}
+
+// reservedOutputs are the fields every result has besides the aggregations.
+var reservedOutputs = []string{"window_type", "window_start", "window_end"}
+
+func (c Config) Validate() error {
+	if len(c.Aggregations) == 0 {
+		return fmt.Errorf("%w: no aggregations", ErrInvalidConfig)
+	}
+	outputs := map[string]bool{c.KeyOutput: true}
+	for _, reserved := range reservedOutputs {
+		outputs[reserved] = true
+	}
+	for _, spec := range c.Aggregations {
+		if _, ok := factories[spec.Type]; !ok {
+			return fmt.Errorf("%w: unknown aggregation %q", ErrInvalidConfig, spec.Type)
+		}
+		if spec.Field == "" && spec.Type != Count {
+			return fmt.Errorf("%w: %s needs a field", ErrInvalidConfig, spec.Type)
+		}
+		if outputs[spec.Output] {
+			return fmt.Errorf("%w: output %q is used twice", ErrInvalidConfig, spec.Output)
+		}
+		outputs[spec.Output] = true
+		if spec.Type == TopK && spec.K < 1 {
+			return fmt.Errorf("%w: top_k needs k >= 1", ErrInvalidConfig)
+		}
+		if spec.Type == DistinctCount && (spec.Precision < 4 || spec.Precision > 16) {
+			return fmt.Errorf("%w: distinct_count precision must be 4 to 16", ErrInvalidConfig)
+		}
+	}
+	return nil
+}
+
+func (c Config) String() string {
+	specs := make([]string, 0, len(c.Aggregations))
+	for _, spec := range c.Aggregations {
+		if spec.Field == "" {
+			specs = append(specs, string(spec.Type))
+		} else {
+			specs = append(specs, fmt.Sprintf("%s(%s)", spec.Type, spec.Field))
+		}
+	}
+	by := c.GroupBy
+	if by == "" {
+		by = "message key"
+	}
+	return fmt.Sprintf("%s by %s", strings.Join(specs, ", "), by)
+}
+
+// Accumulator aggregates the values of one window. It is saved to the state
+// store as JSON: New must return a pointer json.Unmarshal can fill, the
+// settings of the spec go in unexported fields.
+type Accumulator interface {
+	// Add is only called with the values the event has
+	Add(value any)
+	// Merge adds other, an accumulator of the same aggregation
+	Merge(other Accumulator)
+	Result() any
+}
+
+// Aggregator makes the empty accumulators of one aggregation.
+type Aggregator interface {
+	New() Accumulator
+}
+
+type AggregatorFunc func() Accumulator
+
+func (f AggregatorFunc) New() Accumulator {
+	return f()
+}
+
+// Factory builds the aggregator of a spec.
+type Factory func(spec Spec) Aggregator
+
+var factories = map[Kind]Factory{
+	Count:         func(Spec) Aggregator { return AggregatorFunc(func() Accumulator { return &count{} }) },
+	Sum:           func(Spec) Aggregator { return AggregatorFunc(func() Accumulator { return &sum{} }) },
+	Min:           func(Spec) Aggregator { return AggregatorFunc(func() Accumulator { return &extreme{min: true} }) },
+	Max:           func(Spec) Aggregator { return AggregatorFunc(func() Accumulator { return &extreme{} }) },
+	Avg:           func(Spec) Aggregator { return AggregatorFunc(func() Accumulator { return &avg{} }) },
+	DistinctCount: newDistinctCount,
+	TopK:          newTopK,
+}
+
+// Register adds an aggregation type, before any config is loaded.
+func Register(kind Kind, factory Factory) {
+	factories[kind] = factory
+}
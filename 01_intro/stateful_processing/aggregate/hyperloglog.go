@@ -0,0 +1,120 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// valueKey is how distinct_count and top_k tell values apart: strings as
+// they are, anything else as its JSON.
+func valueKey(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// hash64 is FNV-1a with the murmur3 finalizer on top, the registers need
+// all 64 bits well mixed.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// HyperLogLog estimates how many distinct values were added in 2^p bytes,
+// whatever their number. Two of the same precision merge into the sketch of
+// both sets, so hopping windows and merged sessions stay exact sketches.
+type HyperLogLog struct {
+	// Registers hold, per bucket, the longest run of leading zeros seen + 1
+	Registers []uint8 `json:"registers"`
+}
+
+func NewHyperLogLog(precision int) *HyperLogLog {
+	return &HyperLogLog{Registers: make([]uint8, 1<<precision)}
+}
+
+func (h *HyperLogLog) precision() int {
+	return bits.TrailingZeros(uint(len(h.Registers)))
+}
+
+func (h *HyperLogLog) Add(value string) {
+	p := h.precision()
+	x := hash64(value)
+	// the first p bits pick the register, the rest is the run of zeros
+	index := x >> (64 - p)
+	rank := uint8(bits.LeadingZeros64(x<<p|1<<(p-1))) + 1
+	if rank > h.Registers[index] {
+		h.Registers[index] = rank
+	}
+}
+
+// Merge keeps the largest register of both, they must have the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.Registers {
+		if rank > h.Registers[i] {
+			h.Registers[i] = rank
+		}
+	}
+}
+
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(len(h.Registers))
+	var alpha float64
+	switch len(h.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	var sum float64
+	zeros := 0
+	for _, rank := range h.Registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	// small sets leave registers empty, linear counting is closer then
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+type distinctCount struct {
+	*HyperLogLog
+}
+
+func newDistinctCount(spec Spec) Aggregator {
+	return AggregatorFunc(func() Accumulator {
+		return &distinctCount{NewHyperLogLog(spec.Precision)}
+	})
+}
+
+func (d *distinctCount) Add(value any) {
+	d.HyperLogLog.Add(valueKey(value))
+}
+
+func (d *distinctCount) Merge(other Accumulator) {
+	d.HyperLogLog.Merge(other.(*distinctCount).HyperLogLog)
+}
+
+func (d *distinctCount) Result() any {
+	return d.Estimate()
+}
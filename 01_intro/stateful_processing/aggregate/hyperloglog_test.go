@@ -0,0 +1,67 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	tests := []struct {
+		precision int
+		distinct  int
+		// maxError is the relative error allowed, about 3 times the standard one
+		maxError float64
+	}{
+		{precision: 10, distinct: 10, maxError: 0},
+		{precision: 10, distinct: 500, maxError: 0.05},
+		{precision: 10, distinct: 10000, maxError: 0.1},
+		{precision: 10, distinct: 100000, maxError: 0.1},
+		{precision: 14, distinct: 100000, maxError: 0.025},
+		{precision: 4, distinct: 1000, maxError: 0.8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("p%d/%d", tt.precision, tt.distinct), func(t *testing.T) {
+			h := NewHyperLogLog(tt.precision)
+			for i := 0; i < tt.distinct; i++ {
+				// every value twice, repeats must not count
+				h.Add(fmt.Sprintf("user-%d", i))
+				h.Add(fmt.Sprintf("user-%d", i))
+			}
+			got := h.Estimate()
+			if e := relativeError(got, tt.distinct); e > tt.maxError {
+				t.Errorf("Estimate() = %d for %d distinct values, error %.3f > %.3f", got, tt.distinct, e, tt.maxError)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	// two overlapping halves of 0..19999
+	a, b := NewHyperLogLog(12), NewHyperLogLog(12)
+	both := NewHyperLogLog(12)
+	for i := 0; i < 20000; i++ {
+		value := fmt.Sprint(i)
+		if i < 12000 {
+			a.Add(value)
+		}
+		if i >= 8000 {
+			b.Add(value)
+		}
+		both.Add(value)
+	}
+	a.Merge(b)
+	// the merged sketch is the one of the union, not only close to it
+	for i := range a.Registers {
+		if a.Registers[i] != both.Registers[i] {
+			t.Fatalf("register %d = %d after merge, %d for the union", i, a.Registers[i], both.Registers[i])
+		}
+	}
+	if e := relativeError(a.Estimate(), 20000); e > 0.05 {
+		t.Errorf("Estimate() = %d after merge, want about 20000", a.Estimate())
+	}
+}
+
+func relativeError(got uint64, want int) float64 {
+	return math.Abs(float64(got)-float64(want)) / float64(want)
+}
@@ -0,0 +1,112 @@
+package aggregate
+
+import (
+	"math"
+	"strconv"
+)
+
+// number reads a numeric value, numbers in strings included. Other values
+// are skipped by the numeric aggregations.
+func number(value any) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case string:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+type count struct {
+	N int64 `json:"n"`
+}
+
+func (c *count) Add(any) {
+	c.N++
+}
+
+func (c *count) Merge(other Accumulator) {
+	c.N += other.(*count).N
+}
+
+func (c *count) Result() any {
+	return c.N
+}
+
+type sum struct {
+	Sum float64 `json:"sum"`
+}
+
+func (s *sum) Add(value any) {
+	if f, ok := number(value); ok {
+		s.Sum += f
+	}
+}
+
+func (s *sum) Merge(other Accumulator) {
+	s.Sum += other.(*sum).Sum
+}
+
+func (s *sum) Result() any {
+	return s.Sum
+}
+
+// extreme is min or max, null until a number comes.
+type extreme struct {
+	N     int64   `json:"n"`
+	Value float64 `json:"value"`
+	min   bool
+}
+
+func (e *extreme) Add(value any) {
+	if f, ok := number(value); ok {
+		e.take(1, f)
+	}
+}
+
+func (e *extreme) Merge(other Accumulator) {
+	if o := other.(*extreme); o.N > 0 {
+		e.take(o.N, o.Value)
+	}
+}
+
+// take counts n more numbers, f the extreme of them.
+func (e *extreme) take(n int64, f float64) {
+	if e.N == 0 || (e.min && f < e.Value) || (!e.min && f > e.Value) {
+		e.Value = f
+	}
+	e.N += n
+}
+
+func (e *extreme) Result() any {
+	if e.N == 0 {
+		return nil
+	}
+	return e.Value
+}
+
+type avg struct {
+	N   int64   `json:"n"`
+	Sum float64 `json:"sum"`
+}
+
+func (a *avg) Add(value any) {
+	if f, ok := number(value); ok {
+		a.N++
+		a.Sum += f
+	}
+}
+
+func (a *avg) Merge(other Accumulator) {
+	o := other.(*avg)
+	a.N += o.N
+	a.Sum += o.Sum
+}
+
+func (a *avg) Result() any {
+	if a.N == 0 {
+		return nil
+	}
+	return a.Sum / float64(a.N)
+}
@@ -0,0 +1,142 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Values are what an event brings to every aggregation, in config order:
+// the value of its field, nil when the event doesn't have it.
+type Values []any
+
+// Row is the accumulator of a window, one per aggregation in config order.
+type Row []Accumulator
+
+// Pipeline runs the aggregations of a config, it is the windowing
+// Aggregator of Values into Rows.
+type Pipeline struct {
+	cfg  Config
+	aggs []Aggregator
+}
+
+func New(cfg Config) (*Pipeline, error) {
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	aggs := make([]Aggregator, len(cfg.Aggregations))
+	for i, spec := range cfg.Aggregations {
+		aggs[i] = factories[spec.Type](spec)
+	}
+	return &Pipeline{cfg: cfg, aggs: aggs}, nil
+}
+
+func (p *Pipeline) Config() Config {
+	return p.cfg
+}
+
+// lookup finds the field of a JSON object, dots go into nested objects.
+func lookup(payload map[string]any, field string) any {
+	var value any = payload
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// Extract returns the group of an event and its values. The payload may
+// not be JSON, the fields are all missing then. It returns false when the
+// group by field is missing.
+func (p *Pipeline) Extract(key, payload []byte) (string, Values, bool) {
+	var fields map[string]any
+	_ = json.Unmarshal(payload, &fields)
+
+	group := string(key)
+	if p.cfg.GroupBy != "" {
+		value := lookup(fields, p.cfg.GroupBy)
+		if value == nil {
+			return "", nil, false
+		}
+		group = valueKey(value)
+	}
+
+	values := make(Values, len(p.cfg.Aggregations))
+	for i, spec := range p.cfg.Aggregations {
+		if spec.Field == "" {
+			// counted whatever the event holds
+			values[i] = true
+			continue
+		}
+		values[i] = lookup(fields, spec.Field)
+	}
+	return group, values, true
+}
+
+func (p *Pipeline) Zero() Row {
+	row := make(Row, len(p.aggs))
+	for i, agg := range p.aggs {
+		row[i] = agg.New()
+	}
+	return row
+}
+
+func (p *Pipeline) Add(row Row, values Values) Row {
+	for i, value := range values {
+		if value != nil {
+			row[i].Add(value)
+		}
+	}
+	return row
+}
+
+func (p *Pipeline) Merge(a, b Row) Row {
+	for i := range a {
+		a[i].Merge(b[i])
+	}
+	return a
+}
+
+// Output is the result of a window of group, the window fields aside.
+func (p *Pipeline) Output(group string, row Row) map[string]any {
+	output := map[string]any{p.cfg.KeyOutput: group}
+	for i, spec := range p.cfg.Aggregations {
+		output[spec.Output] = row[i].Result()
+	}
+	return output
+}
+
+// Decode reads a Row saved as JSON.
+func (p *Pipeline) Decode(data []byte) (Row, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) != len(p.aggs) {
+		return nil, fmt.Errorf("saved row has %d aggregations, the config %d", len(raw), len(p.aggs))
+	}
+	row := p.Zero()
+	for i := range raw {
+		if err := json.Unmarshal(raw[i], row[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.cfg.Aggregations[i].Output, err)
+		}
+	}
+	return row, nil
+}
+
+// Fingerprint identifies what the rows hold: state saved under another
+// fingerprint can't be decoded, or means something else. Output names are
+// left out, renaming them keeps the state.
+func (p *Pipeline) Fingerprint() string {
+	specs := make([]Spec, len(p.cfg.Aggregations))
+	for i, spec := range p.cfg.Aggregations {
+		spec.Output = ""
+		specs[i] = spec
+	}
+	data, _ := json.Marshal(Config{GroupBy: p.cfg.GroupBy, Aggregations: specs})
+	return string(data)
+}
@@ -0,0 +1,142 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "default", cfg: Default()},
+		{name: "no aggregations", cfg: Config{}, wantErr: true},
+		{name: "unknown type", cfg: Config{Aggregations: []Spec{{Type: "median", Field: "x"}}}, wantErr: true},
+		{name: "sum without field", cfg: Config{Aggregations: []Spec{{Type: Sum}}}, wantErr: true},
+		{name: "count without field", cfg: Config{Aggregations: []Spec{{Type: Count}}}},
+		{
+			name:    "output used twice",
+			cfg:     Config{Aggregations: []Spec{{Type: Sum, Field: "x", Output: "v"}, {Type: Max, Field: "x", Output: "v"}}},
+			wantErr: true,
+		},
+		{name: "output of the key", cfg: Config{Aggregations: []Spec{{Type: Count, Output: DefaultKeyOutput}}}, wantErr: true},
+		{name: "reserved output", cfg: Config{Aggregations: []Spec{{Type: Count, Output: "window_end"}}}, wantErr: true},
+		{name: "top_k defaults", cfg: Config{Aggregations: []Spec{{Type: TopK, Field: "page"}}}},
+		{name: "precision too high", cfg: Config{Aggregations: []Spec{{Type: DistinctCount, Field: "x", Precision: 17}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("New() error = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	p, err := New(Config{
+		GroupBy: "user.id",
+		Aggregations: []Spec{
+			{Type: Count},
+			{Type: Sum, Field: "amount"},
+			{Type: Min, Field: "amount"},
+			{Type: Max, Field: "amount"},
+			{Type: Avg, Field: "amount"},
+			{Type: DistinctCount, Field: "page"},
+			{Type: TopK, Field: "page", K: 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{
+		`{"user": {"id": 1}, "amount": 10, "page": "home"}`,
+		`{"user": {"id": 1}, "amount": "2.5", "page": "cart"}`,
+		`{"user": {"id": 1}, "page": "home"}`,
+		`{"user": {"id": 1}, "amount": "n/a", "page": "home"}`,
+		`{"user": {"id": 2}, "amount": 100}`,
+		`{"amount": 1}`,
+		`not json`,
+	}
+	rows := map[string]Row{}
+	for _, event := range events {
+		group, values, ok := p.Extract([]byte("key"), []byte(event))
+		if !ok {
+			continue
+		}
+		row, found := rows[group]
+		if !found {
+			row = p.Zero()
+		}
+		rows[group] = p.Add(row, values)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("groups = %d, want 2, events without the group by field are skipped", len(rows))
+	}
+
+	want := map[string]map[string]any{
+		"1": {
+			DefaultKeyOutput:      "1",
+			"count":               int64(4),
+			"sum_amount":          12.5,
+			"min_amount":          2.5,
+			"max_amount":          10.0,
+			"avg_amount":          6.25,
+			"distinct_count_page": uint64(2),
+			"top_k_page":          []topEntry{{Value: "home", Count: 3}, {Value: "cart", Count: 1}},
+		},
+		"2": {
+			DefaultKeyOutput:      "2",
+			"count":               int64(1),
+			"sum_amount":          100.0,
+			"min_amount":          100.0,
+			"max_amount":          100.0,
+			"avg_amount":          100.0,
+			"distinct_count_page": uint64(0),
+			"top_k_page":          []topEntry{},
+		},
+	}
+	for group, row := range rows {
+		if got := p.Output(group, row); !reflect.DeepEqual(got, want[group]) {
+			t.Errorf("Output(%s) = %v, want %v", group, got, want[group])
+		}
+
+		// a row saved to the state store comes back the same
+		data, err := json.Marshal(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := p.Decode(data)
+		if err != nil {
+			t.Fatalf("Decode(%s): %v", data, err)
+		}
+		if got := p.Output(group, decoded); !reflect.DeepEqual(got, want[group]) {
+			t.Errorf("Output(%s) after Decode = %v, want %v", group, got, want[group])
+		}
+	}
+
+	// merging the rows of both groups, like a session merge does
+	merged := p.Output("both", p.Merge(rows["1"], rows["2"]))
+	if merged["count"] != int64(5) || merged["min_amount"] != 2.5 || merged["max_amount"] != 100.0 || merged["sum_amount"] != 112.5 {
+		t.Errorf("merged output = %v", merged)
+	}
+}
+
+func TestPipelineDecodeRejectsAnotherConfig(t *testing.T) {
+	p, err := New(Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Decode([]byte(`[{"n": 1}, {"sum": 2}]`)); err == nil {
+		t.Error("Decode of a row with 2 aggregations succeeded for a config with 1")
+	}
+}
@@ -0,0 +1,75 @@
+package aggregate
+
+import "sort"
+
+// capacityPerK is how many values top_k tracks per value it reports. The
+// counts are exact while fewer values come, approximate after that.
+const capacityPerK = 10
+
+// topK is the Space-Saving algorithm: it tracks a bounded number of values,
+// a new one replaces the least counted and inherits its count. Frequent
+// values stay, the counts of the others may be overestimated.
+type topK struct {
+	Counts   map[string]int64 `json:"counts"`
+	k        int
+	capacity int
+}
+
+func newTopK(spec Spec) Aggregator {
+	return AggregatorFunc(func() Accumulator {
+		return &topK{Counts: make(map[string]int64), k: spec.K, capacity: spec.K * capacityPerK}
+	})
+}
+
+func (t *topK) Add(value any) {
+	t.add(valueKey(value), 1)
+}
+
+func (t *topK) add(value string, n int64) {
+	if _, ok := t.Counts[value]; ok || len(t.Counts) < t.capacity {
+		t.Counts[value] += n
+		return
+	}
+	least, leastCount := "", int64(-1)
+	for v, count := range t.Counts {
+		if leastCount < 0 || count < leastCount || (count == leastCount && v > least) {
+			least, leastCount = v, count
+		}
+	}
+	delete(t.Counts, least)
+	t.Counts[value] = leastCount + n
+}
+
+func (t *topK) Merge(other Accumulator) {
+	for value, count := range other.(*topK).Counts {
+		t.Counts[value] += count
+	}
+	// keep the most counted ones
+	for _, entry := range t.top(len(t.Counts))[min(t.capacity, len(t.Counts)):] {
+		delete(t.Counts, entry.Value)
+	}
+}
+
+type topEntry struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// top returns the n most counted values, most counted first.
+func (t *topK) top(n int) []topEntry {
+	entries := make([]topEntry, 0, len(t.Counts))
+	for value, count := range t.Counts {
+		entries = append(entries, topEntry{Value: value, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Value < entries[j].Value
+	})
+	return entries[:min(n, len(entries))]
+}
+
+func (t *topK) Result() any {
+	return t.top(t.k)
+}
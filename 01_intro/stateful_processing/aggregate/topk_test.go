@@ -0,0 +1,92 @@
+package aggregate
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// stream returns the values of a skewed stream, shuffled: hot[i] comes
+// counts[i] times, then noise distinct values come once or twice.
+func stream(hot []string, counts []int, noise int, seed int64) []string {
+	var values []string
+	for i, value := range hot {
+		for j := 0; j < counts[i]; j++ {
+			values = append(values, value)
+		}
+	}
+	for i := 0; i < noise; i++ {
+		for j := 0; j <= i%2; j++ {
+			values = append(values, fmt.Sprintf("noise-%d", i))
+		}
+	}
+	rand.New(rand.NewSource(seed)).Shuffle(len(values), func(i, j int) {
+		values[i], values[j] = values[j], values[i]
+	})
+	return values
+}
+
+func topValues(entries []topEntry) []string {
+	var values []string
+	for _, entry := range entries {
+		values = append(values, entry.Value)
+	}
+	return values
+}
+
+func TestTopK(t *testing.T) {
+	tests := []struct {
+		name   string
+		k      int
+		hot    []string
+		counts []int
+		noise  int
+		// exact is true when fewer values than the capacity came
+		exact bool
+	}{
+		{name: "exact", k: 3, hot: []string{"a", "b", "c", "d"}, counts: []int{50, 40, 30, 20}, noise: 10, exact: true},
+		{name: "heavy hitters over many values", k: 3, hot: []string{"a", "b", "c"}, counts: []int{3000, 2000, 1000}, noise: 20000},
+		{name: "k of 1", k: 1, hot: []string{"x", "y"}, counts: []int{5000, 1000}, noise: 20000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := newTopK(Spec{K: tt.k}).New().(*topK)
+			for _, value := range stream(tt.hot, tt.counts, tt.noise, 1) {
+				acc.Add(value)
+			}
+			got := acc.Result().([]topEntry)
+			if want := tt.hot[:tt.k]; !slices.Equal(topValues(got), want) {
+				t.Fatalf("top %d = %v, want %v", tt.k, got, want)
+			}
+			if len(acc.Counts) > tt.k*capacityPerK {
+				t.Errorf("tracks %d values, capacity %d", len(acc.Counts), tt.k*capacityPerK)
+			}
+			for i, entry := range got {
+				// Space-Saving only overestimates
+				if entry.Count < int64(tt.counts[i]) || (tt.exact && entry.Count != int64(tt.counts[i])) {
+					t.Errorf("count of %s = %d, %d came", entry.Value, entry.Count, tt.counts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTopKMerge(t *testing.T) {
+	agg := newTopK(Spec{K: 2})
+	a, b := agg.New().(*topK), agg.New().(*topK)
+	for _, value := range stream([]string{"a", "b"}, []int{1000, 10}, 5000, 1) {
+		a.Add(value)
+	}
+	for _, value := range stream([]string{"b", "c"}, []int{1500, 10}, 5000, 2) {
+		b.Add(value)
+	}
+	a.Merge(b)
+	got := a.Result().([]topEntry)
+	if !slices.Equal(topValues(got), []string{"b", "a"}) {
+		t.Errorf("top 2 after merge = %v, want [b a]", got)
+	}
+	if len(a.Counts) > 2*capacityPerK {
+		t.Errorf("tracks %d values after merge, capacity %d", len(a.Counts), 2*capacityPerK)
+	}
+}
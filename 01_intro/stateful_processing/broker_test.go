@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// fakeBroker keeps what is produced to it, one partition per topic.
+type fakeBroker struct {
+	mu   sync.Mutex
+	logs map[string][]kafka.Message
+	// err fails every produce request, or the next failures ones
+	err      error
+	failures int
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{logs: make(map[string][]kafka.Message)}
+}
+
+func (b *fakeBroker) messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.logs[topic])
+}
+
+func (b *fakeBroker) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// failNext fails the next n produce requests with err.
+func (b *fakeBroker) failNext(n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err, b.failures = err, n
+}
+
+// writer writes to the broker without batching.
+func (b *fakeBroker) writer() *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP("localhost:9092"),
+		Transport:    b,
+		BatchTimeout: time.Millisecond,
+		MaxAttempts:  1,
+	}
+}
+
+// client asks the broker for metadata and offsets.
+func (b *fakeBroker) client() *kafka.Client {
+	return &kafka.Client{Addr: kafka.TCP("localhost:9092"), Transport: b}
+}
+
+func (b *fakeBroker) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch req := req.(type) {
+	case *metadata.Request:
+		resp := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}}}
+		for _, topic := range req.TopicNames {
+			resp.Topics = append(resp.Topics, metadata.ResponseTopic{
+				Name:       topic,
+				Partitions: []metadata.ResponsePartition{{PartitionIndex: 0, LeaderID: 1}},
+			})
+		}
+		return resp, nil
+	case *listoffsets.Request:
+		resp := &listoffsets.Response{}
+		for _, topic := range req.Topics {
+			respTopic := listoffsets.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				var offset int64
+				if partition.Timestamp == kafka.LastOffset {
+					offset = int64(len(b.logs[topic.Topic]))
+				}
+				respTopic.Partitions = append(respTopic.Partitions, listoffsets.ResponsePartition{
+					Partition: partition.Partition,
+					Timestamp: partition.Timestamp,
+					Offset:    offset,
+				})
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil
+	case *produce.Request:
+		if b.err != nil {
+			if b.failures > 0 {
+				if b.failures--; b.failures == 0 {
+					defer func() { b.err = nil }()
+				}
+			}
+			return nil, b.err
+		}
+		resp := &produce.Response{}
+		for _, topic := range req.Topics {
+			for _, partition := range topic.Partitions {
+				base := int64(len(b.logs[topic.Topic]))
+				for {
+					record, err := partition.RecordSet.Records.ReadRecord()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return nil, err
+					}
+					key, _ := protocol.ReadAll(record.Key)
+					value, _ := protocol.ReadAll(record.Value)
+					b.logs[topic.Topic] = append(b.logs[topic.Topic], kafka.Message{
+						Topic:  topic.Topic,
+						Offset: int64(len(b.logs[topic.Topic])),
+						Key:    key,
+						Value:  value,
+						Time:   record.Time,
+					})
+				}
+				resp.Topics = append(resp.Topics, produce.ResponseTopic{
+					Topic:      topic.Topic,
+					Partitions: []produce.ResponsePartition{{Partition: partition.Partition, BaseOffset: base}},
+				})
+			}
+		}
+		return resp, nil
+	default:
+		return nil, errors.New("fake broker: unsupported request")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// emitBatchSize caps how many results go in one write
+	emitBatchSize = 100
+	emitTimeout   = 10 * time.Second
+	// emitRetries is how many times a failed write is tried again
+	emitRetries = 5
+)
+
+// emitBackoff is the pause before a failed write is tried again.
+var emitBackoff = time.Second
+
+// emitter writes the results in the background, so a slow broker doesn't
+// hold the processing loop. wait is the barrier a flush goes through: the
+// windows it deletes from the state must have been written first.
+type emitter struct {
+	producer *kafka.Writer
+	results  chan kafka.Message
+	pending  sync.WaitGroup
+	done     chan struct{}
+
+	mu sync.Mutex
+	// err is the first write that failed for good, the results after it are
+	// dropped: the state must not be flushed anymore, a restart emits them again
+	err error
+}
+
+func newEmitter(producer *kafka.Writer, buffer int) *emitter {
+	return &emitter{
+		producer: producer,
+		results:  make(chan kafka.Message, buffer),
+		done:     make(chan struct{}),
+	}
+}
+
+// emit queues msg, it only blocks when the buffer is full.
+func (e *emitter) emit(msg kafka.Message) {
+	e.pending.Add(1)
+	e.results <- msg
+}
+
+// wait returns once every queued result was written, the error when one
+// could not be.
+func (e *emitter) wait() error {
+	e.pending.Wait()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// close stops run after the queued results.
+func (e *emitter) close() {
+	close(e.results)
+	<-e.done
+}
+
+func (e *emitter) run() {
+	defer close(e.done)
+	for msg := range e.results {
+		batch := []kafka.Message{msg}
+		// take whatever else is queued already
+	drain:
+		for len(batch) < emitBatchSize {
+			select {
+			case next, ok := <-e.results:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		if err := e.write(batch); err != nil {
+			log.Println("Failed to write results:", err)
+		} else {
+			for _, msg := range batch {
+				log.Printf("Emitted the result for the user: %s: %s", msg.Key, msg.Value)
+			}
+		}
+		e.pending.Add(-len(batch))
+	}
+}
+
+// write tries batch until it is written, emitRetries times at most. It
+// gives up right away once an earlier batch failed, results go in order.
+func (e *emitter) write(batch []kafka.Message) error {
+	e.mu.Lock()
+	err := e.err
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), emitTimeout)
+		err = e.producer.WriteMessages(ctx, batch...)
+		cancel()
+		if err == nil || attempt == emitRetries {
+			break
+		}
+		log.Printf("Failed to write results, retrying in %s: %v", emitBackoff, err)
+		time.Sleep(emitBackoff)
+	}
+	if err != nil {
+		e.mu.Lock()
+		e.err = err
+		e.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// newTestEmitter runs an emitter writing to the broker until the test ends,
+// retrying without pause.
+func newTestEmitter(t *testing.T, broker *fakeBroker) *emitter {
+	t.Helper()
+	backoff := emitBackoff
+	emitBackoff = time.Millisecond
+	t.Cleanup(func() { emitBackoff = backoff })
+	results := newEmitter(broker.writer(), 16)
+	go results.run()
+	t.Cleanup(results.close)
+	return results
+}
+
+func TestEmitter(t *testing.T) {
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+
+	// more than the buffer, emit blocks until there is room again
+	for i := range 40 {
+		results.emit(kafka.Message{Topic: topic2, Key: []byte("user_A"), Value: []byte(fmt.Sprint(i))})
+	}
+	if err := results.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := broker.messages(topic2)
+	if len(messages) != 40 {
+		t.Fatalf("wrote %d results, want 40", len(messages))
+	}
+	for i, msg := range messages {
+		if string(msg.Value) != fmt.Sprint(i) {
+			t.Fatalf("result %d = %s, want the results in order", i, msg.Value)
+		}
+	}
+}
+
+func TestEmitterRetries(t *testing.T) {
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	broker.failNext(emitRetries, errors.New("leader not available"))
+
+	results.emit(kafka.Message{Topic: topic2, Key: []byte("user_A"), Value: []byte("1")})
+	if err := results.wait(); err != nil {
+		t.Fatalf("wait = %v, want the write retried until it went through", err)
+	}
+	if messages := broker.messages(topic2); len(messages) != 1 {
+		t.Errorf("wrote %d results, want 1", len(messages))
+	}
+}
+
+func TestEmitterWriteFailure(t *testing.T) {
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	broker.fail(errors.New("leader not available"))
+
+	results.emit(kafka.Message{Topic: topic2, Key: []byte("user_A"), Value: []byte("1")})
+	// a failed write doesn't hold the barrier forever
+	if err := results.wait(); err == nil {
+		t.Fatal("wait = nil error, want the write error")
+	}
+
+	// the results after it are dropped, they would be out of order
+	broker.fail(nil)
+	results.emit(kafka.Message{Topic: topic2, Key: []byte("user_A"), Value: []byte("2")})
+	if err := results.wait(); err == nil {
+		t.Error("wait = nil error after a later result, want the first failure kept")
+	}
+	if messages := broker.messages(topic2); len(messages) != 0 {
+		t.Errorf("wrote %v, want nothing", messages)
+	}
+}
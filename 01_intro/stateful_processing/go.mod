@@ -2,8 +2,9 @@ module stateful_counter
 
 go 1.23.3
 
+require github.com/segmentio/kafka-go v0.4.50
+
 require (
 	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
-	github.com/segmentio/kafka-go v0.4.50 // indirect
 )
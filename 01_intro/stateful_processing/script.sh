@@ -7,7 +7,10 @@ do
     else
         key="user_B"
     fi
-    value="$key: \"user performed a task\""
+    pages=("/home" "/search" "/cart")
+    page=${pages[$((i % 3))]}
+    # JSON clicks for the aggregations of aggregations.example.json
+    value="$key:{\"user_id\": \"$key\", \"page\": \"$page\", \"duration_ms\": $((RANDOM % 1000))}"
 
     echo "$value"
     sleep 0.500
@@ -3,25 +3,361 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"stateful_counter/aggregate"
+	"stateful_counter/statestore"
+	"stateful_counter/windowing"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 )
 
+// aggregations are what is computed per window and group, from the
+// -aggregations config: the click count of every user by default.
+var aggregations *aggregate.Pipeline
+
 // The state of our application
-// We use a simple in-memory map
-// Key: user_id (string), Value: click_count(int64)
-var clickCounts = make(map[string]int)
+// The open windows of every group with their aggregates. The state, the
+// watermark and the offsets are only touched by the processing loop.
+var clickWindows *windowing.Windows[aggregate.Values, aggregate.Row]
+
+// watermark is how far event time has progressed: the latest event time
+// seen minus the allowed lateness. A window ending before the watermark
+// won't get any more clicks, it can be emitted.
+var watermark time.Time
+
+// nextOffsets is the offset of the next click to count, per partition of
+// user-clicks. It is saved with the windows, so clicks read again after a
+// crash (their offsets were not committed yet) are not counted twice.
+var nextOffsets = make(map[int]int64)
 
 const (
+	// clickBuffer is how many clicks the reader gets ahead of the processing loop
+	clickBuffer = 256
+	// resultBuffer is how many results wait for the emitter
+	resultBuffer = 1024
+
 	topic   = "user-clicks"
 	topic2  = "clicks-per-window"
 	URL     = "localhost:9092"
 	groupID = "click-counter-group"
+	// changelog is the compacted topic the state is backed up to. The state
+	// covers every partition, so run one counter per group.
+	changelog = "click-counter-state-changelog"
+
+	// shutdownTimeout bounds the last flush
+	shutdownTimeout = 10 * time.Second
+	// lagCheckTimeout bounds the lag check of an idle punctuation
+	lagCheckTimeout = 2 * time.Second
+)
+
+// Keys of the state store.
+const (
+	windowsPrefix   = "windows/"
+	watermarkKey    = "meta/watermark"
+	offsetsKey      = "meta/offsets"
+	aggregationsKey = "meta/aggregations"
+	windowConfigKey = "meta/windows"
+)
+
+var (
+	windowType      = flag.String("window-type", "tumbling", "tumbling, hopping, sliding or session")
+	windowSize      = flag.Duration("window", 10*time.Second, "size of the tumbling, hopping and sliding windows")
+	windowAdvance   = flag.Duration("advance", 5*time.Second, "how often a hopping window starts")
+	sessionGap      = flag.Duration("gap", 30*time.Second, "inactivity that ends a user's session window")
+	allowedLateness = flag.Duration("allowed-lateness", 5*time.Second, "how late a click may arrive and still be counted")
+	stateDir        = flag.String("state-dir", "state", "directory of the local copy of the state")
+	commitInterval  = flag.Duration("commit-interval", 5*time.Second, "how often the state is flushed and the offsets committed")
+	punctuation     = flag.Duration("punctuate-interval", time.Second, "how often windows are checked for closing, clicks or not")
+	idleTimeout     = flag.Duration("idle-timeout", 10*time.Second, "without clicks for that long and nothing left to read, event time follows the wall clock")
+	aggregationsCfg = flag.String("aggregations", "", "JSON file of the aggregations and the group by field, the click count per message key without it")
+	timestampField  = flag.String("timestamp-field", "timestamp", "JSON field of the click holding its event time, the record timestamp is used without it")
 )
 
+// eventTime is when the click happened: the timestamp field of a JSON
+// payload (RFC3339 or epoch milliseconds), else the Kafka record timestamp.
+func eventTime(msg kafka.Message) time.Time {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(msg.Value, &payload); err == nil {
+		switch value := payload[*timestampField].(type) {
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				return t
+			}
+			if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return time.UnixMilli(millis)
+			}
+		case float64:
+			return time.UnixMilli(int64(value))
+		}
+	}
+	return msg.Time
+}
+
+// emitClosedWindows queues the aggregates of every window that ends at or
+// before the watermark, oldest first. Closing drops them from the state.
+func emitClosedWindows(results *emitter) {
+	for _, closed := range clickWindows.Close(watermark) {
+		// Create the result payload
+		result := aggregations.Output(closed.Key, closed.Value)
+		result["window_type"] = clickWindows.Config().Type
+		result["window_start"] = closed.Window.Start.UTC().Format(time.RFC3339Nano)
+		result["window_end"] = closed.Window.End.UTC().Format(time.RFC3339Nano)
+		resultBytes, err := json.Marshal(result)
+		if err != nil {
+			log.Println("Failed to marshall results:", err)
+			continue
+		}
+
+		results.emit(kafka.Message{
+			Topic: topic2,
+			Key:   []byte(closed.Key),
+			Value: resultBytes,
+			// the result happened when its window ended
+			Time: closed.Window.End,
+		})
+	}
+}
+
+// advanceWatermark moves the watermark to next, it only moves forward.
+func advanceWatermark(next time.Time, results *emitter) {
+	if next.After(watermark) {
+		watermark = next
+		emitClosedWindows(results)
+	}
+}
+
+// restoreState loads the windows, the watermark and the offsets saved by
+// the last flush.
+func restoreState(store statestore.Store) error {
+	// the windows hold the aggregates of the config they were saved with
+	if value, ok := store.Get(aggregationsKey); ok && string(value) != aggregations.Fingerprint() {
+		return fmt.Errorf("the state in %s and %s was built with other aggregations (%s), remove both or go back to that config",
+			*stateDir, changelog, value)
+	}
+
+	if value, ok := store.Get(windowConfigKey); ok && string(value) != clickWindows.Config().Fingerprint() {
+		return fmt.Errorf("the state in %s and %s was built with other windows (%s), remove both or go back to those windows",
+			*stateDir, changelog, value)
+	}
+
+	var err error
+	store.Range(windowsPrefix, func(key string, value []byte) {
+		if err != nil {
+			return
+		}
+		// the rows are decoded with the aggregations they hold
+		var saved windowing.KeyState[aggregate.Values, json.RawMessage]
+		if err = json.Unmarshal(value, &saved); err != nil {
+			return
+		}
+		state := windowing.KeyState[aggregate.Values, aggregate.Row]{Events: saved.Events}
+		for _, pane := range saved.Panes {
+			var row aggregate.Row
+			if row, err = aggregations.Decode(pane.Acc); err != nil {
+				err = fmt.Errorf("%s: %w", key, err)
+				return
+			}
+			state.Panes = append(state.Panes, windowing.Pane[aggregate.Row]{Window: pane.Window, Acc: row})
+		}
+		clickWindows.Restore(strings.TrimPrefix(key, windowsPrefix), state)
+	})
+	if err != nil {
+		return err
+	}
+	if value, ok := store.Get(watermarkKey); ok {
+		if err := json.Unmarshal(value, &watermark); err != nil {
+			return err
+		}
+	}
+	if value, ok := store.Get(offsetsKey); ok {
+		if err := json.Unmarshal(value, &nextOffsets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushState saves what changed since the last flush and only then commits
+// the offsets of the clicks it includes. A crash in between reads those
+// clicks again, nextOffsets skips them. Results emitted since the last flush
+// are emitted again after a crash.
+func flushState(ctx context.Context, store statestore.Store, consumer *kafka.Reader, results *emitter, pending map[int]kafka.Message) error {
+	// the windows closed since the last flush are gone from the state, their
+	// results must be out before the state says so
+	if err := results.wait(); err != nil {
+		return fmt.Errorf("results not written, the state is kept as of the last flush: %w", err)
+	}
+
+	for _, group := range clickWindows.Dirty() {
+		state, ok := clickWindows.State(group)
+		if !ok {
+			store.Delete(windowsPrefix + group)
+			continue
+		}
+		value, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		store.Put(windowsPrefix+group, value)
+	}
+	store.Put(aggregationsKey, []byte(aggregations.Fingerprint()))
+	store.Put(windowConfigKey, []byte(clickWindows.Config().Fingerprint()))
+	value, _ := json.Marshal(watermark)
+	store.Put(watermarkKey, value)
+	value, _ = json.Marshal(nextOffsets)
+	store.Put(offsetsKey, value)
+
+	if err := store.Flush(ctx); err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+	msgs := make([]kafka.Message, 0, len(pending))
+	for _, msg := range pending {
+		msgs = append(msgs, msg)
+	}
+	if err := consumer.CommitMessages(ctx, msgs...); err != nil {
+		return err
+	}
+	clear(pending)
+	return nil
+}
+
+// countClick adds the click of msg to the windows of its group and emits
+// the windows the watermark closes.
+func countClick(msg kafka.Message, results *emitter) {
+	// already counted before a restart
+	if next, ok := nextOffsets[msg.Partition]; ok && msg.Offset < next {
+		return
+	}
+	nextOffsets[msg.Partition] = msg.Offset + 1
+
+	group, values, ok := aggregations.Extract(msg.Key, msg.Value)
+	if !ok {
+		log.Printf("Skipped click without %s at offset %d", aggregations.Config().GroupBy, msg.Offset)
+		return
+	}
+	at := eventTime(msg)
+
+	// Aggregation Logic
+	// too late when all its windows were already emitted
+	if !clickWindows.Add(group, at, values, watermark) {
+		log.Printf("Dropped late click of %s at %s (watermark %s)",
+			group, at.Format(time.TimeOnly), watermark.Format(time.TimeOnly))
+		return
+	}
+	log.Printf("Aggregated click of %s at %s, %d windows open", group, at.Format(time.TimeOnly), clickWindows.Len())
+
+	advanceWatermark(at.Add(-*allowedLateness), results)
+}
+
+// punctuate runs on schedule, whether clicks come or not. Event time only
+// moves with the clicks, so once the input is idle for a while the
+// watermark follows the wall clock, or the last windows would never close.
+// An idle reader may also be one still joining the group with a backlog
+// waiting (after a crash the old member stays until its session times out),
+// so the wall clock only takes over once every click was counted.
+func punctuate(ctx context.Context, client *kafka.Client, now, lastClick time.Time, results *emitter) {
+	if now.Sub(lastClick) < *idleTimeout {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, lagCheckTimeout)
+	defer cancel()
+	done, err := caughtUp(ctx, client)
+	if err != nil {
+		log.Println("Failed to check the lag, the watermark waits:", err)
+		return
+	}
+	if done {
+		advanceWatermark(now.Add(-*allowedLateness), results)
+	}
+}
+
+// caughtUp tells whether every click of the topic was counted: the next
+// offset of every partition is its end, or the partition is empty.
+func caughtUp(ctx context.Context, client *kafka.Client) (bool, error) {
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return false, err
+	}
+	var requests []kafka.OffsetRequest
+	for _, t := range metadata.Topics {
+		if t.Error != nil {
+			return false, t.Error
+		}
+		for _, partition := range t.Partitions {
+			requests = append(requests, kafka.FirstOffsetOf(partition.ID), kafka.LastOffsetOf(partition.ID))
+		}
+	}
+	offsets, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: requests},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, partition := range offsets.Topics[topic] {
+		if partition.Error != nil {
+			return false, partition.Error
+		}
+		next, ok := nextOffsets[partition.Partition]
+		if !ok {
+			next = partition.FirstOffset
+		}
+		if next < partition.LastOffset {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// readClicks fetches clicks for the processing loop until ctx is canceled
+// or the reader fails, then closes clicks.
+func readClicks(ctx context.Context, consumer *kafka.Reader, clicks chan<- kafka.Message) error {
+	defer close(clicks)
+	for {
+		// FetchMessage doesn't commit, the offsets are committed with the state
+		msg, err := consumer.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+		select {
+		case clicks <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func main() {
+	flag.Parse()
+	cfg, err := aggregate.Load(*aggregationsCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if aggregations, err = aggregate.New(cfg); err != nil {
+		log.Fatal(err)
+	}
+	clickWindows, err = windowing.New[aggregate.Values, aggregate.Row](windowing.Config{
+		Type:    windowing.Type(*windowType),
+		Size:    *windowSize,
+		Advance: *windowAdvance,
+		Gap:     *sessionGap,
+	}, aggregations)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	consumer := kafka.NewReader(kafka.ReaderConfig{
 		Brokers: []string{URL},
 		Topic:   topic,
@@ -30,67 +366,87 @@ func main() {
 	defer consumer.Close()
 
 	// Procuer setup (Transformer)
-	producer := kafka.Writer{
+	producer := &kafka.Writer{
 		Addr: kafka.TCP(URL),
 	}
 	defer producer.Close()
 
-	log.Println("Starting statelful click counter...")
+	// asks for the end of the partitions, to tell a backlog from an idle topic
+	client := &kafka.Client{Addr: kafka.TCP(URL)}
 
-	ctx := context.Background()
+	// stop reading on Ctrl-C, the state is flushed one last time
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// windowing logic
-	// Creating a ticker that fires every 10seconds
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	// the state of the last run, from the local copy and the changelog
+	store, err := statestore.Open(ctx, statestore.ChangelogConfig{
+		Brokers: []string{URL},
+		Topic:   changelog,
+		Dir:     *stateDir,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	if err := restoreState(store); err != nil {
+		log.Fatal("Failed to restore the state:", err)
+	}
+
+	log.Printf("Starting statelful click counter (%s, %s windows, allowed lateness %s, %d windows restored)...",
+		aggregations.Config(), clickWindows.Config(), *allowedLateness, clickWindows.Len())
+
+	// the last message read of every partition, committed on the next flush
+	pending := make(map[int]kafka.Message)
 
+	// Reading and emitting run on their own, the loop below owns the state:
+	// it counts the clicks, closes the windows on schedule and flushes.
+	clicks := make(chan kafka.Message, clickBuffer)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readClicks(ctx, consumer, clicks)
+	}()
+	results := newEmitter(producer, resultBuffer)
+	go results.run()
+
+	punctuations := time.NewTicker(*punctuation)
+	defer punctuations.Stop()
+	flushes := time.NewTicker(*commitInterval)
+	defer flushes.Stop()
+	lastClick := time.Now()
+
+	// windowing logic
+	// Windows follow the time the clicks happened, not the time we read them,
+	// so late or replayed clicks still land in their windows. A window closes
+	// once the watermark passes its end.
+loop:
 	for {
 		select {
-		case <-ticker.C:
-			// The 10 second has tumbled. It's now time to process the results
-			log.Println("window closed. Processing and emitting results.")
-			for userId, count := range clickCounts {
-				// Create the result payload
-				result := map[string]interface{}{
-					"user_id":     userId,
-					"click_count": count,
-					"window_end":  time.Now().UTC().Format(time.RFC3339),
-				}
-				resultBytes, err := json.Marshal(result)
-				if err != nil {
-					log.Println("Failed to marshall results:", err)
-					continue
-				}
-
-				msg := kafka.Message{
-					Topic: topic2,
-					Key:   []byte(userId),
-					Value: resultBytes,
-				}
-
-				err = producer.WriteMessages(ctx, msg)
-				if err != nil {
-					log.Println("Failed to write results:", err)
-				} else {
-					log.Printf("Emitted the result for the user: %s, count: %d", userId, count)
-				}
+		case msg, ok := <-clicks:
+			if !ok {
+				break loop
 			}
-
-			// IMPORTANT: Reset the state for the next window
-			clickCounts = make(map[string]int)
-			log.Println("************** STATE RESET FOR NEW WINDOW **************")
-		default:
-			// In between clicks, we continously read messages
-			msg, err := consumer.ReadMessage(ctx)
-			if err != nil {
-				log.Println("count not read the message", err)
-				return
+			lastClick = time.Now()
+			countClick(msg, results)
+			pending[msg.Partition] = msg
+		case now := <-punctuations.C:
+			punctuate(ctx, client, now, lastClick, results)
+		case <-flushes.C:
+			if err := flushState(ctx, store, consumer, results, pending); err != nil {
+				log.Println("Failed to flush the state:", err)
+				stop()
 			}
-
-			// Aggregation Logic
-			userId := string(msg.Key)
-			clickCounts[userId]++
-			log.Printf("Incremented count for user %s to %d", userId, clickCounts[userId])
 		}
 	}
+
+	if err := <-readErr; !errors.Is(err, context.Canceled) {
+		log.Println("count not read the message", err)
+	}
+	// the last flush gets its own deadline, ctx is canceled already
+	flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := flushState(flushCtx, store, consumer, results, pending); err != nil {
+		log.Println("Failed to flush the state:", err)
+	}
+	results.close()
+	log.Println("Click counter stopped")
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"stateful_counter/aggregate"
+	"stateful_counter/statestore"
+	"stateful_counter/windowing"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// resetState starts a test with no windows and no watermark, counting the
+// clicks in windows of cfg.
+func resetState(t *testing.T, cfg windowing.Config) {
+	t.Helper()
+	var err error
+	if aggregations, err = aggregate.New(aggregate.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if clickWindows, err = windowing.New[aggregate.Values, aggregate.Row](cfg, aggregations); err != nil {
+		t.Fatal(err)
+	}
+	watermark = time.Time{}
+	nextOffsets = make(map[int]int64)
+	t.Cleanup(func() {
+		aggregations = nil
+		clickWindows = nil
+		watermark = time.Time{}
+		nextOffsets = make(map[int]int64)
+	})
+}
+
+func TestEventTime(t *testing.T) {
+	recordTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clickTime := time.Date(2024, 5, 1, 11, 59, 30, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		want  time.Time
+	}{
+		{"rfc3339", `{"timestamp": "2024-05-01T11:59:30Z"}`, clickTime},
+		{"epoch millis", `{"timestamp": 1714564770000}`, clickTime},
+		{"epoch millis as a string", `{"timestamp": "1714564770000"}`, clickTime},
+		{"no timestamp", `{"page": "/home"}`, recordTime},
+		{"bad timestamp", `{"timestamp": "yesterday"}`, recordTime},
+		{"not json", `user_A: "user performed a task"`, recordTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := kafka.Message{Value: []byte(tt.value), Time: recordTime}
+			if got := eventTime(msg); !got.Equal(tt.want) {
+				t.Errorf("eventTime = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmitClosedWindows(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	next := start.Add(10 * time.Second)
+	clicks := []struct {
+		user string
+		at   time.Time
+	}{
+		{"user_A", next}, {"user_B", start}, {"user_A", start}, {"user_B", start.Add(time.Second)},
+		{"user_A", start.Add(2 * time.Second)}, {"user_A", start.Add(9 * time.Second)},
+	}
+	for _, click := range clicks {
+		if !clickWindows.Add(click.user, click.at, aggregate.Values{true}, watermark) {
+			t.Fatalf("click of %s at %s dropped", click.user, click.at)
+		}
+	}
+
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	// the watermark at the end of the first window closes it, not the next
+	watermark = next
+	emitClosedWindows(results)
+	results.wait()
+
+	messages := broker.messages(topic2)
+	if len(messages) != 2 {
+		t.Fatalf("emitted %d results, want the 2 of the first window", len(messages))
+	}
+	for i, want := range []struct {
+		user  string
+		count int
+	}{{"user_A", 3}, {"user_B", 2}} {
+		var result struct {
+			UserID      string `json:"user_id"`
+			ClickCount  int    `json:"click_count"`
+			WindowType  string `json:"window_type"`
+			WindowStart string `json:"window_start"`
+			WindowEnd   string `json:"window_end"`
+		}
+		if err := json.Unmarshal(messages[i].Value, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.UserID != want.user || result.ClickCount != want.count || result.WindowType != "tumbling" ||
+			result.WindowStart != "2024-05-01T12:00:00Z" || result.WindowEnd != next.Format(time.RFC3339) {
+			t.Errorf("result %d = %+v, want %s with %d in the first window", i, result, want.user, want.count)
+		}
+		if string(messages[i].Key) != want.user || !messages[i].Time.Equal(next) {
+			t.Errorf("result %d has key %s at %s, want %s at the window end", i, messages[i].Key, messages[i].Time, want.user)
+		}
+	}
+	if clickWindows.Len() != 1 {
+		t.Errorf("%d windows open, want only the second one", clickWindows.Len())
+	}
+}
+
+// click is the message of a click of user at t, read at offset.
+func click(user string, t time.Time, offset int64) kafka.Message {
+	return kafka.Message{Partition: 0, Offset: offset, Key: []byte(user), Value: []byte("{}"), Time: t}
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	cfg := windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second}
+	resetState(t, cfg)
+	ctx := context.Background()
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	countClick(click("user_A", start.Add(time.Second), 0), results)
+	countClick(click("user_B", start.Add(2*time.Second), 1), results)
+	countClick(click("user_A", start.Add(3*time.Second), 2), results)
+
+	dir := t.TempDir()
+	store, err := statestore.OpenLocal(dir, changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing pending, no offsets to commit
+	if err := flushState(ctx, store, nil, results, map[int]kafka.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	wantWatermark := watermark
+
+	// a restart
+	resetState(t, cfg)
+	store, err = statestore.OpenLocal(dir, changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreState(store); err != nil {
+		t.Fatal(err)
+	}
+	if clickWindows.Len() != 2 || !watermark.Equal(wantWatermark) || nextOffsets[0] != 3 {
+		t.Fatalf("restored %d windows, watermark %s and offsets %v, want 2, %s and 3", clickWindows.Len(), watermark, nextOffsets, wantWatermark)
+	}
+
+	// clicks read again because their offsets were not committed
+	countClick(click("user_A", start.Add(3*time.Second), 2), results)
+	countClick(click("user_A", start.Add(4*time.Second), 3), results)
+	// closes the first window
+	countClick(click("user_B", start.Add(20*time.Second), 4), results)
+	results.wait()
+
+	counts := make(map[string]int)
+	for _, msg := range broker.messages(topic2) {
+		var result struct {
+			UserID     string `json:"user_id"`
+			ClickCount int    `json:"click_count"`
+		}
+		if err := json.Unmarshal(msg.Value, &result); err != nil {
+			t.Fatal(err)
+		}
+		counts[result.UserID] = result.ClickCount
+	}
+	if want := map[string]int{"user_A": 3, "user_B": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("emitted %v, want %v", counts, want)
+	}
+}
+
+func TestFlushStateDeletesEmptiedUsers(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	ctx := context.Background()
+	results := newTestEmitter(t, newFakeBroker())
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store, err := statestore.OpenLocal(t.TempDir(), changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countClick(click("user_A", start, 0), results)
+	if err := flushState(ctx, store, nil, results, map[int]kafka.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get(windowsPrefix + "user_A"); !ok {
+		t.Fatal("windows of user_A not saved")
+	}
+
+	countClick(click("user_B", start.Add(time.Minute), 1), results)
+	if err := flushState(ctx, store, nil, results, map[int]kafka.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get(windowsPrefix + "user_A"); ok {
+		t.Error("windows of user_A kept after they were all emitted")
+	}
+	if _, ok := store.Get(windowsPrefix + "user_B"); !ok {
+		t.Error("windows of user_B not saved")
+	}
+}
+
+func TestFlushStateKeptWhenResultsFail(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	ctx := context.Background()
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store, err := statestore.OpenLocal(t.TempDir(), changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countClick(click("user_A", start, 0), results)
+	if err := flushState(ctx, store, nil, results, map[int]kafka.Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// closes the window of user_A, its result never makes it out
+	broker.fail(errors.New("leader not available"))
+	countClick(click("user_B", start.Add(time.Minute), 1), results)
+	if err := flushState(ctx, store, nil, results, map[int]kafka.Message{}); err == nil {
+		t.Fatal("flushState = nil error, want the write error")
+	}
+	if _, ok := store.Get(windowsPrefix + "user_A"); !ok {
+		t.Error("windows of user_A deleted, their result was not written")
+	}
+}
+
+func TestRestoreStateOtherWindows(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	ctx := context.Background()
+	results := newTestEmitter(t, newFakeBroker())
+	store, err := statestore.OpenLocal(t.TempDir(), changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countClick(click("user_A", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 0), results)
+	if err := flushState(ctx, store, nil, results, map[int]kafka.Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	if err := restoreState(store); err != nil {
+		t.Fatalf("restoreState with the same windows = %v", err)
+	}
+	resetState(t, windowing.Config{Type: windowing.Hopping, Size: 10 * time.Second, Advance: 5 * time.Second})
+	if err := restoreState(store); err == nil {
+		t.Error("restoreState with other windows = nil error, want one")
+	}
+}
+
+func TestPunctuate(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	ctx := context.Background()
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// two clicks in the topic, only the first one counted yet
+	clicks := []kafka.Message{{Topic: topic, Key: []byte("user_A"), Value: []byte("{}")}, {Topic: topic, Key: []byte("user_A"), Value: []byte("{}")}}
+	if err := broker.writer().WriteMessages(ctx, clicks...); err != nil {
+		t.Fatal(err)
+	}
+	countClick(click("user_A", start.Add(time.Second), 0), results)
+	lastClick := start.Add(time.Second)
+
+	// the input is not idle yet, event time stays where the clicks put it
+	punctuate(ctx, broker.client(), lastClick.Add(*idleTimeout-time.Second), lastClick, results)
+	results.wait()
+	if len(broker.messages(topic2)) != 0 || clickWindows.Len() != 1 {
+		t.Fatalf("window closed before the idle timeout")
+	}
+
+	// idle but a click is still to read, it may belong to the open window
+	punctuate(ctx, broker.client(), lastClick.Add(*idleTimeout+*allowedLateness), lastClick, results)
+	results.wait()
+	if len(broker.messages(topic2)) != 0 || clickWindows.Len() != 1 {
+		t.Fatalf("window closed with a backlog left")
+	}
+
+	// caught up, the watermark follows the wall clock and closes the window
+	countClick(click("user_A", start.Add(2*time.Second), 1), results)
+	punctuate(ctx, broker.client(), lastClick.Add(*idleTimeout+*allowedLateness), lastClick, results)
+	results.wait()
+	if len(broker.messages(topic2)) != 1 || clickWindows.Len() != 0 {
+		t.Errorf("wrote %d results with %d windows open, want the window closed", len(broker.messages(topic2)), clickWindows.Len())
+	}
+}
+
+func TestReadClicksStops(t *testing.T) {
+	consumer := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{"127.0.0.1:1"}, Topic: topic, GroupID: groupID})
+	defer consumer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	clicks := make(chan kafka.Message)
+	if err := readClicks(ctx, consumer, clicks); !errors.Is(err, context.Canceled) {
+		t.Errorf("readClicks = %v, want context.Canceled", err)
+	}
+	if _, ok := <-clicks; ok {
+		t.Error("clicks still open after readClicks returned")
+	}
+}
+
+// useAggregations swaps the default count for the aggregations of path.
+func useAggregations(t *testing.T, path string) {
+	t.Helper()
+	cfg, err := aggregate.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggregations, err = aggregate.New(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if clickWindows, err = windowing.New[aggregate.Values, aggregate.Row](clickWindows.Config(), aggregations); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfiguredAggregations(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	useAggregations(t, "aggregations.example.json")
+	broker := newFakeBroker()
+	results := newTestEmitter(t, broker)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	clicks := []string{
+		`{"user_id": "u1", "page": "/home", "duration_ms": 120}`,
+		`{"user_id": "u1", "page": "/cart", "duration_ms": 80}`,
+		`{"user_id": "u1", "page": "/home", "duration_ms": 100}`,
+		// no group, skipped
+		`{"page": "/home", "duration_ms": 5}`,
+	}
+	for i, value := range clicks {
+		countClick(kafka.Message{Offset: int64(i), Value: []byte(value), Time: start.Add(time.Duration(i) * time.Second)}, results)
+	}
+	countClick(kafka.Message{Offset: 4, Value: []byte(`{"user_id": "u2"}`), Time: start.Add(time.Minute)}, results)
+	results.wait()
+
+	messages := broker.messages(topic2)
+	if len(messages) != 1 {
+		t.Fatalf("emitted %d results, want the window of u1", len(messages))
+	}
+	var result map[string]any
+	if err := json.Unmarshal(messages[0].Value, &result); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"user_id":           "u1",
+		"click_count":       3.0,
+		"total_duration_ms": 300.0,
+		"fastest_ms":        80.0,
+		"slowest_ms":        120.0,
+		"avg_duration_ms":   100.0,
+		"distinct_pages":    2.0,
+	}
+	for field, value := range want {
+		if result[field] != value {
+			t.Errorf("%s = %v, want %v", field, result[field], value)
+		}
+	}
+	if top, _ := result["top_pages"].([]any); len(top) != 2 {
+		t.Errorf("top_pages = %v, want /home and /cart", result["top_pages"])
+	}
+	if string(messages[0].Key) != "u1" {
+		t.Errorf("result key = %s, want the group", messages[0].Key)
+	}
+}
+
+func TestRestoreStateOtherAggregations(t *testing.T) {
+	resetState(t, windowing.Config{Type: windowing.Tumbling, Size: 10 * time.Second})
+	store, err := statestore.OpenLocal(t.TempDir(), changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(aggregationsKey, []byte(aggregations.Fingerprint()))
+	if err := restoreState(store); err != nil {
+		t.Fatalf("restoreState with the same aggregations = %v", err)
+	}
+
+	useAggregations(t, "aggregations.example.json")
+	if err := restoreState(store); err == nil {
+		t.Error("restoreState with other aggregations = nil error, want one")
+	}
+}
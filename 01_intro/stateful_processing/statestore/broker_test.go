@@ -0,0 +1,199 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/createtopics"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// entry is a changelog record, a nil value is a tombstone. flush is the
+// value of its flush header, compacted entries are left out of fetches.
+type entry struct {
+	key       string
+	value     []byte
+	flush     string
+	compacted bool
+}
+
+// fakeBroker serves single partition topics. The offset of an entry is its
+// index, entries before start were compacted or deleted.
+type fakeBroker struct {
+	mu      sync.Mutex
+	created map[string]createtopics.RequestTopic
+	logs    map[string][]entry
+	start   map[string]int64
+	// err fails every produce request
+	err      error
+	requests int
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		created: make(map[string]createtopics.RequestTopic),
+		logs:    make(map[string][]entry),
+		start:   make(map[string]int64),
+	}
+}
+
+func (b *fakeBroker) entries(topic string) []entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]entry(nil), b.logs[topic]...)
+}
+
+func (b *fakeBroker) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// produces is how many produce requests the broker served.
+func (b *fakeBroker) produces() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests
+}
+
+// append adds entries to the changelog, like an instance that crashed part
+// way through a flush.
+func (b *fakeBroker) append(topic string, entries ...entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logs[topic] = append(b.logs[topic], entries...)
+}
+
+// deleteBefore drops the entries before offset, like retention does.
+func (b *fakeBroker) deleteBefore(topic string, offset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.start[topic] = offset
+}
+
+// compact drops every entry with a later one of the same key, like log
+// compaction does, the tombstones included.
+func (b *fakeBroker) compact(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log := b.logs[topic]
+	latest := make(map[string]bool)
+	for i := len(log) - 1; i >= 0; i-- {
+		if latest[log[i].key] {
+			log[i].compacted = true
+		}
+		latest[log[i].key] = true
+	}
+}
+
+func (b *fakeBroker) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch req := req.(type) {
+	case *createtopics.Request:
+		resp := &createtopics.Response{}
+		for _, topic := range req.Topics {
+			respTopic := createtopics.ResponseTopic{Name: topic.Name}
+			if _, ok := b.created[topic.Name]; ok {
+				respTopic.ErrorCode = int16(kafka.TopicAlreadyExists)
+			} else {
+				b.created[topic.Name] = topic
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil
+	case *listoffsets.Request:
+		resp := &listoffsets.Response{}
+		for _, topic := range req.Topics {
+			respTopic := listoffsets.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				offset := b.start[topic.Topic]
+				if partition.Timestamp == kafka.LastOffset {
+					offset = int64(len(b.logs[topic.Topic]))
+				}
+				respTopic.Partitions = append(respTopic.Partitions, listoffsets.ResponsePartition{
+					Partition: partition.Partition,
+					Timestamp: partition.Timestamp,
+					Offset:    offset,
+				})
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil
+	case *fetch.Request:
+		topic := req.Topics[0].Topic
+		log := b.logs[topic]
+		from := max(req.Topics[0].Partitions[0].FetchOffset, b.start[topic])
+		var records []protocol.Record
+		for offset := from; offset < int64(len(log)); offset++ {
+			if log[offset].compacted {
+				continue
+			}
+			record := protocol.Record{
+				Offset: offset,
+				Time:   time.Now(),
+				Key:    protocol.NewBytes([]byte(log[offset].key)),
+				Value:  protocol.NewBytes(log[offset].value),
+			}
+			if log[offset].flush != "" {
+				record.Headers = []protocol.Header{{Key: "flush", Value: []byte(log[offset].flush)}}
+			}
+			records = append(records, record)
+		}
+		return &fetch.Response{Topics: []fetch.ResponseTopic{{
+			Topic: topic,
+			Partitions: []fetch.ResponsePartition{{
+				HighWatermark: int64(len(log)),
+				RecordSet:     protocol.RecordSet{Version: 2, Records: protocol.NewRecordReader(records...)},
+			}},
+		}}}, nil
+	case *produce.Request:
+		if b.err != nil {
+			return nil, b.err
+		}
+		b.requests++
+		resp := &produce.Response{}
+		for _, topic := range req.Topics {
+			for _, partition := range topic.Partitions {
+				base := int64(len(b.logs[topic.Topic]))
+				for {
+					record, err := partition.RecordSet.Records.ReadRecord()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return nil, err
+					}
+					key, _ := protocol.ReadAll(record.Key)
+					var value []byte
+					if record.Value != nil {
+						value, _ = protocol.ReadAll(record.Value)
+					}
+					e := entry{key: string(key), value: value}
+					for _, header := range record.Headers {
+						if header.Key == "flush" {
+							e.flush = string(header.Value)
+						}
+					}
+					b.logs[topic.Topic] = append(b.logs[topic.Topic], e)
+				}
+				resp.Topics = append(resp.Topics, produce.ResponseTopic{
+					Topic:      topic.Topic,
+					Partitions: []produce.ResponsePartition{{Partition: partition.Partition, BaseOffset: base}},
+				})
+			}
+		}
+		return resp, nil
+	default:
+		return nil, errors.New("fake broker: unsupported request")
+	}
+}
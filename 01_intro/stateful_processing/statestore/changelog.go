@@ -0,0 +1,354 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	changelogFetchMaxBytes = 4 << 20
+	changelogFetchMaxWait  = 500 * time.Millisecond
+	// changelogBatchMaxBytes keeps every produce request well under the
+	// broker's message.max.bytes (1MB by default)
+	changelogBatchMaxBytes = 512 << 10
+	// recordOverhead is an estimate of the bytes a record takes besides its
+	// key and value
+	recordOverhead = 64
+)
+
+// headerFlush marks the records of a flush: the changes have the value
+// flushPart, then a marker record keyed by the flush sequence has flushEnd.
+// No later write reuses the key of a marker, so compaction can't drop it for
+// a newer record. A restore only applies a flush up to its marker: a crash
+// part way through a flush leaves records without one at the end of the
+// changelog. Each flush deletes the previous marker in the request writing
+// its own, an old marker is only compacted away with a newer one after it.
+const (
+	headerFlush  = "flush"
+	flushPart    = "part"
+	flushEnd     = "end"
+	markerPrefix = "\x00flush/"
+)
+
+type ChangelogConfig struct {
+	Brokers []string
+	// Topic is created compacted, with a single partition, when missing
+	Topic string
+	// Dir holds the local copy of the state
+	Dir string
+}
+
+// ChangelogStore is a LocalStore whose every flushed change is also written
+// to a compacted changelog topic. The local file remembers the changelog
+// offset it is at, so a restart only replays what it missed, and a lost
+// disk replays the whole topic.
+type ChangelogStore struct {
+	local  *LocalStore
+	client *kafka.Client
+	topic  string
+	// dirty are the keys changed since the last flush, true when deleted
+	dirty map[string]bool
+}
+
+// Open creates the changelog topic if needed and restores the state.
+func Open(ctx context.Context, cfg ChangelogConfig) (*ChangelogStore, error) {
+	local, err := OpenLocal(cfg.Dir, cfg.Topic)
+	if err != nil {
+		return nil, err
+	}
+	s := &ChangelogStore{
+		local:  local,
+		client: &kafka.Client{Addr: kafka.TCP(cfg.Brokers...)},
+		topic:  cfg.Topic,
+		dirty:  make(map[string]bool),
+	}
+	if err := s.createTopic(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create changelog %s: %w", s.topic, err)
+	}
+	if err := s.restore(ctx); err != nil {
+		return nil, fmt.Errorf("failed to restore from changelog %s: %w", s.topic, err)
+	}
+	return s, nil
+}
+
+func (s *ChangelogStore) createTopic(ctx context.Context) error {
+	resp, err := s.client.CreateTopics(ctx, &kafka.CreateTopicsRequest{
+		Topics: []kafka.TopicConfig{{
+			Topic: s.topic,
+			// one partition, so the flushes stay in order
+			NumPartitions: 1,
+			// the broker default
+			ReplicationFactor: -1,
+			ConfigEntries: []kafka.ConfigEntry{
+				{ConfigName: "cleanup.policy", ConfigValue: "compact"},
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := resp.Errors[s.topic]; err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// restore replays the changelog from the local checkpoint to its end. When
+// the checkpoint is not in the changelog anymore (recreated topic, local copy
+// too old) the local copy is dropped and the whole changelog replayed. The
+// records of a flush that didn't end are left out, and their keys written
+// again with the next flush so no later restore applies them.
+func (s *ChangelogStore) restore(ctx context.Context) error {
+	offsets, err := s.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{
+			s.topic: {kafka.FirstOffsetOf(0), kafka.LastOffsetOf(0)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	partitions := offsets.Topics[s.topic]
+	if len(partitions) == 0 {
+		return fmt.Errorf("no offsets for partition 0")
+	}
+	if partitions[0].Error != nil {
+		return partitions[0].Error
+	}
+	first, end := partitions[0].FirstOffset, partitions[0].LastOffset
+
+	offset := s.local.Checkpoint + 1
+	if offset < first || offset > end {
+		if s.local.Checkpoint >= 0 || len(s.local.Entries) > 0 {
+			log.Printf("local state at offset %d doesn't match changelog [%d, %d), restoring all of it", s.local.Checkpoint, first, end)
+		}
+		s.local.reset()
+		offset = first
+	}
+
+	restored := 0
+	// the changes read since the last end of a flush, and where it was
+	unfinished := make(map[string][]byte)
+	checkpoint := offset - 1
+	for offset < end {
+		resp, err := s.client.Fetch(ctx, &kafka.FetchRequest{
+			Topic:     s.topic,
+			Partition: 0,
+			Offset:    offset,
+			MinBytes:  1,
+			MaxBytes:  changelogFetchMaxBytes,
+			MaxWait:   changelogFetchMaxWait,
+		})
+		if err == nil {
+			err = resp.Error
+		}
+		if err != nil {
+			return err
+		}
+
+		start := offset
+		for {
+			record, err := resp.Records.ReadRecord()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			// a fetch may start with the beginning of the batch holding offset
+			if record.Offset < offset {
+				continue
+			}
+			key, value, err := readRecord(record)
+			if err != nil {
+				return err
+			}
+			offset = record.Offset + 1
+			seq, marker := markerSeq(key)
+			if !marker {
+				unfinished[key] = value
+			}
+			if flushed(record) {
+				for key, value := range unfinished {
+					// a nil value is a tombstone
+					if value == nil {
+						s.local.Delete(key)
+					} else {
+						s.local.Put(key, value)
+					}
+					restored++
+				}
+				clear(unfinished)
+				checkpoint = record.Offset
+				if marker {
+					s.local.Flushes = seq
+				}
+			}
+		}
+		if offset == start {
+			break
+		}
+	}
+
+	s.local.Checkpoint = checkpoint
+	if len(unfinished) > 0 {
+		log.Printf("left out %d changes of an unfinished flush of %s\n", len(unfinished), s.topic)
+		for key := range unfinished {
+			_, ok := s.local.Get(key)
+			s.dirty[key] = !ok
+		}
+	}
+	if restored > 0 {
+		log.Printf("restored %d changes from %s, %d keys\n", restored, s.topic, len(s.local.Entries))
+		return s.local.Flush(ctx)
+	}
+	return nil
+}
+
+// readRecord reads the key and the value of a changelog record, the value
+// is nil for a tombstone.
+func readRecord(record *kafka.Record) (string, []byte, error) {
+	key, err := kafka.ReadAll(record.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	if record.Value == nil {
+		return string(key), nil, nil
+	}
+	value, err := kafka.ReadAll(record.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	// an empty value is not a tombstone
+	if value == nil {
+		value = []byte{}
+	}
+	return string(key), value, nil
+}
+
+// markerKey is the key of the marker ending flush seq.
+func markerKey(seq int64) string {
+	return markerPrefix + strconv.FormatInt(seq, 10)
+}
+
+// markerSeq is the flush sequence of a marker key, false for the keys of
+// the state.
+func markerSeq(key string) (int64, bool) {
+	rest, ok := strings.CutPrefix(key, markerPrefix)
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(rest, 10, 64)
+	return seq, err == nil
+}
+
+// flushed tells whether record ends a flush. Records written before flushes
+// were marked have no header, each of them is a flush of its own.
+func flushed(record *kafka.Record) bool {
+	for _, header := range record.Headers {
+		if header.Key == headerFlush {
+			return string(header.Value) == flushEnd
+		}
+	}
+	return true
+}
+
+func (s *ChangelogStore) Get(key string) ([]byte, bool) {
+	return s.local.Get(key)
+}
+
+func (s *ChangelogStore) Put(key string, value []byte) {
+	s.local.Put(key, value)
+	s.dirty[key] = false
+}
+
+func (s *ChangelogStore) Delete(key string) {
+	s.local.Delete(key)
+	s.dirty[key] = true
+}
+
+func (s *ChangelogStore) Range(prefix string, fn func(key string, value []byte)) {
+	s.local.Range(prefix, fn)
+}
+
+// Flush writes the changes since the last flush to the changelog, in as
+// many produce requests as their size takes, then to the local file with the
+// new checkpoint. A marker record ends the flush, a restore leaves out a
+// flush that didn't end. When a request fails the changes stay
+// dirty, the next flush writes them all again.
+func (s *ChangelogStore) Flush(ctx context.Context) error {
+	if len(s.dirty) == 0 {
+		return nil
+	}
+	var batches [][]kafka.Record
+	var batch []kafka.Record
+	size := 0
+	for key, deleted := range s.dirty {
+		record := kafka.Record{
+			Key:     kafka.NewBytes([]byte(key)),
+			Headers: []kafka.Header{{Key: headerFlush, Value: []byte(flushPart)}},
+		}
+		recordSize := len(key) + recordOverhead
+		if !deleted {
+			value, _ := s.local.Get(key)
+			record.Value = kafka.NewBytes(value)
+			recordSize += len(value)
+		}
+		if len(batch) > 0 && size+recordSize > changelogBatchMaxBytes {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, record)
+		size += recordSize
+	}
+	// the markers go in the last request, after every change of the flush
+	seq := s.local.Flushes + 1
+	if s.local.Flushes > 0 {
+		batch = append(batch, kafka.Record{
+			Key:     kafka.NewBytes([]byte(markerKey(s.local.Flushes))),
+			Headers: []kafka.Header{{Key: headerFlush, Value: []byte(flushPart)}},
+		})
+	}
+	batch = append(batch, kafka.Record{
+		Key:     kafka.NewBytes([]byte(markerKey(seq))),
+		Value:   kafka.NewBytes([]byte{}),
+		Headers: []kafka.Header{{Key: headerFlush, Value: []byte(flushEnd)}},
+	})
+	batches = append(batches, batch)
+
+	checkpoint := s.local.Checkpoint
+	for _, records := range batches {
+		resp, err := s.client.Produce(ctx, &kafka.ProduceRequest{
+			Topic:        s.topic,
+			Partition:    0,
+			RequiredAcks: kafka.RequireAll,
+			Records:      kafka.NewRecordReader(records...),
+		})
+		if err == nil {
+			err = resp.Error
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write changelog: %w", err)
+		}
+		checkpoint = resp.BaseOffset + int64(len(records)) - 1
+	}
+
+	s.local.Checkpoint, s.local.Flushes = checkpoint, seq
+	if err := s.local.Flush(ctx); err != nil {
+		// the changelog has the changes, a restart replays them
+		return fmt.Errorf("failed to write local state: %w", err)
+	}
+	s.dirty = make(map[string]bool)
+	return nil
+}
+
+func (s *ChangelogStore) Close() error {
+	return s.local.Close()
+}
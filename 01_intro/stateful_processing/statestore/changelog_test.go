@@ -0,0 +1,281 @@
+package statestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const testTopic = "state-changelog"
+
+// openTestStore opens the store of dir like Open, on the fake broker.
+func openTestStore(t *testing.T, broker *fakeBroker, dir string) *ChangelogStore {
+	t.Helper()
+	local, err := OpenLocal(dir, testTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ChangelogStore{
+		local:  local,
+		client: &kafka.Client{Addr: kafka.TCP("localhost:9092"), Transport: broker},
+		topic:  testTopic,
+		dirty:  make(map[string]bool),
+	}
+	if err := s.createTopic(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// contents is every key and value of the store.
+func contents(s Store) map[string]string {
+	got := make(map[string]string)
+	s.Range("", func(key string, value []byte) {
+		got[key] = string(value)
+	})
+	return got
+}
+
+func flush(t *testing.T, s Store) {
+	t.Helper()
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangelogCreatesCompactedTopic(t *testing.T) {
+	broker := newFakeBroker()
+	openTestStore(t, broker, t.TempDir())
+	// a second instance finds the topic
+	openTestStore(t, broker, t.TempDir())
+
+	topic := broker.created[testTopic]
+	if topic.NumPartitions != 1 || len(topic.Configs) != 1 || topic.Configs[0].Name != "cleanup.policy" || topic.Configs[0].Value != "compact" {
+		t.Errorf("created topic = %+v, want one compacted partition", topic)
+	}
+}
+
+func TestChangelogFlush(t *testing.T) {
+	broker := newFakeBroker()
+	s := openTestStore(t, broker, t.TempDir())
+
+	// nothing changed, nothing written
+	flush(t, s)
+	if len(broker.entries(testTopic)) != 0 {
+		t.Fatalf("empty flush wrote %v", broker.entries(testTopic))
+	}
+
+	s.Put("a", []byte("1"))
+	s.Put("b", []byte("2"))
+	flush(t, s)
+	s.Put("a", []byte("3"))
+	s.Delete("b")
+	flush(t, s)
+
+	entries := broker.entries(testTopic)
+	if len(entries) != 7 {
+		t.Fatalf("changelog = %v, want both flushes", entries)
+	}
+	// the second flush, in any order
+	second := map[string][]byte{entries[3].key: entries[3].value, entries[4].key: entries[4].value}
+	if value, ok := second["b"]; !ok || value != nil {
+		t.Errorf("deleted key written as %q, want a tombstone", value)
+	}
+	if string(second["a"]) != "3" {
+		t.Errorf("a written as %q, want 3", second["a"])
+	}
+	// then the first marker deleted and the second one
+	if e := entries[5]; e.key != markerKey(1) || e.value != nil || e.flush != flushPart {
+		t.Errorf("entry 5 = %+v, want the tombstone of the first marker", e)
+	}
+	if e := entries[6]; e.key != markerKey(2) || e.value == nil || e.flush != flushEnd {
+		t.Errorf("entry 6 = %+v, want the second marker", e)
+	}
+	if s.local.Checkpoint != 6 || s.local.Flushes != 2 {
+		t.Errorf("checkpoint = %d, flushes = %d, want the last offset 6 and 2 flushes", s.local.Checkpoint, s.local.Flushes)
+	}
+}
+
+func TestChangelogFlushSplitsRequests(t *testing.T) {
+	broker := newFakeBroker()
+	s := openTestStore(t, broker, t.TempDir())
+	big := bytes.Repeat([]byte("x"), changelogBatchMaxBytes/2)
+	for _, key := range []string{"a", "b", "c"} {
+		s.Put(key, big)
+	}
+	flush(t, s)
+
+	if broker.produces() < 2 {
+		t.Errorf("flush sent %d produce requests, want it split", broker.produces())
+	}
+	entries := broker.entries(testTopic)
+	if len(entries) != 4 {
+		t.Fatalf("changelog has %d entries, want 3 and the marker", len(entries))
+	}
+	for i, e := range entries {
+		want := flushPart
+		if i == len(entries)-1 {
+			want = flushEnd
+		}
+		if e.flush != want {
+			t.Errorf("entry %d marked %q, want %q", i, e.flush, want)
+		}
+	}
+	if s.local.Checkpoint != 3 {
+		t.Errorf("checkpoint = %d, want the last offset 3", s.local.Checkpoint)
+	}
+}
+
+func TestChangelogFlushFailure(t *testing.T) {
+	broker := newFakeBroker()
+	dir := t.TempDir()
+	s := openTestStore(t, broker, dir)
+	s.Put("a", []byte("1"))
+
+	broker.fail(errors.New("not enough replicas"))
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("Flush = nil error, want the produce error")
+	}
+	if s.local.Checkpoint != -1 {
+		t.Errorf("checkpoint = %d after a failed flush, want -1", s.local.Checkpoint)
+	}
+
+	// the change is kept for the next flush
+	broker.fail(nil)
+	flush(t, s)
+	if entries := broker.entries(testTopic); len(entries) != 2 || entries[0].key != "a" || entries[1].key != markerKey(1) {
+		t.Errorf("changelog = %v, want a and the marker", entries)
+	}
+}
+
+func TestChangelogRestore(t *testing.T) {
+	broker := newFakeBroker()
+	dir := t.TempDir()
+	s := openTestStore(t, broker, dir)
+	s.Put("a", []byte("1"))
+	s.Put("b", []byte("2"))
+	flush(t, s)
+	s.Delete("b")
+	s.Put("c", []byte("3"))
+	flush(t, s)
+	want := map[string]string{"a": "1", "c": "3"}
+
+	t.Run("lost disk", func(t *testing.T) {
+		restored := openTestStore(t, broker, t.TempDir())
+		if got := contents(restored); !reflect.DeepEqual(got, want) {
+			t.Errorf("restored %v, want %v", got, want)
+		}
+		if restored.local.Checkpoint != 6 || restored.local.Flushes != 2 {
+			t.Errorf("checkpoint = %d, flushes = %d, want 6 and 2", restored.local.Checkpoint, restored.local.Flushes)
+		}
+	})
+
+	t.Run("behind", func(t *testing.T) {
+		// another instance went on from the same state
+		other := openTestStore(t, broker, t.TempDir())
+		other.Put("d", []byte("4"))
+		flush(t, other)
+
+		restored := openTestStore(t, broker, dir)
+		if got := contents(restored); !reflect.DeepEqual(got, map[string]string{"a": "1", "c": "3", "d": "4"}) {
+			t.Errorf("restored %v, want d added", got)
+		}
+	})
+
+	t.Run("checkpoint no longer in the changelog", func(t *testing.T) {
+		stale := t.TempDir()
+		local, err := OpenLocal(stale, testTopic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.Put("gone", []byte("x"))
+		local.Checkpoint = 0
+		flush(t, local)
+		broker.deleteBefore(testTopic, 2)
+
+		restored := openTestStore(t, broker, stale)
+		if _, ok := restored.Get("gone"); ok {
+			t.Error("the stale local state was kept")
+		}
+		if _, ok := restored.Get("c"); !ok {
+			t.Error("c was not restored from the changelog")
+		}
+	})
+}
+
+func TestChangelogRestoreUnfinishedFlush(t *testing.T) {
+	broker := newFakeBroker()
+	s := openTestStore(t, broker, t.TempDir())
+	s.Put("a", []byte("1"))
+	flush(t, s)
+	// an instance crashed part way through the next flush
+	broker.append(testTopic, entry{key: "a", value: []byte("2"), flush: flushPart}, entry{key: "b", value: []byte("3"), flush: flushPart})
+
+	restored := openTestStore(t, broker, t.TempDir())
+	if got := contents(restored); !reflect.DeepEqual(got, map[string]string{"a": "1"}) {
+		t.Errorf("restored %v, want the unfinished flush left out", got)
+	}
+	if restored.local.Checkpoint != 1 {
+		t.Errorf("checkpoint = %d, want the end of the last flush 1", restored.local.Checkpoint)
+	}
+
+	// the next flush writes the keys again, a later flush ending doesn't
+	// make the unfinished records count
+	flush(t, restored)
+	again := openTestStore(t, broker, t.TempDir())
+	if got := contents(again); !reflect.DeepEqual(got, map[string]string{"a": "1"}) {
+		t.Errorf("restored %v after the next flush, want a=1 only", got)
+	}
+}
+
+func TestChangelogRestoreCompacted(t *testing.T) {
+	broker := newFakeBroker()
+	s := openTestStore(t, broker, t.TempDir())
+	s.Put("a", []byte("1"))
+	flush(t, s)
+	s.Put("b", []byte("2"))
+	s.Put("c", []byte("3"))
+	flush(t, s)
+
+	// an instance crashed part way through the next flush, rewriting the last
+	// change of the flush before, then compaction dropped the older records
+	// of its keys and the first marker
+	var last string
+	for _, e := range broker.entries(testTopic) {
+		if _, marker := markerSeq(e.key); !marker {
+			last = e.key
+		}
+	}
+	broker.append(testTopic, entry{key: last, value: []byte("4"), flush: flushPart})
+	broker.compact(testTopic)
+
+	restored := openTestStore(t, broker, t.TempDir())
+	// the rewritten key is only left in the unfinished flush, the next flush
+	// deletes it
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	delete(want, last)
+	if got := contents(restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	if restored.local.Flushes != 2 {
+		t.Errorf("flushes = %d, want 2", restored.local.Flushes)
+	}
+
+	flush(t, restored)
+	entries := broker.entries(testTopic)
+	if e := entries[len(entries)-1]; e.key != markerKey(3) {
+		t.Errorf("last entry = %+v, want the marker of flush 3", e)
+	}
+	again := openTestStore(t, broker, t.TempDir())
+	if got := contents(again); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v after the next flush, want %v", got, want)
+	}
+}
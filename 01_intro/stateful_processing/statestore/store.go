@@ -0,0 +1,128 @@
+// Package statestore keeps the state of a stream processor: a key-value
+// store on local disk, backed up to a compacted changelog topic it is
+// restored from when the local copy is missing or behind.
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Store is a key-value state store. Changes are buffered until Flush makes
+// them durable, a crash loses what was not flushed.
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, value []byte)
+	Delete(key string)
+	// Range calls fn for every key starting with prefix, in key order
+	Range(prefix string, fn func(key string, value []byte))
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// snapshot is the file of a LocalStore.
+type snapshot struct {
+	// Checkpoint is the last changelog offset the entries include, -1 for none
+	Checkpoint int64 `json:"checkpoint"`
+	// Flushes is the sequence of the last changelog flush the entries include
+	Flushes int64             `json:"flushes"`
+	Entries map[string][]byte `json:"entries"`
+}
+
+// LocalStore is the embedded store: a map written to a single file on
+// Flush, replaced atomically so a crash leaves either the old or the new one.
+type LocalStore struct {
+	path string
+	snapshot
+}
+
+// OpenLocal loads dir/name.json, an empty store when it doesn't exist.
+func OpenLocal(dir, name string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &LocalStore{
+		path:     filepath.Join(dir, name+".json"),
+		snapshot: snapshot{Checkpoint: -1, Entries: make(map[string][]byte)},
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.snapshot); err != nil {
+		return nil, fmt.Errorf("corrupted state file %s: %w", s.path, err)
+	}
+	if s.Entries == nil {
+		s.Entries = make(map[string][]byte)
+	}
+	return s, nil
+}
+
+func (s *LocalStore) Get(key string) ([]byte, bool) {
+	value, ok := s.Entries[key]
+	return value, ok
+}
+
+func (s *LocalStore) Put(key string, value []byte) {
+	s.Entries[key] = value
+}
+
+func (s *LocalStore) Delete(key string) {
+	delete(s.Entries, key)
+}
+
+func (s *LocalStore) Range(prefix string, fn func(key string, value []byte)) {
+	var keys []string
+	for key := range s.Entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fn(key, s.Entries[key])
+	}
+}
+
+// reset forgets everything, before a full restore.
+func (s *LocalStore) reset() {
+	s.Checkpoint = -1
+	s.Flushes = 0
+	s.Entries = make(map[string][]byte)
+}
+
+func (s *LocalStore) Flush(context.Context) error {
+	data, err := json.Marshal(s.snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *LocalStore) Close() error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package statestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLocal(dir, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Checkpoint != -1 || len(s.Entries) != 0 {
+		t.Fatalf("new store = %+v, want it empty", s.snapshot)
+	}
+
+	s.Put("windows/b", []byte("2"))
+	s.Put("windows/a", []byte("1"))
+	s.Put("meta/watermark", []byte("0"))
+	s.Put("windows/c", []byte("3"))
+	s.Delete("windows/c")
+	if value, ok := s.Get("windows/a"); !ok || string(value) != "1" {
+		t.Errorf("Get(windows/a) = %q, %v", value, ok)
+	}
+	if _, ok := s.Get("windows/c"); ok {
+		t.Error("Get of a deleted key found it")
+	}
+	var keys []string
+	s.Range("windows/", func(key string, value []byte) {
+		keys = append(keys, key)
+	})
+	if want := []string{"windows/a", "windows/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Range(windows/) = %v, want %v", keys, want)
+	}
+
+	s.Checkpoint = 7
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// not flushed, lost on reopen
+	s.Put("windows/d", []byte("4"))
+
+	reopened, err := OpenLocal(dir, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Checkpoint != 7 || len(reopened.Entries) != 3 {
+		t.Errorf("reopened store = %+v, want the flushed entries at checkpoint 7", reopened.snapshot)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestLocalStoreCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLocal(dir, "state"); err == nil {
+		t.Error("OpenLocal of a corrupted file = nil error, want one")
+	}
+}
@@ -0,0 +1,364 @@
+// Package windowing groups timestamped events per key into tumbling,
+// hopping, sliding or session windows and aggregates every window. Windows
+// follow event time: they close once the watermark passes their end.
+package windowing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type Type string
+
+const (
+	// Tumbling windows of Size follow each other without overlapping.
+	Tumbling Type = "tumbling"
+	// Hopping windows of Size start every Advance, an event is in Size/Advance of them.
+	Hopping Type = "hopping"
+	// Sliding windows of Size end at every event: the aggregate of the Size
+	// before each event of the key.
+	Sliding Type = "sliding"
+	// Session windows of a key last as long as its events are less than Gap apart.
+	Session Type = "session"
+)
+
+// SlidingPrecision is the time resolution of sliding windows, the one of Kafka timestamps.
+const SlidingPrecision = time.Millisecond
+
+var ErrInvalidConfig = errors.New("invalid window config")
+
+type Config struct {
+	Type    Type
+	Size    time.Duration
+	Advance time.Duration
+	Gap     time.Duration
+}
+
+func (c Config) Validate() error {
+	switch c.Type {
+	case Tumbling, Sliding:
+		if c.Size <= 0 {
+			return fmt.Errorf("%w: %s windows need a positive size", ErrInvalidConfig, c.Type)
+		}
+	case Hopping:
+		if c.Size <= 0 || c.Advance <= 0 || c.Advance > c.Size {
+			return fmt.Errorf("%w: hopping windows need 0 < advance <= size", ErrInvalidConfig)
+		}
+	case Session:
+		if c.Gap <= 0 {
+			return fmt.Errorf("%w: session windows need a positive gap", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: unknown window type %q", ErrInvalidConfig, c.Type)
+	}
+	return nil
+}
+
+func (c Config) String() string {
+	switch c.Type {
+	case Hopping:
+		return fmt.Sprintf("hopping %s every %s", c.Size, c.Advance)
+	case Session:
+		return fmt.Sprintf("session with a %s gap", c.Gap)
+	default:
+		return fmt.Sprintf("%s %s", c.Type, c.Size)
+	}
+}
+
+// Fingerprint identifies the windows of the config, the settings its type
+// ignores left out: state saved under another fingerprint holds other windows.
+func (c Config) Fingerprint() string {
+	switch c.Type {
+	case Tumbling, Sliding:
+		return fmt.Sprintf("%s/%s", c.Type, c.Size)
+	case Hopping:
+		return fmt.Sprintf("%s/%s/%s", c.Type, c.Size, c.Advance)
+	default:
+		return fmt.Sprintf("%s/%s", c.Type, c.Gap)
+	}
+}
+
+// Window is the time range [Start, End).
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (w Window) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// Aggregator folds the values V of a window into an accumulator A. Merge
+// combines the accumulators of two session windows joined by an event.
+type Aggregator[V, A any] interface {
+	Zero() A
+	Add(acc A, value V) A
+	Merge(a, b A) A
+}
+
+type Pane[A any] struct {
+	Window Window `json:"window"`
+	Acc    A      `json:"acc"`
+}
+
+type Event[V any] struct {
+	Time  time.Time `json:"time"`
+	Value V         `json:"value"`
+}
+
+// KeyState is everything kept for one key: its open windows and, for
+// sliding windows, the recent events new windows are built from.
+type KeyState[V, A any] struct {
+	Panes  []Pane[A]  `json:"panes"`
+	Events []Event[V] `json:"events,omitempty"`
+}
+
+// Result is the final aggregate of a closed window.
+type Result[A any] struct {
+	Key    string
+	Window Window
+	Value  A
+}
+
+// Windows holds the open windows of every key. It is not safe for
+// concurrent use.
+type Windows[V, A any] struct {
+	cfg  Config
+	agg  Aggregator[V, A]
+	keys map[string]*KeyState[V, A]
+	// dirty are the keys changed since the last call to Dirty
+	dirty map[string]bool
+}
+
+func New[V, A any](cfg Config, agg Aggregator[V, A]) (*Windows[V, A], error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Windows[V, A]{
+		cfg:   cfg,
+		agg:   agg,
+		keys:  make(map[string]*KeyState[V, A]),
+		dirty: make(map[string]bool),
+	}, nil
+}
+
+func (w *Windows[V, A]) Config() Config {
+	return w.cfg
+}
+
+// Add puts the value of key at t in its windows that are still open at
+// watermark. It returns false when all of them already closed: the event
+// is too late and was dropped.
+func (w *Windows[V, A]) Add(key string, t time.Time, value V, watermark time.Time) bool {
+	state, ok := w.keys[key]
+	if !ok {
+		state = &KeyState[V, A]{}
+	}
+
+	var added bool
+	switch w.cfg.Type {
+	case Tumbling, Hopping:
+		added = w.addAligned(state, t, value, watermark)
+	case Sliding:
+		added = w.addSliding(state, t, value, watermark)
+	case Session:
+		added = w.addSession(state, t, value, watermark)
+	}
+	if added {
+		w.keys[key] = state
+		w.dirty[key] = true
+	}
+	return added
+}
+
+// open tells whether a window ending at end still takes events.
+func open(end, watermark time.Time) bool {
+	return end.After(watermark)
+}
+
+func (w *Windows[V, A]) addAligned(state *KeyState[V, A], t time.Time, value V, watermark time.Time) bool {
+	advance := w.cfg.Advance
+	if w.cfg.Type == Tumbling {
+		advance = w.cfg.Size
+	}
+	added := false
+	// the windows containing t start every advance, from the last one before t back
+	for start := t.Truncate(advance); start.Add(w.cfg.Size).After(t); start = start.Add(-advance) {
+		window := Window{Start: start, End: start.Add(w.cfg.Size)}
+		if !open(window.End, watermark) {
+			// the older ones end even sooner
+			break
+		}
+		w.addTo(state, window, value)
+		added = true
+	}
+	return added
+}
+
+// addTo adds value to the pane of window, created when missing.
+func (w *Windows[V, A]) addTo(state *KeyState[V, A], window Window, value V) {
+	for i := range state.Panes {
+		if state.Panes[i].Window == window {
+			state.Panes[i].Acc = w.agg.Add(state.Panes[i].Acc, value)
+			return
+		}
+	}
+	state.Panes = append(state.Panes, Pane[A]{Window: window, Acc: w.agg.Add(w.agg.Zero(), value)})
+}
+
+func (w *Windows[V, A]) addSliding(state *KeyState[V, A], t time.Time, value V, watermark time.Time) bool {
+	t = t.Truncate(SlidingPrecision)
+	added := false
+	// an event arriving out of order also belongs to the later windows
+	exists := false
+	for i := range state.Panes {
+		pane := &state.Panes[i]
+		if pane.Window.Contains(t) && open(pane.Window.End, watermark) {
+			pane.Acc = w.agg.Add(pane.Acc, value)
+			added = true
+		}
+		if pane.Window.End.Equal(t.Add(SlidingPrecision)) {
+			exists = true
+		}
+	}
+
+	// the window ending with this event, built from the events before it
+	own := Window{End: t.Add(SlidingPrecision)}
+	own.Start = own.End.Add(-w.cfg.Size)
+	if !exists && open(own.End, watermark) {
+		acc := w.agg.Zero()
+		for _, event := range state.Events {
+			if own.Contains(event.Time) {
+				acc = w.agg.Add(acc, event.Value)
+			}
+		}
+		state.Panes = append(state.Panes, Pane[A]{Window: own, Acc: w.agg.Add(acc, value)})
+		added = true
+	}
+	if added {
+		state.Events = append(state.Events, Event[V]{Time: t, Value: value})
+	}
+	return added
+}
+
+func (w *Windows[V, A]) addSession(state *KeyState[V, A], t time.Time, value V, watermark time.Time) bool {
+	session := Window{Start: t, End: t.Add(w.cfg.Gap)}
+	// a late event still joins an open session it falls in, it is only too
+	// late for a session of its own
+	joins := false
+	for _, pane := range state.Panes {
+		if overlaps(pane.Window, session) && open(pane.Window.End, watermark) {
+			joins = true
+		}
+	}
+	if !joins && !open(session.End, watermark) {
+		return false
+	}
+	acc := w.agg.Add(w.agg.Zero(), value)
+
+	// the event may join, and so merge, several sessions of the key
+	panes := state.Panes[:0]
+	for _, pane := range state.Panes {
+		if !overlaps(pane.Window, session) {
+			panes = append(panes, pane)
+			continue
+		}
+		if pane.Window.Start.Before(session.Start) {
+			session.Start = pane.Window.Start
+		}
+		if pane.Window.End.After(session.End) {
+			session.End = pane.Window.End
+		}
+		acc = w.agg.Merge(pane.Acc, acc)
+	}
+	state.Panes = append(panes, Pane[A]{Window: session, Acc: acc})
+	return true
+}
+
+// overlaps tells whether two sessions touch, they are one session then.
+func overlaps(a, b Window) bool {
+	return !a.Start.After(b.End) && !b.Start.After(a.End)
+}
+
+// Close removes and returns the windows ending at or before watermark,
+// oldest first.
+func (w *Windows[V, A]) Close(watermark time.Time) []Result[A] {
+	var results []Result[A]
+	for key, state := range w.keys {
+		panes := state.Panes[:0]
+		for _, pane := range state.Panes {
+			if open(pane.Window.End, watermark) {
+				panes = append(panes, pane)
+				continue
+			}
+			results = append(results, Result[A]{Key: key, Window: pane.Window, Value: pane.Acc})
+			w.dirty[key] = true
+		}
+		state.Panes = panes
+
+		if w.cfg.Type == Sliding {
+			// a window opened later starts after watermark - size
+			horizon := watermark.Add(-w.cfg.Size)
+			events := state.Events[:0]
+			for _, event := range state.Events {
+				if !event.Time.Before(horizon) {
+					events = append(events, event)
+				}
+			}
+			if len(events) < len(state.Events) {
+				w.dirty[key] = true
+			}
+			state.Events = events
+		}
+		if len(state.Panes) == 0 && len(state.Events) == 0 {
+			delete(w.keys, key)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].Window.End.Equal(results[j].Window.End) {
+			return results[i].Window.End.Before(results[j].Window.End)
+		}
+		if !results[i].Window.Start.Equal(results[j].Window.Start) {
+			return results[i].Window.Start.Before(results[j].Window.Start)
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results
+}
+
+// Len is the number of open windows.
+func (w *Windows[V, A]) Len() int {
+	n := 0
+	for _, state := range w.keys {
+		n += len(state.Panes)
+	}
+	return n
+}
+
+// Dirty returns the keys changed since the last call, for a state store to
+// save them. State tells what to save, a key without state was emptied.
+func (w *Windows[V, A]) Dirty() []string {
+	keys := make([]string, 0, len(w.dirty))
+	for key := range w.dirty {
+		keys = append(keys, key)
+	}
+	w.dirty = make(map[string]bool)
+	sort.Strings(keys)
+	return keys
+}
+
+func (w *Windows[V, A]) State(key string) (KeyState[V, A], bool) {
+	state, ok := w.keys[key]
+	if !ok {
+		return KeyState[V, A]{}, false
+	}
+	return *state, true
+}
+
+// Restore puts back the state of a key saved from State, after a restart.
+func (w *Windows[V, A]) Restore(key string, state KeyState[V, A]) {
+	w.keys[key] = &state
+}
@@ -0,0 +1,289 @@
+package windowing
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type sum struct{}
+
+func (sum) Zero() int              { return 0 }
+func (sum) Add(acc, value int) int { return acc + value }
+func (sum) Merge(a, b int) int     { return a + b }
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at is the time s seconds after epoch.
+func at(s int) time.Time {
+	return epoch.Add(time.Duration(s) * time.Second)
+}
+
+type event struct {
+	key       string
+	t         int
+	value     int
+	watermark int
+	// dropped is true when the event is expected to be too late
+	dropped bool
+}
+
+type result struct {
+	key        string
+	start, end int
+	value      int
+}
+
+func results(got []Result[int]) []result {
+	out := []result{}
+	for _, r := range got {
+		out = append(out, result{
+			key:   r.Key,
+			start: int(r.Window.Start.Sub(epoch) / time.Second),
+			end:   int(r.Window.End.Sub(epoch) / time.Second),
+			value: r.Value,
+		})
+	}
+	return out
+}
+
+func TestWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    Config
+		events []event
+		// close is the watermark the windows are closed at, want what it returns
+		close    int
+		want     []result
+		wantOpen int
+	}{
+		{
+			name: "tumbling",
+			cfg:  Config{Type: Tumbling, Size: 10 * time.Second},
+			events: []event{
+				{key: "a", t: 1, value: 1}, {key: "a", t: 9, value: 2},
+				{key: "a", t: 10, value: 4}, {key: "b", t: 3, value: 8},
+				{key: "a", t: 25, value: 16},
+			},
+			close:    20,
+			want:     []result{{"a", 0, 10, 3}, {"b", 0, 10, 8}, {"a", 10, 20, 4}},
+			wantOpen: 1,
+		},
+		{
+			name: "tumbling drops events of closed windows",
+			cfg:  Config{Type: Tumbling, Size: 10 * time.Second},
+			events: []event{
+				{key: "a", t: 12, value: 1, watermark: 10},
+				{key: "a", t: 5, value: 2, watermark: 10, dropped: true},
+				{key: "a", t: 19, value: 4, watermark: 15},
+			},
+			close: 20,
+			want:  []result{{"a", 10, 20, 5}},
+		},
+		{
+			name: "hopping",
+			cfg:  Config{Type: Hopping, Size: 10 * time.Second, Advance: 5 * time.Second},
+			events: []event{
+				{key: "a", t: 3, value: 1}, {key: "a", t: 7, value: 2}, {key: "a", t: 12, value: 4},
+			},
+			close: 15,
+			want: []result{
+				{"a", -5, 5, 1}, {"a", 0, 10, 3}, {"a", 5, 15, 6},
+			},
+			wantOpen: 1,
+		},
+		{
+			name: "hopping only counts the open windows of a late event",
+			cfg:  Config{Type: Hopping, Size: 10 * time.Second, Advance: 5 * time.Second},
+			events: []event{
+				{key: "a", t: 7, value: 1, watermark: 10},
+			},
+			close: 20,
+			want:  []result{{"a", 5, 15, 1}},
+		},
+		{
+			name: "session",
+			cfg:  Config{Type: Session, Gap: 10 * time.Second},
+			events: []event{
+				{key: "a", t: 0, value: 1}, {key: "a", t: 5, value: 2},
+				{key: "a", t: 40, value: 4}, {key: "b", t: 1, value: 8},
+			},
+			close:    30,
+			want:     []result{{"b", 1, 11, 8}, {"a", 0, 15, 3}},
+			wantOpen: 1,
+		},
+		{
+			name: "an event between two sessions merges them",
+			cfg:  Config{Type: Session, Gap: 10 * time.Second},
+			events: []event{
+				{key: "a", t: 0, value: 1}, {key: "a", t: 20, value: 2}, {key: "a", t: 10, value: 4},
+			},
+			close: 100,
+			want:  []result{{"a", 0, 30, 7}},
+		},
+		{
+			name: "a late event joins an open session",
+			cfg:  Config{Type: Session, Gap: 10 * time.Second},
+			events: []event{
+				{key: "a", t: 35, value: 1, watermark: 30},
+				// its own session would end at 38, before the watermark
+				{key: "a", t: 28, value: 2, watermark: 40},
+			},
+			close: 100,
+			want:  []result{{"a", 28, 45, 3}},
+		},
+		{
+			name: "a late event of its own session is dropped",
+			cfg:  Config{Type: Session, Gap: 10 * time.Second},
+			events: []event{
+				{key: "a", t: 35, value: 1, watermark: 30},
+				{key: "a", t: 5, value: 2, watermark: 40, dropped: true},
+			},
+			close: 100,
+			want:  []result{{"a", 35, 45, 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := New[int, int](tt.cfg, sum{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tt.events {
+				watermark := at(e.watermark)
+				if e.watermark == 0 {
+					// no watermark yet
+					watermark = time.Time{}
+				}
+				if added := w.Add(e.key, at(e.t), e.value, watermark); added == e.dropped {
+					t.Errorf("Add(%s at %d) = %v, want %v", e.key, e.t, added, !e.dropped)
+				}
+			}
+
+			got := results(w.Close(at(tt.close)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Close(%d) = %v, want %v", tt.close, got, tt.want)
+			}
+			if w.Len() != tt.wantOpen {
+				t.Errorf("Len() = %d open windows, want %d", w.Len(), tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestSlidingWindows(t *testing.T) {
+	w, err := New[int, int](Config{Type: Sliding, Size: 10 * time.Second}, sum{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []event{{t: 0, value: 1}, {t: 5, value: 2}, {t: 12, value: 4}, {t: 3, value: 8}} {
+		if !w.Add("a", at(e.t), e.value, time.Time{}) {
+			t.Fatalf("Add(%d) dropped", e.t)
+		}
+	}
+
+	// every window ends right after its event and holds the size before it,
+	// the out of order event at 3 also went to the later windows it falls in
+	window := func(s int) Window {
+		end := at(s).Add(SlidingPrecision)
+		return Window{Start: end.Add(-10 * time.Second), End: end}
+	}
+	want := []Result[int]{
+		{Key: "a", Window: window(0), Value: 1},
+		{Key: "a", Window: window(3), Value: 9},
+		{Key: "a", Window: window(5), Value: 11},
+		{Key: "a", Window: window(12), Value: 14},
+	}
+	got := w.Close(at(13))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Close = %v, want %v", got, want)
+	}
+	// the events at 3, 5 and 12 may still be in a window opened later
+	if events := w.keys["a"].Events; len(events) != 3 {
+		t.Errorf("kept %d events, want 3", len(events))
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := []Config{
+		{Type: Tumbling, Size: time.Minute},
+		{Type: Sliding, Size: time.Minute},
+		{Type: Hopping, Size: time.Minute, Advance: time.Minute},
+		{Type: Session, Gap: time.Minute},
+	}
+	for _, cfg := range valid {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%v.Validate() = %v", cfg, err)
+		}
+	}
+	invalid := []Config{
+		{Type: Tumbling},
+		{Type: Sliding, Size: -time.Second},
+		{Type: Hopping, Size: time.Minute},
+		{Type: Hopping, Size: time.Minute, Advance: 2 * time.Minute},
+		{Type: Session, Size: time.Minute},
+		{Type: "daily", Size: time.Minute},
+	}
+	for _, cfg := range invalid {
+		if _, err := New[int, int](cfg, sum{}); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("New(%+v) = %v, want ErrInvalidConfig", cfg, err)
+		}
+	}
+}
+
+func TestDirtyAndRestore(t *testing.T) {
+	cfg := Config{Type: Tumbling, Size: 10 * time.Second}
+	w, err := New[int, int](cfg, sum{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add("b", at(1), 1, time.Time{})
+	w.Add("a", at(2), 2, time.Time{})
+	w.Add("a", at(15), 4, time.Time{})
+	if dirty := w.Dirty(); !reflect.DeepEqual(dirty, []string{"a", "b"}) {
+		t.Errorf("Dirty = %v, want a and b", dirty)
+	}
+	if dirty := w.Dirty(); len(dirty) != 0 {
+		t.Errorf("Dirty = %v right after the last call, want none", dirty)
+	}
+
+	// closing changes both, b has no window left
+	w.Close(at(10))
+	if dirty := w.Dirty(); !reflect.DeepEqual(dirty, []string{"a", "b"}) {
+		t.Errorf("Dirty after Close = %v, want a and b", dirty)
+	}
+	if _, ok := w.State("b"); ok {
+		t.Error("State(b) found an emptied key")
+	}
+	state, ok := w.State("a")
+	if !ok || len(state.Panes) != 1 {
+		t.Fatalf("State(a) = %+v, %v, want its open window", state, ok)
+	}
+
+	restored, err := New[int, int](cfg, sum{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Restore("a", state)
+	restored.Add("a", at(18), 8, at(10))
+	if got := results(restored.Close(at(20))); !reflect.DeepEqual(got, []result{{"a", 10, 20, 12}}) {
+		t.Errorf("Close after Restore = %v, want the restored window", got)
+	}
+}
+func TestConfigFingerprint(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Type: Tumbling, Size: time.Minute, Gap: time.Second}, "tumbling/1m0s"},
+		{Config{Type: Sliding, Size: time.Minute}, "sliding/1m0s"},
+		{Config{Type: Hopping, Size: time.Minute, Advance: 10 * time.Second}, "hopping/1m0s/10s"},
+		{Config{Type: Session, Size: time.Minute, Gap: 5 * time.Minute}, "session/5m0s"},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.Fingerprint(); got != tt.want {
+			t.Errorf("%v.Fingerprint() = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"config"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+)
+
+type apiKey struct {
+	hash      [sha256.Size]byte
+	principal Principal
+}
+
+// APIKeys authenticates the X-API-Key header against the configured keys.
+// Only their hashes are kept and compared in constant time.
+type APIKeys struct {
+	keys []apiKey
+}
+
+func NewAPIKeys(keys []config.APIKeyConfig) *APIKeys {
+	a := &APIKeys{}
+	for i, key := range keys {
+		subject := "api-key-" + strconv.Itoa(i)
+		if key.UserID > 0 {
+			subject = strconv.Itoa(key.UserID)
+		}
+		a.keys = append(a.keys, apiKey{
+			hash: sha256.Sum256([]byte(key.Key)),
+			principal: Principal{
+				Subject: subject,
+				UserID:  key.UserID,
+				Roles:   append([]string{}, key.Roles...),
+				Method:  "api_key",
+			},
+		})
+	}
+	return a
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	hash := sha256.Sum256([]byte(key))
+	for _, candidate := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], candidate.hash[:]) == 1 {
+			return candidate.principal, nil
+		}
+	}
+	return Principal{}, ErrInvalidCredentials
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	keys := testKeys()
+	tests := []struct {
+		name    string
+		key     string
+		want    Principal
+		wantErr error
+	}{
+		{name: "user key", key: emmaKey, want: Principal{Subject: "1", UserID: 1, Roles: []string{}, Method: "api_key"}},
+		{name: "service key", key: adminKey, want: Principal{Subject: "api-key-1", Roles: []string{RoleAdmin}, Method: "api_key"}},
+		{name: "no key", wantErr: ErrNoCredentials},
+		{name: "unknown key", key: emmaKey + "x", wantErr: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.key != "" {
+				req.Header.Set(HeaderAPIKey, tt.key)
+			}
+			got, err := keys.Authenticate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate = %v, want %v", err, tt.wantErr)
+			}
+			if got.Subject != tt.want.Subject || got.UserID != tt.want.UserID || got.Method != tt.want.Method || !slices.Equal(got.Roles, tt.want.Roles) {
+				t.Errorf("Authenticate = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
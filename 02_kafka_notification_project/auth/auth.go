@@ -0,0 +1,146 @@
+// Package auth authenticates the HTTP requests of the producer and the
+// consumer, with API keys from the config or HMAC signed JWTs verified
+// locally with the shared secret.
+package auth
+
+import (
+	"config"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HeaderAPIKey = "X-API-Key"
+	// RoleAdmin can act as any user and use the admin endpoints
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is who made the request.
+type Principal struct {
+	// Subject is the user ID for users, the key or token subject otherwise
+	Subject string   `json:"subject"`
+	UserID  int      `json:"user_id,omitempty"`
+	Roles   []string `json:"roles"`
+	// Method is how it authenticated, "api_key", "jwt" or "none"
+	Method string `json:"method"`
+}
+
+func (p Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+func (p Principal) IsAdmin() bool {
+	return p.HasRole(RoleAdmin)
+}
+
+// Anonymous tells whether the request went through without auth.
+func (p Principal) Anonymous() bool {
+	return p.Method == "none"
+}
+
+// CanActAs tells whether the principal may send as or read the notifications of userID.
+func (p Principal) CanActAs(userID int) bool {
+	return p.IsAdmin() || (p.UserID > 0 && p.UserID == userID)
+}
+
+// Authenticator finds the principal of a request. It returns ErrNoCredentials
+// when the request carries none of its credentials, so the next one is tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// New builds the authenticators of the config, nil when auth is disabled.
+func New(cfg config.AuthConfig) []Authenticator {
+	if !cfg.Enabled {
+		return nil
+	}
+	var authenticators []Authenticator
+	if len(cfg.APIKeys) > 0 {
+		authenticators = append(authenticators, NewAPIKeys(cfg.APIKeys))
+	}
+	if cfg.JWT.Secret != "" {
+		authenticators = append(authenticators, NewJWT(cfg.JWT))
+	}
+	return authenticators
+}
+
+const principalKey = "auth.principal"
+
+// anonymous is the principal of every request when auth is disabled, it is
+// an admin so the APIs behave as they did before auth.
+var anonymous = Principal{Subject: "anonymous", Roles: []string{RoleAdmin}, Method: "none"}
+
+// Middleware rejects the requests none of the authenticators accepts with a
+// 401, and stores the principal for the handlers. Without authenticators
+// every request goes through as an anonymous admin.
+func Middleware(authenticators []Authenticator) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if len(authenticators) == 0 {
+			ctx.Set(principalKey, anonymous)
+			ctx.Next()
+			return
+		}
+
+		err := ErrNoCredentials
+		for _, authenticator := range authenticators {
+			var principal Principal
+			principal, err = authenticator.Authenticate(ctx.Request)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			ctx.Set(principalKey, principal)
+			ctx.Next()
+			return
+		}
+		ctx.Header("WWW-Authenticate", `Bearer realm="notifications"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+	}
+}
+
+// FromContext returns the principal Middleware stored, false when it did not run.
+func FromContext(ctx *gin.Context) (Principal, bool) {
+	value, ok := ctx.Get(principalKey)
+	if !ok {
+		return Principal{}, false
+	}
+	principal, ok := value.(Principal)
+	return principal, ok
+}
+
+// RequireRole answers 403 to the principals without the role.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		principal, _ := FromContext(ctx)
+		if !principal.HasRole(role) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "the " + role + " role is required"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireUser answers 403 unless the principal is the user of the userID
+// path parameter or an admin.
+func RequireUser(param string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		principal, _ := FromContext(ctx)
+		userID, err := strconv.Atoi(ctx.Param(param))
+		if err != nil || !principal.CanActAs(userID) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "you can only access your own notifications"})
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+const (
+	emmaKey  = "emma-key-0000000001"
+	adminKey = "admin-key-000000000"
+)
+
+func testKeys() *APIKeys {
+	return NewAPIKeys([]config.APIKeyConfig{
+		{Key: emmaKey, UserID: 1},
+		{Key: adminKey, Roles: []string{RoleAdmin}},
+	})
+}
+
+// serve runs a request with the headers through router and decodes the answer.
+func serve(t *testing.T, router http.Handler, path string, headers map[string]string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var response map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("GET %s answered %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+func TestPrincipal(t *testing.T) {
+	user := Principal{Subject: "1", UserID: 1, Roles: []string{}}
+	service := Principal{Subject: "mailer", Roles: []string{"sender"}}
+	admin := Principal{Subject: "ops", Roles: []string{RoleAdmin}}
+
+	if !user.CanActAs(1) || user.CanActAs(2) || user.IsAdmin() {
+		t.Errorf("user %+v can act as 1 only", user)
+	}
+	if service.CanActAs(0) || service.CanActAs(1) || !service.HasRole("sender") {
+		t.Errorf("service %+v can't act as a user", service)
+	}
+	if !admin.CanActAs(1) || !admin.CanActAs(2) || !admin.IsAdmin() {
+		t.Errorf("admin %+v can act as anyone", admin)
+	}
+	if user.Anonymous() || admin.Anonymous() || !anonymous.Anonymous() {
+		t.Error("only the principal of requests without auth is anonymous")
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg := config.AuthConfig{
+		APIKeys: []config.APIKeyConfig{{Key: emmaKey, UserID: 1}},
+		JWT:     config.JWTConfig{Secret: testSecret, Algorithms: []string{"HS256"}},
+	}
+	if authenticators := New(cfg); authenticators != nil {
+		t.Errorf("New with auth disabled = %v, want nil", authenticators)
+	}
+
+	cfg.Enabled = true
+	authenticators := New(cfg)
+	if len(authenticators) != 2 {
+		t.Fatalf("New = %v, want the API keys and JWT", authenticators)
+	}
+	if _, ok := authenticators[0].(*APIKeys); !ok {
+		t.Errorf("first authenticator = %T, want *APIKeys", authenticators[0])
+	}
+	if _, ok := authenticators[1].(*JWT); !ok {
+		t.Errorf("second authenticator = %T, want *JWT", authenticators[1])
+	}
+
+	cfg.JWT.Secret = ""
+	if authenticators := New(cfg); len(authenticators) != 1 {
+		t.Errorf("New without a JWT secret = %v, want the API keys only", authenticators)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	newRouter := func(authenticators ...Authenticator) *gin.Engine {
+		router := gin.New()
+		router.Use(Middleware(authenticators))
+		router.GET("/whoami", func(ctx *gin.Context) {
+			principal, ok := FromContext(ctx)
+			if !ok {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"message": "no principal"})
+				return
+			}
+			ctx.JSON(http.StatusOK, principal)
+		})
+		return router
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		code, response := serve(t, newRouter(), "/whoami", nil)
+		if code != http.StatusOK || response["subject"] != "anonymous" || response["method"] != "none" {
+			t.Errorf("GET /whoami = %d %v, want the anonymous admin", code, response)
+		}
+	})
+
+	router := newRouter(testKeys(), testJWT(t))
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		wantCode    int
+		wantSubject string
+	}{
+		{name: "no credentials", wantCode: http.StatusUnauthorized},
+		{name: "api key", headers: map[string]string{HeaderAPIKey: emmaKey}, wantCode: http.StatusOK, wantSubject: "1"},
+		{name: "service key", headers: map[string]string{HeaderAPIKey: adminKey}, wantCode: http.StatusOK, wantSubject: "api-key-1"},
+		{name: "wrong key", headers: map[string]string{HeaderAPIKey: "nope"}, wantCode: http.StatusUnauthorized},
+		// the next authenticator is only tried when the request has none of these credentials
+		{name: "jwt", headers: map[string]string{"Authorization": "Bearer " + sign(t, claims("2", time.Hour))}, wantCode: http.StatusOK, wantSubject: "2"},
+		{
+			name:     "wrong key and a valid jwt",
+			headers:  map[string]string{HeaderAPIKey: "nope", "Authorization": "Bearer " + sign(t, claims("2", time.Hour))},
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, response := serve(t, router, "/whoami", tt.headers)
+			if code != tt.wantCode || (tt.wantSubject != "" && response["subject"] != tt.wantSubject) {
+				t.Errorf("GET /whoami = %d %v, want %d %s", code, response, tt.wantCode, tt.wantSubject)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	router := gin.New()
+	router.GET("/admin", Middleware([]Authenticator{testKeys()}), RequireRole(RoleAdmin), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{})
+	})
+
+	if code, response := serve(t, router, "/admin", map[string]string{HeaderAPIKey: emmaKey}); code != http.StatusForbidden {
+		t.Errorf("GET /admin as a user = %d %v, want 403", code, response)
+	}
+	if code, response := serve(t, router, "/admin", map[string]string{HeaderAPIKey: adminKey}); code != http.StatusOK {
+		t.Errorf("GET /admin as an admin = %d %v, want 200", code, response)
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	router := gin.New()
+	router.GET("/notifications/:userID", Middleware([]Authenticator{testKeys()}), RequireUser("userID"), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{})
+	})
+
+	tests := []struct {
+		key      string
+		path     string
+		wantCode int
+	}{
+		{emmaKey, "/notifications/1", http.StatusOK},
+		{emmaKey, "/notifications/2", http.StatusForbidden},
+		{emmaKey, "/notifications/emma", http.StatusForbidden},
+		{adminKey, "/notifications/2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code, response := serve(t, router, tt.path, map[string]string{HeaderAPIKey: tt.key}); code != tt.wantCode {
+			t.Errorf("GET %s with %s = %d %v, want %d", tt.path, tt.key, code, response, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"config"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the registered claims plus the roles of the user.
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles"`
+}
+
+// JWT verifies HMAC signed tokens from the Authorization header. The sub
+// claim is the user ID, or a service name for tokens of other services.
+// GET requests can pass the token in ?access_token as browsers can't set
+// headers on EventSource and WebSocket connections.
+type JWT struct {
+	secret []byte
+	parser *jwt.Parser
+}
+
+func NewJWT(cfg config.JWTConfig) *JWT {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(cfg.Algorithms),
+		jwt.WithLeeway(cfg.Leeway),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+	return &JWT{secret: []byte(cfg.Secret), parser: jwt.NewParser(options...)}
+}
+
+func token(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+func (j *JWT) Authenticate(r *http.Request) (Principal, error) {
+	raw := token(r)
+	if raw == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	var claims Claims
+	_, err := j.parser.ParseWithClaims(raw, &claims, func(*jwt.Token) (any, error) {
+		return j.secret, nil
+	})
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if claims.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: the token has no sub claim", ErrInvalidCredentials)
+	}
+
+	principal := Principal{Subject: claims.Subject, Roles: claims.Roles, Method: "jwt"}
+	if principal.Roles == nil {
+		principal.Roles = []string{}
+	}
+	if userID, err := strconv.Atoi(claims.Subject); err == nil && userID > 0 {
+		principal.UserID = userID
+	}
+	return principal, nil
+}
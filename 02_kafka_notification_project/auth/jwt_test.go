@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"config"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func testJWT(t *testing.T) *JWT {
+	t.Helper()
+	return NewJWT(config.JWTConfig{
+		Secret:     testSecret,
+		Algorithms: []string{"HS256"},
+		Issuer:     "notifications",
+		Audience:   "api",
+		Leeway:     time.Second,
+	})
+}
+
+// claims are valid claims for testJWT expiring in ttl (negative for an expired token).
+func claims(subject string, ttl time.Duration) Claims {
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			Issuer:    "notifications",
+			Audience:  jwt.ClaimStrings{"api"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+}
+
+func sign(t *testing.T, c Claims) string {
+	t.Helper()
+	return signWith(t, jwt.SigningMethodHS256, testSecret, c)
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, secret string, c Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, c).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWT(t *testing.T) {
+	j := testJWT(t)
+	admin := claims("mailer", time.Hour)
+	admin.Roles = []string{RoleAdmin}
+	wrongIssuer := claims("1", time.Hour)
+	wrongIssuer.Issuer = "someone-else"
+	noExpiry := claims("1", time.Hour)
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name    string
+		header  string
+		want    Principal
+		wantErr error
+	}{
+		{name: "user", header: "Bearer " + sign(t, claims("1", time.Hour)), want: Principal{Subject: "1", UserID: 1, Roles: []string{}, Method: "jwt"}},
+		{name: "service", header: "bearer " + sign(t, admin), want: Principal{Subject: "mailer", Roles: []string{RoleAdmin}, Method: "jwt"}},
+		{name: "no header", wantErr: ErrNoCredentials},
+		{name: "other scheme", header: "Basic dXNlcjpwYXNz", wantErr: ErrNoCredentials},
+		{name: "expired", header: "Bearer " + sign(t, claims("1", -time.Minute)), wantErr: ErrInvalidCredentials},
+		{name: "no expiry", header: "Bearer " + sign(t, noExpiry), wantErr: ErrInvalidCredentials},
+		{name: "no subject", header: "Bearer " + sign(t, claims("", time.Hour)), wantErr: ErrInvalidCredentials},
+		{name: "wrong issuer", header: "Bearer " + sign(t, wrongIssuer), wantErr: ErrInvalidCredentials},
+		{name: "wrong secret", header: "Bearer " + signWith(t, jwt.SigningMethodHS256, testSecret+"x", claims("1", time.Hour)), wantErr: ErrInvalidCredentials},
+		{name: "algorithm not accepted", header: "Bearer " + signWith(t, jwt.SigningMethodHS512, testSecret, claims("1", time.Hour)), wantErr: ErrInvalidCredentials},
+		{name: "garbage", header: "Bearer not.a.token", wantErr: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			got, err := j.Authenticate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate = %v, want %v", err, tt.wantErr)
+			}
+			if got.Subject != tt.want.Subject || got.UserID != tt.want.UserID || got.Method != tt.want.Method || !slices.Equal(got.Roles, tt.want.Roles) {
+				t.Errorf("Authenticate = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTQueryToken(t *testing.T) {
+	j := testJWT(t)
+	token := sign(t, claims("1", time.Hour))
+
+	// browsers can't set headers on EventSource and WebSocket connections
+	req := httptest.NewRequest(http.MethodGet, "/notifications/1/stream?access_token="+token, nil)
+	if principal, err := j.Authenticate(req); err != nil || principal.UserID != 1 {
+		t.Errorf("Authenticate with ?access_token = %+v, %v, want user 1", principal, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/notifications/1/read-all?access_token="+token, nil)
+	if _, err := j.Authenticate(req); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Authenticate of a PUT with ?access_token = %v, want ErrNoCredentials", err)
+	}
+}
@@ -0,0 +1,285 @@
+package config
+
+import "time"
+
+// Config is shared by the producer and the consumer, each one reads the
+// Kafka and Topics sections plus its own.
+type Config struct {
+	Kafka     KafkaConfig     `yaml:"kafka"`
+	Topics    TopicsConfig    `yaml:"topics"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Templates TemplatesConfig `yaml:"templates"`
+	Producer  ProducerConfig  `yaml:"producer"`
+	Consumer  ConsumerConfig  `yaml:"consumer"`
+}
+
+type KafkaConfig struct {
+	Brokers []string   `yaml:"brokers"`
+	TLS     TLSConfig  `yaml:"tls"`
+	SASL    SASLConfig `yaml:"sasl"`
+}
+
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// SASLConfig is disabled while Mechanism is empty.
+type SASLConfig struct {
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+// AuthConfig is shared so a key or a token works on both services.
+type AuthConfig struct {
+	// Enabled false leaves the APIs open to anyone
+	Enabled bool           `yaml:"enabled"`
+	APIKeys []APIKeyConfig `yaml:"api_keys"`
+	JWT     JWTConfig      `yaml:"jwt"`
+}
+
+type APIKeyConfig struct {
+	Key string `yaml:"key"`
+	// UserID is the user the key acts as, 0 for a service key
+	UserID int      `yaml:"user_id"`
+	Roles  []string `yaml:"roles"`
+}
+
+// JWTConfig verifies HMAC signed tokens locally, disabled while Secret is empty.
+type JWTConfig struct {
+	Secret string `yaml:"secret"`
+	// Algorithms accepted, HS256, HS384 and/or HS512
+	Algorithms []string      `yaml:"algorithms"`
+	Issuer     string        `yaml:"issuer"`
+	Audience   string        `yaml:"audience"`
+	Leeway     time.Duration `yaml:"leeway"`
+}
+
+// Render modes of templated notifications.
+const (
+	// RenderSend renders in the producer, in the recipient's locale
+	RenderSend = "send"
+	// RenderClient stores the template and its variables, the consumer API
+	// renders them in the locale each client asks for
+	RenderClient = "client"
+)
+
+// TemplatesConfig is shared so the consumer renders raw notifications with
+// the same templates the producer accepted them with.
+type TemplatesConfig struct {
+	// File adds templates to the built in ones, or replaces them by name
+	File          string `yaml:"file"`
+	DefaultLocale string `yaml:"default_locale"`
+	// Render is the producer's default mode, send or client
+	Render string `yaml:"render"`
+}
+
+type TopicsConfig struct {
+	Notifications string `yaml:"notifications"`
+	Users         string `yaml:"users"`
+	// DeadLetter gets the messages the consumer can't turn into a notification
+	DeadLetter string `yaml:"dead_letter"`
+}
+
+type ProducerConfig struct {
+	HTTPAddr          string        `yaml:"http_addr"`
+	Acks              string        `yaml:"acks"`
+	Retries           int           `yaml:"retries"`
+	EnableIdempotence bool          `yaml:"enable_idempotence"`
+	Linger            time.Duration `yaml:"linger"`
+	Compression       string        `yaml:"compression"`
+	// DeliveryTimeout is how long POST /send waits for the broker
+	DeliveryTimeout time.Duration `yaml:"delivery_timeout"`
+	// WireFormat is how notifications are encoded: json or avro
+	WireFormat string `yaml:"wire_format"`
+	// ShutdownTimeout is how long running requests get to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// FlushTimeout is how long the queued messages get to reach the brokers
+	// on shutdown, the rest is reported as undelivered
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+	// ReadyMaxQueue is the producer queue depth /readyz starts failing at
+	ReadyMaxQueue int                 `yaml:"ready_max_queue"`
+	UserDirectory UserDirectoryConfig `yaml:"user_directory"`
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+}
+
+// DefaultRole holds the rate limits of the callers without a listed role.
+const DefaultRole = "default"
+
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Roles are the limits of the callers holding the role, a caller with
+	// several listed roles gets the most generous one
+	Roles map[string]RoleLimits `yaml:"roles"`
+	// GlobalRate caps the notifications produced per second by all callers
+	// together, 0 disables the cap
+	GlobalRate  float64 `yaml:"global_rate"`
+	GlobalBurst int     `yaml:"global_burst"`
+	// MaxWait is how long a request may wait for the global cap or for room
+	// in a full producer queue before it gets a 429
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+// RoleLimits are token buckets, rates are per second and 0 means no limit.
+type RoleLimits struct {
+	// Sender limits the notifications a caller sends, whoever they go to
+	SenderRate  float64 `yaml:"sender_rate"`
+	SenderBurst int     `yaml:"sender_burst"`
+	// Recipient limits the notifications a user gets from callers of the role
+	RecipientRate  float64 `yaml:"recipient_rate"`
+	RecipientBurst int     `yaml:"recipient_burst"`
+}
+
+type UserDirectoryConfig struct {
+	// Backend is memory, file or kafka
+	Backend        string        `yaml:"backend"`
+	File           string        `yaml:"file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+type ConsumerConfig struct {
+	HTTPAddr string `yaml:"http_addr"`
+	GroupID  string `yaml:"group_id"`
+	// ClientID identifies this instance in the group, empty generates one
+	// from the host name and the pid
+	ClientID string `yaml:"client_id"`
+	// StartOffset is where a new group starts reading: first or last
+	StartOffset string        `yaml:"start_offset"`
+	MinBytes    int           `yaml:"min_bytes"`
+	MaxBytes    int           `yaml:"max_bytes"`
+	MaxWait     time.Duration `yaml:"max_wait"`
+	// Offsets of stored notifications are committed every CommitBatchSize
+	// messages or every CommitInterval, whichever comes first
+	CommitBatchSize int           `yaml:"commit_batch_size"`
+	CommitInterval  time.Duration `yaml:"commit_interval"`
+	StreamBuffer    int           `yaml:"stream_buffer"`
+	// ShutdownTimeout is how long running requests and the message being
+	// processed get to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReadyMaxLag is the group lag /readyz starts failing at, 0 ignores the lag
+	ReadyMaxLag int64 `yaml:"ready_max_lag"`
+	// AdvertisedURL is how the other instances reach this one, empty uses
+	// the host name and the port of HTTPAddr. It must be unique to the
+	// instance, it is how an instance finds itself among the group members.
+	AdvertisedURL string `yaml:"advertised_url"`
+	// Routing is what happens to a request for a user whose partition is
+	// owned by another instance: forward, redirect or off (answer locally)
+	Routing             string        `yaml:"routing"`
+	PeerRefreshInterval time.Duration `yaml:"peer_refresh_interval"`
+	// DirectoryURL is the producer, it owns the user directory the groups
+	// of a user are read from and the recipients are checked against
+	DirectoryURL string `yaml:"directory_url"`
+	// DirectoryAPIKey is the key the consumer checks the recipients with,
+	// needed when the producer has auth enabled
+	DirectoryAPIKey string      `yaml:"directory_api_key"`
+	Store           StoreConfig `yaml:"store"`
+}
+
+type StoreConfig struct {
+	// Backend is disk or memory
+	Backend         string          `yaml:"backend"`
+	Dir             string          `yaml:"dir"`
+	SyncWrites      bool            `yaml:"sync_writes"`
+	MaxSegmentBytes int64           `yaml:"max_segment_bytes"`
+	Retention       RetentionConfig `yaml:"retention"`
+}
+
+type RetentionConfig struct {
+	MaxPerUser int           `yaml:"max_per_user"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBytes   int64         `yaml:"max_bytes"`
+	// Policy is oldest or largest-user
+	Policy string `yaml:"policy"`
+}
+
+// Default is what both services run with when nothing is configured: the
+// local three broker cluster from kafka/docker-compose.yml.
+func Default() Config {
+	return Config{
+		Kafka: KafkaConfig{
+			Brokers: []string{"localhost:9092", "localhost:9094", "localhost:9095"},
+		},
+		Auth: AuthConfig{
+			JWT: JWTConfig{
+				Algorithms: []string{"HS256"},
+				Leeway:     30 * time.Second,
+			},
+		},
+		Templates: TemplatesConfig{
+			DefaultLocale: "en",
+			Render:        RenderSend,
+		},
+		Topics: TopicsConfig{
+			Notifications: "notifications",
+			Users:         "users",
+			DeadLetter:    "notifications-dlq",
+		},
+		Producer: ProducerConfig{
+			HTTPAddr:          ":8083",
+			Acks:              "all",
+			Retries:           10,
+			EnableIdempotence: true,
+			Linger:            5 * time.Millisecond,
+			Compression:       "none",
+			DeliveryTimeout:   10 * time.Second,
+			WireFormat:        "json",
+			ShutdownTimeout:   30 * time.Second,
+			FlushTimeout:      10 * time.Second,
+			ReadyMaxQueue:     10000,
+			UserDirectory: UserDirectoryConfig{
+				Backend:        "file",
+				File:           "users.json",
+				ReloadInterval: 2 * time.Second,
+				Timeout:        10 * time.Second,
+			},
+			RateLimit: RateLimitConfig{
+				Enabled: true,
+				Roles: map[string]RoleLimits{
+					DefaultRole: {SenderRate: 5, SenderBurst: 20, RecipientRate: 2, RecipientBurst: 10},
+					// other services notifying users on their behalf
+					"admin": {RecipientRate: 50, RecipientBurst: 200},
+				},
+				GlobalRate:  5000,
+				GlobalBurst: 10000,
+				MaxWait:     2 * time.Second,
+			},
+		},
+		Consumer: ConsumerConfig{
+			HTTPAddr:            ":8082",
+			GroupID:             "notifications-group",
+			StartOffset:         "first",
+			MinBytes:            1,
+			MaxBytes:            10 << 20,
+			MaxWait:             time.Second,
+			CommitBatchSize:     100,
+			CommitInterval:      time.Second,
+			StreamBuffer:        64,
+			ShutdownTimeout:     15 * time.Second,
+			Routing:             "forward",
+			PeerRefreshInterval: 5 * time.Second,
+			DirectoryURL:        "http://localhost:8083",
+			Store: StoreConfig{
+				Backend:         "disk",
+				Dir:             "data/notifications",
+				MaxSegmentBytes: 16 << 20,
+				Retention: RetentionConfig{
+					MaxPerUser: 1000,
+					MaxAge:     30 * 24 * time.Hour,
+					MaxBytes:   64 << 20,
+					Policy:     "oldest",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,5 @@
+module config
+
+go 1.23.3
+
+require github.com/goccy/go-yaml v1.18.0
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Service picks the section of the config a binary reads, and the flags it accepts.
+type Service string
+
+const (
+	Producer Service = "producer"
+	Consumer Service = "consumer"
+)
+
+// EnvPrefix is prepended to every environment variable, a setting like
+// kafka.brokers is read from NOTIFY_KAFKA_BROKERS.
+const EnvPrefix = "NOTIFY_"
+
+// Load builds the config of a service. Every setting starts from Default()
+// and is overridden, in order, by the config file (-config or NOTIFY_CONFIG,
+// YAML or JSON), the environment and the command line flags. The result is
+// validated before it is returned.
+func Load(service Service, args []string) (Config, error) {
+	cfg := Default()
+	fs := flag.NewFlagSet(string(service), flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path of a YAML or JSON config file")
+	cfg.bind(fs, service)
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	// the flags were only parsed to find the config file, start over so the
+	// file and the environment come first
+	cfg = Default()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return cfg, err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if value, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", EnvName(f.Name), err))
+			}
+		}
+	})
+	for name, value := range flags {
+		if name != "config" {
+			// already parsed once, can't fail
+			fs.Lookup(name).Value.Set(value)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate(service)
+}
+
+// EnvName is the environment variable of a setting.
+func EnvName(setting string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(setting))
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	// JSON is valid YAML, one decoder reads both
+	if err := yaml.UnmarshalWithOptions(data, cfg, yaml.DisallowUnknownField()); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// bind registers one flag per setting, pointing into cfg.
+func (cfg *Config) bind(fs *flag.FlagSet, service Service) {
+	fs.Var((*listValue)(&cfg.Kafka.Brokers), "kafka.brokers", "comma separated list of bootstrap brokers")
+	fs.BoolVar(&cfg.Kafka.TLS.Enabled, "kafka.tls.enabled", cfg.Kafka.TLS.Enabled, "connect to the brokers over TLS")
+	fs.StringVar(&cfg.Kafka.TLS.CAFile, "kafka.tls.ca-file", cfg.Kafka.TLS.CAFile, "PEM file of the CA that signed the broker certificates")
+	fs.StringVar(&cfg.Kafka.TLS.CertFile, "kafka.tls.cert-file", cfg.Kafka.TLS.CertFile, "PEM client certificate")
+	fs.StringVar(&cfg.Kafka.TLS.KeyFile, "kafka.tls.key-file", cfg.Kafka.TLS.KeyFile, "PEM key of the client certificate")
+	fs.BoolVar(&cfg.Kafka.TLS.InsecureSkipVerify, "kafka.tls.insecure-skip-verify", cfg.Kafka.TLS.InsecureSkipVerify, "do not verify the broker certificates")
+	fs.StringVar(&cfg.Kafka.SASL.Mechanism, "kafka.sasl.mechanism", cfg.Kafka.SASL.Mechanism, "PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, empty disables SASL")
+	fs.StringVar(&cfg.Kafka.SASL.Username, "kafka.sasl.username", cfg.Kafka.SASL.Username, "SASL username")
+	fs.StringVar(&cfg.Kafka.SASL.Password, "kafka.sasl.password", cfg.Kafka.SASL.Password, "SASL password")
+	fs.BoolVar(&cfg.Auth.Enabled, "auth.enabled", cfg.Auth.Enabled, "require an API key or a JWT, api keys are only read from the config file")
+	fs.StringVar(&cfg.Auth.JWT.Secret, "auth.jwt.secret", cfg.Auth.JWT.Secret, "HMAC secret of the tokens, empty disables JWT")
+	fs.Var((*listValue)(&cfg.Auth.JWT.Algorithms), "auth.jwt.algorithms", "comma separated HMAC algorithms accepted")
+	fs.StringVar(&cfg.Auth.JWT.Issuer, "auth.jwt.issuer", cfg.Auth.JWT.Issuer, "required iss claim, empty accepts any")
+	fs.StringVar(&cfg.Auth.JWT.Audience, "auth.jwt.audience", cfg.Auth.JWT.Audience, "required aud claim, empty accepts any")
+	fs.DurationVar(&cfg.Auth.JWT.Leeway, "auth.jwt.leeway", cfg.Auth.JWT.Leeway, "clock skew allowed on exp and nbf")
+	fs.StringVar(&cfg.Templates.File, "templates.file", cfg.Templates.File, "YAML or JSON file of notification templates, added to the built in ones")
+	fs.StringVar(&cfg.Templates.DefaultLocale, "templates.default-locale", cfg.Templates.DefaultLocale, "locale of the users without one")
+	fs.StringVar(&cfg.Topics.Notifications, "topics.notifications", cfg.Topics.Notifications, "topic notifications are sent to")
+
+	switch service {
+	case Producer:
+		p := &cfg.Producer
+		fs.StringVar(&cfg.Topics.Users, "topics.users", cfg.Topics.Users, "compacted topic of the kafka user directory")
+		fs.StringVar(&p.HTTPAddr, "producer.http-addr", p.HTTPAddr, "HTTP listen address")
+		fs.StringVar(&p.Acks, "producer.acks", p.Acks, "acks required from the brokers: 0, 1 or all")
+		fs.IntVar(&p.Retries, "producer.retries", p.Retries, "retries of a failed produce")
+		fs.BoolVar(&p.EnableIdempotence, "producer.enable-idempotence", p.EnableIdempotence, "idempotent producer, requires acks=all")
+		fs.DurationVar(&p.Linger, "producer.linger", p.Linger, "how long messages wait to be batched")
+		fs.StringVar(&p.Compression, "producer.compression", p.Compression, "none, gzip, snappy, lz4 or zstd")
+		fs.DurationVar(&p.DeliveryTimeout, "producer.delivery-timeout", p.DeliveryTimeout, "how long a send waits for the brokers")
+		fs.StringVar(&cfg.Templates.Render, "templates.render", cfg.Templates.Render, "where templates are rendered by default: send (producer) or client (consumer API)")
+		fs.StringVar(&p.WireFormat, "producer.wire-format", p.WireFormat, "notification encoding: json or avro")
+		fs.DurationVar(&p.ShutdownTimeout, "producer.shutdown-timeout", p.ShutdownTimeout, "how long running requests get to finish on shutdown")
+		fs.DurationVar(&p.FlushTimeout, "producer.flush-timeout", p.FlushTimeout, "how long queued messages get to be delivered on shutdown")
+		fs.IntVar(&p.ReadyMaxQueue, "producer.ready-max-queue", p.ReadyMaxQueue, "queue depth at which /readyz fails")
+		fs.StringVar(&p.UserDirectory.Backend, "producer.user-directory.backend", p.UserDirectory.Backend, "memory, file or kafka")
+		fs.StringVar(&p.UserDirectory.File, "producer.user-directory.file", p.UserDirectory.File, "JSON or YAML file of the file user directory")
+		fs.DurationVar(&p.UserDirectory.ReloadInterval, "producer.user-directory.reload-interval", p.UserDirectory.ReloadInterval, "how often the user file is checked for changes")
+		fs.DurationVar(&p.UserDirectory.Timeout, "producer.user-directory.timeout", p.UserDirectory.Timeout, "timeout of the kafka user directory requests")
+		fs.BoolVar(&p.RateLimit.Enabled, "producer.rate-limit.enabled", p.RateLimit.Enabled, "rate limit the senders and recipients, the per role limits are only read from the config file")
+		fs.Float64Var(&p.RateLimit.GlobalRate, "producer.rate-limit.global-rate", p.RateLimit.GlobalRate, "notifications produced per second by all callers, 0 disables the cap")
+		fs.IntVar(&p.RateLimit.GlobalBurst, "producer.rate-limit.global-burst", p.RateLimit.GlobalBurst, "burst of the global cap")
+		fs.DurationVar(&p.RateLimit.MaxWait, "producer.rate-limit.max-wait", p.RateLimit.MaxWait, "how long a send waits for the global cap or a full queue before a 429")
+	case Consumer:
+		c := &cfg.Consumer
+		fs.StringVar(&cfg.Topics.DeadLetter, "topics.dead-letter", cfg.Topics.DeadLetter, "topic undecodable notifications are moved to")
+		fs.StringVar(&c.HTTPAddr, "consumer.http-addr", c.HTTPAddr, "HTTP listen address")
+		fs.StringVar(&c.GroupID, "consumer.group-id", c.GroupID, "consumer group")
+		fs.StringVar(&c.ClientID, "consumer.client-id", c.ClientID, "client id of this instance, generated when empty")
+		fs.StringVar(&c.StartOffset, "consumer.start-offset", c.StartOffset, "where a new group starts: first or last")
+		fs.IntVar(&c.MinBytes, "consumer.min-bytes", c.MinBytes, "minimum bytes of a fetch")
+		fs.IntVar(&c.MaxBytes, "consumer.max-bytes", c.MaxBytes, "maximum bytes of a fetch")
+		fs.DurationVar(&c.MaxWait, "consumer.max-wait", c.MaxWait, "how long a fetch waits for min-bytes")
+		fs.IntVar(&c.CommitBatchSize, "consumer.commit-batch-size", c.CommitBatchSize, "stored messages per offset commit")
+		fs.DurationVar(&c.CommitInterval, "consumer.commit-interval", c.CommitInterval, "longest time between offset commits")
+		fs.IntVar(&c.StreamBuffer, "consumer.stream-buffer", c.StreamBuffer, "notifications buffered per live stream")
+		fs.DurationVar(&c.ShutdownTimeout, "consumer.shutdown-timeout", c.ShutdownTimeout, "how long running requests get to finish on shutdown")
+		fs.Int64Var(&c.ReadyMaxLag, "consumer.ready-max-lag", c.ReadyMaxLag, "group lag at which /readyz fails, 0 ignores the lag")
+		fs.StringVar(&c.AdvertisedURL, "consumer.advertised-url", c.AdvertisedURL, "URL the other instances reach this one at")
+		fs.StringVar(&c.Routing, "consumer.routing", c.Routing, "requests for users owned by another instance: forward, redirect or off")
+		fs.DurationVar(&c.PeerRefreshInterval, "consumer.peer-refresh-interval", c.PeerRefreshInterval, "how often the partition owners are read from the group")
+		fs.StringVar(&c.DirectoryURL, "consumer.directory-url", c.DirectoryURL, "URL of the producer, the user groups are read from its directory")
+		fs.StringVar(&c.DirectoryAPIKey, "consumer.directory-api-key", c.DirectoryAPIKey, "API key the recipients are checked in the user directory with")
+		fs.StringVar(&c.Store.Backend, "consumer.store.backend", c.Store.Backend, "notification store: disk or memory")
+		fs.StringVar(&c.Store.Dir, "consumer.store.dir", c.Store.Dir, "directory of the disk store")
+		fs.BoolVar(&c.Store.SyncWrites, "consumer.store.sync-writes", c.Store.SyncWrites, "fsync every disk store write")
+		fs.Int64Var(&c.Store.MaxSegmentBytes, "consumer.store.max-segment-bytes", c.Store.MaxSegmentBytes, "size of a disk store segment")
+		fs.IntVar(&c.Store.Retention.MaxPerUser, "consumer.store.retention.max-per-user", c.Store.Retention.MaxPerUser, "notifications kept per user, 0 is unlimited")
+		fs.DurationVar(&c.Store.Retention.MaxAge, "consumer.store.retention.max-age", c.Store.Retention.MaxAge, "age notifications are dropped at, 0 is unlimited")
+		fs.Int64Var(&c.Store.Retention.MaxBytes, "consumer.store.retention.max-bytes", c.Store.Retention.MaxBytes, "memory budget of the store, 0 is unlimited")
+		fs.StringVar(&c.Store.Retention.Policy, "consumer.store.retention.policy", c.Store.Retention.Policy, "eviction policy: oldest or largest-user")
+	}
+}
+
+// listValue is a comma separated flag.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*l = items
+	return nil
+}
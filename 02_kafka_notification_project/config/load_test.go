@@ -0,0 +1,121 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExampleIsDefault(t *testing.T) {
+	for _, service := range []Service{Producer, Consumer} {
+		cfg, err := Load(service, []string{"-config", "notifications.example.yaml"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg, Default()) {
+			t.Errorf("%s: the example config is not the default one:\n%+v\n%+v", service, cfg, Default())
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	yamlFile := writeFile(t, "config.yaml", "kafka:\n  brokers: [file:9092]\nproducer:\n  retries: 3\n  linger: 20ms\n")
+	jsonFile := writeFile(t, "config.json", `{"producer": {"retries": 4, "compression": "zstd"}}`)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		brokers []string
+		retries int
+		linger  time.Duration
+	}{
+		{name: "defaults", brokers: Default().Kafka.Brokers, retries: 10, linger: 5 * time.Millisecond},
+		{name: "file", args: []string{"-config", yamlFile}, brokers: []string{"file:9092"}, retries: 3, linger: 20 * time.Millisecond},
+		{name: "file from the environment", env: map[string]string{"NOTIFY_CONFIG": yamlFile}, brokers: []string{"file:9092"}, retries: 3, linger: 20 * time.Millisecond},
+		{
+			name:    "environment over file",
+			env:     map[string]string{"NOTIFY_KAFKA_BROKERS": "env:9092, env:9094", "NOTIFY_PRODUCER_RETRIES": "5"},
+			args:    []string{"-config", yamlFile},
+			brokers: []string{"env:9092", "env:9094"},
+			retries: 5,
+			linger:  20 * time.Millisecond,
+		},
+		{
+			name:    "flags over environment",
+			env:     map[string]string{"NOTIFY_PRODUCER_RETRIES": "5"},
+			args:    []string{"-config", yamlFile, "-producer.retries", "6", "-kafka.brokers", "flag:9092"},
+			brokers: []string{"flag:9092"},
+			retries: 6,
+			linger:  20 * time.Millisecond,
+		},
+		{name: "json file", args: []string{"-config", jsonFile}, brokers: Default().Kafka.Brokers, retries: 4, linger: 5 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := Load(Producer, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.Kafka.Brokers, tt.brokers) || cfg.Producer.Retries != tt.retries || cfg.Producer.Linger != tt.linger {
+				t.Errorf("brokers %v, retries %d, linger %v, want %v, %d, %v",
+					cfg.Kafka.Brokers, cfg.Producer.Retries, cfg.Producer.Linger, tt.brokers, tt.retries, tt.linger)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		wantErr error
+	}{
+		{name: "help", args: []string{"-h"}, wantErr: flag.ErrHelp},
+		{name: "unknown flag", args: []string{"-nope"}},
+		{name: "flag of the other service", args: []string{"-consumer.group-id", "g"}},
+		{name: "arguments", args: []string{"extra"}},
+		{name: "missing file", args: []string{"-config", "missing.yaml"}},
+		{name: "unknown field", args: []string{"-config", writeFile(t, "typo.yaml", "producer:\n  retires: 3\n")}},
+		{name: "bad environment", env: map[string]string{"NOTIFY_PRODUCER_RETRIES": "many"}},
+		{name: "invalid", args: []string{"-producer.acks", "2"}, wantErr: ErrInvalidConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := Load(Producer, tt.args)
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Load = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("consumer.store.retention.max-per-user"); got != "NOTIFY_CONSUMER_STORE_RETENTION_MAX_PER_USER" {
+		t.Errorf("EnvName = %s", got)
+	}
+}
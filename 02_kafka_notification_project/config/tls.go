@@ -0,0 +1,53 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Load builds the client TLS config, nil when TLS is disabled.
+func (t TLSConfig) Load() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// SecurityProtocol is the Kafka security.protocol matching the TLS and SASL settings.
+func (k KafkaConfig) SecurityProtocol() string {
+	switch {
+	case k.TLS.Enabled && k.SASL.Mechanism != "":
+		return "SASL_SSL"
+	case k.TLS.Enabled:
+		return "SSL"
+	case k.SASL.Mechanism != "":
+		return "SASL_PLAINTEXT"
+	default:
+		return "PLAINTEXT"
+	}
+}
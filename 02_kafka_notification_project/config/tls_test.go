@@ -0,0 +1,85 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSigned writes a certificate and its key as PEM files.
+func selfSigned(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func TestTLSLoad(t *testing.T) {
+	if tlsConfig, err := (TLSConfig{CAFile: "ignored.pem"}).Load(); tlsConfig != nil || err != nil {
+		t.Errorf("disabled TLS = %v, %v, want nil", tlsConfig, err)
+	}
+
+	certFile, keyFile := selfSigned(t)
+	tlsConfig, err := TLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 {
+		t.Errorf("tls config = %+v, want the CA and the client certificate", tlsConfig)
+	}
+
+	broken := []TLSConfig{
+		{Enabled: true, CAFile: "missing.pem"},
+		{Enabled: true, CAFile: keyFile},
+		{Enabled: true, CertFile: certFile, KeyFile: certFile},
+	}
+	for _, cfg := range broken {
+		if _, err := cfg.Load(); err == nil {
+			t.Errorf("Load(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestSecurityProtocol(t *testing.T) {
+	tests := []struct {
+		tls  bool
+		sasl string
+		want string
+	}{
+		{false, "", "PLAINTEXT"},
+		{true, "", "SSL"},
+		{false, SASLPlain, "SASL_PLAINTEXT"},
+		{true, SASLScramSHA256, "SASL_SSL"},
+	}
+	for _, tt := range tests {
+		k := KafkaConfig{TLS: TLSConfig{Enabled: tt.tls}, SASL: SASLConfig{Mechanism: tt.sasl}}
+		if got := k.SecurityProtocol(); got != tt.want {
+			t.Errorf("tls %v, sasl %q: SecurityProtocol = %s, want %s", tt.tls, tt.sasl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Validate checks the shared settings and the section of the service,
+// reporting every problem at once.
+func (cfg Config) Validate(service Service) error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(cfg.Kafka.Brokers) > 0, "kafka.brokers is required")
+	for _, broker := range cfg.Kafka.Brokers {
+		_, port, err := net.SplitHostPort(broker)
+		check(err == nil && port != "", "kafka.brokers: %q is not host:port", broker)
+	}
+	tls := cfg.Kafka.TLS
+	check((tls.CertFile == "") == (tls.KeyFile == ""), "kafka.tls.cert-file and kafka.tls.key-file go together")
+	check(tls.Enabled || (tls.CAFile == "" && tls.CertFile == ""), "kafka.tls files are set but kafka.tls.enabled is false")
+	sasl := cfg.Kafka.SASL
+	check(slices.Contains([]string{"", SASLPlain, SASLScramSHA256, SASLScramSHA512}, sasl.Mechanism),
+		"kafka.sasl.mechanism: unknown mechanism %q", sasl.Mechanism)
+	check(sasl.Mechanism == "" || sasl.Username != "", "kafka.sasl.username is required with kafka.sasl.mechanism")
+	check(cfg.Topics.Notifications != "", "topics.notifications is required")
+	check(cfg.Templates.DefaultLocale != "", "templates.default-locale is required")
+	check(slices.Contains([]string{RenderSend, RenderClient}, cfg.Templates.Render),
+		"templates.render: must be %s or %s, got %q", RenderSend, RenderClient, cfg.Templates.Render)
+	auth := cfg.Auth
+	check(!auth.Enabled || len(auth.APIKeys) > 0 || auth.JWT.Secret != "", "auth.enabled needs auth.api_keys or auth.jwt.secret")
+	keys := make(map[string]bool)
+	for i, key := range auth.APIKeys {
+		check(len(key.Key) >= 16, "auth.api_keys[%d]: keys must be at least 16 characters", i)
+		check(!keys[key.Key], "auth.api_keys[%d]: duplicate key", i)
+		check(key.UserID >= 0, "auth.api_keys[%d]: user_id can't be negative", i)
+		keys[key.Key] = true
+	}
+	if auth.JWT.Secret != "" {
+		check(len(auth.JWT.Secret) >= 32, "auth.jwt.secret must be at least 32 characters")
+		check(len(auth.JWT.Algorithms) > 0, "auth.jwt.algorithms is required")
+		for _, alg := range auth.JWT.Algorithms {
+			check(slices.Contains([]string{"HS256", "HS384", "HS512"}, alg), "auth.jwt.algorithms: unsupported algorithm %q", alg)
+		}
+		check(auth.JWT.Leeway >= 0, "auth.jwt.leeway can't be negative")
+	}
+
+	switch service {
+	case Producer:
+		p := cfg.Producer
+		check(p.HTTPAddr != "", "producer.http-addr is required")
+		check(slices.Contains([]string{"0", "1", "all", "-1"}, p.Acks), "producer.acks: must be 0, 1 or all, got %q", p.Acks)
+		check(!p.EnableIdempotence || p.Acks == "all" || p.Acks == "-1", "producer.enable-idempotence requires producer.acks=all")
+		check(p.Retries >= 0, "producer.retries can't be negative")
+		check(p.Linger >= 0, "producer.linger can't be negative")
+		check(slices.Contains([]string{"none", "gzip", "snappy", "lz4", "zstd"}, p.Compression),
+			"producer.compression: unknown codec %q", p.Compression)
+		check(p.DeliveryTimeout > 0, "producer.delivery-timeout must be positive")
+		check(slices.Contains([]string{"json", "avro"}, p.WireFormat), "producer.wire-format: must be json or avro, got %q", p.WireFormat)
+		check(p.ShutdownTimeout > 0, "producer.shutdown-timeout must be positive")
+		check(p.FlushTimeout > 0, "producer.flush-timeout must be positive")
+		check(p.ReadyMaxQueue > 0, "producer.ready-max-queue must be positive")
+		dir := p.UserDirectory
+		check(slices.Contains([]string{"memory", "file", "kafka"}, dir.Backend),
+			"producer.user-directory.backend: must be memory, file or kafka, got %q", dir.Backend)
+		check(dir.Backend != "file" || dir.File != "", "producer.user-directory.file is required by the file backend")
+		check(dir.Backend != "kafka" || cfg.Topics.Users != "", "topics.users is required by the kafka user directory")
+		check(dir.ReloadInterval > 0, "producer.user-directory.reload-interval must be positive")
+		check(dir.Timeout > 0, "producer.user-directory.timeout must be positive")
+		limit := p.RateLimit
+		if limit.Enabled {
+			_, ok := limit.Roles[DefaultRole]
+			check(ok, "producer.rate-limit.roles: the %s role is required", DefaultRole)
+			for role, limits := range limit.Roles {
+				check(limits.SenderRate >= 0 && limits.RecipientRate >= 0, "producer.rate-limit.roles.%s: rates can't be negative", role)
+				check(limits.SenderRate == 0 || limits.SenderBurst >= 1, "producer.rate-limit.roles.%s: sender_burst must be at least 1", role)
+				check(limits.RecipientRate == 0 || limits.RecipientBurst >= 1, "producer.rate-limit.roles.%s: recipient_burst must be at least 1", role)
+			}
+		}
+		check(limit.GlobalRate >= 0, "producer.rate-limit.global-rate can't be negative")
+		check(limit.GlobalRate == 0 || limit.GlobalBurst >= 1, "producer.rate-limit.global-burst must be at least 1")
+		check(limit.MaxWait >= 0, "producer.rate-limit.max-wait can't be negative")
+	case Consumer:
+		c := cfg.Consumer
+		check(c.HTTPAddr != "", "consumer.http-addr is required")
+		check(c.GroupID != "", "consumer.group-id is required")
+		check(cfg.Topics.DeadLetter != "", "topics.dead-letter is required")
+		check(cfg.Topics.DeadLetter != cfg.Topics.Notifications, "topics.dead-letter can't be topics.notifications")
+		check(c.StartOffset == "first" || c.StartOffset == "last", "consumer.start-offset: must be first or last, got %q", c.StartOffset)
+		check(c.MinBytes > 0, "consumer.min-bytes must be positive")
+		check(c.MaxBytes >= c.MinBytes, "consumer.max-bytes can't be lower than consumer.min-bytes")
+		check(c.MaxWait > 0, "consumer.max-wait must be positive")
+		check(c.CommitBatchSize > 0, "consumer.commit-batch-size must be positive")
+		check(c.CommitInterval > 0, "consumer.commit-interval must be positive")
+		check(c.StreamBuffer > 0, "consumer.stream-buffer must be positive")
+		check(c.ShutdownTimeout > 0, "consumer.shutdown-timeout must be positive")
+		check(c.ReadyMaxLag >= 0, "consumer.ready-max-lag can't be negative")
+		if c.AdvertisedURL != "" {
+			u, err := url.Parse(c.AdvertisedURL)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"consumer.advertised-url: %q is not an http(s) URL", c.AdvertisedURL)
+		}
+		check(slices.Contains([]string{"forward", "redirect", "off"}, c.Routing),
+			"consumer.routing: must be forward, redirect or off, got %q", c.Routing)
+		check(c.PeerRefreshInterval > 0, "consumer.peer-refresh-interval must be positive")
+		directory, err := url.Parse(c.DirectoryURL)
+		check(err == nil && (directory.Scheme == "http" || directory.Scheme == "https") && directory.Host != "",
+			"consumer.directory-url: %q is not an http(s) URL", c.DirectoryURL)
+		check(!cfg.Auth.Enabled || c.DirectoryAPIKey != "", "consumer.directory-api-key is required with auth enabled, the recipients are checked with it")
+		st := c.Store
+		check(st.Backend == "disk" || st.Backend == "memory", "consumer.store.backend: must be disk or memory, got %q", st.Backend)
+		check(st.Backend != "disk" || st.Dir != "", "consumer.store.dir is required by the disk store")
+		check(st.MaxSegmentBytes > 0, "consumer.store.max-segment-bytes must be positive")
+		r := st.Retention
+		check(r.MaxPerUser >= 0 && r.MaxAge >= 0 && r.MaxBytes >= 0, "consumer.store.retention limits can't be negative")
+		check(r.Policy == "oldest" || r.Policy == "largest-user", "consumer.store.retention.policy: must be oldest or largest-user, got %q", r.Policy)
+	default:
+		check(false, "unknown service %q", service)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n  %s", ErrInvalidConfig, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		change  func(cfg *Config)
+		// wantProblems are pieces of the error, empty when the config is valid
+		wantProblems []string
+	}{
+		{name: "default producer", service: Producer, change: func(cfg *Config) {}},
+		{name: "default consumer", service: Consumer, change: func(cfg *Config) {}},
+		{
+			name:    "brokers",
+			service: Consumer,
+			change:  func(cfg *Config) { cfg.Kafka.Brokers = []string{"localhost"} },
+			wantProblems: []string{
+				`"localhost" is not host:port`,
+			},
+		},
+		{
+			name:    "tls and sasl",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Kafka.TLS = TLSConfig{CertFile: "cert.pem"}
+				cfg.Kafka.SASL = SASLConfig{Mechanism: SASLScramSHA256}
+			},
+			wantProblems: []string{
+				"kafka.tls.cert-file and kafka.tls.key-file go together",
+				"kafka.tls.enabled is false",
+				"kafka.sasl.username is required",
+			},
+		},
+		{
+			name:    "every producer problem is reported",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Producer.Acks = "1"
+				cfg.Producer.Compression = "brotli"
+				cfg.Producer.WireFormat = "xml"
+				cfg.Producer.UserDirectory = UserDirectoryConfig{Backend: "file"}
+			},
+			wantProblems: []string{
+				"producer.enable-idempotence requires producer.acks=all",
+				`unknown codec "brotli"`,
+				"producer.wire-format",
+				"producer.user-directory.file is required",
+				"reload-interval must be positive",
+				"timeout must be positive",
+			},
+		},
+		{
+			name:    "consumer",
+			service: Consumer,
+			change: func(cfg *Config) {
+				cfg.Consumer.StartOffset = "middle"
+				cfg.Consumer.MaxBytes = 0
+				cfg.Consumer.Store.Dir = ""
+				cfg.Consumer.Store.Retention.MaxAge = -1
+				cfg.Consumer.Store.Retention.Policy = "newest"
+			},
+			wantProblems: []string{
+				"consumer.start-offset",
+				"consumer.max-bytes can't be lower",
+				"consumer.store.dir is required",
+				"limits can't be negative",
+				"consumer.store.retention.policy",
+			},
+		},
+		{
+			name:    "shutdown timeouts",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Producer.ShutdownTimeout = 0
+				cfg.Producer.FlushTimeout = -time.Second
+			},
+			wantProblems: []string{"producer.shutdown-timeout must be positive", "producer.flush-timeout must be positive"},
+		},
+		{
+			name:         "consumer shutdown timeout",
+			service:      Consumer,
+			change:       func(cfg *Config) { cfg.Consumer.ShutdownTimeout = 0 },
+			wantProblems: []string{"consumer.shutdown-timeout must be positive"},
+		},
+		{
+			name:         "dead letter topic",
+			service:      Consumer,
+			change:       func(cfg *Config) { cfg.Topics.DeadLetter = "" },
+			wantProblems: []string{"topics.dead-letter is required"},
+		},
+		{
+			name:         "dead letter topic is the notifications topic",
+			service:      Consumer,
+			change:       func(cfg *Config) { cfg.Topics.DeadLetter = cfg.Topics.Notifications },
+			wantProblems: []string{"topics.dead-letter can't be topics.notifications"},
+		},
+		{
+			name:    "rate limits",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Producer.RateLimit.Roles = map[string]RoleLimits{
+					"partner": {SenderRate: -1, RecipientRate: 1},
+				}
+				cfg.Producer.RateLimit.GlobalBurst = 0
+				cfg.Producer.RateLimit.MaxWait = -time.Second
+			},
+			wantProblems: []string{
+				"producer.rate-limit.roles: the default role is required",
+				"producer.rate-limit.roles.partner: rates can't be negative",
+				"producer.rate-limit.roles.partner: recipient_burst must be at least 1",
+				"producer.rate-limit.global-burst must be at least 1",
+				"producer.rate-limit.max-wait can't be negative",
+			},
+		},
+		{
+			name:    "rate limits disabled",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Producer.RateLimit.Enabled = false
+				cfg.Producer.RateLimit.Roles = nil
+				cfg.Producer.RateLimit.GlobalRate = 0
+				cfg.Producer.RateLimit.GlobalBurst = 0
+			},
+		},
+		{
+			name:         "auth without credentials",
+			service:      Producer,
+			change:       func(cfg *Config) { cfg.Auth.Enabled = true },
+			wantProblems: []string{"auth.enabled needs auth.api_keys or auth.jwt.secret"},
+		},
+		{
+			name:    "auth",
+			service: Consumer,
+			change: func(cfg *Config) {
+				cfg.Auth.Enabled = true
+				cfg.Auth.APIKeys = []APIKeyConfig{
+					{Key: "short"},
+					{Key: "emma-key-0000000001", UserID: 1},
+					{Key: "emma-key-0000000001", UserID: -1},
+				}
+				cfg.Auth.JWT = JWTConfig{Secret: "too short", Algorithms: []string{"HS256", "RS256"}, Leeway: -time.Second}
+			},
+			wantProblems: []string{
+				"auth.api_keys[0]: keys must be at least 16 characters",
+				"auth.api_keys[2]: duplicate key",
+				"auth.api_keys[2]: user_id can't be negative",
+				"auth.jwt.secret must be at least 32 characters",
+				`auth.jwt.algorithms: unsupported algorithm "RS256"`,
+				"auth.jwt.leeway can't be negative",
+				"consumer.directory-api-key is required with auth enabled, the recipients are checked with it",
+			},
+		},
+		{
+			name:    "jwt without algorithms",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Auth.JWT.Secret = "0123456789abcdef0123456789abcdef"
+				cfg.Auth.JWT.Algorithms = nil
+			},
+			wantProblems: []string{"auth.jwt.algorithms is required"},
+		},
+		{
+			name:    "templates",
+			service: Producer,
+			change: func(cfg *Config) {
+				cfg.Templates.DefaultLocale = ""
+				cfg.Templates.Render = "later"
+			},
+			wantProblems: []string{
+				"templates.default-locale is required",
+				`templates.render: must be send or client, got "later"`,
+			},
+		},
+		{name: "client render", service: Producer, change: func(cfg *Config) { cfg.Templates.Render = RenderClient }},
+		{
+			name:    "routing",
+			service: Consumer,
+			change: func(cfg *Config) {
+				cfg.Consumer.AdvertisedURL = "consumer-1:8082"
+				cfg.Consumer.Routing = "proxy"
+				cfg.Consumer.PeerRefreshInterval = 0
+			},
+			wantProblems: []string{
+				`consumer.advertised-url: "consumer-1:8082" is not an http(s) URL`,
+				"consumer.routing: must be forward, redirect or off",
+				"consumer.peer-refresh-interval must be positive",
+			},
+		},
+		{name: "advertised url", service: Consumer, change: func(cfg *Config) { cfg.Consumer.AdvertisedURL = "https://consumer-1:8443" }},
+		{
+			name:         "directory url",
+			service:      Consumer,
+			change:       func(cfg *Config) { cfg.Consumer.DirectoryURL = "producer:8083" },
+			wantProblems: []string{`consumer.directory-url: "producer:8083" is not an http(s) URL`},
+		},
+		{
+			name:    "commits",
+			service: Consumer,
+			change: func(cfg *Config) {
+				cfg.Consumer.CommitBatchSize = 0
+				cfg.Consumer.CommitInterval = -time.Second
+			},
+			wantProblems: []string{"consumer.commit-batch-size must be positive", "consumer.commit-interval must be positive"},
+		},
+		{
+			name:    "readiness",
+			service: Consumer,
+			change: func(cfg *Config) {
+				cfg.Producer.ReadyMaxQueue = 0
+				cfg.Consumer.ReadyMaxLag = -1
+			},
+			wantProblems: []string{"consumer.ready-max-lag can't be negative"},
+		},
+		{
+			name:         "producer readiness",
+			service:      Producer,
+			change:       func(cfg *Config) { cfg.Producer.ReadyMaxQueue = 0 },
+			wantProblems: []string{"producer.ready-max-queue must be positive"},
+		},
+		// the other section is not checked
+		{name: "producer ignores the consumer", service: Producer, change: func(cfg *Config) { cfg.Consumer.GroupID = "" }},
+		{name: "unknown service", service: "mailer", change: func(cfg *Config) {}, wantProblems: []string{`unknown service "mailer"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+			err := cfg.Validate(tt.service)
+			if len(tt.wantProblems) == 0 {
+				if err != nil {
+					t.Errorf("Validate = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("Validate = %v, want ErrInvalidConfig", err)
+			}
+			for _, problem := range tt.wantProblems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("Validate = %v, want %q", err, problem)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"consumer/pkg/store"
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// CommitTimeout bounds a single CommitMessages call, it also runs on
+	// shutdown when the consumer context is already canceled.
+	CommitTimeout = 10 * time.Second
+	// AssignmentTTL is how long the partitions the group assigns us are
+	// trusted before they are asked again, rebalances are rare.
+	AssignmentTTL = 5 * time.Second
+)
+
+// offsetCommitter is the part of kafka.Reader the committer needs.
+type offsetCommitter interface {
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// assignment returns the partitions the group currently assigns us.
+type assignment func(ctx context.Context) ([]int, error)
+
+// committer commits the offsets of processed messages in batches, every
+// batchSize messages or every interval, whichever comes first. The store is
+// synced before each commit, so a committed offset never points past a
+// notification that is not on disk: after a crash the uncommitted messages
+// are fetched again and the idempotent store.Add drops the ones it has.
+//
+// kafka-go commits in the current generation whatever the generation of the
+// messages, so the offsets of partitions a rebalance took away are dropped
+// rather than committed over the progress of their new owner. When our
+// partitions can't be looked up everything pending is committed, as before
+// the check: a coordinator outage must not stop the commits.
+type committer struct {
+	reader    offsetCommitter
+	store     store.NotificationStore
+	assigned  assignment
+	batchSize int
+	interval  time.Duration
+
+	// owned are our partitions as of ownedAt, only run touches them
+	owned   []int
+	ownedAt time.Time
+
+	processed chan kafka.Message
+	done      chan struct{}
+}
+
+func newCommitter(reader offsetCommitter, notificationStore store.NotificationStore, assigned assignment, batchSize int, interval time.Duration) *committer {
+	c := &committer{
+		reader:    reader,
+		store:     notificationStore,
+		assigned:  assigned,
+		batchSize: batchSize,
+		interval:  interval,
+		processed: make(chan kafka.Message, batchSize),
+		done:      make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Processed hands over a message whose notification is stored (or skipped for good).
+func (c *committer) Processed(msg kafka.Message) {
+	c.processed <- msg
+}
+
+// Close commits what is left and stops the committer.
+func (c *committer) Close() {
+	close(c.processed)
+	<-c.done
+}
+
+func (c *committer) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	// only the last message of a partition matters, its offset covers the earlier ones
+	pending := make(map[int]kafka.Message)
+	count := 0
+	for {
+		select {
+		case msg, ok := <-c.processed:
+			if !ok {
+				c.commit(pending)
+				return
+			}
+			pending[msg.Partition] = msg
+			count++
+			if count >= c.batchSize && c.commit(pending) {
+				count = 0
+			}
+		case <-ticker.C:
+			if c.commit(pending) {
+				count = 0
+			}
+		}
+	}
+}
+
+// commit syncs the store and commits the pending offsets. On failure they
+// stay pending and the next batch retries them.
+func (c *committer) commit(pending map[int]kafka.Message) bool {
+	if len(pending) == 0 {
+		return true
+	}
+	if err := c.store.Sync(); err != nil {
+		log.Printf("failed to sync notification store, offsets not committed: %v\n", err)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CommitTimeout)
+	defer cancel()
+	partitions, err := c.partitions(ctx)
+	if err != nil {
+		log.Printf("warning: failed to get our partitions, committing every pending offset: %v\n", err)
+	}
+	msgs := make([]kafka.Message, 0, len(pending))
+	for partition, msg := range pending {
+		if err == nil && !slices.Contains(partitions, partition) {
+			// the new owner reads it again from the last commit, the store drops the duplicates
+			log.Printf("partition %d was revoked, dropping its offset %d\n", partition, msg.Offset)
+			delete(pending, partition)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return true
+	}
+	if err := c.reader.CommitMessages(ctx, msgs...); err != nil {
+		log.Printf("failed to commit offsets (retrying with the next batch): %v\n", err)
+		return false
+	}
+
+	clear(pending)
+	return true
+}
+
+// partitions returns our partitions, looked up again once AssignmentTTL passed.
+func (c *committer) partitions(ctx context.Context) ([]int, error) {
+	if !c.ownedAt.IsZero() && time.Since(c.ownedAt) < AssignmentTTL {
+		return c.owned, nil
+	}
+	owned, err := c.assigned(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.owned, c.ownedAt = owned, time.Now()
+	return owned, nil
+}
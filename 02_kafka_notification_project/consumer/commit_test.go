@@ -0,0 +1,234 @@
+package main
+
+import (
+	"consumer/pkg/store"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeCommitter records the offsets committed per call, the first failures
+// calls fail. owned are the partitions the group assigns us.
+type fakeCommitter struct {
+	mu       sync.Mutex
+	commits  [][]string
+	failures int
+	owned    []int
+	// assignFailures fails the first assignment lookups, lookups counts them
+	assignFailures int
+	lookups        int
+	// synced is the number of store syncs seen at every commit
+	store  *syncCountingStore
+	synced []int
+}
+
+func (f *fakeCommitter) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("group is rebalancing")
+	}
+	var offsets []string
+	for _, msg := range msgs {
+		offsets = append(offsets, partitionOffset(msg))
+	}
+	slices.Sort(offsets)
+	f.commits = append(f.commits, offsets)
+	f.synced = append(f.synced, f.store.syncs())
+	return nil
+}
+
+func (f *fakeCommitter) assigned(ctx context.Context) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	if f.assignFailures > 0 {
+		f.assignFailures--
+		return nil, errors.New("coordinator not available")
+	}
+	return slices.Clone(f.owned), nil
+}
+
+// revoke takes partition away from us.
+func (f *fakeCommitter) revoke(partition int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.owned = slices.DeleteFunc(f.owned, func(p int) bool { return p == partition })
+}
+
+func (f *fakeCommitter) committed() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.commits)
+}
+
+// syncCountingStore counts the syncs, the first failures of them fail.
+type syncCountingStore struct {
+	store.NotificationStore
+	mu       sync.Mutex
+	count    int
+	failures int
+}
+
+func (s *syncCountingStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("disk full")
+	}
+	s.count++
+	return nil
+}
+
+func (s *syncCountingStore) syncs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func partitionOffset(msg kafka.Message) string {
+	return string(rune('0'+msg.Partition)) + ":" + string(rune('0'+msg.Offset))
+}
+
+func message(partition int, offset int64) kafka.Message {
+	return kafka.Message{Topic: "notifications", Partition: partition, Offset: offset}
+}
+
+// waitForCommits waits until n commits were made.
+func waitForCommits(t *testing.T, f *fakeCommitter, n int) [][]string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if commits := f.committed(); len(commits) >= n {
+			return commits
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("commits = %v, want %d of them", f.committed(), n)
+	return nil
+}
+
+func newTestCommitter(batchSize int, interval time.Duration, commitFailures, syncFailures int) (*committer, *fakeCommitter) {
+	s := &syncCountingStore{NotificationStore: store.NewMemoryStore(store.Retention{}), failures: syncFailures}
+	f := &fakeCommitter{store: s, failures: commitFailures, owned: []int{0, 1, 2}}
+	return newCommitter(f, s, f.assigned, batchSize, interval), f
+}
+
+func TestCommitterBatches(t *testing.T) {
+	c, f := newTestCommitter(3, time.Hour, 0, 0)
+	for _, msg := range []kafka.Message{message(0, 1), message(0, 2), message(1, 5), message(1, 6), message(2, 1)} {
+		c.Processed(msg)
+	}
+	// only the last offset of every partition is committed
+	commits := waitForCommits(t, f, 1)
+	if !slices.Equal(commits[0], []string{"0:2", "1:5"}) {
+		t.Errorf("first batch = %v, want 0:2 and 1:5", commits[0])
+	}
+
+	// the rest is committed on close
+	c.Close()
+	commits = f.committed()
+	if len(commits) != 2 || !slices.Equal(commits[1], []string{"1:6", "2:1"}) {
+		t.Errorf("commits = %v, want 1:6 and 2:1 on close", commits)
+	}
+	// the store was synced before every commit
+	if !slices.Equal(f.synced, []int{1, 2}) {
+		t.Errorf("syncs at commit = %v, want one before every commit", f.synced)
+	}
+}
+
+func TestCommitterInterval(t *testing.T) {
+	c, f := newTestCommitter(100, 20*time.Millisecond, 0, 0)
+	defer c.Close()
+	c.Processed(message(0, 1))
+	if commits := waitForCommits(t, f, 1); !slices.Equal(commits[0], []string{"0:1"}) {
+		t.Errorf("commits = %v, want 0:1 after the interval", commits)
+	}
+}
+
+func TestCommitterRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		commitFailures int
+		syncFailures   int
+	}{
+		{name: "commit fails", commitFailures: 1},
+		{name: "sync fails", syncFailures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, f := newTestCommitter(1, time.Hour, tt.commitFailures, tt.syncFailures)
+			c.Processed(message(0, 1))
+			// the failed offset stays pending and goes with the next batch
+			c.Processed(message(1, 1))
+			c.Close()
+
+			commits := f.committed()
+			if len(commits) != 1 || !slices.Equal(commits[0], []string{"0:1", "1:1"}) {
+				t.Errorf("commits = %v, want 0:1 and 1:1 together", commits)
+			}
+		})
+	}
+}
+
+func TestCommitterAssignmentFailure(t *testing.T) {
+	c, f := newTestCommitter(1, time.Hour, 0, 0)
+	f.assignFailures = 1
+	f.revoke(1)
+	// our partitions are unknown, it is committed anyway
+	c.Processed(message(1, 1))
+	waitForCommits(t, f, 1)
+	// known again, the revoked partition is dropped
+	c.Processed(message(0, 1))
+	c.Processed(message(1, 2))
+	c.Close()
+
+	commits := f.committed()
+	if len(commits) != 2 || !slices.Equal(commits[0], []string{"1:1"}) || !slices.Equal(commits[1], []string{"0:1"}) {
+		t.Errorf("commits = %v, want 1:1 then 0:1", commits)
+	}
+}
+
+func TestCommitterCachesAssignment(t *testing.T) {
+	c, f := newTestCommitter(1, time.Hour, 0, 0)
+	for offset := range int64(5) {
+		c.Processed(message(0, offset))
+	}
+	c.Close()
+
+	if commits := f.committed(); len(commits) != 5 {
+		t.Errorf("commits = %v, want one per message", commits)
+	}
+	if f.lookups != 1 {
+		t.Errorf("%d assignment lookups, want 1 within %s", f.lookups, AssignmentTTL)
+	}
+}
+
+func TestCommitterDropsRevokedPartitions(t *testing.T) {
+	c, f := newTestCommitter(10, time.Hour, 0, 0)
+	c.Processed(message(0, 1))
+	c.Processed(message(1, 4))
+	// a rebalance gave partition 1 to another instance
+	f.revoke(1)
+	c.Close()
+
+	commits := f.committed()
+	if len(commits) != 1 || !slices.Equal(commits[0], []string{"0:1"}) {
+		t.Errorf("commits = %v, want only 0:1", commits)
+	}
+}
+
+func TestCommitterCloseWithoutMessages(t *testing.T) {
+	c, f := newTestCommitter(10, time.Hour, 0, 0)
+	c.Close()
+	if commits := f.committed(); len(commits) != 0 {
+		t.Errorf("commits = %v, want none", commits)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"auth"
+	"consumer/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DirectoryTimeout bounds a request to the user directory.
+	DirectoryTimeout = 5 * time.Second
+	// KnownUserTTL is how long a recipient found in the directory is not
+	// looked up again.
+	KnownUserTTL = time.Minute
+)
+
+var ErrUnknownUser = errors.New("user not found")
+
+// Directory reads the users from the producer, which owns the user
+// directory. Group membership changes there, the notifications only carry
+// the groups of the moment they were sent.
+type Directory struct {
+	base   *url.URL
+	client *http.Client
+	// apiKey is our own key, for the lookups no request asked for
+	apiKey string
+
+	mu sync.Mutex
+	// known are the users found lately, and when
+	known map[string]time.Time
+}
+
+func newDirectory(rawURL, apiKey string) (*Directory, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Directory{
+		base:   base,
+		client: &http.Client{Timeout: DirectoryTimeout},
+		apiKey: apiKey,
+		known:  make(map[string]time.Time),
+	}, nil
+}
+
+// User gets a user with the credentials of the request it answers, the
+// producer checks them again. Without a request our own key is used.
+func (d *Directory) User(ctx context.Context, userID string, credentials *http.Request) (models.User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base.JoinPath("users", userID).String(), nil)
+	if err != nil {
+		return models.User{}, err
+	}
+	if credentials == nil {
+		if d.apiKey != "" {
+			req.Header.Set(auth.HeaderAPIKey, d.apiKey)
+		}
+	} else {
+		for _, header := range []string{"Authorization", auth.HeaderAPIKey} {
+			if value := credentials.Header.Get(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return models.User{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return models.User{}, ErrUnknownUser
+	default:
+		return models.User{}, fmt.Errorf("user directory answered %s", resp.Status)
+	}
+
+	var user models.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return models.User{}, fmt.Errorf("invalid user from the directory: %w", err)
+	}
+	return user, nil
+}
+
+// Exists tells whether the user is in the directory: nil, ErrUnknownUser or
+// the lookup error. A user found is remembered for KnownUserTTL, a user not
+// found is looked up again next time, they may have been created since.
+func (d *Directory) Exists(ctx context.Context, userID string) error {
+	d.mu.Lock()
+	foundAt, ok := d.known[userID]
+	d.mu.Unlock()
+	if ok && time.Since(foundAt) < KnownUserTTL {
+		return nil
+	}
+
+	if _, err := d.User(ctx, userID, nil); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.known[userID] = time.Now()
+	d.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"auth"
+	"consumer/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestDirectory serves users like the producer does, user 500 fails.
+func newTestDirectory(t *testing.T, users map[string]models.User) *Directory {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimPrefix(r.URL.Path, "/users/")
+		if userID == "500" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if key := r.Header.Get(auth.HeaderAPIKey); key != "" && key != "valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		user, ok := users[userID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	}))
+	t.Cleanup(server.Close)
+
+	directory, err := newDirectory(server.URL, "valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+func TestDirectoryUser(t *testing.T) {
+	directory := newTestDirectory(t, map[string]models.User{"1": {ID: 1, Name: "Emma", Groups: []string{"work"}}})
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		userID  string
+		key     string
+		wantErr bool
+	}{
+		{"found", "1", "", false},
+		{"credentials forwarded", "1", "valid", false},
+		{"credentials refused", "1", "wrong", true},
+		{"unknown", "2", "", true},
+		{"directory failing", "500", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/notifications/"+tt.userID+"/groups", nil)
+			if tt.key != "" {
+				req.Header.Set(auth.HeaderAPIKey, tt.key)
+			}
+			user, err := directory.User(ctx, tt.userID, req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("User(%s) = %+v, %v", tt.userID, user, err)
+			}
+			if err == nil && (user.Name != "Emma" || len(user.Groups) != 1) {
+				t.Errorf("User(%s) = %+v, want Emma in work", tt.userID, user)
+			}
+			if tt.userID == "2" && !errors.Is(err, ErrUnknownUser) {
+				t.Errorf("User(2) = %v, want ErrUnknownUser", err)
+			}
+		})
+	}
+}
+
+func TestDirectoryExists(t *testing.T) {
+	lookups := 0
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		keys = append(keys, r.Header.Get(auth.HeaderAPIKey))
+		if r.URL.Path != "/users/1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(models.User{ID: 1})
+	}))
+	defer server.Close()
+	directory, err := newDirectory(server.URL, "consumer-key-000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for range 3 {
+		if err := directory.Exists(ctx, "1"); err != nil {
+			t.Fatalf("Exists(1) = %v", err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("%d lookups of a known user, want 1", lookups)
+	}
+	// an unknown user is not remembered, they may be created
+	for range 2 {
+		if err := directory.Exists(ctx, "2"); !errors.Is(err, ErrUnknownUser) {
+			t.Fatalf("Exists(2) = %v, want ErrUnknownUser", err)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("%d lookups, want the unknown user looked up every time", lookups)
+	}
+	for _, key := range keys {
+		if key != "consumer-key-000001" {
+			t.Errorf("looked up with key %q, want our own", key)
+		}
+	}
+}
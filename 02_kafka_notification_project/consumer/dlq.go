@@ -0,0 +1,510 @@
+package main
+
+import (
+	"config"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+)
+
+// Headers added to every dead letter, next to the original ones.
+const (
+	HeaderDLQReason    = "dlq-error-reason"
+	HeaderDLQError     = "dlq-error"
+	HeaderDLQTopic     = "dlq-original-topic"
+	HeaderDLQPartition = "dlq-original-partition"
+	HeaderDLQOffset    = "dlq-original-offset"
+	HeaderDLQFailedAt  = "dlq-failed-at"
+	// HeaderDLQReplayedFrom marks a replayed message with the dead letter it came from
+	HeaderDLQReplayedFrom = "dlq-replayed-from"
+)
+
+// Why a message was dead lettered, the value of HeaderDLQReason.
+const (
+	ReasonDecodeFailed   = "decode_failed"
+	ReasonEmptyKey       = "empty_key"
+	ReasonKeyMismatch    = "key_mismatch"
+	ReasonUnknownUser    = "unknown_user"
+	ReasonRecordTooLarge = "record_too_large"
+)
+
+const (
+	DefaultDLQLimit = 50
+	MaxDLQLimit     = 500
+	// DLQRequestTimeout bounds the broker requests of an admin call
+	DLQRequestTimeout = 10 * time.Second
+	dlqFetchMaxBytes  = 4 << 20
+	dlqFetchMaxWait   = 500 * time.Millisecond
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrInvalidDeadLetter  = errors.New("invalid dead letter id")
+)
+
+// DeadLetterQueue moves the messages the consumer can't store to their own
+// topic, untouched, and lets an admin look at them and replay them once the
+// cause is fixed.
+type DeadLetterQueue struct {
+	client *kafka.Client
+	// writer has no topic, every message says where it goes: dead letters
+	// to topic, replays back to notificationsTopic
+	writer             *kafka.Writer
+	topic              string
+	notificationsTopic string
+}
+
+func newDeadLetterQueue(cfg config.Config, client *kafka.Client, transport *kafka.Transport) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		client: client,
+		writer: &kafka.Writer{
+			Addr: kafka.TCP(cfg.Kafka.Brokers...),
+			// same partitioner as the producer, a replayed message lands where the original did
+			Balancer:               &kafka.CRC32Balancer{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+			Transport:              transport,
+		},
+		topic:              cfg.Topics.DeadLetter,
+		notificationsTopic: cfg.Topics.Notifications,
+	}
+}
+
+func (dlq *DeadLetterQueue) Close() error {
+	return dlq.writer.Close()
+}
+
+// Send writes msg to the dead letter topic and waits for the brokers, the
+// original offset must only be committed once it returned nil.
+func (dlq *DeadLetterQueue) Send(ctx context.Context, msg kafka.Message, reason string, cause error) error {
+	headers := withoutDLQHeaders(msg.Headers)
+	headers = append(headers,
+		kafka.Header{Key: HeaderDLQReason, Value: []byte(reason)},
+		kafka.Header{Key: HeaderDLQTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderDLQPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderDLQOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderDLQFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+	if cause != nil {
+		headers = append(headers, kafka.Header{Key: HeaderDLQError, Value: []byte(cause.Error())})
+	}
+
+	err := dlq.writer.WriteMessages(ctx, kafka.Message{
+		Topic:   dlq.topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	deadLettered.WithLabelValues(reason).Inc()
+	return nil
+}
+
+func withoutDLQHeaders(headers []kafka.Header) []kafka.Header {
+	kept := make([]kafka.Header, 0, len(headers))
+	for _, header := range headers {
+		if !strings.HasPrefix(header.Key, "dlq-") {
+			kept = append(kept, header)
+		}
+	}
+	return kept
+}
+
+type originalPosition struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// deadLetter is one message of the dead letter topic. Value is only filled
+// when inspecting a single entry: as JSON when it is JSON, base64 otherwise.
+type deadLetter struct {
+	ID          string            `json:"id"`
+	Partition   int               `json:"partition"`
+	Offset      int64             `json:"offset"`
+	Time        time.Time         `json:"time"`
+	Reason      string            `json:"reason"`
+	Error       string            `json:"error,omitempty"`
+	FailedAt    string            `json:"failed_at,omitempty"`
+	Original    originalPosition  `json:"original"`
+	Key         string            `json:"key"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Value       json.RawMessage   `json:"value,omitempty"`
+	ValueBase64 string            `json:"value_base64,omitempty"`
+
+	key     []byte
+	value   []byte
+	headers []kafka.Header
+}
+
+func deadLetterID(partition int, offset int64) string {
+	return fmt.Sprintf("%d-%d", partition, offset)
+}
+
+func parseDeadLetterID(id string) (int, int64, error) {
+	partition, offset, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidDeadLetter, id)
+	}
+	p, err := strconv.Atoi(partition)
+	if err != nil || p < 0 {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidDeadLetter, id)
+	}
+	o, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || o < 0 {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidDeadLetter, id)
+	}
+	return p, o, nil
+}
+
+func newDeadLetter(partition int, record *kafka.Record) (deadLetter, error) {
+	key, err := protocol.ReadAll(record.Key)
+	if err != nil {
+		return deadLetter{}, err
+	}
+	value, err := protocol.ReadAll(record.Value)
+	if err != nil {
+		return deadLetter{}, err
+	}
+
+	entry := deadLetter{
+		ID:        deadLetterID(partition, record.Offset),
+		Partition: partition,
+		Offset:    record.Offset,
+		Time:      record.Time,
+		Key:       string(key),
+		key:       key,
+		value:     value,
+		// the record is only valid until the next read
+		headers: append([]kafka.Header(nil), record.Headers...),
+	}
+	for _, header := range entry.headers {
+		switch header.Key {
+		case HeaderDLQReason:
+			entry.Reason = string(header.Value)
+		case HeaderDLQError:
+			entry.Error = string(header.Value)
+		case HeaderDLQFailedAt:
+			entry.FailedAt = string(header.Value)
+		case HeaderDLQTopic:
+			entry.Original.Topic = string(header.Value)
+		case HeaderDLQPartition:
+			entry.Original.Partition, _ = strconv.Atoi(string(header.Value))
+		case HeaderDLQOffset:
+			entry.Original.Offset, _ = strconv.ParseInt(string(header.Value), 10, 64)
+		}
+	}
+	return entry, nil
+}
+
+// withValue fills the fields only shown when inspecting one entry.
+func (entry deadLetter) withValue() deadLetter {
+	entry.Headers = make(map[string]string, len(entry.headers))
+	for _, header := range entry.headers {
+		entry.Headers[header.Key] = string(header.Value)
+	}
+	if json.Valid(entry.value) {
+		entry.Value = entry.value
+	} else {
+		entry.ValueBase64 = base64.StdEncoding.EncodeToString(entry.value)
+	}
+	return entry
+}
+
+type partitionRange struct {
+	Partition   int   `json:"partition"`
+	FirstOffset int64 `json:"first_offset"`
+	// LastOffset is the offset the next dead letter will get
+	LastOffset int64 `json:"last_offset"`
+}
+
+// partitions returns the offset range of every partition of the dead letter
+// topic, none when nothing was dead lettered yet.
+func (dlq *DeadLetterQueue) partitions(ctx context.Context) ([]partitionRange, error) {
+	metadata, err := dlq.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{dlq.topic}})
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []kafka.OffsetRequest
+	for _, topic := range metadata.Topics {
+		if topic.Name != dlq.topic || topic.Error != nil {
+			continue
+		}
+		for _, partition := range topic.Partitions {
+			requests = append(requests, kafka.FirstOffsetOf(partition.ID), kafka.LastOffsetOf(partition.ID))
+		}
+	}
+	if len(requests) == 0 {
+		return []partitionRange{}, nil
+	}
+
+	offsets, err := dlq.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{dlq.topic: requests},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ranges := []partitionRange{}
+	for _, partition := range offsets.Topics[dlq.topic] {
+		if partition.Error != nil {
+			return nil, partition.Error
+		}
+		ranges = append(ranges, partitionRange{
+			Partition:   partition.Partition,
+			FirstOffset: partition.FirstOffset,
+			LastOffset:  partition.LastOffset,
+		})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Partition < ranges[j].Partition })
+	return ranges, nil
+}
+
+// fetch reads up to limit dead letters of a partition, from offset to end (excluded).
+func (dlq *DeadLetterQueue) fetch(ctx context.Context, partition int, offset, end int64, limit int) ([]deadLetter, error) {
+	entries := []deadLetter{}
+	for offset < end && len(entries) < limit {
+		resp, err := dlq.client.Fetch(ctx, &kafka.FetchRequest{
+			Topic:     dlq.topic,
+			Partition: partition,
+			Offset:    offset,
+			MinBytes:  1,
+			MaxBytes:  dlqFetchMaxBytes,
+			MaxWait:   dlqFetchMaxWait,
+		})
+		if err == nil {
+			err = resp.Error
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start := offset
+		for len(entries) < limit {
+			record, err := resp.Records.ReadRecord()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			// a fetch may start with the beginning of the batch holding offset
+			if record.Offset < offset || record.Offset >= end {
+				continue
+			}
+			entry, err := newDeadLetter(partition, record)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			offset = record.Offset + 1
+		}
+		if offset == start {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (dlq *DeadLetterQueue) Get(ctx context.Context, partition int, offset int64) (deadLetter, error) {
+	entries, err := dlq.fetch(ctx, partition, offset, offset+1, 1)
+	if err != nil {
+		return deadLetter{}, err
+	}
+	if len(entries) == 0 {
+		return deadLetter{}, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, deadLetterID(partition, offset))
+	}
+	return entries[0], nil
+}
+
+// Replay writes the dead letters back to the notifications topic, with their
+// original key, value and headers.
+func (dlq *DeadLetterQueue) Replay(ctx context.Context, entries []deadLetter) error {
+	msgs := make([]kafka.Message, 0, len(entries))
+	for _, entry := range entries {
+		headers := withoutDLQHeaders(entry.headers)
+		headers = append(headers, kafka.Header{Key: HeaderDLQReplayedFrom, Value: []byte(entry.ID)})
+		msgs = append(msgs, kafka.Message{
+			Topic:   dlq.notificationsTopic,
+			Key:     entry.key,
+			Value:   entry.value,
+			Headers: headers,
+		})
+	}
+	if err := dlq.writer.WriteMessages(ctx, msgs...); err != nil {
+		return fmt.Errorf("failed to replay dead letters: %w", err)
+	}
+	return nil
+}
+
+func getDLQLimit(ctx *gin.Context) (int, error) {
+	limit := DefaultDLQLimit
+	if value := ctx.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid limit %q", value)
+		}
+		limit = min(n, MaxDLQLimit)
+	}
+	return limit, nil
+}
+
+// handleListDeadLetters lists dead letters without their value, every
+// partition from its first offset or, with ?partition=, one partition from
+// ?offset=.
+func handleListDeadLetters(ctx *gin.Context, dlq *DeadLetterQueue) {
+	limit, err := getDLQLimit(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	onlyPartition := -1
+	var from int64
+	if value := ctx.Query("partition"); value != "" {
+		if onlyPartition, err = strconv.Atoi(value); err != nil || onlyPartition < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("invalid partition %q", value)})
+			return
+		}
+		if value := ctx.Query("offset"); value != "" {
+			if from, err = strconv.ParseInt(value, 10, 64); err != nil || from < 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("invalid offset %q", value)})
+				return
+			}
+		}
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), DLQRequestTimeout)
+	defer cancel()
+	ranges, err := dlq.partitions(reqCtx)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+
+	entries := []deadLetter{}
+	for _, r := range ranges {
+		if onlyPartition >= 0 && r.Partition != onlyPartition {
+			continue
+		}
+		if len(entries) == limit {
+			break
+		}
+		fetched, err := dlq.fetch(reqCtx, r.Partition, max(from, r.FirstOffset), r.LastOffset, limit-len(entries))
+		if err != nil {
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+			return
+		}
+		entries = append(entries, fetched...)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"topic":      dlq.topic,
+		"partitions": ranges,
+		"entries":    entries,
+	})
+}
+
+func getDeadLetterFromRequest(ctx *gin.Context, dlq *DeadLetterQueue) (deadLetter, bool) {
+	partition, offset, err := parseDeadLetterID(ctx.Param("partition") + "-" + ctx.Param("offset"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return deadLetter{}, false
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), DLQRequestTimeout)
+	defer cancel()
+	entry, err := dlq.Get(reqCtx, partition, offset)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return deadLetter{}, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return deadLetter{}, false
+	}
+	return entry, true
+}
+
+func handleGetDeadLetter(ctx *gin.Context, dlq *DeadLetterQueue) {
+	entry, ok := getDeadLetterFromRequest(ctx, dlq)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, entry.withValue())
+}
+
+func handleReplayDeadLetter(ctx *gin.Context, dlq *DeadLetterQueue) {
+	entry, ok := getDeadLetterFromRequest(ctx, dlq)
+	if !ok {
+		return
+	}
+	replay(ctx, dlq, []deadLetter{entry})
+}
+
+type replayRequest struct {
+	IDs []string `json:"ids" binding:"required,min=1,max=500"`
+}
+
+// handleReplayDeadLetters replays several dead letters by id ("partition-offset").
+// Nothing is replayed when one of them can't be found.
+func handleReplayDeadLetters(ctx *gin.Context, dlq *DeadLetterQueue) {
+	var req replayRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), DLQRequestTimeout)
+	defer cancel()
+	entries := make([]deadLetter, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		partition, offset, err := parseDeadLetterID(id)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		entry, err := dlq.Get(reqCtx, partition, offset)
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+			return
+		}
+		entries = append(entries, entry)
+	}
+	replay(ctx, dlq, entries)
+}
+
+func replay(ctx *gin.Context, dlq *DeadLetterQueue, entries []deadLetter) {
+	reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), DLQRequestTimeout)
+	defer cancel()
+	if err := dlq.Replay(reqCtx, entries); err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":  fmt.Sprintf("Replayed %d dead letters to %s", len(entries), dlq.notificationsTopic),
+		"replayed": ids,
+	})
+}
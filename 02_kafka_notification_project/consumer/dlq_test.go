@@ -0,0 +1,390 @@
+package main
+
+import (
+	"config"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// fakeBroker keeps what is produced to it, one partition per topic, and
+// serves it back to fetches. The offset of a message is its index.
+type fakeBroker struct {
+	mu   sync.Mutex
+	logs map[string][]kafka.Message
+	// err fails every request
+	err error
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{logs: make(map[string][]kafka.Message)}
+}
+
+func (b *fakeBroker) messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.logs[topic])
+}
+
+func (b *fakeBroker) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *fakeBroker) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	switch req := req.(type) {
+	case *metadata.Request:
+		resp := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}}}
+		for _, topic := range req.TopicNames {
+			resp.Topics = append(resp.Topics, metadata.ResponseTopic{
+				Name:       topic,
+				Partitions: []metadata.ResponsePartition{{PartitionIndex: 0, LeaderID: 1}},
+			})
+		}
+		return resp, nil
+	case *produce.Request:
+		resp := &produce.Response{}
+		for _, topic := range req.Topics {
+			for _, partition := range topic.Partitions {
+				base := int64(len(b.logs[topic.Topic]))
+				for {
+					record, err := partition.RecordSet.Records.ReadRecord()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return nil, err
+					}
+					key, _ := protocol.ReadAll(record.Key)
+					value, _ := protocol.ReadAll(record.Value)
+					b.logs[topic.Topic] = append(b.logs[topic.Topic], kafka.Message{
+						Topic:   topic.Topic,
+						Offset:  int64(len(b.logs[topic.Topic])),
+						Key:     key,
+						Value:   value,
+						Headers: slices.Clone(record.Headers),
+						Time:    time.Now(),
+					})
+				}
+				resp.Topics = append(resp.Topics, produce.ResponseTopic{
+					Topic:      topic.Topic,
+					Partitions: []produce.ResponsePartition{{Partition: partition.Partition, BaseOffset: base}},
+				})
+			}
+		}
+		return resp, nil
+	case *listoffsets.Request:
+		resp := &listoffsets.Response{}
+		for _, topic := range req.Topics {
+			respTopic := listoffsets.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				var offset int64
+				if partition.Timestamp == kafka.LastOffset {
+					offset = int64(len(b.logs[topic.Topic]))
+				}
+				respTopic.Partitions = append(respTopic.Partitions, listoffsets.ResponsePartition{
+					Partition: partition.Partition,
+					Timestamp: partition.Timestamp,
+					Offset:    offset,
+				})
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil
+	case *fetch.Request:
+		topic := req.Topics[0].Topic
+		log := b.logs[topic]
+		var records []protocol.Record
+		for _, msg := range log[min(req.Topics[0].Partitions[0].FetchOffset, int64(len(log))):] {
+			records = append(records, protocol.Record{
+				Offset:  msg.Offset,
+				Time:    msg.Time,
+				Key:     protocol.NewBytes(msg.Key),
+				Value:   protocol.NewBytes(msg.Value),
+				Headers: msg.Headers,
+			})
+		}
+		return &fetch.Response{Topics: []fetch.ResponseTopic{{
+			Topic: topic,
+			Partitions: []fetch.ResponsePartition{{
+				HighWatermark: int64(len(log)),
+				RecordSet:     protocol.RecordSet{Version: 2, Records: protocol.NewRecordReader(records...)},
+			}},
+		}}}, nil
+	default:
+		return nil, errors.New("unexpected request")
+	}
+}
+
+func newTestDeadLetterQueue(broker *fakeBroker) *DeadLetterQueue {
+	cfg := config.Default()
+	dlq := newDeadLetterQueue(cfg, &kafka.Client{Addr: kafka.TCP("localhost:9092"), Transport: broker}, nil)
+	dlq.writer.Transport = broker
+	// don't wait for a batch to fill up
+	dlq.writer.BatchTimeout = time.Millisecond
+	dlq.writer.MaxAttempts = 1
+	return dlq
+}
+
+func header(headers []kafka.Header, key string) (string, bool) {
+	for _, h := range headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+func TestParseDeadLetterID(t *testing.T) {
+	partition, offset, err := parseDeadLetterID("2-15")
+	if err != nil || partition != 2 || offset != 15 {
+		t.Errorf("parseDeadLetterID(2-15) = %d, %d, %v", partition, offset, err)
+	}
+	for _, id := range []string{"", "2", "a-1", "1-b", "-1-2", "1--2", "1-2-3"} {
+		if _, _, err := parseDeadLetterID(id); !errors.Is(err, ErrInvalidDeadLetter) {
+			t.Errorf("parseDeadLetterID(%q) = %v, want ErrInvalidDeadLetter", id, err)
+		}
+	}
+}
+
+func TestDeadLetterQueueSend(t *testing.T) {
+	broker := newFakeBroker()
+	dlq := newTestDeadLetterQueue(broker)
+	defer dlq.Close()
+
+	msg := kafka.Message{
+		Topic:     "notifications",
+		Partition: 3,
+		Offset:    42,
+		Key:       []byte("1"),
+		Value:     []byte("not json"),
+		Headers: []kafka.Header{
+			{Key: "content-type", Value: []byte("application/json")},
+			// left over from an earlier trip through the queue
+			{Key: HeaderDLQReason, Value: []byte(ReasonEmptyKey)},
+		},
+	}
+	if err := dlq.Send(context.Background(), msg, ReasonDecodeFailed, errors.New("bad json")); err != nil {
+		t.Fatal(err)
+	}
+
+	letters := broker.messages("notifications-dlq")
+	if len(letters) != 1 {
+		t.Fatalf("dead letters = %v, want one", letters)
+	}
+	letter := letters[0]
+	if string(letter.Key) != "1" || string(letter.Value) != "not json" {
+		t.Errorf("dead letter = %s %s, want the original key and value", letter.Key, letter.Value)
+	}
+	want := map[string]string{
+		"content-type":     "application/json",
+		HeaderDLQReason:    ReasonDecodeFailed,
+		HeaderDLQError:     "bad json",
+		HeaderDLQTopic:     "notifications",
+		HeaderDLQPartition: "3",
+		HeaderDLQOffset:    "42",
+	}
+	for key, value := range want {
+		if got, _ := header(letter.Headers, key); got != value {
+			t.Errorf("header %s = %q, want %q", key, got, value)
+		}
+	}
+	reasons := 0
+	for _, h := range letter.Headers {
+		if h.Key == HeaderDLQReason {
+			reasons++
+		}
+	}
+	if reasons != 1 {
+		t.Errorf("headers = %v, want a single reason", letter.Headers)
+	}
+	if _, ok := header(letter.Headers, HeaderDLQFailedAt); !ok {
+		t.Errorf("headers = %v, want %s", letter.Headers, HeaderDLQFailedAt)
+	}
+
+	broker.fail(errors.New("broker down"))
+	if err := dlq.Send(context.Background(), msg, ReasonDecodeFailed, nil); err == nil {
+		t.Error("Send with the broker down = nil, want an error")
+	}
+}
+
+func newTestDLQRouter(dlq *DeadLetterQueue) *gin.Engine {
+	router := gin.New()
+	admin := router.Group("/admin")
+	admin.GET("/dlq", func(ctx *gin.Context) {
+		handleListDeadLetters(ctx, dlq)
+	})
+	admin.GET("/dlq/:partition/:offset", func(ctx *gin.Context) {
+		handleGetDeadLetter(ctx, dlq)
+	})
+	admin.POST("/dlq/:partition/:offset/replay", func(ctx *gin.Context) {
+		handleReplayDeadLetter(ctx, dlq)
+	})
+	admin.POST("/dlq/replay", func(ctx *gin.Context) {
+		handleReplayDeadLetters(ctx, dlq)
+	})
+	return router
+}
+
+// deadLetters sends one dead letter per value.
+func deadLetters(t *testing.T, dlq *DeadLetterQueue, values ...string) {
+	t.Helper()
+	for i, value := range values {
+		msg := kafka.Message{Topic: "notifications", Offset: int64(i), Key: []byte("1"), Value: []byte(value)}
+		if err := dlq.Send(context.Background(), msg, ReasonDecodeFailed, errors.New("bad")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListDeadLetters(t *testing.T) {
+	broker := newFakeBroker()
+	dlq := newTestDeadLetterQueue(broker)
+	defer dlq.Close()
+	router := newTestDLQRouter(dlq)
+
+	code, response := do(t, router, http.MethodGet, "/admin/dlq", "")
+	if code != http.StatusOK || len(response["entries"].([]any)) != 0 {
+		t.Errorf("GET /admin/dlq before any dead letter = %d %v, want no entries", code, response)
+	}
+
+	deadLetters(t, dlq, `{"a":1}`, "b", "c")
+	entryIDs := func(response map[string]any) []string {
+		var out []string
+		for _, entry := range response["entries"].([]any) {
+			out = append(out, entry.(map[string]any)["id"].(string))
+		}
+		return out
+	}
+	tests := []struct {
+		path    string
+		wantIDs []string
+	}{
+		{"/admin/dlq", []string{"0-0", "0-1", "0-2"}},
+		{"/admin/dlq?limit=2", []string{"0-0", "0-1"}},
+		{"/admin/dlq?partition=0&offset=1", []string{"0-1", "0-2"}},
+		{"/admin/dlq?partition=1", nil},
+	}
+	for _, tt := range tests {
+		code, response := do(t, router, http.MethodGet, tt.path, "")
+		if code != http.StatusOK || !slices.Equal(entryIDs(response), tt.wantIDs) {
+			t.Errorf("GET %s = %d %v, want %v", tt.path, code, response, tt.wantIDs)
+		}
+	}
+
+	_, response = do(t, router, http.MethodGet, "/admin/dlq?limit=1", "")
+	entry := response["entries"].([]any)[0].(map[string]any)
+	if entry["reason"] != ReasonDecodeFailed || entry["error"] != "bad" || entry["key"] != "1" || entry["value"] != nil {
+		t.Errorf("entry = %v, want the reason and no value", entry)
+	}
+	if original := entry["original"].(map[string]any); original["topic"] != "notifications" || original["offset"] != 0.0 {
+		t.Errorf("original = %v, want notifications offset 0", original)
+	}
+
+	for _, path := range []string{"/admin/dlq?limit=0", "/admin/dlq?limit=x", "/admin/dlq?partition=-1", "/admin/dlq?partition=0&offset=x"} {
+		if code, response := do(t, router, http.MethodGet, path, ""); code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d %v, want 400", path, code, response)
+		}
+	}
+
+	broker.fail(errors.New("broker down"))
+	if code, response := do(t, router, http.MethodGet, "/admin/dlq", ""); code != http.StatusBadGateway {
+		t.Errorf("GET /admin/dlq with the broker down = %d %v, want 502", code, response)
+	}
+}
+
+func TestGetDeadLetter(t *testing.T) {
+	broker := newFakeBroker()
+	dlq := newTestDeadLetterQueue(broker)
+	defer dlq.Close()
+	router := newTestDLQRouter(dlq)
+	deadLetters(t, dlq, `{"a":1}`, "\x00binary")
+
+	code, response := do(t, router, http.MethodGet, "/admin/dlq/0/0", "")
+	if code != http.StatusOK || response["value"].(map[string]any)["a"] != 1.0 || response["value_base64"] != nil {
+		t.Errorf("GET /admin/dlq/0/0 = %d %v, want the JSON value", code, response)
+	}
+	if headers := response["headers"].(map[string]any); headers[HeaderDLQReason] != ReasonDecodeFailed {
+		t.Errorf("headers = %v, want the reason", headers)
+	}
+	code, response = do(t, router, http.MethodGet, "/admin/dlq/0/1", "")
+	if code != http.StatusOK || response["value_base64"] != "AGJpbmFyeQ==" || response["value"] != nil {
+		t.Errorf("GET /admin/dlq/0/1 = %d %v, want the value in base64", code, response)
+	}
+
+	if code, response := do(t, router, http.MethodGet, "/admin/dlq/0/2", ""); code != http.StatusNotFound {
+		t.Errorf("GET of a missing dead letter = %d %v, want 404", code, response)
+	}
+	if code, response := do(t, router, http.MethodGet, "/admin/dlq/x/0", ""); code != http.StatusBadRequest {
+		t.Errorf("GET of an invalid id = %d %v, want 400", code, response)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	broker := newFakeBroker()
+	dlq := newTestDeadLetterQueue(broker)
+	defer dlq.Close()
+	router := newTestDLQRouter(dlq)
+	deadLetters(t, dlq, "a", "b", "c")
+
+	code, response := do(t, router, http.MethodPost, "/admin/dlq/0/1/replay", "")
+	if code != http.StatusOK || !slices.Equal(response["replayed"].([]any), []any{"0-1"}) {
+		t.Errorf("POST /admin/dlq/0/1/replay = %d %v, want 0-1 replayed", code, response)
+	}
+	replayed := broker.messages("notifications")
+	if len(replayed) != 1 || string(replayed[0].Key) != "1" || string(replayed[0].Value) != "b" {
+		t.Fatalf("notifications = %v, want b back", replayed)
+	}
+	if from, _ := header(replayed[0].Headers, HeaderDLQReplayedFrom); from != "0-1" {
+		t.Errorf("%s = %q, want 0-1", HeaderDLQReplayedFrom, from)
+	}
+	if _, ok := header(replayed[0].Headers, HeaderDLQReason); ok {
+		t.Errorf("headers = %v, want the dead letter headers dropped", replayed[0].Headers)
+	}
+
+	// nothing is replayed when one id is unknown
+	if code, response := do(t, router, http.MethodPost, "/admin/dlq/replay", `{"ids":["0-0","0-9"]}`); code != http.StatusNotFound {
+		t.Errorf("POST /admin/dlq/replay with an unknown id = %d %v, want 404", code, response)
+	}
+	for _, body := range []string{`{"ids":[]}`, `{"ids":["x"]}`, `{}`} {
+		if code, response := do(t, router, http.MethodPost, "/admin/dlq/replay", body); code != http.StatusBadRequest {
+			t.Errorf("POST /admin/dlq/replay %s = %d %v, want 400", body, code, response)
+		}
+	}
+	if got := broker.messages("notifications"); len(got) != 1 {
+		t.Fatalf("notifications = %v, want nothing more replayed", got)
+	}
+
+	code, response = do(t, router, http.MethodPost, "/admin/dlq/replay", `{"ids":["0-0","0-2"]}`)
+	if code != http.StatusOK || !slices.Equal(response["replayed"].([]any), []any{"0-0", "0-2"}) {
+		t.Errorf("POST /admin/dlq/replay = %d %v, want 0-0 and 0-2 replayed", code, response)
+	}
+	var values []string
+	for _, msg := range broker.messages("notifications") {
+		values = append(values, string(msg.Value))
+	}
+	if !slices.Equal(values, []string{"b", "a", "c"}) {
+		t.Errorf("notifications = %v, want b a c", values)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"templates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 500
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursors are opaque to clients, under the hood they are just an offset
+// into the user's history.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	value, ok := strings.CutPrefix(string(raw), "o:")
+	if !ok {
+		return 0, ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(value)
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return offset, nil
+}
+
+func getListOptionsFromRequest(ctx *gin.Context) (store.ListOptions, error) {
+	opts := store.ListOptions{Limit: DefaultPageLimit}
+
+	if limit := ctx.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			return opts, fmt.Errorf("limit must be a positive integer, got %q", limit)
+		}
+		opts.Limit = min(value, MaxPageLimit)
+	}
+
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		offset, err := decodeCursor(cursor)
+		if err != nil {
+			return opts, err
+		}
+		opts.Offset = offset
+	}
+
+	var err error
+	if opts.Since, err = parseTimeQuery(ctx, "since"); err != nil {
+		return opts, err
+	}
+	if opts.Until, err = parseTimeQuery(ctx, "until"); err != nil {
+		return opts, err
+	}
+	opts.Group = ctx.Query("group")
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+		return opts, errors.New("since must be before until")
+	}
+
+	return opts, nil
+}
+
+func parseTimeQuery(ctx *gin.Context, name string) (time.Time, error) {
+	value := ctx.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 timestamp: %w", name, err)
+	}
+	return t, nil
+}
+
+func handleNotifications(ctx *gin.Context, store store.NotificationStore, catalog *templates.Catalog) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	opts, err := getListOptionsFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	page, err := store.List(userID, opts)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	var nextCursor *string
+	if page.NextOffset >= 0 {
+		cursor := encodeCursor(page.NextOffset)
+		nextCursor = &cursor
+	}
+
+	if len(page.Notifications) == 0 {
+		ctx.JSON(http.StatusOK, gin.H{
+			"message":       "No notifications found for user",
+			"notifications": []models.Notification{},
+			"next_cursor":   nextCursor,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"notifications": renderAllForClient(catalog, clientLocale(ctx), page.Notifications),
+		"next_cursor":   nextCursor,
+	})
+}
+
+func handleUnreadNotifications(ctx *gin.Context, store store.NotificationStore, catalog *templates.Catalog) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	notes, err := store.GetUnread(userID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"notifications": renderAllForClient(catalog, clientLocale(ctx), notes),
+		"unread_count":  len(notes),
+	})
+}
+
+type markReadRequest struct {
+	IDs []string `json:"ids" binding:"required,min=1"`
+}
+
+func handleMarkRead(ctx *gin.Context, store store.NotificationStore) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	var req markReadRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	markRead(ctx, store, userID, req.IDs)
+}
+
+func handleMarkOneRead(ctx *gin.Context, store store.NotificationStore) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	markRead(ctx, store, userID, []string{ctx.Param("notificationID")})
+}
+
+func markRead(ctx *gin.Context, notificationStore store.NotificationStore, userID string, ids []string) {
+	marked, err := notificationStore.MarkRead(userID, ids)
+	if errors.Is(err, store.ErrNotificationNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"marked_read": marked})
+}
+
+func handleMarkAllRead(ctx *gin.Context, store store.NotificationStore) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	marked, err := store.MarkAllRead(userID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"marked_read": marked})
+}
+
+// handleUserGroups reports the groups a user is in now, from the user
+// directory of the producer.
+func handleUserGroups(ctx *gin.Context, directory *Directory) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	user, err := directory.User(ctx.Request.Context(), userID, ctx.Request)
+	if errors.Is(err, ErrUnknownUser) {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+
+	groups := user.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"user_id": userID, "groups": groups})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"schema"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestRouter registers the notification routes like main does.
+func newTestRouter(s store.NotificationStore) *gin.Engine {
+	router := gin.New()
+	router.GET("/notifications/:userID", func(ctx *gin.Context) {
+		handleNotifications(ctx, s, testCatalog)
+	})
+	router.GET("/notifications/:userID/unread", func(ctx *gin.Context) {
+		handleUnreadNotifications(ctx, s, testCatalog)
+	})
+	router.PUT("/notifications/:userID/read", func(ctx *gin.Context) {
+		handleMarkRead(ctx, s)
+	})
+	router.PUT("/notifications/:userID/read-all", func(ctx *gin.Context) {
+		handleMarkAllRead(ctx, s)
+	})
+	router.PUT("/notifications/:userID/:notificationID/read", func(ctx *gin.Context) {
+		handleMarkOneRead(ctx, s)
+	})
+	return router
+}
+
+// do sends a request and decodes the JSON answer.
+func do(t *testing.T, router http.Handler, method, path, body string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var response map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s answered %q: %v", method, path, rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+func newTestStore(t *testing.T, userID string, ids ...string) store.NotificationStore {
+	t.Helper()
+	s := store.NewMemoryStore(store.Retention{})
+	for _, id := range ids {
+		if err := s.Add(userID, models.Notification{ID: id, Notification: schema.Notification{Message: "hello " + id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestReadStateHandlers(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+		// wantMarked is the marked_read count of a 200 answer
+		wantMarked float64
+		wantUnread float64
+	}{
+		{name: "mark some", method: http.MethodPut, path: "/notifications/1/read", body: `{"ids": ["a", "b"]}`, want: http.StatusOK, wantMarked: 2, wantUnread: 1},
+		{name: "mark one", method: http.MethodPut, path: "/notifications/1/c/read", want: http.StatusOK, wantMarked: 1, wantUnread: 2},
+		{name: "mark all", method: http.MethodPut, path: "/notifications/1/read-all", want: http.StatusOK, wantMarked: 3, wantUnread: 0},
+		{name: "unknown id", method: http.MethodPut, path: "/notifications/1/read", body: `{"ids": ["a", "zzz"]}`, want: http.StatusNotFound, wantUnread: 3},
+		{name: "unknown single id", method: http.MethodPut, path: "/notifications/1/zzz/read", want: http.StatusNotFound, wantUnread: 3},
+		{name: "no ids", method: http.MethodPut, path: "/notifications/1/read", body: `{"ids": []}`, want: http.StatusBadRequest, wantUnread: 3},
+		{name: "not json", method: http.MethodPut, path: "/notifications/1/read", body: `ids=a`, want: http.StatusBadRequest, wantUnread: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(newTestStore(t, "1", "a", "b", "c"))
+			code, response := do(t, router, tt.method, tt.path, tt.body)
+			if code != tt.want {
+				t.Fatalf("%s %s = %d %v, want %d", tt.method, tt.path, code, response, tt.want)
+			}
+			if code == http.StatusOK && response["marked_read"] != tt.wantMarked {
+				t.Errorf("marked_read = %v, want %v", response["marked_read"], tt.wantMarked)
+			}
+
+			code, response = do(t, router, http.MethodGet, "/notifications/1/unread", "")
+			if code != http.StatusOK || response["unread_count"] != tt.wantUnread {
+				t.Errorf("GET unread = %d %v, want unread_count %v", code, response, tt.wantUnread)
+			}
+		})
+	}
+}
+
+func TestHandleNotificationsReportsReadState(t *testing.T) {
+	router := newTestRouter(newTestStore(t, "1", "a", "b"))
+	do(t, router, http.MethodPut, "/notifications/1/a/read", "")
+
+	code, response := do(t, router, http.MethodGet, "/notifications/1", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET = %d %v", code, response)
+	}
+	notifications, _ := response["notifications"].([]any)
+	if len(notifications) != 2 {
+		t.Fatalf("notifications = %v, want 2", notifications)
+	}
+	for _, n := range notifications {
+		n := n.(map[string]any)
+		if n["read"] != (n["id"] == "a") {
+			t.Errorf("notification %v has read = %v", n["id"], n["read"])
+		}
+	}
+
+	code, response = do(t, router, http.MethodGet, "/notifications/2", "")
+	if code != http.StatusOK || len(response["notifications"].([]any)) != 0 {
+		t.Errorf("GET of a user without notifications = %d %v", code, response)
+	}
+}
+
+func TestHandleNotificationsPagination(t *testing.T) {
+	s := store.NewMemoryStore(store.Retention{})
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		s.Add("1", models.Notification{ID: string(rune('a' + i)), ReceivedAt: base.Add(time.Duration(i) * time.Hour)})
+	}
+	router := newTestRouter(s)
+
+	// walk the pages with the cursors
+	var got []string
+	path := "/notifications/1?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		code, response := do(t, router, http.MethodGet, path, "")
+		if code != http.StatusOK {
+			t.Fatalf("GET %s = %d %v", path, code, response)
+		}
+		for _, n := range response["notifications"].([]any) {
+			got = append(got, n.(map[string]any)["id"].(string))
+		}
+		path = ""
+		if cursor, ok := response["next_cursor"].(string); ok {
+			path = "/notifications/1?limit=2&cursor=" + cursor
+		}
+	}
+	if strings.Join(got, "") != "abcde" {
+		t.Errorf("pages = %v, want a to e", got)
+	}
+
+	code, response := do(t, router, http.MethodGet, "/notifications/1?since=2026-01-01T13:00:00Z&until=2026-01-01T15:00:00Z", "")
+	if code != http.StatusOK || len(response["notifications"].([]any)) != 2 || response["next_cursor"] != nil {
+		t.Errorf("GET with a time range = %d %v, want b and c", code, response)
+	}
+}
+
+func TestHandleNotificationsBadQuery(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore(store.Retention{}))
+	for _, query := range []string{
+		"limit=0",
+		"limit=ten",
+		"cursor=not-a-cursor",
+		"cursor=" + encodeCursor(-1),
+		"since=yesterday",
+		"since=2026-01-02T00:00:00Z&until=2026-01-01T00:00:00Z",
+	} {
+		if code, response := do(t, router, http.MethodGet, "/notifications/1?"+query, ""); code != http.StatusBadRequest {
+			t.Errorf("GET ?%s = %d %v, want 400", query, code, response)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, offset := range []int{0, 1, 50, 123456} {
+		got, err := decodeCursor(encodeCursor(offset))
+		if err != nil || got != offset {
+			t.Errorf("decodeCursor(encodeCursor(%d)) = %d, %v", offset, got, err)
+		}
+	}
+}
+
+func TestHandleUserGroups(t *testing.T) {
+	directory := newTestDirectory(t, map[string]models.User{
+		"1": {ID: 1, Groups: []string{"friends", "work"}},
+		"2": {ID: 2},
+	})
+	router := gin.New()
+	router.GET("/notifications/:userID/groups", func(ctx *gin.Context) {
+		handleUserGroups(ctx, directory)
+	})
+
+	tests := []struct {
+		path       string
+		want       int
+		wantGroups []any
+	}{
+		{"/notifications/1/groups", http.StatusOK, []any{"friends", "work"}},
+		{"/notifications/2/groups", http.StatusOK, []any{}},
+		{"/notifications/3/groups", http.StatusNotFound, nil},
+		{"/notifications/500/groups", http.StatusBadGateway, nil},
+	}
+	for _, tt := range tests {
+		code, response := do(t, router, http.MethodGet, tt.path, "")
+		if code != tt.want {
+			t.Errorf("GET %s = %d %v, want %d", tt.path, code, response, tt.want)
+			continue
+		}
+		if tt.wantGroups != nil && !slices.Equal(response["groups"].([]any), tt.wantGroups) {
+			t.Errorf("GET %s groups = %v, want %v", tt.path, response["groups"], tt.wantGroups)
+		}
+	}
+
+	// the groups of a notification are those of the moment it was sent
+	s := store.NewMemoryStore(store.Retention{})
+	s.Add("1", models.Notification{ID: "a", Notification: schema.Notification{To: models.User{ID: 1, Groups: []string{"work"}}}})
+	router = newTestRouter(s)
+	code, response := do(t, router, http.MethodGet, "/notifications/1?group=work", "")
+	if code != http.StatusOK || len(response["notifications"].([]any)) != 0 {
+		t.Errorf("GET ?group=work = %d %v, want no broadcasts", code, response)
+	}
+}
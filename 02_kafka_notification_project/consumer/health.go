@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+)
+
+// HealthCheckTimeout bounds the broker requests of a single /readyz call.
+const HealthCheckTimeout = 3 * time.Second
+
+var ErrNotGroupMember = errors.New("not a member of the consumer group")
+
+// Health answers /healthz and /readyz from the brokers' point of view:
+// metadata for connectivity, the group description for our membership and
+// the committed and last offsets for the lag.
+type Health struct {
+	client   *kafka.Client
+	topic    string
+	groupID  string
+	clientID string
+	// selfURL is our advertised URL, it tells our member in the group
+	selfURL string
+	maxLag  int64
+	// consumerDone is closed once the consumer loop exited
+	consumerDone <-chan struct{}
+}
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type brokersCheck struct {
+	checkResult
+	Brokers    int   `json:"brokers"`
+	Partitions []int `json:"partitions"`
+}
+
+type groupCheck struct {
+	checkResult
+	GroupID  string `json:"group_id"`
+	ClientID string `json:"client_id"`
+	URL      string `json:"url"`
+	MemberID string `json:"member_id,omitempty"`
+	State    string `json:"state,omitempty"`
+	Members  int    `json:"members"`
+	Assigned []int  `json:"assigned_partitions"`
+}
+
+type lagCheck struct {
+	checkResult
+	Total int64 `json:"total"`
+	// Assigned is the lag of our own partitions only
+	Assigned   int64         `json:"assigned"`
+	Partitions map[int]int64 `json:"partitions"`
+}
+
+func (h *Health) consumerRunning() bool {
+	select {
+	case <-h.consumerDone:
+		return false
+	default:
+		return true
+	}
+}
+
+func (h *Health) checkBrokers(ctx context.Context) brokersCheck {
+	check := brokersCheck{Partitions: []int{}}
+	metadata, err := h.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{h.topic}})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Brokers = len(metadata.Brokers)
+
+	for _, topic := range metadata.Topics {
+		if topic.Name != h.topic {
+			continue
+		}
+		if topic.Error != nil {
+			check.Error = topic.Error.Error()
+			return check
+		}
+		for _, partition := range topic.Partitions {
+			check.Partitions = append(check.Partitions, partition.ID)
+		}
+	}
+	sort.Ints(check.Partitions)
+
+	if len(check.Partitions) == 0 {
+		check.Error = fmt.Sprintf("topic %s has no partitions", h.topic)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+func (h *Health) checkGroup(ctx context.Context) groupCheck {
+	check := groupCheck{GroupID: h.groupID, ClientID: h.clientID, URL: h.selfURL, Assigned: []int{}}
+	resp, err := h.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{h.groupID}})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	if len(resp.Groups) == 0 {
+		check.Error = ErrNotGroupMember.Error()
+		return check
+	}
+
+	group := resp.Groups[0]
+	if group.Error != nil {
+		check.Error = group.Error.Error()
+		return check
+	}
+	check.State = group.GroupState
+	check.Members = len(group.Members)
+
+	for _, member := range group.Members {
+		if memberURL(member) != h.selfURL {
+			continue
+		}
+		check.MemberID = member.MemberID
+		for _, topic := range member.MemberAssignments.Topics {
+			if topic.Topic == h.topic {
+				check.Assigned = append(check.Assigned, topic.Partitions...)
+			}
+		}
+	}
+	sort.Ints(check.Assigned)
+
+	if check.MemberID == "" {
+		check.Error = ErrNotGroupMember.Error()
+		return check
+	}
+	// a member without partitions (more instances than partitions) is still ready
+	check.OK = true
+	return check
+}
+
+// assigned returns our partitions as the group coordinator sees them.
+func (h *Health) assigned(ctx context.Context) ([]int, error) {
+	check := h.checkGroup(ctx)
+	if !check.OK {
+		return nil, errors.New(check.Error)
+	}
+	return check.Assigned, nil
+}
+
+func (h *Health) checkLag(ctx context.Context, partitions, assigned []int) lagCheck {
+	check := lagCheck{Partitions: make(map[int]int64)}
+	if len(partitions) == 0 {
+		check.Error = "no partitions to measure"
+		return check
+	}
+
+	committed, err := h.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: h.groupID,
+		Topics:  map[string][]int{h.topic: partitions},
+	})
+	if err == nil {
+		err = committed.Error
+	}
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	requests := make([]kafka.OffsetRequest, 0, len(partitions))
+	for _, partition := range partitions {
+		requests = append(requests, kafka.FirstOffsetOf(partition), kafka.LastOffsetOf(partition))
+	}
+	offsets, err := h.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{h.topic: requests},
+	})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	committedOffsets := make(map[int]int64)
+	for _, partition := range committed.Topics[h.topic] {
+		committedOffsets[partition.Partition] = partition.CommittedOffset
+	}
+	isAssigned := make(map[int]bool)
+	for _, partition := range assigned {
+		isAssigned[partition] = true
+	}
+
+	for _, partition := range offsets.Topics[h.topic] {
+		if partition.Error != nil {
+			check.Error = partition.Error.Error()
+			return check
+		}
+		offset, ok := committedOffsets[partition.Partition]
+		// nothing committed yet, the group starts from the beginning
+		if !ok || offset < 0 {
+			offset = partition.FirstOffset
+		}
+		lag := max(partition.LastOffset-offset, 0)
+		check.Partitions[partition.Partition] = lag
+		check.Total += lag
+		if isAssigned[partition.Partition] {
+			check.Assigned += lag
+		}
+	}
+
+	if h.maxLag > 0 && check.Total > h.maxLag {
+		check.Error = fmt.Sprintf("lag %d is above %d", check.Total, h.maxLag)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// handleHealthz is the liveness probe: the process serves HTTP and the
+// consumer loop is still running.
+func handleHealthz(ctx *gin.Context, h *Health) {
+	if !h.consumerRunning() {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "consumer stopped"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz is the readiness probe: the brokers answer, we are a member
+// of the group and the lag is within bounds.
+func handleReadyz(ctx *gin.Context, h *Health) {
+	checkCtx, cancel := context.WithTimeout(ctx.Request.Context(), HealthCheckTimeout)
+	defer cancel()
+
+	brokers := h.checkBrokers(checkCtx)
+	group := h.checkGroup(checkCtx)
+	lag := h.checkLag(checkCtx, brokers.Partitions, group.Assigned)
+
+	ready := h.consumerRunning() && brokers.OK && group.OK && lag.OK
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	ctx.JSON(code, gin.H{
+		"status": status,
+		"checks": gin.H{
+			"consumer": checkResult{OK: h.consumerRunning()},
+			"brokers":  brokers,
+			"group":    group,
+			"lag":      lag,
+		},
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/describegroups"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/offsetfetch"
+)
+
+// fakeMember is a member of the consumer group with its partitions and the
+// URL it advertises, if any.
+type fakeMember struct {
+	clientID   string
+	partitions []int
+	url        string
+}
+
+// fakeKafka answers the admin requests of kafka.Client like a one broker
+// cluster hosting a single topic would.
+type fakeKafka struct {
+	topic      string
+	partitions int
+	members    []fakeMember
+	// committed offsets of the group, first and last offsets of the topic
+	committed map[int]int64
+	first     map[int]int64
+	last      map[int]int64
+	// err fails every request
+	err error
+}
+
+// memberAssignment encodes partitions the way the consumer protocol does.
+func memberAssignment(topic string, partitions []int) []byte {
+	var b bytes.Buffer
+	write := func(v any) { binary.Write(&b, binary.BigEndian, v) }
+	write(int16(0))
+	write(int32(1))
+	write(int16(len(topic)))
+	b.WriteString(topic)
+	write(int32(len(partitions)))
+	for _, partition := range partitions {
+		write(int32(partition))
+	}
+	write(int32(-1))
+	return b.Bytes()
+}
+
+// memberMetadata encodes a subscription to topic carrying our memberInfo.
+func memberMetadata(topic, url string) []byte {
+	userData, _ := json.Marshal(memberInfo{URL: url})
+	var b bytes.Buffer
+	write := func(v any) { binary.Write(&b, binary.BigEndian, v) }
+	write(int16(0))
+	write(int32(1))
+	write(int16(len(topic)))
+	b.WriteString(topic)
+	write(int32(len(userData)))
+	b.Write(userData)
+	return b.Bytes()
+}
+
+func (f *fakeKafka) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	switch req := req.(type) {
+	case *metadata.Request:
+		topic := metadata.ResponseTopic{Name: f.topic}
+		for i := 0; i < f.partitions; i++ {
+			topic.Partitions = append(topic.Partitions, metadata.ResponsePartition{PartitionIndex: int32(i)})
+		}
+		return &metadata.Response{
+			Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}},
+			Topics:  []metadata.ResponseTopic{topic},
+		}, nil
+	case *describegroups.Request:
+		group := describegroups.ResponseGroup{GroupID: req.Groups[0], GroupState: "Stable"}
+		for i, member := range f.members {
+			groupMember := describegroups.ResponseGroupMember{
+				MemberID:         member.clientID + "-" + string(rune('a'+i)),
+				ClientID:         member.clientID,
+				MemberAssignment: memberAssignment(f.topic, member.partitions),
+			}
+			if member.url != "" {
+				groupMember.MemberMetadata = memberMetadata(f.topic, member.url)
+			}
+			group.Members = append(group.Members, groupMember)
+		}
+		return &describegroups.Response{Groups: []describegroups.ResponseGroup{group}}, nil
+	case *offsetfetch.Request:
+		topic := offsetfetch.ResponseTopic{Name: f.topic}
+		for partition, offset := range f.committed {
+			topic.Partitions = append(topic.Partitions, offsetfetch.ResponsePartition{PartitionIndex: int32(partition), CommittedOffset: offset})
+		}
+		return &offsetfetch.Response{Topics: []offsetfetch.ResponseTopic{topic}}, nil
+	case *listoffsets.Request:
+		topic := listoffsets.ResponseTopic{Topic: f.topic}
+		for _, partition := range req.Topics[0].Partitions {
+			offsets := f.last
+			if partition.Timestamp == kafka.FirstOffset {
+				offsets = f.first
+			}
+			topic.Partitions = append(topic.Partitions, listoffsets.ResponsePartition{
+				Partition: partition.Partition,
+				Timestamp: partition.Timestamp,
+				Offset:    offsets[int(partition.Partition)],
+			})
+		}
+		return &listoffsets.Response{Topics: []listoffsets.ResponseTopic{topic}}, nil
+	default:
+		return nil, errors.New("unexpected request")
+	}
+}
+
+func newTestHealth(f *fakeKafka, maxLag int64, consumerDone chan struct{}) *Health {
+	return &Health{
+		client:       &kafka.Client{Addr: kafka.TCP("localhost:9092"), Transport: f},
+		topic:        f.topic,
+		groupID:      "notifications-group",
+		clientID:     "me",
+		selfURL:      "http://me:8082",
+		maxLag:       maxLag,
+		consumerDone: consumerDone,
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	consumerDone := make(chan struct{})
+	router := gin.New()
+	router.GET("/healthz", func(ctx *gin.Context) {
+		handleHealthz(ctx, newTestHealth(&fakeKafka{}, 0, consumerDone))
+	})
+
+	if code, response := do(t, router, http.MethodGet, "/healthz", ""); code != http.StatusOK {
+		t.Errorf("GET /healthz = %d %v, want 200", code, response)
+	}
+	close(consumerDone)
+	if code, response := do(t, router, http.MethodGet, "/healthz", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz after the consumer stopped = %d %v, want 503", code, response)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	cluster := func() *fakeKafka {
+		return &fakeKafka{
+			topic:      "notifications",
+			partitions: 3,
+			members:    []fakeMember{{"me", []int{0, 2}, "http://me:8082"}, {"other", []int{1}, "http://other:8082"}},
+			// partition 2 has nothing committed yet
+			committed: map[int]int64{0: 5, 1: 10, 2: -1},
+			first:     map[int]int64{0: 0, 1: 0, 2: 4},
+			last:      map[int]int64{0: 8, 1: 10, 2: 6},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		change       func(f *fakeKafka)
+		maxLag       int64
+		stopConsumer bool
+		want         int
+		// wantFailed is the check that fails
+		wantFailed string
+	}{
+		{name: "ready", change: func(f *fakeKafka) {}, want: http.StatusOK},
+		{name: "lag within bounds", change: func(f *fakeKafka) {}, maxLag: 5, want: http.StatusOK},
+		{name: "lag too high", change: func(f *fakeKafka) {}, maxLag: 4, want: http.StatusServiceUnavailable, wantFailed: "lag"},
+		{name: "brokers unreachable", change: func(f *fakeKafka) { f.err = errors.New("connection refused") }, want: http.StatusServiceUnavailable, wantFailed: "brokers"},
+		{name: "no partitions", change: func(f *fakeKafka) { f.partitions = 0 }, want: http.StatusServiceUnavailable, wantFailed: "brokers"},
+		{name: "not a member", change: func(f *fakeKafka) { f.members = f.members[1:] }, want: http.StatusServiceUnavailable, wantFailed: "group"},
+		// instances sharing a config have the same client id
+		{name: "not a member, our client id is", change: func(f *fakeKafka) { f.members = []fakeMember{{"me", []int{0, 1, 2}, "http://other:8082"}} }, want: http.StatusServiceUnavailable, wantFailed: "group"},
+		// more instances than partitions
+		{name: "member without partitions", change: func(f *fakeKafka) { f.members[0].partitions = nil }, want: http.StatusOK},
+		{name: "consumer stopped", change: func(f *fakeKafka) {}, stopConsumer: true, want: http.StatusServiceUnavailable, wantFailed: "consumer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := cluster()
+			tt.change(f)
+			consumerDone := make(chan struct{})
+			if tt.stopConsumer {
+				close(consumerDone)
+			}
+			health := newTestHealth(f, tt.maxLag, consumerDone)
+			router := gin.New()
+			router.GET("/readyz", func(ctx *gin.Context) {
+				handleReadyz(ctx, health)
+			})
+
+			code, response := do(t, router, http.MethodGet, "/readyz", "")
+			if code != tt.want {
+				t.Fatalf("GET /readyz = %d %v, want %d", code, response, tt.want)
+			}
+			checks := response["checks"].(map[string]any)
+			for name, check := range checks {
+				ok := check.(map[string]any)["ok"].(bool)
+				if tt.wantFailed == name && ok {
+					t.Errorf("check %s passed: %v", name, check)
+				}
+				// a broken cluster fails the checks that depend on it
+				if tt.wantFailed == "" && !ok {
+					t.Errorf("check %s failed: %v", name, check)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyzReportsLag(t *testing.T) {
+	f := &fakeKafka{
+		topic:      "notifications",
+		partitions: 3,
+		members:    []fakeMember{{"me", []int{0, 2}, "http://me:8082"}, {"other", []int{1}, "http://other:8082"}},
+		committed:  map[int]int64{0: 5, 1: 10, 2: -1},
+		first:      map[int]int64{0: 0, 1: 0, 2: 4},
+		last:       map[int]int64{0: 8, 1: 10, 2: 6},
+	}
+	health := newTestHealth(f, 0, make(chan struct{}))
+	ctx := context.Background()
+
+	group := health.checkGroup(ctx)
+	if !group.OK || group.Members != 2 || len(group.Assigned) != 2 || group.Assigned[0] != 0 || group.Assigned[1] != 2 {
+		t.Errorf("group = %+v, want partitions 0 and 2 out of 2 members", group)
+	}
+
+	lag := health.checkLag(ctx, []int{0, 1, 2}, group.Assigned)
+	// partition 2 counts from its first offset since nothing was committed
+	want := map[int]int64{0: 3, 1: 0, 2: 2}
+	for partition, lagged := range want {
+		if lag.Partitions[partition] != lagged {
+			t.Errorf("lag of partition %d = %d, want %d", partition, lag.Partitions[partition], lagged)
+		}
+	}
+	if lag.Total != 5 || lag.Assigned != 5 {
+		t.Errorf("lag = %+v, want 5 in total, all of it ours", lag)
+	}
+}
+
+func TestHealthAssigned(t *testing.T) {
+	f := &fakeKafka{
+		topic:      "notifications",
+		partitions: 3,
+		members:    []fakeMember{{"me", []int{0, 2}, "http://me:8082"}, {"other", []int{1}, "http://other:8082"}},
+	}
+	health := newTestHealth(f, 0, make(chan struct{}))
+	ctx := context.Background()
+
+	if assigned, err := health.assigned(ctx); err != nil || !slices.Equal(assigned, []int{0, 2}) {
+		t.Errorf("assigned = %v, %v, want 0 and 2", assigned, err)
+	}
+	f.err = errors.New("connection refused")
+	if _, err := health.assigned(ctx); err == nil {
+		t.Error("assigned = nil error with the brokers unreachable, want one")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"config"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const KafkaDialTimeout = 10 * time.Second
+
+// clientID names this instance on the brokers. It may be shared by the
+// instances of one config, the advertised URL tells them apart in the group.
+func clientID(cfg config.ConsumerConfig) string {
+	if cfg.ClientID != "" {
+		return cfg.ClientID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%s-%d", cfg.GroupID, host, os.Getpid())
+}
+
+// kafkaSecurity turns the TLS and SASL settings into what kafka-go expects.
+func kafkaSecurity(cfg config.KafkaConfig) (*tls.Config, sasl.Mechanism, error) {
+	tlsConfig, err := cfg.TLS.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch cfg.SASL.Mechanism {
+	case "":
+		return tlsConfig, nil, nil
+	case config.SASLPlain:
+		return tlsConfig, plain.Mechanism{Username: cfg.SASL.Username, Password: cfg.SASL.Password}, nil
+	case config.SASLScramSHA256, config.SASLScramSHA512:
+		algorithm := scram.SHA256
+		if cfg.SASL.Mechanism == config.SASLScramSHA512 {
+			algorithm = scram.SHA512
+		}
+		mechanism, err := scram.Mechanism(algorithm, cfg.SASL.Username, cfg.SASL.Password)
+		return tlsConfig, mechanism, err
+	default:
+		return nil, nil, fmt.Errorf("unknown SASL mechanism %q", cfg.SASL.Mechanism)
+	}
+}
+
+func newReader(cfg config.Config) (*kafka.Reader, error) {
+	tlsConfig, mechanism, err := kafkaSecurity(cfg.Kafka)
+	if err != nil {
+		return nil, err
+	}
+	startOffset := kafka.FirstOffset
+	if cfg.Consumer.StartOffset == "last" {
+		startOffset = kafka.LastOffset
+	}
+	selfURL, err := advertisedURL(cfg.Consumer)
+	if err != nil {
+		return nil, err
+	}
+	balancers, err := groupBalancers(selfURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.Kafka.Brokers,
+		Topic:   cfg.Topics.Notifications,
+		GroupID: cfg.Consumer.GroupID,
+		Dialer: &kafka.Dialer{
+			ClientID:      clientID(cfg.Consumer),
+			Timeout:       KafkaDialTimeout,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
+		GroupBalancers: balancers,
+		// no CommitInterval, CommitMessages stays synchronous for the committer
+		StartOffset: startOffset,
+		MinBytes:    cfg.Consumer.MinBytes,
+		MaxBytes:    cfg.Consumer.MaxBytes,
+		MaxWait:     cfg.Consumer.MaxWait,
+	}), nil
+}
+
+// newTransport carries the admin requests and the dead letter writes.
+func newTransport(cfg config.Config) (*kafka.Transport, error) {
+	tlsConfig, mechanism, err := kafkaSecurity(cfg.Kafka)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafka.Transport{
+		ClientID:    clientID(cfg.Consumer),
+		DialTimeout: KafkaDialTimeout,
+		TLS:         tlsConfig,
+		SASL:        mechanism,
+	}, nil
+}
+
+// newKafkaClient is for the admin requests (metadata, group, offsets, fetch).
+func newKafkaClient(cfg config.Config, transport *kafka.Transport) *kafka.Client {
+	return &kafka.Client{
+		Addr:      kafka.TCP(cfg.Kafka.Brokers...),
+		Transport: transport,
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"config"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+func TestClientID(t *testing.T) {
+	if got := clientID(config.ConsumerConfig{GroupID: "g", ClientID: "fixed"}); got != "fixed" {
+		t.Errorf("clientID = %s, want the configured one", got)
+	}
+	if got := clientID(config.ConsumerConfig{GroupID: "g"}); !strings.HasPrefix(got, "g-") || got != clientID(config.ConsumerConfig{GroupID: "g"}) {
+		t.Errorf("clientID = %s, want a stable id starting with the group", got)
+	}
+}
+
+func TestKafkaSecurity(t *testing.T) {
+	tlsConfig, mechanism, err := kafkaSecurity(config.KafkaConfig{SASL: config.SASLConfig{Mechanism: config.SASLPlain, Username: "u", Password: "p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil || mechanism != (plain.Mechanism{Username: "u", Password: "p"}) {
+		t.Errorf("kafkaSecurity = %v, %v, want plain SASL without TLS", tlsConfig, mechanism)
+	}
+
+	for _, name := range []string{config.SASLScramSHA256, config.SASLScramSHA512} {
+		_, mechanism, err := kafkaSecurity(config.KafkaConfig{SASL: config.SASLConfig{Mechanism: name, Username: "u", Password: "p"}})
+		if err != nil || mechanism.Name() != name {
+			t.Errorf("kafkaSecurity(%s) = %v, %v", name, mechanism, err)
+		}
+	}
+
+	broken := []config.KafkaConfig{
+		{SASL: config.SASLConfig{Mechanism: "GSSAPI"}},
+		{TLS: config.TLSConfig{Enabled: true, CAFile: "missing.pem"}},
+	}
+	for _, cfg := range broken {
+		if _, _, err := kafkaSecurity(cfg); err == nil {
+			t.Errorf("kafkaSecurity(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -1,32 +1,30 @@
 package main
 
 import (
+	"auth"
+	"config"
 	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"consumer/pkg/stream"
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"schema"
+	"strconv"
 	"syscall"
+	"templates"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/segmentio/kafka-go"
 )
 
-const (
-	ConsumerGroup       = "notifications-group"
-	ConsumerTopic       = "notifications"
-	ConsumerPort        = ":8082"
-	Kafka1ServerAddress = "localhost:9092"
-	Kafka2ServerAddress = "localhost:9094"
-	Kafka3ServerAddress = "localhost:9095"
-)
-
 var ErrNoMessageFound = errors.New("no message found")
 
 func getUserIDFromRequest(ctx *gin.Context) (string, error) {
@@ -37,46 +35,171 @@ func getUserIDFromRequest(ctx *gin.Context) (string, error) {
 	return userID, nil
 }
 
-type UserNotifications map[string][]models.Notification
+func openStore(cfg config.StoreConfig) (store.NotificationStore, error) {
+	retention := store.Retention{
+		MaxPerUser: cfg.Retention.MaxPerUser,
+		MaxAge:     cfg.Retention.MaxAge,
+		MaxBytes:   cfg.Retention.MaxBytes,
+		Policy:     store.EvictionPolicy(cfg.Retention.Policy),
+	}
 
-type NotificationStore struct {
-	data UserNotifications
-	mu   sync.RWMutex
+	switch cfg.Backend {
+	case "memory":
+		return store.NewMemoryStore(retention), nil
+	case "disk":
+		return store.OpenDiskStore(cfg.Dir, store.DiskOptions{
+			MaxSegmentBytes: cfg.MaxSegmentBytes,
+			SyncWrites:      cfg.SyncWrites,
+			Retention:       retention,
+		})
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", cfg.Backend)
+	}
 }
 
-func (ns *NotificationStore) Add(userID string, notification models.Notification) {
-	newNotifications := make([]models.Notification, len(ns.data[userID])+1)
-	ns.mu.Lock()
-	defer ns.mu.Unlock()
-	copy(newNotifications, ns.data[userID])
-	newNotifications = append(newNotifications, notification)
-	ns.data[userID] = newNotifications
+// notificationID is stable across redeliveries since a record never
+// changes its topic/partition/offset.
+func notificationID(msg kafka.Message) string {
+	return fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset)
 }
 
-func (ns *NotificationStore) Get(userID string) []models.Notification {
-	ns.mu.RLock()
-	defer ns.mu.RUnlock()
-	return ns.data[userID]
+func headerValue(msg kafka.Message, key string) string {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
 }
 
+// StoreRetryDelay is the pause before storing a notification (or writing a
+// dead letter) again after a failure, the message is not committed until then.
+const StoreRetryDelay = time.Second
+
 type Consumer struct {
-	store *NotificationStore
+	store       store.NotificationStore
+	hub         *stream.Hub
+	deadLetters *DeadLetterQueue
+	// directory checks the recipients exist, nil skips the check
+	directory *Directory
 }
 
-func setupConsumerGroup(ctx context.Context, store *NotificationStore) {
-	consumer := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{Kafka1ServerAddress, Kafka2ServerAddress, Kafka3ServerAddress},
-		Topic:   ConsumerTopic,
-		GroupID: ConsumerGroup,
-	})
-	defer consumer.Close()
+// validRecipient tells whether the key names the user the notification is for.
+func validRecipient(userID string, notification models.Notification) bool {
+	id, err := strconv.Atoi(userID)
+	return err == nil && id > 0 && id == notification.To.ID
+}
+
+// process stores the notification of msg, or moves msg to the dead letter
+// topic when it can't be stored. It returns false only when ctx is canceled
+// before either happened, msg must not be committed then.
+func (c *Consumer) process(ctx context.Context, msg kafka.Message) bool {
+	userID := string(msg.Key)
+	if userID == "" {
+		return c.deadLetter(ctx, msg, ReasonEmptyKey, nil)
+	}
+	envelope, err := schema.Decode(msg.Value, headerValue(msg, schema.HeaderContentType))
+	if err != nil {
+		unmarshalFailures.WithLabelValues(msg.Topic).Inc()
+		return c.deadLetter(ctx, msg, ReasonDecodeFailed, err)
+	}
+	notification := models.Notification{Notification: envelope.Payload}
+	if !validRecipient(userID, notification) {
+		return c.deadLetter(ctx, msg, ReasonKeyMismatch,
+			fmt.Errorf("key %q does not match recipient %d", userID, notification.To.ID))
+	}
+	if c.directory != nil {
+		err := c.directory.Exists(ctx, userID)
+		if errors.Is(err, ErrUnknownUser) {
+			return c.deadLetter(ctx, msg, ReasonUnknownUser,
+				fmt.Errorf("recipient %s is not in the user directory", userID))
+		}
+		if err != nil {
+			// the producer checked the recipient when it was sent, a directory
+			// outage must not hold the partition
+			log.Printf("failed to check recipient %s, storing the notification unchecked: %v\n", userID, err)
+		}
+	}
+	notification.ID = notificationID(msg)
+	notification.ReceivedAt = msg.Time
+	if notification.ReceivedAt.IsZero() {
+		notification.ReceivedAt = time.Now()
+	}
+
+	for {
+		err = c.store.Add(userID, notification)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, store.ErrDuplicateNotification) {
+			duplicateNotifications.WithLabelValues(msg.Topic).Inc()
+			log.Printf("skipping duplicate notification %s for user %s\n", notification.ID, userID)
+			return true
+		}
+		storeFailures.WithLabelValues(msg.Topic).Inc()
+		if errors.Is(err, store.ErrRecordTooLarge) {
+			return c.deadLetter(ctx, msg, ReasonRecordTooLarge, err)
+		}
+		log.Printf("failed to store notification for user %s (retrying): %v\n", userID, err)
+		if !sleepCtx(ctx, StoreRetryDelay) {
+			return false
+		}
+	}
+
+	// only stored notifications are pushed, so a stream can always resume from the store
+	c.hub.Publish(userID, notification)
+	return true
+}
+
+// deadLetter retries until msg is in the dead letter topic, like a store
+// failure the offset is not committed before.
+func (c *Consumer) deadLetter(ctx context.Context, msg kafka.Message, reason string, cause error) bool {
+	log.Printf("dead lettering %s (%s): %v\n", notificationID(msg), reason, cause)
+	for {
+		err := c.deadLetters.Send(ctx, msg, reason, cause)
+		if err == nil {
+			return true
+		}
+		log.Printf("%v (retrying)\n", err)
+		if !sleepCtx(ctx, StoreRetryDelay) {
+			return false
+		}
+	}
+}
+
+// sleepCtx returns false when ctx is canceled before d elapsed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func setupConsumerGroup(ctx context.Context, cfg config.ConsumerConfig, consumer *kafka.Reader, notificationStore store.NotificationStore, hub *stream.Hub, deadLetters *DeadLetterQueue, directory *Directory, assigned assignment) {
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Printf("failed to close consumer: %v\n", err)
+		}
+	}()
 
 	consumerStore := &Consumer{
-		store: store,
+		store:       notificationStore,
+		hub:         hub,
+		deadLetters: deadLetters,
+		directory:   directory,
 	}
+	commits := newCommitter(consumer, notificationStore, assigned, cfg.CommitBatchSize, cfg.CommitInterval)
+	defer func() {
+		// the last batch is committed before the reader is closed
+		commits.Close()
+		log.Println("consumer stopped, processed offsets committed")
+	}()
 
 	for {
-		msg, err := consumer.ReadMessage(ctx)
+		// FetchMessage does not commit, offsets are committed once the notifications are stored
+		msg, err := consumer.FetchMessage(ctx)
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				log.Println("consumer context canceled, shutting down")
@@ -87,61 +210,175 @@ func setupConsumerGroup(ctx context.Context, store *NotificationStore) {
 			continue // 👈 DO NOT return
 		}
 
-		userID := string(msg.Key)
-		var notification models.Notification
-		if err := json.Unmarshal(msg.Value, &notification); err != nil {
-			log.Printf("failed to unmarshal notification: %v\n", err)
-			continue
+		notificationsConsumed.WithLabelValues(msg.Topic).Inc()
+		if !consumerStore.process(ctx, msg) {
+			return
 		}
-		consumerStore.store.Add(userID, notification)
+		commits.Processed(msg)
 	}
 }
 
-func handleNotifications(ctx *gin.Context, store *NotificationStore) {
-	userID, err := getUserIDFromRequest(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+func main() {
+	cfg, err := config.Load(config.Consumer, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	// the same templates as the producer, to render notifications stored raw
+	catalog, err := templates.Load(cfg.Templates.File, cfg.Templates.DefaultLocale)
+	if err != nil {
+		log.Fatalf("failed to load templates: %v", err)
+	}
 
-	notes := store.Get(userID)
-	if len(notes) == 0 {
-		ctx.JSON(http.StatusOK, gin.H{
-			"message":       "No notifications found for user",
-			"notifications": []models.Notification{},
-		})
-		return
+	consumer, err := newReader(cfg)
+	if err != nil {
+		log.Fatalf("failed to initialize consumer: %v", err)
 	}
+	transport, err := newTransport(cfg)
+	if err != nil {
+		log.Fatalf("failed to initialize kafka client: %v", err)
+	}
+	client := newKafkaClient(cfg, transport)
+	deadLetters := newDeadLetterQueue(cfg, client, transport)
+	defer deadLetters.Close()
 
-	ctx.JSON(http.StatusOK, gin.H{"notifications": notes})
-}
+	store, err := openStore(cfg.Consumer.Store)
+	if err != nil {
+		log.Fatalf("failed to open notification store: %v", err)
+	}
+	defer store.Close()
 
-func main() {
+	hub := stream.NewHub(cfg.Consumer.StreamBuffer)
 
-	store := &NotificationStore{
-		data: make(UserNotifications),
+	selfURL, err := advertisedURL(cfg.Consumer)
+	if err != nil {
+		log.Fatalf("failed to find the advertised url: %v", err)
+	}
+	consumerDone := make(chan struct{})
+	health := &Health{
+		client:       client,
+		topic:        cfg.Topics.Notifications,
+		groupID:      cfg.Consumer.GroupID,
+		clientID:     clientID(cfg.Consumer),
+		selfURL:      selfURL,
+		maxLag:       cfg.Consumer.ReadyMaxLag,
+		consumerDone: consumerDone,
+	}
+
+	directory, err := newDirectory(cfg.Consumer.DirectoryURL, cfg.Consumer.DirectoryAPIKey)
+	if err != nil {
+		log.Fatalf("failed to initialize the user directory: %v", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	go setupConsumerGroup(ctx, store)
+	go func() {
+		defer close(consumerDone)
+		setupConsumerGroup(ctx, cfg.Consumer, consumer, store, hub, deadLetters, directory, health.assigned)
+	}()
+
+	peers := newPeers(cfg, client, selfURL)
+	go peers.Run(ctx, cfg.Consumer.PeerRefreshInterval)
+
+	prometheus.MustRegister(newStoreCollector(store), newLagCollector(health))
 
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
-	router.GET("/notifications/:userID", func(ctx *gin.Context) {
-		handleNotifications(ctx, store)
+	router.Use(httpMetrics())
+	router.GET("/metrics", metricsHandler())
+	router.GET("/healthz", func(ctx *gin.Context) {
+		handleHealthz(ctx, health)
+	})
+	router.GET("/readyz", func(ctx *gin.Context) {
+		handleReadyz(ctx, health)
+	})
+	authenticators := auth.New(cfg.Auth)
+	if authenticators == nil {
+		log.Println("auth is disabled, anyone can read any user's notifications")
+	}
+	authenticate := auth.Middleware(authenticators)
+	requireAdmin := auth.RequireRole(auth.RoleAdmin)
+
+	admin := router.Group("/admin", authenticate, requireAdmin)
+	admin.GET("/dlq", func(ctx *gin.Context) {
+		handleListDeadLetters(ctx, deadLetters)
+	})
+	admin.GET("/dlq/:partition/:offset", func(ctx *gin.Context) {
+		handleGetDeadLetter(ctx, deadLetters)
+	})
+	admin.POST("/dlq/:partition/:offset/replay", func(ctx *gin.Context) {
+		handleReplayDeadLetter(ctx, deadLetters)
+	})
+	admin.POST("/dlq/replay", func(ctx *gin.Context) {
+		handleReplayDeadLetters(ctx, deadLetters)
+	})
+	router.GET("/store/stats", authenticate, requireAdmin, func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, store.Stats())
+	})
+	router.GET("/cluster/peers", authenticate, requireAdmin, func(ctx *gin.Context) {
+		handlePeers(ctx, peers)
+	})
+	// every route of a user goes through the instance owning the user's partition
+	// checked before routing, the owner checks the forwarded credentials again
+	notifications := router.Group("/notifications/:userID", authenticate, auth.RequireUser("userID"), peers.routeUser())
+	notifications.GET("", func(ctx *gin.Context) {
+		handleNotifications(ctx, store, catalog)
+	})
+	notifications.GET("/groups", func(ctx *gin.Context) {
+		handleUserGroups(ctx, directory)
+	})
+	notifications.GET("/unread", func(ctx *gin.Context) {
+		handleUnreadNotifications(ctx, store, catalog)
+	})
+	notifications.GET("/stream", func(ctx *gin.Context) {
+		handleStreamSSE(ctx, hub, store, catalog)
+	})
+	notifications.GET("/ws", func(ctx *gin.Context) {
+		handleStreamWebSocket(ctx, hub, store, catalog)
+	})
+	notifications.PUT("/read", func(ctx *gin.Context) {
+		handleMarkRead(ctx, store)
+	})
+	notifications.PUT("/read-all", func(ctx *gin.Context) {
+		handleMarkAllRead(ctx, store)
+	})
+	notifications.PUT("/:notificationID/read", func(ctx *gin.Context) {
+		handleMarkOneRead(ctx, store)
 	})
 
+	server := &http.Server{
+		Addr:    cfg.Consumer.HTTPAddr,
+		Handler: router,
+	}
+	// live streams never end on their own, close them once we stop listening
+	server.RegisterOnShutdown(hub.Close)
+	serverErr := make(chan error, 1)
 	go func() {
-		fmt.Printf("Kafka CONSUMER (Group: %s) 👥📥 "+"started at http://localhost%s\n", ConsumerGroup, ConsumerPort)
-
-		if err := router.Run(ConsumerPort); err != nil {
-			log.Printf("failed to run the server: %v", err)
-		}
+		fmt.Printf("Kafka CONSUMER (Group: %s) 👥📥 "+"listening on %s\n", cfg.Consumer.GroupID, cfg.Consumer.HTTPAddr)
+		serverErr <- server.ListenAndServe()
 	}()
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	<-sig
-	log.Println("shutting down consumer...")
+	select {
+	case s := <-sig:
+		log.Printf("received %s, shutting down consumer...", s)
+	case err := <-serverErr:
+		log.Printf("failed to run the server: %v", err)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Consumer.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("some requests did not finish in time: %v", err)
+	}
+
 	cancel()
+	// let the consumer finish its last Add and commit before the store gets closed
+	select {
+	case <-consumerDone:
+	case <-shutdownCtx.Done():
+		log.Println("consumer did not stop in time, offsets of the last messages may not be committed")
+	}
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"config"
+	"consumer/pkg/models"
+	"testing"
+)
+
+func TestOpenStore(t *testing.T) {
+	cfg := config.Default().Consumer.Store
+	cfg.Dir = t.TempDir()
+	for _, backend := range []string{"disk", "memory"} {
+		cfg.Backend = backend
+		s, err := openStore(cfg)
+		if err != nil {
+			t.Fatalf("openStore(%s): %v", backend, err)
+		}
+		s.Close()
+	}
+
+	memory, _ := openStore(config.StoreConfig{Backend: "memory", Retention: config.RetentionConfig{MaxPerUser: 1}})
+	memory.Add("1", models.Notification{ID: "a"})
+	memory.Add("1", models.Notification{ID: "b"})
+	if stats := memory.Stats(); stats.Notifications != 1 {
+		t.Errorf("stats = %+v, want the retention applied", stats)
+	}
+
+	if _, err := openStore(config.StoreConfig{Backend: "tape"}); err == nil {
+		t.Error("openStore of an unknown backend succeeded")
+	}
+}
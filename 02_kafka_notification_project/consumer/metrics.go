@@ -0,0 +1,155 @@
+package main
+
+import (
+	"consumer/pkg/store"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	notificationsConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_consumed_total",
+		Help: "Messages read from Kafka, whatever happened to them next.",
+	}, []string{"topic"})
+	unmarshalFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_unmarshal_failures_total",
+		Help: "Messages that could not be decoded into a notification.",
+	}, []string{"topic"})
+	storeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_store_failures_total",
+		Help: "Notifications the store refused.",
+	}, []string{"topic"})
+	deadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_dead_lettered_total",
+		Help: "Messages moved to the dead letter topic.",
+	}, []string{"reason"})
+	duplicateNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_duplicates_total",
+		Help: "Notifications already stored, dropped as duplicates.",
+	}, []string{"topic"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests, live streams last as long as the client stays.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// userSizeBuckets are the upper bounds of the per user store size histogram.
+var userSizeBuckets = []float64{1, 5, 10, 50, 100, 250, 500, 1000, 5000}
+
+// httpMetrics times every request, labelled with the route pattern so
+// /notifications/:userID stays one series whatever the user.
+func httpMetrics() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.
+			WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// storeCollector reads the store Stats on every scrape.
+type storeCollector struct {
+	store store.NotificationStore
+
+	users         *prometheus.Desc
+	notifications *prometheus.Desc
+	bytes         *prometheus.Desc
+	evicted       *prometheus.Desc
+	userSizes     *prometheus.Desc
+}
+
+func newStoreCollector(notificationStore store.NotificationStore) *storeCollector {
+	return &storeCollector{
+		store:         notificationStore,
+		users:         prometheus.NewDesc("notification_store_users", "Users with notifications in the store.", nil, nil),
+		notifications: prometheus.NewDesc("notification_store_notifications", "Notifications kept in the store.", nil, nil),
+		bytes:         prometheus.NewDesc("notification_store_bytes", "Estimated memory used by the store.", nil, nil),
+		evicted:       prometheus.NewDesc("notification_store_evicted_total", "Notifications dropped by the retention rules.", []string{"reason"}, nil),
+		userSizes:     prometheus.NewDesc("notification_store_user_notifications", "How many notifications every user has in the store.", nil, nil),
+	}
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.users
+	ch <- c.notifications
+	ch <- c.bytes
+	ch <- c.evicted
+	ch <- c.userSizes
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.store.Stats()
+	ch <- prometheus.MustNewConstMetric(c.users, prometheus.GaugeValue, float64(stats.Users))
+	ch <- prometheus.MustNewConstMetric(c.notifications, prometheus.GaugeValue, float64(stats.Notifications))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(stats.Bytes))
+	for reason, count := range stats.Evicted {
+		ch <- prometheus.MustNewConstMetric(c.evicted, prometheus.CounterValue, float64(count), string(reason))
+	}
+
+	buckets := make(map[float64]uint64, len(userSizeBuckets))
+	for _, bound := range userSizeBuckets {
+		buckets[bound] = 0
+	}
+	var sum float64
+	for _, size := range stats.UserSizes {
+		sum += float64(size)
+		for _, bound := range userSizeBuckets {
+			if float64(size) <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(c.userSizes, uint64(len(stats.UserSizes)), sum, buckets)
+}
+
+// lagCollector asks the brokers for the group lag on every scrape, the same
+// way /readyz does.
+type lagCollector struct {
+	health *Health
+	lag    *prometheus.Desc
+}
+
+func newLagCollector(health *Health) *lagCollector {
+	return &lagCollector{
+		health: health,
+		lag: prometheus.NewDesc("notifications_consumer_lag",
+			"Messages of the partition the group did not commit yet.", []string{"topic", "partition"}, nil),
+	}
+}
+
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lag
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+	defer cancel()
+
+	brokers := c.health.checkBrokers(ctx)
+	if !brokers.OK {
+		return
+	}
+	lag := c.health.checkLag(ctx, brokers.Partitions, nil)
+	for partition, messages := range lag.Partitions {
+		ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, float64(messages),
+			c.health.topic, strconv.Itoa(partition))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns what Prometheus would read from the gatherer.
+func scrape(t *testing.T, gatherer prometheus.Gatherer) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape = %d %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+func wantMetrics(t *testing.T, text string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics miss %q:\n%s", line, text)
+		}
+	}
+}
+
+func TestStoreCollector(t *testing.T) {
+	s := newTestStore(t, "1", "a", "b", "c")
+	s.Add("2", models.Notification{ID: "d"})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newStoreCollector(s))
+
+	wantMetrics(t, scrape(t, registry),
+		"notification_store_users 2",
+		"notification_store_notifications 4",
+		`notification_store_user_notifications_bucket{le="1"} 1`,
+		`notification_store_user_notifications_bucket{le="5"} 2`,
+		"notification_store_user_notifications_sum 4",
+		"notification_store_user_notifications_count 2",
+	)
+}
+
+func TestStoreCollectorEvictions(t *testing.T) {
+	s := store.NewMemoryStore(store.Retention{MaxPerUser: 1})
+	for _, id := range []string{"a", "b", "c"} {
+		s.Add("1", models.Notification{ID: id})
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newStoreCollector(s))
+
+	wantMetrics(t, scrape(t, registry), `notification_store_evicted_total{reason="per_user_cap"} 2`)
+}
+
+func TestLagCollector(t *testing.T) {
+	f := &fakeKafka{
+		topic:      "notifications",
+		partitions: 2,
+		committed:  map[int]int64{0: 5, 1: 10},
+		first:      map[int]int64{0: 0, 1: 0},
+		last:       map[int]int64{0: 8, 1: 10},
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newLagCollector(newTestHealth(f, 0, make(chan struct{}))))
+	wantMetrics(t, scrape(t, registry),
+		`notifications_consumer_lag{partition="0",topic="notifications"} 3`,
+		`notifications_consumer_lag{partition="1",topic="notifications"} 0`,
+	)
+
+	// unreachable brokers leave the lag out instead of failing the scrape
+	f.err = errors.New("connection refused")
+	if text := scrape(t, registry); strings.Contains(text, "notifications_consumer_lag{") {
+		t.Errorf("lag reported without brokers:\n%s", text)
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	// the histogram is global, start from no requests when the test runs again
+	httpRequestDuration.Reset()
+	router := gin.New()
+	router.Use(httpMetrics())
+	router.GET("/notifications/:userID", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{})
+	})
+	router.GET("/metrics", metricsHandler())
+
+	for _, path := range []string{"/notifications/1", "/notifications/2", "/nowhere"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// every user ends up in the same series
+	wantMetrics(t, scrape(t, prometheus.DefaultGatherer),
+		`http_request_duration_seconds_count{method="GET",route="/notifications/:userID",status="200"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+	)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+)
+
+// HeaderForwardedBy is set on requests forwarded to a peer, a peer never
+// forwards such a request again (the owners may disagree during a rebalance).
+const HeaderForwardedBy = "X-Notifications-Forwarded-By"
+
+const (
+	RoutingForward  = "forward"
+	RoutingRedirect = "redirect"
+	RoutingOff      = "off"
+)
+
+// memberInfo is what every instance puts in the user data of its group
+// subscription, like application.server in Kafka Streams.
+type memberInfo struct {
+	URL string `json:"url"`
+}
+
+// advertisingBalancer is a kafka-go GroupBalancer that adds our memberInfo to
+// the JoinGroup request, the assignment itself is left to the wrapped one.
+type advertisingBalancer struct {
+	kafka.GroupBalancer
+	userData []byte
+}
+
+func (b advertisingBalancer) UserData() ([]byte, error) {
+	return b.userData, nil
+}
+
+// memberURL is the URL a member of the group advertises, empty for members
+// without our user data (other tools). It is how an instance finds itself
+// too: client IDs may be shared by instances using the same config file.
+func memberURL(member kafka.DescribeGroupsResponseMember) string {
+	var info memberInfo
+	_ = json.Unmarshal(member.MemberMetadata.UserData, &info)
+	return info.URL
+}
+
+// groupBalancers are the kafka-go defaults, advertising our URL.
+func groupBalancers(advertisedURL string) ([]kafka.GroupBalancer, error) {
+	userData, err := json.Marshal(memberInfo{URL: advertisedURL})
+	if err != nil {
+		return nil, err
+	}
+	return []kafka.GroupBalancer{
+		advertisingBalancer{GroupBalancer: kafka.RangeGroupBalancer{}, userData: userData},
+		advertisingBalancer{GroupBalancer: kafka.RoundRobinGroupBalancer{}, userData: userData},
+	}, nil
+}
+
+// advertisedURL is the configured URL, or one built from the host name and
+// the port we listen on.
+func advertisedURL(cfg config.ConsumerConfig) (string, error) {
+	if cfg.AdvertisedURL != "" {
+		return cfg.AdvertisedURL, nil
+	}
+	host, port, err := net.SplitHostPort(cfg.HTTPAddr)
+	if err != nil {
+		return "", fmt.Errorf("can't derive the advertised url from %q: %w", cfg.HTTPAddr, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+type peer struct {
+	MemberID   string `json:"member_id"`
+	ClientID   string `json:"client_id"`
+	URL        string `json:"url"`
+	Partitions []int  `json:"partitions"`
+	Self       bool   `json:"self"`
+}
+
+// Peers tracks which instance of the group owns which partition, read from
+// the group description every refresh interval. A user lives on the
+// partition its key hashes to, so any instance can find the one holding a
+// user's notifications.
+type Peers struct {
+	client   *kafka.Client
+	topic    string
+	groupID  string
+	clientID string
+	selfURL  string
+	routing  string
+
+	mu         sync.RWMutex
+	partitions []int
+	members    []peer
+	owners     map[int]peer
+	refreshed  time.Time
+	lastErr    error
+}
+
+func newPeers(cfg config.Config, client *kafka.Client, selfURL string) *Peers {
+	return &Peers{
+		client:   client,
+		topic:    cfg.Topics.Notifications,
+		groupID:  cfg.Consumer.GroupID,
+		clientID: clientID(cfg.Consumer),
+		selfURL:  selfURL,
+		routing:  cfg.Consumer.Routing,
+		owners:   make(map[int]peer),
+	}
+}
+
+// Run refreshes the owners until ctx is canceled.
+func (p *Peers) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Peers) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	partitions, members, err := p.describe(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		if p.lastErr == nil {
+			log.Printf("failed to refresh partition owners (keeping the last ones): %v\n", err)
+		}
+		p.lastErr = err
+		return
+	}
+
+	p.partitions = partitions
+	p.members = members
+	p.owners = make(map[int]peer)
+	for _, member := range members {
+		for _, partition := range member.Partitions {
+			p.owners[partition] = member
+		}
+	}
+	p.refreshed = time.Now()
+	p.lastErr = nil
+}
+
+func (p *Peers) describe(ctx context.Context) ([]int, []peer, error) {
+	metadata, err := p.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{p.topic}})
+	if err != nil {
+		return nil, nil, err
+	}
+	var partitions []int
+	for _, topic := range metadata.Topics {
+		if topic.Name != p.topic {
+			continue
+		}
+		if topic.Error != nil {
+			return nil, nil, topic.Error
+		}
+		for _, partition := range topic.Partitions {
+			partitions = append(partitions, partition.ID)
+		}
+	}
+	sort.Ints(partitions)
+
+	resp, err := p.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{p.groupID}})
+	if err != nil {
+		return nil, nil, err
+	}
+	members := []peer{}
+	for _, group := range resp.Groups {
+		if group.Error != nil {
+			return nil, nil, group.Error
+		}
+		for _, member := range group.Members {
+			// members without our user data (other tools) can't be forwarded to
+			advertised := memberURL(member)
+			found := peer{
+				MemberID:   member.MemberID,
+				ClientID:   member.ClientID,
+				URL:        advertised,
+				Partitions: []int{},
+				Self:       advertised != "" && advertised == p.selfURL,
+			}
+			for _, topic := range member.MemberAssignments.Topics {
+				if topic.Topic == p.topic {
+					found.Partitions = append(found.Partitions, topic.Partitions...)
+				}
+			}
+			sort.Ints(found.Partitions)
+			members = append(members, found)
+		}
+	}
+	return partitions, members, nil
+}
+
+// partitionOf mirrors the producer's partitioner (librdkafka consistent_random,
+// CRC32 of the key), so it must stay in sync with it.
+func partitionOf(userID string, partitions []int) int {
+	return (&kafka.CRC32Balancer{}).Balance(kafka.Message{Key: []byte(userID)}, partitions...)
+}
+
+// owner returns the instance holding the user, false when unknown.
+func (p *Peers) owner(userID string) (peer, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.partitions) == 0 {
+		return peer{}, false
+	}
+	owner, ok := p.owners[partitionOf(userID, p.partitions)]
+	return owner, ok
+}
+
+// routeUser sends the requests for a user owned by another instance there,
+// by forwarding (streams included) or redirecting. Requests are answered
+// locally when we own the user, when the owner is unknown (rebalance, no
+// broker) or when they were already forwarded once.
+func (p *Peers) routeUser() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if p.routing == RoutingOff || ctx.GetHeader(HeaderForwardedBy) != "" {
+			ctx.Next()
+			return
+		}
+		owner, ok := p.owner(ctx.Param("userID"))
+		if !ok || owner.Self || owner.URL == "" {
+			ctx.Next()
+			return
+		}
+		target, err := url.Parse(owner.URL)
+		if err != nil {
+			ctx.Next()
+			return
+		}
+
+		if p.routing == RoutingRedirect {
+			location := target.JoinPath(ctx.Request.URL.Path)
+			location.RawQuery = ctx.Request.URL.RawQuery
+			ctx.Redirect(http.StatusTemporaryRedirect, location.String())
+			ctx.Abort()
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.SetXForwarded()
+				r.Out.Header.Set(HeaderForwardedBy, p.clientID)
+			},
+			// flush right away so live streams go through
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				ctx.JSON(http.StatusBadGateway, gin.H{
+					"message": fmt.Sprintf("instance %s owning user %s is unreachable: %v", owner.URL, ctx.Param("userID"), err),
+				})
+			},
+		}
+		proxy.ServeHTTP(ctx.Writer, ctx.Request)
+		ctx.Abort()
+	}
+}
+
+func handlePeers(ctx *gin.Context, p *Peers) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	owners := make(map[int]string, len(p.owners))
+	for partition, owner := range p.owners {
+		owners[partition] = owner.URL
+	}
+	response := gin.H{
+		"group_id":   p.groupID,
+		"routing":    p.routing,
+		"partitions": p.partitions,
+		"members":    p.members,
+		"owners":     owners,
+		"refreshed":  p.refreshed,
+	}
+	if p.lastErr != nil {
+		response["error"] = p.lastErr.Error()
+	}
+	if userID := ctx.Query("user"); userID != "" && len(p.partitions) > 0 {
+		response["user"] = gin.H{
+			"id":        userID,
+			"partition": partitionOf(userID, p.partitions),
+		}
+	}
+	ctx.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"config"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestAdvertisedURL(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cfg  config.ConsumerConfig
+		want string
+	}{
+		{config.ConsumerConfig{AdvertisedURL: "https://consumer-1:8443", HTTPAddr: ":8082"}, "https://consumer-1:8443"},
+		{config.ConsumerConfig{HTTPAddr: "consumer-1:8082"}, "http://consumer-1:8082"},
+		{config.ConsumerConfig{HTTPAddr: ":8082"}, "http://" + hostname + ":8082"},
+		{config.ConsumerConfig{HTTPAddr: "0.0.0.0:8082"}, "http://" + hostname + ":8082"},
+	}
+	for _, tt := range tests {
+		if got, err := advertisedURL(tt.cfg); err != nil || got != tt.want {
+			t.Errorf("advertisedURL(%+v) = %q, %v, want %q", tt.cfg, got, err, tt.want)
+		}
+	}
+	if _, err := advertisedURL(config.ConsumerConfig{HTTPAddr: "8082"}); err == nil {
+		t.Error("advertisedURL without a port = nil error, want one")
+	}
+}
+
+func TestGroupBalancers(t *testing.T) {
+	balancers, err := groupBalancers("http://consumer-1:8082")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balancers) != 2 || balancers[0].ProtocolName() != "range" || balancers[1].ProtocolName() != "roundrobin" {
+		t.Fatalf("balancers = %v, want range and roundrobin", balancers)
+	}
+	for _, balancer := range balancers {
+		userData, err := balancer.(advertisingBalancer).UserData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info memberInfo
+		if err := json.Unmarshal(userData, &info); err != nil || info.URL != "http://consumer-1:8082" {
+			t.Errorf("user data = %s, want our URL", userData)
+		}
+	}
+}
+
+func TestPartitionOf(t *testing.T) {
+	partitions := []int{0, 1, 2}
+	for id := 1; id <= 100; id++ {
+		userID := strconv.Itoa(id)
+		// what librdkafka's consistent_random does for a non empty key
+		want := int(crc32.ChecksumIEEE([]byte(userID)) % uint32(len(partitions)))
+		if got := partitionOf(userID, partitions); got != want {
+			t.Errorf("partitionOf(%s) = %d, want %d", userID, got, want)
+		}
+	}
+}
+
+// userOn returns a user living on the partition out of partitions.
+func userOn(t *testing.T, partition int, partitions []int) string {
+	t.Helper()
+	for id := 1; id < 1000; id++ {
+		if userID := strconv.Itoa(id); partitionOf(userID, partitions) == partition {
+			return userID
+		}
+	}
+	t.Fatalf("no user on partition %d", partition)
+	return ""
+}
+
+func newTestPeers(f *fakeKafka, routing string) *Peers {
+	cfg := config.Default()
+	cfg.Topics.Notifications = f.topic
+	cfg.Consumer.ClientID = "me"
+	cfg.Consumer.Routing = routing
+	return newPeers(cfg, &kafka.Client{Addr: kafka.TCP("localhost:9092"), Transport: f}, "http://me:8082")
+}
+
+func TestPeersRefresh(t *testing.T) {
+	f := &fakeKafka{
+		topic:      "notifications",
+		partitions: 3,
+		members:    []fakeMember{{"me", []int{0, 2}, "http://me:8082"}, {"other", []int{1}, "http://other:8082"}},
+	}
+	peers := newTestPeers(f, RoutingForward)
+	partitions := []int{0, 1, 2}
+
+	if _, ok := peers.owner("1"); ok {
+		t.Error("owner known before the first refresh")
+	}
+	peers.refresh(context.Background())
+	for partition, want := range map[int]string{0: "http://me:8082", 1: "http://other:8082", 2: "http://me:8082"} {
+		owner, ok := peers.owner(userOn(t, partition, partitions))
+		if !ok || owner.URL != want || owner.Self != (want == "http://me:8082") {
+			t.Errorf("owner of partition %d = %+v, %v, want %s", partition, owner, ok, want)
+		}
+	}
+
+	router := gin.New()
+	router.GET("/cluster/peers", func(ctx *gin.Context) {
+		handlePeers(ctx, peers)
+	})
+	userID := userOn(t, 1, partitions)
+	code, response := do(t, router, http.MethodGet, "/cluster/peers?user="+userID, "")
+	if code != http.StatusOK || len(response["members"].([]any)) != 2 || response["error"] != nil {
+		t.Fatalf("GET /cluster/peers = %d %v, want both members", code, response)
+	}
+	if owners := response["owners"].(map[string]any); owners["1"] != "http://other:8082" {
+		t.Errorf("owners = %v, want partition 1 on other", owners)
+	}
+	if user := response["user"].(map[string]any); user["partition"] != 1.0 {
+		t.Errorf("user = %v, want partition 1", user)
+	}
+
+	// a failed refresh keeps the last owners
+	f.err = errors.New("connection refused")
+	peers.refresh(context.Background())
+	if owner, ok := peers.owner(userID); !ok || owner.URL != "http://other:8082" {
+		t.Errorf("owner after a failed refresh = %+v, %v, want the last one", owner, ok)
+	}
+	if _, response := do(t, router, http.MethodGet, "/cluster/peers", ""); response["error"] == nil {
+		t.Errorf("GET /cluster/peers = %v, want the refresh error", response)
+	}
+}
+
+func TestPeersSharedClientID(t *testing.T) {
+	// both instances run with the same config file
+	f := &fakeKafka{
+		topic:      "notifications",
+		partitions: 2,
+		members:    []fakeMember{{"me", []int{1}, "http://other:8082"}, {"me", []int{0}, "http://me:8082"}},
+	}
+	peers := newTestPeers(f, RoutingForward)
+	peers.refresh(context.Background())
+	partitions := []int{0, 1}
+
+	if owner, ok := peers.owner(userOn(t, 0, partitions)); !ok || !owner.Self {
+		t.Errorf("owner of partition 0 = %+v, %v, want us", owner, ok)
+	}
+	if owner, ok := peers.owner(userOn(t, 1, partitions)); !ok || owner.Self || owner.URL != "http://other:8082" {
+		t.Errorf("owner of partition 1 = %+v, %v, want the other instance", owner, ok)
+	}
+}
+
+func TestRouteUser(t *testing.T) {
+	var forwardedBy string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy = r.Header.Get(HeaderForwardedBy)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"served_by":"other","path":"` + r.URL.RequestURI() + `"}`))
+	}))
+	defer other.Close()
+
+	f := &fakeKafka{
+		topic:      "notifications",
+		partitions: 3,
+		members: []fakeMember{
+			{"me", []int{0}, "http://me:8082"},
+			{"other", []int{1}, other.URL},
+			{"gone", []int{2}, "http://127.0.0.1:1"},
+		},
+	}
+	partitions := []int{0, 1, 2}
+	local, remote, unreachable := userOn(t, 0, partitions), userOn(t, 1, partitions), userOn(t, 2, partitions)
+
+	newRouter := func(routing string) *gin.Engine {
+		peers := newTestPeers(f, routing)
+		peers.refresh(context.Background())
+		router := gin.New()
+		notifications := router.Group("/notifications/:userID", peers.routeUser())
+		notifications.GET("", func(ctx *gin.Context) {
+			ctx.JSON(http.StatusOK, gin.H{"served_by": "me"})
+		})
+		return router
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		// the proxy needs a real connection to stream through
+		me := httptest.NewServer(newRouter(RoutingForward))
+		defer me.Close()
+		get := func(path string) (int, map[string]any) {
+			t.Helper()
+			resp, err := http.Get(me.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var response map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			return resp.StatusCode, response
+		}
+
+		if _, response := get("/notifications/" + local); response["served_by"] != "me" {
+			t.Errorf("local user served by %v, want me", response["served_by"])
+		}
+		code, response := get("/notifications/" + remote + "?limit=2")
+		if code != http.StatusOK || response["served_by"] != "other" || response["path"] != "/notifications/"+remote+"?limit=2" {
+			t.Errorf("remote user = %d %v, want forwarded to other", code, response)
+		}
+		if forwardedBy != "me" {
+			t.Errorf("%s = %q, want me", HeaderForwardedBy, forwardedBy)
+		}
+		if code, response := get("/notifications/" + unreachable); code != http.StatusBadGateway {
+			t.Errorf("user of an unreachable instance = %d %v, want 502", code, response)
+		}
+	})
+
+	t.Run("already forwarded", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/notifications/"+remote, nil)
+		req.Header.Set(HeaderForwardedBy, "other")
+		rec := httptest.NewRecorder()
+		newRouter(RoutingForward).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"served_by":"me"}` {
+			t.Errorf("forwarded request = %d %s, want answered locally", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/notifications/"+remote+"?limit=2", nil)
+		rec := httptest.NewRecorder()
+		newRouter(RoutingRedirect).ServeHTTP(rec, req)
+		want := other.URL + "/notifications/" + remote + "?limit=2"
+		if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != want {
+			t.Errorf("remote user = %d to %q, want 307 to %q", rec.Code, rec.Header().Get("Location"), want)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		if _, response := do(t, newRouter(RoutingOff), http.MethodGet, "/notifications/"+remote, ""); response["served_by"] != "me" {
+			t.Errorf("remote user served by %v, want me", response["served_by"])
+		}
+	})
+}
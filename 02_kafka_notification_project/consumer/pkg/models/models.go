@@ -1,12 +1,18 @@
 package models
 
-type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-}
+import (
+	"schema"
+	"time"
+)
+
+type User = schema.User
 
+// Notification is what the consumer stores: the payload the producer sent
+// plus the bookkeeping done on our side.
 type Notification struct {
-	From    User   `json:"from"`
-	To      User   `json:"to"`
-	Message string `json:"message"`
+	ID string `json:"id"`
+	schema.Notification
+	Read bool `json:"read"`
+	// ReceivedAt is the Kafka timestamp of the record that carried the notification
+	ReceivedAt time.Time `json:"received_at"`
 }
@@ -0,0 +1,627 @@
+package store
+
+import (
+	"bufio"
+	"consumer/pkg/models"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix          = ".log"
+	recordHeaderSize       = 8 // 4 bytes payload length + 4 bytes crc32
+	maxRecordBytes         = 4 << 20
+	DefaultMaxSegmentBytes = 16 << 20
+)
+
+var (
+	ErrCorruptRecord  = errors.New("corrupt record in segment")
+	ErrRecordTooLarge = errors.New("notification too large for store")
+)
+
+// DiskOptions tunes the on-disk store.
+type DiskOptions struct {
+	// MaxSegmentBytes is the size after which a new segment file is started.
+	MaxSegmentBytes int64
+	// SyncWrites fsyncs the active segment after every Add.
+	SyncWrites bool
+	// Retention bounds the index. Once no kept notification lives in the
+	// oldest segments anymore, their files are deleted.
+	Retention Retention
+}
+
+const (
+	kindNotification = ""
+	kindRead         = "read"
+)
+
+// diskRecord is what we append to a segment. Notifications are never
+// rewritten, marking them as read appends a "read" record instead.
+type diskRecord struct {
+	Kind         string               `json:"kind,omitempty"`
+	UserID       string               `json:"user_id"`
+	Notification *models.Notification `json:"notification,omitempty"`
+	ReadIDs      []string             `json:"read_ids,omitempty"`
+	ReadAll      bool                 `json:"read_all,omitempty"`
+}
+
+// recordPos points to one record inside one segment.
+type recordPos struct {
+	segment int
+	offset  int64
+	size    uint32
+}
+
+type indexEntry struct {
+	pos         recordPos
+	id          string
+	broadcastID string
+	group       string
+	read        bool
+	receivedAt  time.Time
+}
+
+// indexEntrySize is roughly what one indexEntry costs in memory, used
+// for the retention memory budget.
+const indexEntrySize = 96
+
+type segment struct {
+	id   int
+	file *os.File
+	size int64
+}
+
+// DiskStore is an embedded append-only log.
+//
+// Notifications are appended to numbered segment files in dir. Every record
+// is framed as [length][crc32][json payload], so a torn write at the tail of
+// the last segment (crash mid-append) is detected and cut off on the next
+// start. The key index (user -> record positions) lives in memory and is
+// rebuilt by scanning the segments when the store is opened.
+type DiskStore struct {
+	dir  string
+	opts DiskOptions
+
+	mu       sync.RWMutex
+	segments map[int]*segment
+	active   *segment
+	index    *retainedIndex[*indexEntry]
+	byID     map[string]map[string]*indexEntry
+	// byBroadcast holds the broadcasts every user already got
+	byBroadcast map[string]map[string]*indexEntry
+	// live counts the kept notifications per segment
+	live   map[int]int
+	closed bool
+}
+
+func OpenDiskStore(dir string, opts DiskOptions) (*DiskStore, error) {
+	if opts.MaxSegmentBytes <= 0 {
+		opts.MaxSegmentBytes = DefaultMaxSegmentBytes
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory %s: %w", dir, err)
+	}
+
+	ds := &DiskStore{
+		dir:         dir,
+		opts:        opts,
+		segments:    make(map[int]*segment),
+		byID:        make(map[string]map[string]*indexEntry),
+		byBroadcast: make(map[string]map[string]*indexEntry),
+		live:        make(map[int]int),
+	}
+	ds.index = newRetainedIndex(opts.Retention, ds.evicted)
+
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		last := i == len(ids)-1
+		if err := ds.loadSegment(id, last); err != nil {
+			ds.closeFiles()
+			return nil, err
+		}
+	}
+
+	if ds.active == nil {
+		if err := ds.roll(); err != nil {
+			ds.closeFiles()
+			return nil, err
+		}
+	}
+
+	ds.dropSegments()
+	return ds, nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store directory %s: %w", dir, err)
+	}
+
+	var ids []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (ds *DiskStore) segmentPath(id int) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// loadSegment opens a segment and adds all of its records to the index.
+// Only the last segment can be repaired, older ones are sealed and must be intact.
+func (ds *DiskStore) loadSegment(id int, last bool) error {
+	file, err := os.OpenFile(ds.segmentPath(id), os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment %d: %w", id, err)
+	}
+
+	seg := &segment{id: id, file: file}
+	ds.segments[id] = seg
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, 1<<62))
+	var offset int64
+	for {
+		rec, size, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("segment %d at offset %d: %w", id, offset, err)
+			}
+			log.Printf("store: truncating segment %d at offset %d: %v\n", id, offset, err)
+			if err := file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate segment %d: %w", id, err)
+			}
+			break
+		}
+
+		ds.apply(rec, recordPos{segment: id, offset: offset, size: size})
+		offset += int64(recordHeaderSize + size)
+	}
+
+	seg.size = offset
+	if last {
+		ds.active = seg
+	}
+	return nil
+}
+
+func readRecord(r io.Reader) (diskRecord, uint32, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return diskRecord{}, 0, ErrCorruptRecord
+		}
+		return diskRecord{}, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > maxRecordBytes {
+		return diskRecord{}, 0, ErrCorruptRecord
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return diskRecord{}, 0, ErrCorruptRecord
+	}
+
+	rec, err := decodePayload(payload, sum)
+	return rec, size, err
+}
+
+func decodePayload(payload []byte, sum uint32) (diskRecord, error) {
+	if crc32.ChecksumIEEE(payload) != sum {
+		return diskRecord{}, ErrCorruptRecord
+	}
+
+	var rec diskRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return diskRecord{}, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	return rec, nil
+}
+
+// roll seals the active segment and starts a new one.
+func (ds *DiskStore) roll() error {
+	id := 0
+	if ds.active != nil {
+		if err := ds.active.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment %d: %w", ds.active.id, err)
+		}
+		id = ds.active.id + 1
+	}
+
+	file, err := os.OpenFile(ds.segmentPath(id), os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %d: %w", id, err)
+	}
+
+	seg := &segment{id: id, file: file}
+	ds.segments[id] = seg
+	ds.active = seg
+	return nil
+}
+
+// apply updates the key index with a record that is already on disk.
+func (ds *DiskStore) apply(rec diskRecord, pos recordPos) {
+	switch rec.Kind {
+	case kindNotification:
+		entry := &indexEntry{pos: pos}
+		if rec.Notification != nil {
+			entry.id = rec.Notification.ID
+			entry.broadcastID = rec.Notification.BroadcastID
+			entry.group = rec.Notification.Group
+			entry.receivedAt = rec.Notification.ReceivedAt
+		}
+		if entry.id != "" {
+			if ds.byID[rec.UserID] == nil {
+				ds.byID[rec.UserID] = make(map[string]*indexEntry)
+			}
+			ds.byID[rec.UserID][entry.id] = entry
+		}
+		if entry.broadcastID != "" {
+			if ds.byBroadcast[rec.UserID] == nil {
+				ds.byBroadcast[rec.UserID] = make(map[string]*indexEntry)
+			}
+			ds.byBroadcast[rec.UserID][entry.broadcastID] = entry
+		}
+		ds.live[pos.segment]++
+		ds.index.add(rec.UserID, entry, int64(indexEntrySize+len(entry.id)), entry.receivedAt)
+	case kindRead:
+		if rec.ReadAll {
+			ds.each(rec.UserID, 0, func(_ int, entry *indexEntry) bool {
+				entry.read = true
+				return true
+			})
+		}
+		for _, id := range rec.ReadIDs {
+			if entry, ok := ds.byID[rec.UserID][id]; ok {
+				entry.read = true
+			}
+		}
+	}
+}
+
+// evicted is called by the retention index for every dropped entry.
+func (ds *DiskStore) evicted(userID string, entry *indexEntry) {
+	if ds.byID[userID][entry.id] == entry {
+		delete(ds.byID[userID], entry.id)
+	}
+	if ds.byBroadcast[userID][entry.broadcastID] == entry {
+		delete(ds.byBroadcast[userID], entry.broadcastID)
+	}
+	ds.live[entry.pos.segment]--
+}
+
+// dropSegments deletes the oldest segments once retention dropped every
+// notification in them. Segments only go in order, so a "read" record is
+// never deleted while the notification it refers to is still kept.
+func (ds *DiskStore) dropSegments() {
+	for {
+		oldest := -1
+		for id := range ds.segments {
+			if oldest < 0 || id < oldest {
+				oldest = id
+			}
+		}
+		if oldest < 0 || oldest == ds.active.id || ds.live[oldest] > 0 {
+			return
+		}
+
+		seg := ds.segments[oldest]
+		if err := seg.file.Close(); err != nil {
+			log.Printf("store: failed to close segment %d: %v\n", oldest, err)
+		}
+		if err := os.Remove(ds.segmentPath(oldest)); err != nil {
+			log.Printf("store: failed to delete segment %d: %v\n", oldest, err)
+		}
+		delete(ds.segments, oldest)
+		delete(ds.live, oldest)
+	}
+}
+
+// each calls fn for every kept entry of the user, starting at sequence from.
+// The caller must hold ds.mu.
+func (ds *DiskStore) each(userID string, from int, fn func(seq int, entry *indexEntry) bool) {
+	r := ds.index.user(userID)
+	if r == nil {
+		return
+	}
+	for i := r.indexOf(from); i < r.len(); i++ {
+		item := r.at(i)
+		if ds.index.isExpired(item.receivedAt) {
+			continue
+		}
+		if !fn(r.first+i, item.value) {
+			return
+		}
+	}
+}
+
+// appendRecord writes rec to the active segment and indexes it.
+// The caller must hold ds.mu.
+func (ds *DiskStore) appendRecord(rec diskRecord) error {
+	if ds.closed {
+		return ErrStoreClosed
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	if len(payload) > maxRecordBytes {
+		return ErrRecordTooLarge
+	}
+
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	if ds.active.size > 0 && ds.active.size+int64(len(buf)) > ds.opts.MaxSegmentBytes {
+		if err := ds.roll(); err != nil {
+			return err
+		}
+	}
+
+	seg := ds.active
+	if _, err := seg.file.Write(buf); err != nil {
+		// cut off whatever part of the record made it to disk
+		_ = seg.file.Truncate(seg.size)
+		return fmt.Errorf("failed to append to segment %d: %w", seg.id, err)
+	}
+
+	if ds.opts.SyncWrites {
+		if err := seg.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment %d: %w", seg.id, err)
+		}
+	}
+
+	ds.apply(rec, recordPos{segment: seg.id, offset: seg.size, size: uint32(len(payload))})
+	seg.size += int64(len(buf))
+	return nil
+}
+
+func (ds *DiskStore) Add(userID string, notification models.Notification) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if id := notification.ID; id != "" && ds.byID[userID][id] != nil {
+		return ErrDuplicateNotification
+	}
+	if id := notification.BroadcastID; id != "" && ds.byBroadcast[userID][id] != nil {
+		return ErrDuplicateNotification
+	}
+
+	notification.Read = false
+	err := ds.appendRecord(diskRecord{
+		Kind:         kindNotification,
+		UserID:       userID,
+		Notification: &notification,
+	})
+	if err != nil {
+		return err
+	}
+
+	ds.dropSegments()
+	return nil
+}
+
+func (ds *DiskStore) Get(userID string) ([]models.Notification, error) {
+	return ds.get(userID, false)
+}
+
+func (ds *DiskStore) GetUnread(userID string) ([]models.Notification, error) {
+	return ds.get(userID, true)
+}
+
+func (ds *DiskStore) get(userID string, unreadOnly bool) ([]models.Notification, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	if ds.closed {
+		return nil, ErrStoreClosed
+	}
+
+	notes := []models.Notification{}
+	var err error
+	ds.each(userID, 0, func(_ int, entry *indexEntry) bool {
+		if unreadOnly && entry.read {
+			return true
+		}
+		var note models.Notification
+		if note, err = ds.readNotification(entry); err != nil {
+			return false
+		}
+		notes = append(notes, note)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (ds *DiskStore) List(userID string, opts ListOptions) (Page, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	if ds.closed {
+		return Page{}, ErrStoreClosed
+	}
+
+	page := Page{Notifications: []models.Notification{}, NextOffset: -1}
+	var err error
+	ds.each(userID, opts.Offset, func(seq int, entry *indexEntry) bool {
+		// the index knows timestamp and group, so filtered out entries are never read from disk
+		if !opts.matches(entry.receivedAt, entry.group) {
+			return true
+		}
+		if opts.Limit > 0 && len(page.Notifications) == opts.Limit {
+			page.NextOffset = seq
+			return false
+		}
+		var note models.Notification
+		if note, err = ds.readNotification(entry); err != nil {
+			return false
+		}
+		page.Notifications = append(page.Notifications, note)
+		return true
+	})
+	if err != nil {
+		return Page{}, err
+	}
+	return page, nil
+}
+
+func (ds *DiskStore) readNotification(entry *indexEntry) (models.Notification, error) {
+	rec, err := ds.readAt(entry.pos)
+	if err != nil {
+		return models.Notification{}, err
+	}
+	if rec.Notification == nil {
+		return models.Notification{}, fmt.Errorf("%w: segment %d at offset %d is not a notification", ErrCorruptRecord, entry.pos.segment, entry.pos.offset)
+	}
+	note := *rec.Notification
+	note.Read = entry.read
+	return note, nil
+}
+
+func (ds *DiskStore) MarkRead(userID string, ids []string) (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	var unread []string
+	// an id may be repeated, it is read once
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		entry := ds.byID[userID][id]
+		if entry == nil || ds.index.isExpired(entry.receivedAt) {
+			return 0, fmt.Errorf("%w: %s", ErrNotificationNotFound, id)
+		}
+		if !entry.read && !seen[id] {
+			unread = append(unread, id)
+		}
+		seen[id] = true
+	}
+
+	if len(unread) == 0 {
+		return 0, nil
+	}
+
+	err := ds.appendRecord(diskRecord{Kind: kindRead, UserID: userID, ReadIDs: unread})
+	if err != nil {
+		return 0, err
+	}
+	return len(unread), nil
+}
+
+func (ds *DiskStore) MarkAllRead(userID string) (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	count := 0
+	ds.each(userID, 0, func(_ int, entry *indexEntry) bool {
+		if !entry.read {
+			count++
+		}
+		return true
+	})
+	if count == 0 {
+		return 0, nil
+	}
+
+	if err := ds.appendRecord(diskRecord{Kind: kindRead, UserID: userID, ReadAll: true}); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (ds *DiskStore) readAt(pos recordPos) (diskRecord, error) {
+	seg, ok := ds.segments[pos.segment]
+	if !ok {
+		return diskRecord{}, fmt.Errorf("segment %d not found", pos.segment)
+	}
+
+	buf := make([]byte, recordHeaderSize+int(pos.size))
+	if _, err := seg.file.ReadAt(buf, pos.offset); err != nil {
+		return diskRecord{}, fmt.Errorf("failed to read segment %d at offset %d: %w", pos.segment, pos.offset, err)
+	}
+
+	return decodePayload(buf[recordHeaderSize:], binary.BigEndian.Uint32(buf[4:8]))
+}
+
+func (ds *DiskStore) Stats() Stats {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.index.stats()
+}
+
+// Sync flushes the active segment, older ones were synced when rolled.
+func (ds *DiskStore) Sync() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return ErrStoreClosed
+	}
+	if err := ds.active.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment %d: %w", ds.active.id, err)
+	}
+	return nil
+}
+
+func (ds *DiskStore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return nil
+	}
+	ds.closed = true
+
+	var errs []error
+	if ds.active != nil {
+		errs = append(errs, ds.active.file.Sync())
+	}
+	errs = append(errs, ds.closeFiles())
+	return errors.Join(errs...)
+}
+
+func (ds *DiskStore) closeFiles() error {
+	var errs []error
+	for _, seg := range ds.segments {
+		errs = append(errs, seg.file.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,227 @@
+package store
+
+import (
+	"consumer/pkg/models"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"schema"
+	"slices"
+	"testing"
+)
+
+func notification(message string) models.Notification {
+	return models.Notification{Notification: schema.Notification{Message: message}}
+}
+
+func messages(notifications []models.Notification) []string {
+	out := []string{}
+	for _, n := range notifications {
+		out = append(out, n.Message)
+	}
+	return out
+}
+
+func openDisk(t *testing.T, dir string, opts DiskOptions) *DiskStore {
+	t.Helper()
+	ds, err := OpenDiskStore(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	return ds
+}
+
+func TestDiskStoreReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		opts DiskOptions
+		// adds are the messages per user, in order
+		adds         map[string][]string
+		wantSegments int
+	}{
+		{
+			name:         "one segment",
+			adds:         map[string][]string{"1": {"a", "b", "c"}, "2": {"d"}},
+			wantSegments: 1,
+		},
+		{
+			name:         "several segments",
+			opts:         DiskOptions{MaxSegmentBytes: 150},
+			adds:         map[string][]string{"1": {"a", "b", "c", "d", "e"}, "2": {"f", "g"}},
+			wantSegments: 7,
+		},
+		{
+			name:         "synced writes",
+			opts:         DiskOptions{SyncWrites: true},
+			adds:         map[string][]string{"1": {"a"}},
+			wantSegments: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ds := openDisk(t, dir, tt.opts)
+			for userID, added := range tt.adds {
+				for _, message := range added {
+					if err := ds.Add(userID, notification(message)); err != nil {
+						t.Fatalf("Add(%s, %s): %v", userID, message, err)
+					}
+				}
+			}
+			if err := ds.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+			if len(segments) != tt.wantSegments {
+				t.Errorf("%d segments, want %d", len(segments), tt.wantSegments)
+			}
+
+			ds = openDisk(t, dir, tt.opts)
+			defer ds.Close()
+			for userID, want := range tt.adds {
+				got, err := ds.Get(userID)
+				if err != nil {
+					t.Fatalf("Get(%s): %v", userID, err)
+				}
+				if !slices.Equal(messages(got), want) {
+					t.Errorf("Get(%s) = %v, want %v", userID, messages(got), want)
+				}
+			}
+			if got, _ := ds.Get("nobody"); len(got) != 0 {
+				t.Errorf("Get of an unknown user = %v, want nothing", got)
+			}
+		})
+	}
+}
+
+// appendToLastSegment writes raw bytes at the end of the newest segment, as
+// a crash in the middle of a write leaves them.
+func appendToLastSegment(t *testing.T, dir string, data []byte) (string, int64) {
+	t.Helper()
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("segments = %v, %v", segments, err)
+	}
+	last := segments[len(segments)-1]
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return last, info.Size()
+}
+
+func TestDiskStoreTruncatesCorruptTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{name: "torn header", tail: []byte{0, 0, 1}},
+		{name: "torn payload", tail: []byte{0, 0, 1, 0, 1, 2, 3, 4, '{'}},
+		{name: "bad checksum", tail: append([]byte{0, 0, 0, 2, 0, 0, 0, 0}, "{}"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ds := openDisk(t, dir, DiskOptions{})
+			for _, message := range []string{"a", "b"} {
+				if err := ds.Add("1", notification(message)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ds.Close(); err != nil {
+				t.Fatal(err)
+			}
+			segment, size := appendToLastSegment(t, dir, tt.tail)
+
+			ds = openDisk(t, dir, DiskOptions{})
+			got, err := ds.Get("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(messages(got), []string{"a", "b"}) {
+				t.Errorf("Get = %v, want [a b]", messages(got))
+			}
+			info, err := os.Stat(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != size {
+				t.Errorf("segment size = %d, want it truncated to %d", info.Size(), size)
+			}
+
+			// writes go on after the repaired tail
+			if err := ds.Add("1", notification("c")); err != nil {
+				t.Fatal(err)
+			}
+			ds.Close()
+			ds = openDisk(t, dir, DiskOptions{})
+			defer ds.Close()
+			got, _ = ds.Get("1")
+			if !slices.Equal(messages(got), []string{"a", "b", "c"}) {
+				t.Errorf("Get after reopening = %v, want [a b c]", messages(got))
+			}
+		})
+	}
+}
+
+func TestDiskStoreRefusesCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDisk(t, dir, DiskOptions{MaxSegmentBytes: 100})
+	for i := 0; i < 3; i++ {
+		if err := ds.Add("1", notification(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds.Close()
+
+	// only the last segment may have a torn tail, an older one is damage
+	first := filepath.Join(dir, fmt.Sprintf("%020d%s", 0, segmentSuffix))
+	if err := os.WriteFile(first, []byte{0, 0, 1}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDiskStore(dir, DiskOptions{}); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("OpenDiskStore = %v, want ErrCorruptRecord", err)
+	}
+}
+
+func TestDiskStoreClosed(t *testing.T) {
+	ds := openDisk(t, t.TempDir(), DiskOptions{})
+	if err := ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Add("1", notification("a")); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Add after Close = %v, want ErrStoreClosed", err)
+	}
+	if _, err := ds.Get("1"); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Get after Close = %v, want ErrStoreClosed", err)
+	}
+	if err := ds.Sync(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Sync after Close = %v, want ErrStoreClosed", err)
+	}
+	if err := ds.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
+
+func TestDiskStoreReplaysIDs(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDisk(t, dir, DiskOptions{})
+	addAll(t, ds, "1", "a")
+	ds.Close()
+
+	ds = openDisk(t, dir, DiskOptions{})
+	defer ds.Close()
+	if err := ds.Add("1", models.Notification{ID: "a"}); !errors.Is(err, ErrDuplicateNotification) {
+		t.Errorf("Add of an id from before the restart = %v, want ErrDuplicateNotification", err)
+	}
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"consumer/pkg/models"
+	"fmt"
+	"sync"
+)
+
+// notificationOverhead roughly covers the fixed part of a stored notification
+// (ints, timestamp, slice and string headers) for the memory budget.
+const notificationOverhead = 160
+
+// MemoryStore keeps every user's notifications in a ring buffer, bounded by
+// the configured Retention. Everything is lost on restart.
+type MemoryStore struct {
+	data *retainedIndex[models.Notification]
+	// ids and broadcasts hold the notification and broadcast ids every user already got
+	ids        map[string]map[string]bool
+	broadcasts map[string]map[string]bool
+	mu         sync.RWMutex
+}
+
+func NewMemoryStore(retention Retention) *MemoryStore {
+	ms := &MemoryStore{
+		ids:        make(map[string]map[string]bool),
+		broadcasts: make(map[string]map[string]bool),
+	}
+	ms.data = newRetainedIndex(retention, ms.evicted)
+	return ms
+}
+
+func (ms *MemoryStore) evicted(userID string, notification models.Notification) {
+	delete(ms.ids[userID], notification.ID)
+	if notification.BroadcastID != "" {
+		delete(ms.broadcasts[userID], notification.BroadcastID)
+	}
+}
+
+func notificationSize(notification models.Notification) int64 {
+	size := notificationOverhead + len(notification.ID) + len(notification.Message) +
+		len(notification.From.Name) + len(notification.To.Name)
+	if content := notification.Content; content != nil {
+		size += len(content.Title) + len(content.Body) + len(content.ActionURL)
+		for name, value := range content.Variables {
+			size += len(name) + len(value)
+		}
+	}
+	return int64(size)
+}
+
+func (ms *MemoryStore) Add(userID string, notification models.Notification) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.ids[userID][notification.ID] || ms.broadcasts[userID][notification.BroadcastID] {
+		return ErrDuplicateNotification
+	}
+	markSeen(ms.ids, userID, notification.ID)
+	markSeen(ms.broadcasts, userID, notification.BroadcastID)
+
+	notification.Read = false
+	ms.data.add(userID, notification, notificationSize(notification), notification.ReceivedAt)
+	return nil
+}
+
+func markSeen(seen map[string]map[string]bool, userID, id string) {
+	if id == "" {
+		return
+	}
+	if seen[userID] == nil {
+		seen[userID] = make(map[string]bool)
+	}
+	seen[userID][id] = true
+}
+
+// each calls fn for every notification of the user still within retention.
+// The caller must hold ms.mu.
+func (ms *MemoryStore) each(userID string, from int, fn func(seq int, notification *models.Notification) bool) {
+	r := ms.data.user(userID)
+	if r == nil {
+		return
+	}
+	for i := r.indexOf(from); i < r.len(); i++ {
+		item := r.at(i)
+		if ms.data.isExpired(item.receivedAt) {
+			continue
+		}
+		if !fn(r.first+i, &item.value) {
+			return
+		}
+	}
+}
+
+func (ms *MemoryStore) Get(userID string) ([]models.Notification, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// hand out copies so callers never race with Add
+	notes := []models.Notification{}
+	ms.each(userID, 0, func(_ int, note *models.Notification) bool {
+		notes = append(notes, *note)
+		return true
+	})
+	return notes, nil
+}
+
+func (ms *MemoryStore) GetUnread(userID string) ([]models.Notification, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	notes := []models.Notification{}
+	ms.each(userID, 0, func(_ int, note *models.Notification) bool {
+		if !note.Read {
+			notes = append(notes, *note)
+		}
+		return true
+	})
+	return notes, nil
+}
+
+func (ms *MemoryStore) List(userID string, opts ListOptions) (Page, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	page := Page{Notifications: []models.Notification{}, NextOffset: -1}
+	ms.each(userID, opts.Offset, func(seq int, note *models.Notification) bool {
+		if !opts.matches(note.ReceivedAt, note.Group) {
+			return true
+		}
+		if opts.Limit > 0 && len(page.Notifications) == opts.Limit {
+			page.NextOffset = seq
+			return false
+		}
+		page.Notifications = append(page.Notifications, *note)
+		return true
+	})
+	return page, nil
+}
+
+func (ms *MemoryStore) MarkRead(userID string, ids []string) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	notes := make([]*models.Notification, 0, len(ids))
+	for _, id := range ids {
+		var found *models.Notification
+		ms.each(userID, 0, func(_ int, note *models.Notification) bool {
+			if note.ID == id {
+				found = note
+				return false
+			}
+			return true
+		})
+		if found == nil {
+			return 0, fmt.Errorf("%w: %s", ErrNotificationNotFound, id)
+		}
+		notes = append(notes, found)
+	}
+
+	count := 0
+	for _, note := range notes {
+		if !note.Read {
+			note.Read = true
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemoryStore) MarkAllRead(userID string) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	count := 0
+	ms.each(userID, 0, func(_ int, note *models.Notification) bool {
+		if !note.Read {
+			note.Read = true
+			count++
+		}
+		return true
+	})
+	return count, nil
+}
+
+func (ms *MemoryStore) Stats() Stats {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.data.stats()
+}
+
+// Sync has nothing to flush, everything is lost on restart anyway.
+func (ms *MemoryStore) Sync() error {
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
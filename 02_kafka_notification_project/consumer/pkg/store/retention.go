@@ -0,0 +1,254 @@
+package store
+
+import "time"
+
+type EvictionPolicy string
+
+const (
+	// EvictOldest drops the oldest notification across all users.
+	EvictOldest EvictionPolicy = "oldest"
+	// EvictLargestUser drops the oldest notification of the user holding the most,
+	// on a tie the user with the oldest notification, then the lowest user ID.
+	EvictLargestUser EvictionPolicy = "largest-user"
+)
+
+type EvictionReason string
+
+const (
+	EvictedPerUserCap   EvictionReason = "per_user_cap"
+	EvictedMaxAge       EvictionReason = "max_age"
+	EvictedMemoryBudget EvictionReason = "memory_budget"
+)
+
+// Retention bounds what a store keeps. Zero values mean unlimited.
+type Retention struct {
+	MaxPerUser int
+	MaxAge     time.Duration
+	// MaxBytes is the global memory budget, measured with an estimate of
+	// the size of every kept notification.
+	MaxBytes int64
+	Policy   EvictionPolicy
+}
+
+// Stats is a snapshot of what a store holds and what retention dropped.
+type Stats struct {
+	Users         int                       `json:"users"`
+	Notifications int                       `json:"notifications"`
+	Bytes         int64                     `json:"bytes"`
+	Evicted       map[EvictionReason]uint64 `json:"evicted"`
+	// UserSizes holds how many notifications every user has, in no particular order
+	UserSizes []int `json:"-"`
+}
+
+type retained[T any] struct {
+	value      T
+	size       int64
+	receivedAt time.Time
+}
+
+// entryRef points into a user's ring. It goes stale once the user's ring
+// popped past seq.
+type entryRef struct {
+	userID string
+	seq    int
+}
+
+// retainedIndex is the per-user history both stores keep in memory (the
+// notifications themselves or just their positions on disk), with the
+// retention rules applied on every add.
+type retainedIndex[T any] struct {
+	retention Retention
+	users     map[string]*ring[retained[T]]
+	// order is the global arrival order, needed for max age and the oldest policy
+	order ring[entryRef]
+	// pushed counts every add, a user's ring created again starts its
+	// sequence numbers there so the refs and cursors of the old one stay stale
+	pushed  int
+	count   int
+	bytes   int64
+	evicted map[EvictionReason]uint64
+	onEvict func(userID string, value T)
+	now     func() time.Time
+}
+
+func newRetainedIndex[T any](retention Retention, onEvict func(userID string, value T)) *retainedIndex[T] {
+	if retention.Policy == "" {
+		retention.Policy = EvictOldest
+	}
+	return &retainedIndex[T]{
+		retention: retention,
+		users:     make(map[string]*ring[retained[T]]),
+		evicted:   make(map[EvictionReason]uint64),
+		onEvict:   onEvict,
+		now:       time.Now,
+	}
+}
+
+func (ri *retainedIndex[T]) user(userID string) *ring[retained[T]] {
+	return ri.users[userID]
+}
+
+func (ri *retainedIndex[T]) tracksOrder() bool {
+	return ri.retention.MaxAge > 0 || (ri.retention.MaxBytes > 0 && ri.retention.Policy == EvictOldest)
+}
+
+func (ri *retainedIndex[T]) add(userID string, value T, size int64, receivedAt time.Time) {
+	r := ri.users[userID]
+	if r == nil {
+		r = &ring[retained[T]]{first: ri.pushed}
+		ri.users[userID] = r
+	}
+	ri.pushed++
+
+	if ri.tracksOrder() {
+		ri.order.push(entryRef{userID: userID, seq: r.next()})
+	}
+	r.push(retained[T]{value: value, size: size, receivedAt: receivedAt})
+	ri.count++
+	ri.bytes += size
+
+	if ri.retention.MaxPerUser > 0 {
+		for r.len() > ri.retention.MaxPerUser {
+			ri.evictFront(userID, EvictedPerUserCap)
+		}
+	}
+
+	ri.expire()
+
+	if ri.retention.MaxBytes > 0 {
+		for ri.bytes > ri.retention.MaxBytes {
+			if !ri.evictForBudget() {
+				break
+			}
+		}
+	}
+
+	ri.compactOrder()
+}
+
+// expire drops notifications older than MaxAge. It walks the global arrival
+// order, so it stops at the first notification still within MaxAge even if a
+// later one (with an older Kafka timestamp) has expired; readers filter
+// those out with isExpired.
+func (ri *retainedIndex[T]) expire() {
+	if ri.retention.MaxAge <= 0 {
+		return
+	}
+
+	cutoff := ri.now().Add(-ri.retention.MaxAge)
+	for ri.order.len() > 0 {
+		ref := ri.order.front()
+		if !ri.live(ref) {
+			ri.order.popFront()
+			continue
+		}
+		if !ri.users[ref.userID].at(0).receivedAt.Before(cutoff) {
+			return
+		}
+		ri.order.popFront()
+		ri.evictFront(ref.userID, EvictedMaxAge)
+	}
+}
+
+func (ri *retainedIndex[T]) isExpired(receivedAt time.Time) bool {
+	return ri.retention.MaxAge > 0 && receivedAt.Before(ri.now().Add(-ri.retention.MaxAge))
+}
+
+func (ri *retainedIndex[T]) evictForBudget() bool {
+	if ri.count == 0 {
+		return false
+	}
+
+	if ri.retention.Policy == EvictLargestUser {
+		// O(users), but we only get here when the budget is exceeded. Among
+		// users as large, the one with the oldest notification goes first,
+		// then the lowest user ID: map order must not pick who loses history.
+		var largest string
+		for userID, r := range ri.users {
+			if largest == "" || ri.evictsBefore(userID, r, largest, ri.users[largest]) {
+				largest = userID
+			}
+		}
+		ri.evictFront(largest, EvictedMemoryBudget)
+		return true
+	}
+
+	for ri.order.len() > 0 {
+		ref := ri.order.popFront()
+		if ri.live(ref) {
+			ri.evictFront(ref.userID, EvictedMemoryBudget)
+			return true
+		}
+	}
+	return false
+}
+
+// evictsBefore tells whether user a is evicted before user b under the
+// largest user policy.
+func (ri *retainedIndex[T]) evictsBefore(a string, ra *ring[retained[T]], b string, rb *ring[retained[T]]) bool {
+	if ra.len() != rb.len() {
+		return ra.len() > rb.len()
+	}
+	oldestA, oldestB := ra.at(0).receivedAt, rb.at(0).receivedAt
+	if !oldestA.Equal(oldestB) {
+		return oldestA.Before(oldestB)
+	}
+	return a < b
+}
+
+// live tells whether ref still points to a kept notification.
+func (ri *retainedIndex[T]) live(ref entryRef) bool {
+	r := ri.users[ref.userID]
+	return r != nil && ref.seq >= r.first
+}
+
+// evictFront drops the oldest notification of the user, and the user once
+// they have none left.
+func (ri *retainedIndex[T]) evictFront(userID string, reason EvictionReason) {
+	r := ri.users[userID]
+	item := r.popFront()
+	if r.len() == 0 {
+		delete(ri.users, userID)
+	}
+	ri.count--
+	ri.bytes -= item.size
+	ri.evicted[reason]++
+	if ri.onEvict != nil {
+		ri.onEvict(userID, item.value)
+	}
+}
+
+// compactOrder drops stale refs (left behind by per-user evictions) once
+// they make up half of the order ring, keeping it bounded.
+func (ri *retainedIndex[T]) compactOrder() {
+	if ri.order.len() <= 2*ri.count+8 {
+		return
+	}
+
+	var order ring[entryRef]
+	for ri.order.len() > 0 {
+		ref := ri.order.popFront()
+		if ri.live(ref) {
+			order.push(ref)
+		}
+	}
+	ri.order = order
+}
+
+func (ri *retainedIndex[T]) stats() Stats {
+	evicted := make(map[EvictionReason]uint64, len(ri.evicted))
+	for reason, n := range ri.evicted {
+		evicted[reason] = n
+	}
+	sizes := make([]int, 0, len(ri.users))
+	for _, r := range ri.users {
+		sizes = append(sizes, r.len())
+	}
+	return Stats{
+		Users:         len(ri.users),
+		Notifications: ri.count,
+		Bytes:         ri.bytes,
+		Evicted:       evicted,
+		UserSizes:     sizes,
+	}
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"consumer/pkg/models"
+	"maps"
+	"schema"
+	"slices"
+	"testing"
+	"time"
+)
+
+// add is one notification for the retention index, age is how long before
+// the clock it was received.
+type add struct {
+	user string
+	size int64
+	age  time.Duration
+}
+
+func TestRetainedIndexEviction(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention Retention
+		adds      []add
+		// want are the values kept per user, the value of an add is its index
+		want        map[string][]int
+		wantEvicted map[EvictionReason]uint64
+	}{
+		{
+			name: "unlimited",
+			adds: []add{{user: "a", size: 1}, {user: "b", size: 1}, {user: "a", size: 1}},
+			want: map[string][]int{"a": {0, 2}, "b": {1}},
+		},
+		{
+			name:        "per user cap drops the oldest of the user",
+			retention:   Retention{MaxPerUser: 2},
+			adds:        []add{{user: "a"}, {user: "a"}, {user: "b"}, {user: "a"}},
+			want:        map[string][]int{"a": {1, 3}, "b": {2}},
+			wantEvicted: map[EvictionReason]uint64{EvictedPerUserCap: 1},
+		},
+		{
+			name:      "max age",
+			retention: Retention{MaxAge: time.Hour},
+			adds: []add{
+				{user: "a", age: 2 * time.Hour}, {user: "b", age: 90 * time.Minute},
+				{user: "a", age: time.Minute}, {user: "b", age: time.Minute},
+			},
+			want:        map[string][]int{"a": {2}, "b": {3}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMaxAge: 2},
+		},
+		{
+			name:      "a user with nothing left is forgotten",
+			retention: Retention{MaxAge: time.Hour},
+			// a comes back after their history expired
+			adds:        []add{{user: "a", age: 2 * time.Hour}, {user: "b"}, {user: "a"}},
+			want:        map[string][]int{"a": {2}, "b": {1}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMaxAge: 1},
+		},
+		{
+			name:        "memory budget evicts a user out and back in",
+			retention:   Retention{MaxBytes: 20, Policy: EvictOldest},
+			adds:        []add{{user: "a", size: 10}, {user: "b", size: 10}, {user: "c", size: 10}, {user: "a", size: 10}},
+			want:        map[string][]int{"a": {3}, "c": {2}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMemoryBudget: 2},
+		},
+		{
+			name:        "memory budget, oldest first",
+			retention:   Retention{MaxBytes: 30, Policy: EvictOldest},
+			adds:        []add{{user: "a", size: 10}, {user: "b", size: 10}, {user: "a", size: 10}, {user: "b", size: 10}},
+			want:        map[string][]int{"a": {2}, "b": {1, 3}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMemoryBudget: 1},
+		},
+		{
+			name:        "memory budget, largest user first",
+			retention:   Retention{MaxBytes: 30, Policy: EvictLargestUser},
+			adds:        []add{{user: "a", size: 10}, {user: "a", size: 10}, {user: "a", size: 10}, {user: "b", size: 10}},
+			want:        map[string][]int{"a": {1, 2}, "b": {3}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMemoryBudget: 1},
+		},
+		{
+			name:      "memory budget, largest user ties go to the oldest notification",
+			retention: Retention{MaxBytes: 30, Policy: EvictLargestUser},
+			adds: []add{
+				{user: "a", size: 10, age: time.Minute}, {user: "b", size: 10, age: 2 * time.Minute},
+				{user: "c", size: 10, age: 3 * time.Minute}, {user: "d", size: 10},
+			},
+			want:        map[string][]int{"a": {0}, "b": {1}, "d": {3}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMemoryBudget: 1},
+		},
+		{
+			name:        "memory budget, largest user ties at the same time go to the lowest user id",
+			retention:   Retention{MaxBytes: 30, Policy: EvictLargestUser},
+			adds:        []add{{user: "c", size: 10}, {user: "b", size: 10}, {user: "a", size: 10}, {user: "d", size: 10}},
+			want:        map[string][]int{"b": {1}, "c": {0}, "d": {3}},
+			wantEvicted: map[EvictionReason]uint64{EvictedMemoryBudget: 1},
+		},
+		{
+			name:      "all rules together",
+			retention: Retention{MaxPerUser: 2, MaxAge: time.Hour, MaxBytes: 50},
+			adds: []add{
+				{user: "a", size: 10, age: 2 * time.Hour}, {user: "a", size: 10}, {user: "a", size: 10}, {user: "a", size: 10},
+				{user: "b", size: 10}, {user: "b", size: 10}, {user: "c", size: 20},
+			},
+			want: map[string][]int{"a": {3}, "b": {4, 5}, "c": {6}},
+			wantEvicted: map[EvictionReason]uint64{
+				EvictedMaxAge: 1, EvictedPerUserCap: 1, EvictedMemoryBudget: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+			evicted := make(map[string][]int)
+			ri := newRetainedIndex(tt.retention, func(userID string, value int) {
+				evicted[userID] = append(evicted[userID], value)
+			})
+			ri.now = func() time.Time { return now }
+
+			for i, a := range tt.adds {
+				ri.add(a.user, i, a.size, now.Add(-a.age))
+			}
+
+			got := make(map[string][]int)
+			count := 0
+			for userID, r := range ri.users {
+				for i := 0; i < r.len(); i++ {
+					got[userID] = append(got[userID], r.at(i).value)
+				}
+				count += r.len()
+			}
+			if !maps.EqualFunc(got, tt.want, slices.Equal[[]int]) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+
+			stats := ri.stats()
+			if stats.Users != len(tt.want) {
+				t.Errorf("Stats.Users = %d, want %d", stats.Users, len(tt.want))
+			}
+			if stats.Notifications != count {
+				t.Errorf("Stats.Notifications = %d, want %d", stats.Notifications, count)
+			}
+			wantEvicted := tt.wantEvicted
+			if wantEvicted == nil {
+				wantEvicted = map[EvictionReason]uint64{}
+			}
+			if !maps.Equal(stats.Evicted, wantEvicted) {
+				t.Errorf("Stats.Evicted = %v, want %v", stats.Evicted, wantEvicted)
+			}
+			total := 0
+			for _, values := range evicted {
+				total += len(values)
+			}
+			if total+count != len(tt.adds) {
+				t.Errorf("%d evicted + %d kept, want %d added", total, count, len(tt.adds))
+			}
+		})
+	}
+}
+
+func TestNotificationSizeCountsContent(t *testing.T) {
+	plain := models.Notification{ID: "n1", Notification: schema.Notification{Message: "hi"}}
+	structured := plain
+	structured.Content = &schema.Content{
+		Template:  "mention",
+		Variables: map[string]string{"url": "/posts/7"},
+		Title:     "Emma mentioned you",
+		Body:      "see you",
+	}
+	want := notificationSize(plain) + int64(len("url")+len("/posts/7")+len("Emma mentioned you")+len("see you"))
+	if got := notificationSize(structured); got != want {
+		t.Errorf("notificationSize = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+// ring is a growable FIFO ring buffer. Pushing and popping are O(1)
+// (amortized when the buffer has to grow).
+//
+// Every element gets an absolute sequence number when pushed, which stays
+// valid after older elements are popped. Cursors are built on top of it.
+type ring[T any] struct {
+	buf   []T
+	head  int
+	size  int
+	first int // sequence number of the element at head
+}
+
+func (r *ring[T]) len() int {
+	return r.size
+}
+
+// next is the sequence number the next pushed element gets.
+func (r *ring[T]) next() int {
+	return r.first + r.size
+}
+
+func (r *ring[T]) push(v T) {
+	if r.size == len(r.buf) {
+		r.grow()
+	}
+	r.buf[(r.head+r.size)%len(r.buf)] = v
+	r.size++
+}
+
+func (r *ring[T]) grow() {
+	capacity := max(2*len(r.buf), 8)
+	buf := make([]T, capacity)
+	for i := 0; i < r.size; i++ {
+		buf[i] = r.buf[(r.head+i)%len(r.buf)]
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+func (r *ring[T]) front() T {
+	return r.buf[r.head]
+}
+
+func (r *ring[T]) popFront() T {
+	var zero T
+	v := r.buf[r.head]
+	r.buf[r.head] = zero // let the GC have it
+	r.head = (r.head + 1) % len(r.buf)
+	r.size--
+	r.first++
+	return v
+}
+
+// at returns a pointer to the i-th element counted from the oldest one.
+func (r *ring[T]) at(i int) *T {
+	return &r.buf[(r.head+i)%len(r.buf)]
+}
+
+// indexOf maps a sequence number to a position for at, clamped to the
+// oldest element still in the ring.
+func (r *ring[T]) indexOf(seq int) int {
+	return max(seq-r.first, 0)
+}
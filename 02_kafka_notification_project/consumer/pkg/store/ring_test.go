@@ -0,0 +1,93 @@
+package store
+
+import "testing"
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		name   string
+		pushes int
+		pops   int
+		// wantFirst is the sequence number of the oldest element left
+		wantFirst int
+		wantLen   int
+	}{
+		{name: "empty", wantFirst: 0, wantLen: 0},
+		{name: "push only", pushes: 5, wantFirst: 0, wantLen: 5},
+		{name: "grows past the initial capacity", pushes: 20, wantFirst: 0, wantLen: 20},
+		{name: "pops keep the sequence numbers", pushes: 10, pops: 4, wantFirst: 4, wantLen: 6},
+		{name: "pop everything", pushes: 3, pops: 3, wantFirst: 3, wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r ring[int]
+			for i := 0; i < tt.pushes; i++ {
+				if r.next() != i {
+					t.Fatalf("next() = %d before push %d", r.next(), i)
+				}
+				r.push(i)
+			}
+			for i := 0; i < tt.pops; i++ {
+				if got := r.popFront(); got != i {
+					t.Fatalf("popFront() = %d, want %d", got, i)
+				}
+			}
+			if r.first != tt.wantFirst || r.len() != tt.wantLen {
+				t.Fatalf("first, len = %d, %d, want %d, %d", r.first, r.len(), tt.wantFirst, tt.wantLen)
+			}
+			// the values are their own sequence numbers
+			for i := 0; i < r.len(); i++ {
+				if got := *r.at(i); got != r.first+i {
+					t.Errorf("at(%d) = %d, want %d", i, got, r.first+i)
+				}
+			}
+		})
+	}
+}
+
+func TestRingWrapsAround(t *testing.T) {
+	var r ring[int]
+	// popping and pushing in turns moves head around the buffer, then grow
+	// has to unwrap it
+	next := 0
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 6; i++ {
+			r.push(next)
+			next++
+		}
+		for i := 0; i < 4; i++ {
+			r.popFront()
+		}
+	}
+	if r.len() != 10 || r.first != 20 {
+		t.Fatalf("len, first = %d, %d, want 10, 20", r.len(), r.first)
+	}
+	for i := 0; i < r.len(); i++ {
+		if got := *r.at(i); got != 20+i {
+			t.Errorf("at(%d) = %d, want %d", i, got, 20+i)
+		}
+	}
+}
+
+func TestRingIndexOf(t *testing.T) {
+	var r ring[int]
+	for i := 0; i < 10; i++ {
+		r.push(i)
+	}
+	for i := 0; i < 4; i++ {
+		r.popFront()
+	}
+	tests := []struct {
+		seq  int
+		want int
+	}{
+		{seq: 0, want: 0}, // popped already, clamped to the oldest
+		{seq: 4, want: 0},
+		{seq: 7, want: 3},
+		{seq: 10, want: 6}, // one past the newest
+	}
+	for _, tt := range tests {
+		if got := r.indexOf(tt.seq); got != tt.want {
+			t.Errorf("indexOf(%d) = %d, want %d", tt.seq, got, tt.want)
+		}
+	}
+}
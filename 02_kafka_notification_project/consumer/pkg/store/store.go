@@ -0,0 +1,71 @@
+package store
+
+import (
+	"consumer/pkg/models"
+	"errors"
+	"time"
+)
+
+var (
+	ErrStoreClosed          = errors.New("notification store is closed")
+	ErrNotificationNotFound = errors.New("notification not found")
+	// ErrDuplicateNotification is returned by Add for a notification or a
+	// broadcast the user already got.
+	ErrDuplicateNotification = errors.New("duplicate notification")
+)
+
+// ListOptions selects one page of a user's notifications.
+type ListOptions struct {
+	// Offset is the position in the user's history to start from.
+	Offset int
+	// Limit caps the page size, 0 means no limit.
+	Limit int
+	// Since and Until filter on ReceivedAt, zero values are open bounds.
+	Since time.Time
+	Until time.Time
+	// Group only keeps broadcasts sent to that group.
+	Group string
+}
+
+func (opts ListOptions) matches(receivedAt time.Time, group string) bool {
+	if !opts.Since.IsZero() && receivedAt.Before(opts.Since) {
+		return false
+	}
+	if !opts.Until.IsZero() && !receivedAt.Before(opts.Until) {
+		return false
+	}
+	if opts.Group != "" && group != opts.Group {
+		return false
+	}
+	return true
+}
+
+// Page is one slice of a user's notifications. NextOffset is -1 on the last page.
+type Page struct {
+	Notifications []models.Notification
+	NextOffset    int
+}
+
+// NotificationStore keeps the notifications received for every user.
+// The consumer only talks to this interface, so the backing storage
+// (memory, disk, ...) can be swapped without touching the handlers.
+type NotificationStore interface {
+	// Add is idempotent: a notification ID the user already has (the
+	// consumer uses topic-partition-offset, so a redelivered message) or a
+	// broadcast the user already got fails with ErrDuplicateNotification.
+	Add(userID string, notification models.Notification) error
+	Get(userID string) ([]models.Notification, error)
+	GetUnread(userID string) ([]models.Notification, error)
+	List(userID string, opts ListOptions) (Page, error)
+
+	// MarkRead marks the given notifications as read and returns how many
+	// were unread before. Nothing is marked if one of the ids is unknown.
+	MarkRead(userID string, ids []string) (int, error)
+	MarkAllRead(userID string) (int, error)
+
+	Stats() Stats
+
+	// Sync makes every Add so far durable, offsets are only committed after it.
+	Sync() error
+	Close() error
+}
@@ -0,0 +1,425 @@
+package store
+
+import (
+	"consumer/pkg/models"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"schema"
+	"slices"
+	"testing"
+	"time"
+)
+
+// backends runs fn against every store implementation.
+func backends(t *testing.T, fn func(t *testing.T, s NotificationStore)) {
+	retainedBackends(t, Retention{}, fn)
+}
+
+func retainedBackends(t *testing.T, retention Retention, fn func(t *testing.T, s NotificationStore)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore(retention))
+	})
+	t.Run("disk", func(t *testing.T) {
+		ds := openDisk(t, t.TempDir(), DiskOptions{Retention: retention})
+		defer ds.Close()
+		fn(t, ds)
+	})
+}
+
+func ids(notifications []models.Notification) []string {
+	out := []string{}
+	for _, n := range notifications {
+		out = append(out, n.ID)
+	}
+	return out
+}
+
+func addAll(t *testing.T, s NotificationStore, userID string, notificationIDs ...string) {
+	t.Helper()
+	for _, id := range notificationIDs {
+		if err := s.Add(userID, models.Notification{ID: id, Notification: schema.Notification{Message: "hello " + id}}); err != nil {
+			t.Fatalf("Add(%s, %s): %v", userID, id, err)
+		}
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+	tests := []struct {
+		name string
+		// marks are applied in order, each one counting wantMarked
+		marks      [][]string
+		wantMarked []int
+		wantUnread []string
+		wantErr    error
+	}{
+		{
+			name:       "one",
+			marks:      [][]string{{"b"}},
+			wantMarked: []int{1},
+			wantUnread: []string{"a", "c"},
+		},
+		{
+			name:       "already read ones are not counted",
+			marks:      [][]string{{"a", "b"}, {"b", "c"}},
+			wantMarked: []int{2, 1},
+			wantUnread: []string{},
+		},
+		{
+			name:       "a repeated id is counted once",
+			marks:      [][]string{{"a", "a", "b"}},
+			wantMarked: []int{2},
+			wantUnread: []string{"c"},
+		},
+		{
+			name:       "an unknown id marks nothing",
+			marks:      [][]string{{"a", "missing"}},
+			wantMarked: []int{0},
+			wantUnread: []string{"a", "b", "c"},
+			wantErr:    ErrNotificationNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends(t, func(t *testing.T, s NotificationStore) {
+				addAll(t, s, "1", "a", "b", "c")
+				addAll(t, s, "2", "a")
+				for i, marks := range tt.marks {
+					marked, err := s.MarkRead("1", marks)
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("MarkRead(%v) error = %v, want %v", marks, err, tt.wantErr)
+					}
+					if marked != tt.wantMarked[i] {
+						t.Errorf("MarkRead(%v) = %d, want %d", marks, marked, tt.wantMarked[i])
+					}
+				}
+
+				unread, err := s.GetUnread("1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(ids(unread), tt.wantUnread) {
+					t.Errorf("GetUnread = %v, want %v", ids(unread), tt.wantUnread)
+				}
+				all, _ := s.Get("1")
+				for _, n := range all {
+					if n.Read == slices.Contains(tt.wantUnread, n.ID) {
+						t.Errorf("notification %s has Read = %v", n.ID, n.Read)
+					}
+				}
+				// the same ids of another user are left alone
+				if unread, _ := s.GetUnread("2"); len(unread) != 1 {
+					t.Errorf("user 2 has %d unread, want 1", len(unread))
+				}
+			})
+		})
+	}
+}
+
+func TestMarkAllRead(t *testing.T) {
+	backends(t, func(t *testing.T, s NotificationStore) {
+		addAll(t, s, "1", "a", "b", "c")
+		if _, err := s.MarkRead("1", []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		if marked, err := s.MarkAllRead("1"); err != nil || marked != 2 {
+			t.Errorf("MarkAllRead = %d, %v, want 2", marked, err)
+		}
+		if marked, err := s.MarkAllRead("1"); err != nil || marked != 0 {
+			t.Errorf("second MarkAllRead = %d, %v, want 0", marked, err)
+		}
+		if marked, err := s.MarkAllRead("nobody"); err != nil || marked != 0 {
+			t.Errorf("MarkAllRead of an unknown user = %d, %v, want 0", marked, err)
+		}
+
+		// a notification added later is unread again
+		addAll(t, s, "1", "d")
+		unread, _ := s.GetUnread("1")
+		if !slices.Equal(ids(unread), []string{"d"}) {
+			t.Errorf("GetUnread = %v, want [d]", ids(unread))
+		}
+	})
+}
+
+func TestDiskStoreReplaysReadState(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDisk(t, dir, DiskOptions{MaxSegmentBytes: 200})
+	addAll(t, ds, "1", "a", "b", "c")
+	addAll(t, ds, "2", "x", "y")
+	if _, err := ds.MarkRead("1", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.MarkAllRead("2"); err != nil {
+		t.Fatal(err)
+	}
+	addAll(t, ds, "2", "z")
+	ds.Close()
+
+	ds = openDisk(t, dir, DiskOptions{})
+	defer ds.Close()
+	for userID, want := range map[string][]string{"1": {"a", "c"}, "2": {"z"}} {
+		unread, err := ds.GetUnread(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids(unread), want) {
+			t.Errorf("GetUnread(%s) after reopening = %v, want %v", userID, ids(unread), want)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	// n0 to n9, one a minute
+	minute := func(m int) time.Time { return base.Add(time.Duration(m) * time.Minute) }
+	tests := []struct {
+		name     string
+		opts     ListOptions
+		want     []string
+		wantNext int
+	}{
+		{name: "everything", want: []string{"n0", "n1", "n2", "n3", "n4", "n5", "n6", "n7", "n8", "n9"}, wantNext: -1},
+		{name: "first page", opts: ListOptions{Limit: 3}, want: []string{"n0", "n1", "n2"}, wantNext: 3},
+		{name: "next page", opts: ListOptions{Offset: 3, Limit: 3}, want: []string{"n3", "n4", "n5"}, wantNext: 6},
+		{name: "last full page", opts: ListOptions{Offset: 7, Limit: 3}, want: []string{"n7", "n8", "n9"}, wantNext: -1},
+		{name: "past the end", opts: ListOptions{Offset: 20, Limit: 3}, want: []string{}, wantNext: -1},
+		{name: "since", opts: ListOptions{Since: minute(8)}, want: []string{"n8", "n9"}, wantNext: -1},
+		{name: "until is exclusive", opts: ListOptions{Until: minute(2)}, want: []string{"n0", "n1"}, wantNext: -1},
+		{
+			name:     "time range over pages",
+			opts:     ListOptions{Limit: 2, Since: minute(3), Until: minute(8)},
+			want:     []string{"n3", "n4"},
+			wantNext: 5,
+		},
+		{
+			name: "the cursor skips filtered out ones",
+			// the next offset is where the next match is, not after the last one
+			opts:     ListOptions{Offset: 5, Limit: 2, Since: minute(3), Until: minute(8)},
+			want:     []string{"n5", "n6"},
+			wantNext: 7,
+		},
+		{name: "no match", opts: ListOptions{Since: minute(30)}, want: []string{}, wantNext: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends(t, func(t *testing.T, s NotificationStore) {
+				for i := 0; i < 10; i++ {
+					id := "n" + string(rune('0'+i))
+					if err := s.Add("1", models.Notification{ID: id, ReceivedAt: minute(i)}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				page, err := s.List("1", tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(ids(page.Notifications), tt.want) || page.NextOffset != tt.wantNext {
+					t.Errorf("List = %v next %d, want %v next %d", ids(page.Notifications), page.NextOffset, tt.want, tt.wantNext)
+				}
+			})
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention Retention
+		want      []string
+	}{
+		{name: "unlimited", want: []string{"a", "b", "c", "d", "e"}},
+		{name: "per user cap", retention: Retention{MaxPerUser: 2}, want: []string{"d", "e"}},
+		{name: "max age", retention: Retention{MaxAge: 90 * time.Minute}, want: []string{"d", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retainedBackends(t, tt.retention, func(t *testing.T, s NotificationStore) {
+				// a to e, received 4h to 0h ago
+				for i, id := range []string{"a", "b", "c", "d", "e"} {
+					receivedAt := time.Now().Add(time.Duration(i-4) * time.Hour)
+					if err := s.Add("1", models.Notification{ID: id, ReceivedAt: receivedAt}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				got, err := s.Get("1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(ids(got), tt.want) {
+					t.Errorf("Get = %v, want %v", ids(got), tt.want)
+				}
+				stats := s.Stats()
+				if stats.Notifications != len(tt.want) {
+					t.Errorf("Stats.Notifications = %d, want %d", stats.Notifications, len(tt.want))
+				}
+				// evicted ones can't be marked read anymore
+				if len(tt.want) < 5 {
+					if _, err := s.MarkRead("1", []string{"a"}); !errors.Is(err, ErrNotificationNotFound) {
+						t.Errorf("MarkRead of an evicted notification = %v, want ErrNotificationNotFound", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCursorSurvivesEviction(t *testing.T) {
+	retainedBackends(t, Retention{MaxPerUser: 4}, func(t *testing.T, s NotificationStore) {
+		addAll(t, s, "1", "a", "b", "c", "d")
+		page, err := s.List("1", ListOptions{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// c is the next one, e and f push a and b out meanwhile
+		addAll(t, s, "1", "e", "f")
+		page, err = s.List("1", ListOptions{Offset: page.NextOffset, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids(page.Notifications), []string{"c", "d"}) {
+			t.Errorf("next page = %v, want [c d]", ids(page.Notifications))
+		}
+
+		// a cursor to an evicted notification starts at the oldest kept
+		addAll(t, s, "1", "g", "h", "i")
+		page, _ = s.List("1", ListOptions{Offset: page.NextOffset, Limit: 2})
+		if !slices.Equal(ids(page.Notifications), []string{"f", "g"}) {
+			t.Errorf("page after eviction = %v, want [f g]", ids(page.Notifications))
+		}
+	})
+}
+
+func TestDiskStoreDeletesEvictedSegments(t *testing.T) {
+	dir := t.TempDir()
+	opts := DiskOptions{MaxSegmentBytes: 200, Retention: Retention{MaxPerUser: 2}}
+	ds := openDisk(t, dir, opts)
+	for i := 0; i < 20; i++ {
+		addAll(t, ds, "1", fmt.Sprint(i))
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	// the 2 kept notifications, in at most 2 segments, and the active one
+	if len(segments) > 3 {
+		t.Errorf("%d segments left, want at most 3", len(segments))
+	}
+	ds.Close()
+
+	ds = openDisk(t, dir, opts)
+	defer ds.Close()
+	got, _ := ds.Get("1")
+	if !slices.Equal(ids(got), []string{"18", "19"}) {
+		t.Errorf("Get after reopening = %v, want [18 19]", ids(got))
+	}
+}
+
+func TestBroadcasts(t *testing.T) {
+	broadcast := func(id, broadcastID, group string) models.Notification {
+		return models.Notification{ID: id, Notification: schema.Notification{BroadcastID: broadcastID, Group: group}}
+	}
+
+	backends(t, func(t *testing.T, s NotificationStore) {
+		adds := []struct {
+			userID       string
+			notification models.Notification
+			wantErr      error
+		}{
+			{"1", broadcast("a", "b1", "work"), nil},
+			// a redelivered broadcast is dropped, even under another record id
+			{"1", broadcast("b", "b1", "work"), ErrDuplicateNotification},
+			{"2", broadcast("c", "b1", "work"), nil},
+			{"1", broadcast("d", "b2", ""), nil},
+			{"1", broadcast("e", "b3", "friends"), nil},
+			{"1", models.Notification{ID: "f"}, nil},
+			{"1", models.Notification{ID: "g"}, nil},
+		}
+		for _, add := range adds {
+			if err := s.Add(add.userID, add.notification); !errors.Is(err, add.wantErr) {
+				t.Fatalf("Add(%s, %s) = %v, want %v", add.userID, add.notification.ID, err, add.wantErr)
+			}
+		}
+
+		groups := map[string][]string{"": {"a", "d", "e", "f", "g"}, "work": {"a"}, "friends": {"e"}, "family": {}}
+		for group, want := range groups {
+			page, err := s.List("1", ListOptions{Group: group})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids(page.Notifications), want) {
+				t.Errorf("List(group %q) = %v, want %v", group, ids(page.Notifications), want)
+			}
+		}
+	})
+}
+
+func TestDiskStoreReplaysBroadcasts(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDisk(t, dir, DiskOptions{})
+	if err := ds.Add("1", models.Notification{ID: "a", Notification: schema.Notification{BroadcastID: "b1", Group: "work"}}); err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+
+	ds = openDisk(t, dir, DiskOptions{})
+	defer ds.Close()
+	if err := ds.Add("1", models.Notification{ID: "b", Notification: schema.Notification{BroadcastID: "b1"}}); !errors.Is(err, ErrDuplicateNotification) {
+		t.Errorf("Add of a broadcast from before the restart = %v, want ErrDuplicateNotification", err)
+	}
+	if page, _ := ds.List("1", ListOptions{Group: "work"}); !slices.Equal(ids(page.Notifications), []string{"a"}) {
+		t.Errorf("List(group work) after reopening = %v, want a", ids(page.Notifications))
+	}
+}
+
+func TestEvictedBroadcastCanBeStoredAgain(t *testing.T) {
+	retainedBackends(t, Retention{MaxPerUser: 1}, func(t *testing.T, s NotificationStore) {
+		for _, n := range []models.Notification{
+			{ID: "a", Notification: schema.Notification{BroadcastID: "b1"}},
+			{ID: "b", Notification: schema.Notification{BroadcastID: "b2"}},
+			// b1 was evicted, so the store no longer remembers it
+			{ID: "c", Notification: schema.Notification{BroadcastID: "b1"}},
+		} {
+			if err := s.Add("1", n); err != nil {
+				t.Fatalf("Add(%s) = %v", n.ID, err)
+			}
+		}
+		if err := s.Add("1", models.Notification{ID: "d", Notification: schema.Notification{BroadcastID: "b1"}}); !errors.Is(err, ErrDuplicateNotification) {
+			t.Errorf("Add of a kept broadcast = %v, want ErrDuplicateNotification", err)
+		}
+	})
+}
+
+func TestStatsUserSizes(t *testing.T) {
+	backends(t, func(t *testing.T, s NotificationStore) {
+		addAll(t, s, "1", "a", "b", "c")
+		addAll(t, s, "2", "d")
+		sizes := s.Stats().UserSizes
+		slices.Sort(sizes)
+		if !slices.Equal(sizes, []int{1, 3}) {
+			t.Errorf("UserSizes = %v, want 1 and 3", sizes)
+		}
+	})
+}
+
+func TestDuplicateNotifications(t *testing.T) {
+	backends(t, func(t *testing.T, s NotificationStore) {
+		addAll(t, s, "1", "a", "b")
+		// a redelivered record keeps its id and is dropped
+		if err := s.Add("1", models.Notification{ID: "a"}); !errors.Is(err, ErrDuplicateNotification) {
+			t.Errorf("Add of a stored id = %v, want ErrDuplicateNotification", err)
+		}
+		// ids are per user
+		addAll(t, s, "2", "a")
+
+		got, _ := s.Get("1")
+		if !slices.Equal(ids(got), []string{"a", "b"}) {
+			t.Errorf("Get = %v, want [a b]", ids(got))
+		}
+	})
+}
+
+func TestSync(t *testing.T) {
+	backends(t, func(t *testing.T, s NotificationStore) {
+		addAll(t, s, "1", "a")
+		if err := s.Sync(); err != nil {
+			t.Errorf("Sync = %v", err)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"consumer/pkg/models"
+	"errors"
+	"sync"
+)
+
+const DefaultBufferSize = 64
+
+var ErrSlowSubscriber = errors.New("subscriber too slow, dropped")
+
+// Subscriber receives the live notifications of one user.
+type Subscriber struct {
+	userID string
+	events chan models.Notification
+	done   chan struct{}
+	err    error
+}
+
+func (s *Subscriber) Events() <-chan models.Notification {
+	return s.events
+}
+
+// Done is closed when the hub drops the subscriber, Err tells why.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscriber) Err() error {
+	return s.err
+}
+
+// Hub fans out every stored notification to the open streams of its user.
+//
+// Publish never blocks the consumer loop: every subscriber has a bounded
+// buffer and a subscriber whose buffer is full is dropped. The client then
+// reconnects with Last-Event-ID and catches up from the store.
+type Hub struct {
+	bufferSize  int
+	mu          sync.Mutex
+	subscribers map[string]map[*Subscriber]struct{}
+}
+
+func NewHub(bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	return &Hub{
+		bufferSize:  bufferSize,
+		subscribers: make(map[string]map[*Subscriber]struct{}),
+	}
+}
+
+func (h *Hub) Subscribe(userID string) *Subscriber {
+	sub := &Subscriber{
+		userID: userID,
+		events: make(chan models.Notification, h.bufferSize),
+		done:   make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*Subscriber]struct{})
+	}
+	h.subscribers[userID][sub] = struct{}{}
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub, nil)
+}
+
+func (h *Hub) Publish(userID string, notification models.Notification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[userID] {
+		select {
+		case sub.events <- notification:
+		default:
+			h.remove(sub, ErrSlowSubscriber)
+		}
+	}
+}
+
+// Close drops every subscriber, used on shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(sub, nil)
+		}
+	}
+}
+
+// remove must be called with h.mu held.
+func (h *Hub) remove(sub *Subscriber, err error) {
+	subs, ok := h.subscribers[sub.userID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.userID)
+	}
+	sub.err = err
+	close(sub.done)
+}
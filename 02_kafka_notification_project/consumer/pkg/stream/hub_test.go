@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"consumer/pkg/models"
+	"errors"
+	"testing"
+)
+
+// received drains what a subscriber got so far.
+func received(sub *Subscriber) []string {
+	var ids []string
+	for {
+		select {
+		case n := <-sub.Events():
+			ids = append(ids, n.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func closed(sub *Subscriber) bool {
+	select {
+	case <-sub.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub(4)
+	a1, a2, b := hub.Subscribe("a"), hub.Subscribe("a"), hub.Subscribe("b")
+
+	hub.Publish("a", models.Notification{ID: "1"})
+	hub.Publish("b", models.Notification{ID: "2"})
+	hub.Publish("c", models.Notification{ID: "3"})
+
+	for name, tt := range map[string]struct {
+		sub  *Subscriber
+		want string
+	}{"a1": {a1, "1"}, "a2": {a2, "1"}, "b": {b, "2"}} {
+		if got := received(tt.sub); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s got %v, want [%s]", name, got, tt.want)
+		}
+	}
+
+	hub.Unsubscribe(a1)
+	hub.Publish("a", models.Notification{ID: "4"})
+	if got := received(a1); len(got) != 0 {
+		t.Errorf("unsubscribed a1 got %v", got)
+	}
+	if !closed(a1) || a1.Err() != nil {
+		t.Errorf("unsubscribed a1: closed %v, err %v", closed(a1), a1.Err())
+	}
+	if got := received(a2); len(got) != 1 || got[0] != "4" {
+		t.Errorf("a2 got %v, want [4]", got)
+	}
+	// unsubscribing twice is fine
+	hub.Unsubscribe(a1)
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub(2)
+	slow, fast := hub.Subscribe("a"), hub.Subscribe("a")
+	for i, id := range []string{"1", "2", "3"} {
+		hub.Publish("a", models.Notification{ID: id})
+		if i < 2 {
+			received(fast)
+		}
+	}
+	if !closed(slow) || !errors.Is(slow.Err(), ErrSlowSubscriber) {
+		t.Errorf("slow subscriber: closed %v, err %v, want ErrSlowSubscriber", closed(slow), slow.Err())
+	}
+	if closed(fast) {
+		t.Error("fast subscriber was dropped")
+	}
+	// what was buffered before the drop can still be read
+	if got := received(slow); len(got) != 2 {
+		t.Errorf("slow subscriber got %v, want the 2 buffered", got)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(0)
+	subs := []*Subscriber{hub.Subscribe("a"), hub.Subscribe("b")}
+	hub.Close()
+	for i, sub := range subs {
+		if !closed(sub) || sub.Err() != nil {
+			t.Errorf("subscriber %d: closed %v, err %v", i, closed(sub), sub.Err())
+		}
+	}
+	// publishing after close reaches nobody and doesn't panic
+	hub.Publish("a", models.Notification{ID: "1"})
+}
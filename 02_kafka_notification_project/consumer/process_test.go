@@ -0,0 +1,245 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"consumer/pkg/stream"
+	"context"
+	"errors"
+	"schema"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// failingStore fails the first failures Adds with err.
+type failingStore struct {
+	store.NotificationStore
+	mu       sync.Mutex
+	err      error
+	failures int
+}
+
+func (s *failingStore) Add(userID string, notification models.Notification) error {
+	s.mu.Lock()
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		return s.err
+	}
+	s.mu.Unlock()
+	return s.NotificationStore.Add(userID, notification)
+}
+
+func notificationMessage(t *testing.T, offset int64, message string) kafka.Message {
+	t.Helper()
+	return messageTo(t, 1, offset, message)
+}
+
+// messageTo is a notification record for the user.
+func messageTo(t *testing.T, userID int, offset int64, message string) kafka.Message {
+	t.Helper()
+	env, err := schema.NewEnvelope(schema.Notification{To: schema.User{ID: userID}, Message: message})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := schema.Encode(env, schema.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{
+		Topic:     "notifications",
+		Partition: 0,
+		Offset:    offset,
+		Key:       []byte(strconv.Itoa(userID)),
+		Value:     value,
+		Time:      time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestProcess(t *testing.T) {
+	s := store.NewMemoryStore(store.Retention{})
+	hub := stream.NewHub(10)
+	sub := hub.Subscribe("1")
+	broker := newFakeBroker()
+	dlq := newTestDeadLetterQueue(broker)
+	defer dlq.Close()
+	c := &Consumer{store: s, hub: hub, deadLetters: dlq}
+	ctx := context.Background()
+
+	msgs := []kafka.Message{
+		notificationMessage(t, 0, "first"),
+		// a redelivered message is dropped by the store
+		notificationMessage(t, 0, "first"),
+		{Topic: "notifications", Offset: 1, Key: []byte("1"), Value: []byte("not json")},
+		notificationMessage(t, 2, "second"),
+	}
+	for _, msg := range msgs {
+		if !c.process(ctx, msg) {
+			t.Fatalf("process(offset %d) = false, want true", msg.Offset)
+		}
+	}
+
+	notes, _ := s.Get("1")
+	if len(notes) != 2 || notes[0].ID != "notifications-0-0" || notes[1].Message != "second" || !notes[0].ReceivedAt.Equal(msgs[0].Time) {
+		t.Errorf("stored = %+v, want the two notifications", notes)
+	}
+	// only stored notifications are published
+	var published []string
+	for len(sub.Events()) > 0 {
+		published = append(published, (<-sub.Events()).Message)
+	}
+	if !slices.Equal(published, []string{"first", "second"}) {
+		t.Errorf("published = %v, want first and second", published)
+	}
+	if letters := broker.messages("notifications-dlq"); len(letters) != 1 || string(letters[0].Value) != "not json" {
+		t.Errorf("dead letters = %v, want the undecodable message", letters)
+	}
+}
+
+func TestProcessDeadLetters(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        func(t *testing.T) kafka.Message
+		wantReason string
+	}{
+		{
+			name: "empty key",
+			msg: func(t *testing.T) kafka.Message {
+				msg := notificationMessage(t, 0, "hi")
+				msg.Key = nil
+				return msg
+			},
+			wantReason: ReasonEmptyKey,
+		},
+		{
+			name: "undecodable",
+			msg: func(t *testing.T) kafka.Message {
+				return kafka.Message{Topic: "notifications", Key: []byte("1"), Value: []byte("{")}
+			},
+			wantReason: ReasonDecodeFailed,
+		},
+		{
+			name: "key is not the recipient",
+			msg: func(t *testing.T) kafka.Message {
+				msg := notificationMessage(t, 0, "hi")
+				msg.Key = []byte("2")
+				return msg
+			},
+			wantReason: ReasonKeyMismatch,
+		},
+		{
+			name: "recipient not in the directory",
+			msg: func(t *testing.T) kafka.Message {
+				return messageTo(t, 3, 0, "hi")
+			},
+			wantReason: ReasonUnknownUser,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore(store.Retention{})
+			broker := newFakeBroker()
+			dlq := newTestDeadLetterQueue(broker)
+			defer dlq.Close()
+			directory := newTestDirectory(t, map[string]models.User{"1": {ID: 1}})
+			c := &Consumer{store: s, hub: stream.NewHub(10), deadLetters: dlq, directory: directory}
+
+			if !c.process(context.Background(), tt.msg(t)) {
+				t.Fatal("process = false, want true")
+			}
+			letters := broker.messages("notifications-dlq")
+			if len(letters) != 1 {
+				t.Fatalf("dead letters = %v, want one", letters)
+			}
+			if reason, _ := header(letters[0].Headers, HeaderDLQReason); reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", reason, tt.wantReason)
+			}
+			if stats := s.Stats(); stats.Notifications != 0 {
+				t.Errorf("stored %d notifications, want none", stats.Notifications)
+			}
+		})
+	}
+}
+
+func TestProcessStoreFailures(t *testing.T) {
+	t.Run("retried until stored", func(t *testing.T) {
+		s := &failingStore{NotificationStore: store.NewMemoryStore(store.Retention{}), err: errors.New("disk full"), failures: 1}
+		c := &Consumer{store: s, hub: stream.NewHub(10)}
+		if !c.process(context.Background(), notificationMessage(t, 0, "hi")) {
+			t.Fatal("process = false, want true")
+		}
+		if notes, _ := s.Get("1"); len(notes) != 1 {
+			t.Errorf("stored = %v, want the notification after a retry", notes)
+		}
+	})
+
+	t.Run("too large is dead lettered", func(t *testing.T) {
+		s := &failingStore{NotificationStore: store.NewMemoryStore(store.Retention{}), err: store.ErrRecordTooLarge, failures: 1}
+		broker := newFakeBroker()
+		dlq := newTestDeadLetterQueue(broker)
+		defer dlq.Close()
+		c := &Consumer{store: s, hub: stream.NewHub(10), deadLetters: dlq}
+		if !c.process(context.Background(), notificationMessage(t, 0, "hi")) {
+			t.Fatal("process = false, want true")
+		}
+		if notes, _ := s.Get("1"); len(notes) != 0 {
+			t.Errorf("stored = %v, want nothing", notes)
+		}
+		letters := broker.messages("notifications-dlq")
+		if len(letters) != 1 {
+			t.Fatalf("dead letters = %v, want one", letters)
+		}
+		if reason, _ := header(letters[0].Headers, HeaderDLQReason); reason != ReasonRecordTooLarge {
+			t.Errorf("reason = %q, want %q", reason, ReasonRecordTooLarge)
+		}
+	})
+
+	t.Run("canceled while dead lettering", func(t *testing.T) {
+		broker := newFakeBroker()
+		broker.fail(errors.New("broker down"))
+		dlq := newTestDeadLetterQueue(broker)
+		defer dlq.Close()
+		c := &Consumer{store: store.NewMemoryStore(store.Retention{}), hub: stream.NewHub(10), deadLetters: dlq}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if c.process(ctx, kafka.Message{Topic: "notifications", Key: []byte("1"), Value: []byte("{")}) {
+			t.Error("process = true, want false")
+		}
+	})
+
+	t.Run("canceled while retrying", func(t *testing.T) {
+		s := &failingStore{NotificationStore: store.NewMemoryStore(store.Retention{}), err: errors.New("disk full"), failures: 1000}
+		c := &Consumer{store: s, hub: stream.NewHub(10)}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		// the message must not be committed then
+		if c.process(ctx, notificationMessage(t, 0, "hi")) {
+			t.Error("process = true, want false")
+		}
+	})
+}
+
+func TestProcessDirectoryDown(t *testing.T) {
+	s := store.NewMemoryStore(store.Retention{})
+	broker := newFakeBroker()
+	dlq := newTestDeadLetterQueue(broker)
+	defer dlq.Close()
+	// the test directory fails for user 500
+	directory := newTestDirectory(t, map[string]models.User{})
+	c := &Consumer{store: s, hub: stream.NewHub(10), deadLetters: dlq, directory: directory}
+
+	if !c.process(context.Background(), messageTo(t, 500, 0, "hi")) {
+		t.Fatal("process = false, want true")
+	}
+	if notes, _ := s.Get("500"); len(notes) != 1 {
+		t.Errorf("stored = %v, want the notification stored unchecked", notes)
+	}
+	if letters := broker.messages("notifications-dlq"); len(letters) != 0 {
+		t.Errorf("dead letters = %v, want none", letters)
+	}
+}
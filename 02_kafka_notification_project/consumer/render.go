@@ -0,0 +1,49 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"log"
+	"strings"
+	"templates"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientLocale is the locale the client asks for, ?locale= or the first
+// language of Accept-Language, empty to use the recipient's.
+func clientLocale(ctx *gin.Context) string {
+	if locale := ctx.Query("locale"); locale != "" {
+		return locale
+	}
+	first, _, _ := strings.Cut(ctx.GetHeader("Accept-Language"), ",")
+	tag, _, _ := strings.Cut(first, ";")
+	if tag = strings.TrimSpace(tag); tag == "*" {
+		return ""
+	}
+	return tag
+}
+
+// renderForClient renders the notifications stored raw in the client's
+// locale. The store keeps them raw, so every client gets its own language.
+func renderForClient(catalog *templates.Catalog, locale string, note models.Notification) models.Notification {
+	if note.Content == nil || note.Content.Rendered {
+		return note
+	}
+	rendered, err := catalog.Render(*note.Content, note.From, note.To, locale)
+	if err != nil {
+		// the message the producer rendered is still there
+		log.Printf("failed to render notification %s: %v\n", note.ID, err)
+		return note
+	}
+	note.Content = &rendered
+	note.Message = rendered.Body
+	return note
+}
+
+func renderAllForClient(catalog *templates.Catalog, locale string, notes []models.Notification) []models.Notification {
+	rendered := make([]models.Notification, len(notes))
+	for i, note := range notes {
+		rendered[i] = renderForClient(catalog, locale, note)
+	}
+	return rendered
+}
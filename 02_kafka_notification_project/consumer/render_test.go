@@ -0,0 +1,115 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"net/http"
+	"net/http/httptest"
+	"schema"
+	"strings"
+	"templates"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testCatalog has the built in templates, like a consumer without a
+// templates file.
+var testCatalog = func() *templates.Catalog {
+	catalog, err := templates.NewCatalog("en", templates.Builtin()...)
+	if err != nil {
+		panic(err)
+	}
+	return catalog
+}()
+
+func TestClientLocale(t *testing.T) {
+	tests := []struct {
+		query, acceptLanguage string
+		want                  string
+	}{
+		{"", "", ""},
+		{"fr", "es", "fr"},
+		{"", "pt-BR,pt;q=0.9,en;q=0.8", "pt-BR"},
+		{"", "es;q=0.8", "es"},
+		{"", "*", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		router := gin.New()
+		router.GET("/", func(ctx *gin.Context) {
+			got = clientLocale(ctx)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/?locale="+tt.query, nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("clientLocale(?locale=%s, Accept-Language: %s) = %q, want %q", tt.query, tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func rawFriendRequest(id string) models.Notification {
+	return models.Notification{ID: id, Notification: schema.Notification{
+		From:    schema.User{ID: 1, Name: "Emma"},
+		To:      schema.User{ID: 2, Name: "Bruno", Locale: "pt-BR"},
+		Message: "Emma quer ser seu amigo.",
+		Content: &schema.Content{Template: "friend_request"},
+	}}
+}
+
+func TestRenderForClient(t *testing.T) {
+	raw := rawFriendRequest("n1")
+
+	if got := renderForClient(testCatalog, "", raw); got.Content.Locale != "pt" || got.Message != "Emma quer ser seu amigo." || got.Content.Title != "Novo pedido de amizade" {
+		t.Errorf("renderForClient = %+v, want the recipient's locale", got.Content)
+	}
+	got := renderForClient(testCatalog, "fr", raw)
+	if !got.Content.Rendered || got.Content.Locale != "fr" || got.Message != "Emma souhaite devenir votre ami." {
+		t.Errorf("renderForClient in fr = %q %+v, want the client's locale", got.Message, got.Content)
+	}
+	if raw.Content.Rendered || raw.Content.Title != "" {
+		t.Error("renderForClient changed the stored content")
+	}
+
+	plain := models.Notification{ID: "n2", Notification: schema.Notification{Message: "hi"}}
+	if got := renderForClient(testCatalog, "fr", plain); got.Message != "hi" || got.Content != nil {
+		t.Errorf("renderForClient of a plain notification = %+v, want it as is", got)
+	}
+
+	// a template the consumer doesn't know keeps the producer's message
+	unknown := rawFriendRequest("n3")
+	unknown.Content = &schema.Content{Template: "invoice"}
+	if got := renderForClient(testCatalog, "fr", unknown); got.Message != unknown.Message || got.Content.Rendered {
+		t.Errorf("renderForClient of an unknown template = %+v, want it as is", got)
+	}
+}
+
+func TestHandleNotificationsRendersForClient(t *testing.T) {
+	s := store.NewMemoryStore(store.Retention{})
+	if err := s.Add("2", rawFriendRequest("n1")); err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(s)
+
+	req := httptest.NewRequest(http.MethodGet, "/notifications/2", nil)
+	req.Header.Set("Accept-Language", "es")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"message":"Emma quiere ser tu amigo."`) {
+		t.Errorf("GET /notifications/2 with Accept-Language: es = %d %s, want it rendered in es", rec.Code, rec.Body.String())
+	}
+
+	for _, path := range []string{"/notifications/2?locale=fr", "/notifications/2/unread?locale=fr"} {
+		code, response := do(t, router, http.MethodGet, path, "")
+		notes := response["notifications"].([]any)
+		if code != http.StatusOK || len(notes) != 1 {
+			t.Fatalf("GET %s = %d %v, want one notification", path, code, response)
+		}
+		note := notes[0].(map[string]any)
+		content := note["content"].(map[string]any)
+		if note["message"] != "Emma souhaite devenir votre ami." || content["locale"] != "fr" || content["rendered"] != true {
+			t.Errorf("GET %s = %v, want it rendered in fr", path, note)
+		}
+	}
+}
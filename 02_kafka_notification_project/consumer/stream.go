@@ -0,0 +1,215 @@
+package main
+
+import (
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"consumer/pkg/stream"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"templates"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	StreamHeartbeat    = 15 * time.Second
+	StreamWriteTimeout = 10 * time.Second
+	StreamRetry        = 3 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// liveStream is an open subscription plus the stored history the client missed.
+type liveStream struct {
+	sub     *stream.Subscriber
+	backlog []models.Notification
+	sent    map[string]bool
+}
+
+// openStream subscribes before reading the history, so nothing stored in
+// between is lost. Notifications seen in both are only sent once.
+func openStream(hub *stream.Hub, notificationStore store.NotificationStore, userID, lastEventID string) (*liveStream, error) {
+	sub := hub.Subscribe(userID)
+
+	ls := &liveStream{sub: sub, sent: make(map[string]bool)}
+	if lastEventID == "" {
+		return ls, nil
+	}
+
+	history, err := notificationStore.Get(userID)
+	if err != nil {
+		hub.Unsubscribe(sub)
+		return nil, err
+	}
+
+	// if the last seen id is gone from the store we replay everything we still have
+	start := 0
+	for i, note := range history {
+		if note.ID == lastEventID {
+			start = i + 1
+			break
+		}
+	}
+	ls.backlog = history[start:]
+	for _, note := range ls.backlog {
+		ls.sent[note.ID] = true
+	}
+	return ls, nil
+}
+
+// next skips live notifications that were already part of the backlog.
+func (ls *liveStream) next(note models.Notification) bool {
+	if ls.sent[note.ID] {
+		delete(ls.sent, note.ID)
+		return false
+	}
+	return true
+}
+
+func getLastEventID(ctx *gin.Context) string {
+	if id := ctx.GetHeader("Last-Event-ID"); id != "" {
+		return id
+	}
+	// browsers' WebSocket API can't set headers
+	return ctx.Query("last_event_id")
+}
+
+func handleStreamSSE(ctx *gin.Context, hub *stream.Hub, notificationStore store.NotificationStore, catalog *templates.Catalog) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	ls, err := openStream(hub, notificationStore, userID, getLastEventID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	defer hub.Unsubscribe(ls.sub)
+
+	locale := clientLocale(ctx)
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+
+	fmt.Fprintf(ctx.Writer, "retry: %d\n\n", StreamRetry.Milliseconds())
+	for _, note := range ls.backlog {
+		ctx.Render(-1, sse.Event{Id: note.ID, Event: "notification", Data: renderForClient(catalog, locale, note)})
+	}
+	ctx.Writer.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-ls.sub.Done():
+			if err := ls.sub.Err(); err != nil {
+				ctx.SSEvent("error", gin.H{"message": err.Error()})
+			}
+			return false
+		case note := <-ls.sub.Events():
+			if ls.next(note) {
+				ctx.Render(-1, sse.Event{Id: note.ID, Event: "notification", Data: renderForClient(catalog, locale, note)})
+			}
+			return true
+		case <-heartbeat.C:
+			// comment lines keep proxies from closing an idle stream
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		}
+	})
+}
+
+func handleStreamWebSocket(ctx *gin.Context, hub *stream.Hub, notificationStore store.NotificationStore, catalog *templates.Catalog) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	ls, err := openStream(hub, notificationStore, userID, getLastEventID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	defer hub.Unsubscribe(ls.sub)
+
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// the upgrader already answered the request
+		log.Printf("websocket upgrade failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// the client never sends us anything, but reading is how we notice it left
+	// and how pong/close frames get processed
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * StreamHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * StreamHeartbeat))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	locale := clientLocale(ctx)
+	send := func(note models.Notification) error {
+		conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		return conn.WriteJSON(gin.H{"id": note.ID, "event": "notification", "data": renderForClient(catalog, locale, note)})
+	}
+
+	for _, note := range ls.backlog {
+		if err := send(note); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ls.sub.Done():
+			code, reason := websocket.CloseGoingAway, "server shutting down"
+			if err := ls.sub.Err(); errors.Is(err, stream.ErrSlowSubscriber) {
+				code, reason = websocket.CloseTryAgainLater, err.Error()
+			}
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(StreamWriteTimeout))
+			return
+		case note := <-ls.sub.Events():
+			if !ls.next(note) {
+				continue
+			}
+			if err := send(note); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(StreamWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"consumer/pkg/models"
+	"consumer/pkg/store"
+	"consumer/pkg/stream"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func newStreamServer(t *testing.T, s store.NotificationStore, hub *stream.Hub) *httptest.Server {
+	t.Helper()
+	router := gin.New()
+	router.GET("/notifications/:userID/stream", func(ctx *gin.Context) {
+		handleStreamSSE(ctx, hub, s, testCatalog)
+	})
+	router.GET("/notifications/:userID/ws", func(ctx *gin.Context) {
+		handleStreamWebSocket(ctx, hub, s, testCatalog)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenStreamBacklog(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{name: "new client gets no history", want: nil},
+		{name: "resume after the last seen", lastEventID: "b", want: []string{"c", "d"}},
+		{name: "up to date", lastEventID: "d", want: []string{}},
+		{name: "unknown id replays everything", lastEventID: "gone", want: []string{"a", "b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := stream.NewHub(8)
+			ls, err := openStream(hub, newTestStore(t, "1", "a", "b", "c", "d"), "1", tt.lastEventID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hub.Unsubscribe(ls.sub)
+			var got []string
+			for _, n := range ls.backlog {
+				got = append(got, n.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("backlog = %v, want %v", got, tt.want)
+			}
+
+			// a notification in the backlog and published live is sent once
+			for _, id := range tt.want {
+				if ls.next(models.Notification{ID: id}) {
+					t.Errorf("%s of the backlog sent again live", id)
+				}
+			}
+			if !ls.next(models.Notification{ID: "e"}) {
+				t.Error("new notification e not sent")
+			}
+		})
+	}
+}
+
+// sseEvents reads the ids of the notification events of an SSE stream.
+func sseEvents(t *testing.T, body *bufio.Reader, n int) []string {
+	t.Helper()
+	var ids []string
+	for len(ids) < n {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream after %v: %v", ids, err)
+		}
+		if id, ok := strings.CutPrefix(strings.TrimSpace(line), "id:"); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestStreamSSE(t *testing.T) {
+	s := newTestStore(t, "1", "a", "b")
+	hub := stream.NewHub(8)
+	server := newStreamServer(t, s, hub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/notifications/1/stream", nil)
+	req.Header.Set("Last-Event-ID", "a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	body := bufio.NewReader(resp.Body)
+	if got := sseEvents(t, body, 1); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("backlog = %v, want [b]", got)
+	}
+
+	// b is published late, after the client already got it from the store
+	hub.Publish("1", models.Notification{ID: "b"})
+	hub.Publish("2", models.Notification{ID: "other"})
+	hub.Publish("1", models.Notification{ID: "c"})
+	if got := sseEvents(t, body, 1); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("live = %v, want [c]", got)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	s := newTestStore(t, "1", "a", "b")
+	hub := stream.NewHub(8)
+	server := newStreamServer(t, s, hub)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/notifications/1/ws?last_event_id=a"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() string {
+		t.Helper()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event struct {
+			ID    string `json:"id"`
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil || event.Event != "notification" {
+			t.Fatalf("message %s: %v", data, err)
+		}
+		return event.ID
+	}
+	if got := read(); got != "b" {
+		t.Fatalf("backlog = %s, want b", got)
+	}
+	hub.Publish("1", models.Notification{ID: "b"})
+	hub.Publish("1", models.Notification{ID: "c"})
+	if got := read(); got != "c" {
+		t.Errorf("live = %s, want c", got)
+	}
+
+	// shutting down closes the socket with going away
+	hub.Close()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("after Close = %v, want a going away close", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"auth"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrForbiddenSender = errors.New("forbidden sender")
+
+// bindSender makes the authenticated user the sender: a missing fromID is
+// theirs, and only admins (other services) may send on behalf of someone else.
+func bindSender(ctx *gin.Context, fromID *int) error {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return fmt.Errorf("%w: not authenticated", ErrForbiddenSender)
+	}
+	if *fromID == 0 && principal.UserID > 0 {
+		*fromID = principal.UserID
+	}
+	if *fromID != 0 && !principal.CanActAs(*fromID) {
+		return fmt.Errorf("%w: %s can't send as user %d", ErrForbiddenSender, principal.Subject, *fromID)
+	}
+	return nil
+}
+
+func forbidden(ctx *gin.Context, err error) {
+	ctx.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+}
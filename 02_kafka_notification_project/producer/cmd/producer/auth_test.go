@@ -0,0 +1,135 @@
+package main
+
+import (
+	"auth"
+	"config"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter authenticates like main does, without authenticators every
+// request is an anonymous admin.
+func newTestRouter(authenticators ...auth.Authenticator) *gin.Engine {
+	router := gin.New()
+	router.Use(auth.Middleware(authenticators))
+	return router
+}
+
+const (
+	emmaKey  = "emma-key-0000000001"
+	adminKey = "admin-key-000000000"
+)
+
+func testAPIKeys() auth.Authenticator {
+	return auth.NewAPIKeys([]config.APIKeyConfig{
+		{Key: emmaKey, UserID: 1},
+		{Key: adminKey, Roles: []string{auth.RoleAdmin}},
+	})
+}
+
+// doAs is do with an API key, none when key is empty.
+func doAs(t *testing.T, router http.Handler, key, method, path, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set(auth.HeaderAPIKey, key)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestBindSender(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		fromID     int
+		wantFromID int
+		wantErr    bool
+	}{
+		{name: "user without fromID", key: emmaKey, wantFromID: 1},
+		{name: "user as themselves", key: emmaKey, fromID: 1, wantFromID: 1},
+		{name: "user as someone else", key: emmaKey, fromID: 2, wantErr: true},
+		{name: "admin as anyone", key: adminKey, fromID: 2, wantFromID: 2},
+		// a service key is no user, the handler asks for fromID then
+		{name: "admin without fromID", key: adminKey, wantFromID: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromID int
+			var err error
+			router := newTestRouter(testAPIKeys())
+			router.POST("/send", func(ctx *gin.Context) {
+				fromID = tt.fromID
+				err = bindSender(ctx, &fromID)
+			})
+			doAs(t, router, tt.key, http.MethodPost, "/send", "")
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrForbiddenSender) {
+					t.Errorf("bindSender = %v, want ErrForbiddenSender", err)
+				}
+				return
+			}
+			if err != nil || fromID != tt.wantFromID {
+				t.Errorf("bindSender = %d, %v, want %d", fromID, err, tt.wantFromID)
+			}
+		})
+	}
+
+	t.Run("not authenticated", func(t *testing.T) {
+		var err error
+		router := gin.New()
+		router.POST("/send", func(ctx *gin.Context) {
+			fromID := 1
+			err = bindSender(ctx, &fromID)
+		})
+		do(t, router, http.MethodPost, "/send", "")
+		if !errors.Is(err, ErrForbiddenSender) {
+			t.Errorf("bindSender without the middleware = %v, want ErrForbiddenSender", err)
+		}
+	})
+}
+
+func TestAuthRoutes(t *testing.T) {
+	router := newTestRouter(testAPIKeys())
+	users := testUsers()
+	router.POST("/send", sendMessageHandler(nil, users, newTestComposer(), newTestLimiter(nil)))
+	router.POST("/send/batch", sendBatchHandler(nil, users, newTestComposer(), newTestLimiter(nil)))
+	router.POST("/broadcast", broadcastHandler(nil, users, newTestLimiter(nil)))
+	registerUserRoutes(router, users)
+
+	tests := []struct {
+		key          string
+		method, path string
+		body         string
+		wantCode     int
+	}{
+		{"", http.MethodGet, "/users", "", http.StatusUnauthorized},
+		{"wrong-key-000000000", http.MethodGet, "/users", "", http.StatusUnauthorized},
+		{emmaKey, http.MethodGet, "/users", "", http.StatusOK},
+		{emmaKey, http.MethodGet, "/users/2", "", http.StatusOK},
+		// only admins change the directory
+		{emmaKey, http.MethodPost, "/users", `{"id": 4, "name": "Lena"}`, http.StatusForbidden},
+		{emmaKey, http.MethodPut, "/users/1", `{"name": "Emma B."}`, http.StatusForbidden},
+		{emmaKey, http.MethodDelete, "/users/1", "", http.StatusForbidden},
+		{adminKey, http.MethodPost, "/users", `{"id": 4, "name": "Lena"}`, http.StatusCreated},
+		// users only send as themselves
+		{emmaKey, http.MethodPost, "/send", `{"fromID": 2, "toID": 3, "message": "hi"}`, http.StatusForbidden},
+		{emmaKey, http.MethodPost, "/send/batch", `{"items": [{"toID": 2}, {"fromID": 2, "toID": 3}]}`, http.StatusForbidden},
+		{emmaKey, http.MethodPost, "/broadcast", `{"fromID": 2, "group": "work", "message": "hi"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code, body := doAs(t, router, tt.key, tt.method, tt.path, tt.body); code != tt.wantCode {
+			t.Errorf("%s %s with key %q = %d %s, want %d", tt.method, tt.path, tt.key, code, body, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"producer/pkg/directory"
+	"producer/pkg/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MaxBatchItems        = 500
+	BatchDeliveryTimeout = 30 * time.Second
+)
+
+type batchRequest struct {
+	Items []sendRequest `json:"items"`
+}
+
+type batchItemError struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+// batchItemResult is the delivery report of one notification of the batch.
+// An item with several recipients gets one result per recipient.
+type batchItemResult struct {
+	Index int `json:"index"`
+	deliveryReport
+}
+
+func sendBatchHandler(producer *Producer, users directory.UserDirectory, composer *Composer, limiter *Limiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req batchRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		if len(req.Items) == 0 || len(req.Items) > MaxBatchItems {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("a batch needs between 1 and %d items", MaxBatchItems),
+			})
+			return
+		}
+
+		// validate everything first, a batch is only sent when all items are fine
+		var indexes []int
+		var notifications []models.Notification
+		var itemErrors []batchItemError
+		for i, item := range req.Items {
+			if err := bindSender(ctx, &item.FromID); err != nil {
+				forbidden(ctx, fmt.Errorf("item %d: %w", i, err))
+				return
+			}
+			built, err := buildNotifications(users, composer, item)
+			if err != nil {
+				if !errors.Is(err, directory.ErrUserNotFound) && !errors.Is(err, ErrInvalidSendRequest) {
+					ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+					return
+				}
+				itemErrors = append(itemErrors, batchItemError{Index: i, Message: err.Error()})
+				continue
+			}
+			for _, notification := range built {
+				indexes = append(indexes, i)
+				notifications = append(notifications, notification)
+			}
+		}
+
+		if len(itemErrors) > 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "batch rejected, no notification was sent",
+				"errors":  itemErrors,
+			})
+			return
+		}
+		if !limitSend(ctx, limiter, notifications) {
+			return
+		}
+
+		reports, failed := produceAndWait(producer, notifications, BatchDeliveryTimeout)
+		results := make([]batchItemResult, len(reports))
+		for i, report := range reports {
+			results[i] = batchItemResult{Index: indexes[i], deliveryReport: report}
+		}
+
+		status := http.StatusOK
+		if failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		ctx.JSON(status, gin.H{
+			"sent":    len(results) - failed,
+			"failed":  failed,
+			"results": results,
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"producer/pkg/directory"
+	"producer/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaxBroadcastRecipients caps how many notifications one broadcast produces.
+const MaxBroadcastRecipients = 10000
+
+// broadcastRequest is the body of POST /broadcast. Without a group the
+// notification goes to every user.
+type broadcastRequest struct {
+	FromID  int    `json:"fromID" form:"fromID"`
+	Group   string `json:"group" form:"group"`
+	Message string `json:"message" form:"message"`
+}
+
+func newBroadcastID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func broadcastHandler(producer *Producer, users directory.UserDirectory, limiter *Limiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req broadcastRequest
+		if err := ctx.ShouldBind(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		if err := bindSender(ctx, &req.FromID); err != nil {
+			forbidden(ctx, err)
+			return
+		}
+
+		fromUser, err := users.Get(req.FromID)
+		if err != nil {
+			ctx.JSON(directoryErrorStatus(err), gin.H{"message": "User not found"})
+			return
+		}
+
+		members, err := directory.Members(users, req.Group)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+
+		broadcastID, err := newBroadcastID()
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+
+		var notifications []models.Notification
+		for _, member := range members {
+			// the sender doesn't notify themselves
+			if member.ID == fromUser.ID {
+				continue
+			}
+			notifications = append(notifications, models.Notification{
+				From:        fromUser,
+				To:          member,
+				Message:     req.Message,
+				BroadcastID: broadcastID,
+				Group:       req.Group,
+			})
+		}
+
+		if len(notifications) == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "No recipients found for broadcast"})
+			return
+		}
+		if len(notifications) > MaxBroadcastRecipients {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Too many recipients for one broadcast"})
+			return
+		}
+		if !limitSend(ctx, limiter, notifications) {
+			return
+		}
+
+		reports, failed := produceAndWait(producer, notifications, BatchDeliveryTimeout)
+
+		status := http.StatusOK
+		if failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		ctx.JSON(status, gin.H{
+			"broadcast_id": broadcastID,
+			"group":        req.Group,
+			"sent":         len(reports) - failed,
+			"failed":       failed,
+			"deliveries":   reports,
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"producer/pkg/directory"
+	"producer/pkg/models"
+	"strings"
+	"testing"
+)
+
+func groupUsers() *directory.MemoryDirectory {
+	return directory.NewMemoryDirectory(
+		models.User{ID: 1, Name: "Emma", Groups: []string{"friends"}},
+		models.User{ID: 2, Name: "Bruno", Groups: []string{"friends", "work"}},
+		models.User{ID: 3, Name: "Rick", Groups: []string{"work"}},
+		models.User{ID: 4, Name: "Lena", Groups: []string{"solo"}},
+	)
+}
+
+func TestBroadcastHandlerValidation(t *testing.T) {
+	// nothing is produced when the broadcast is rejected
+	router := newTestRouter()
+	router.POST("/broadcast", broadcastHandler(nil, groupUsers(), newTestLimiter(nil)))
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "not json", body: `{"fromID":`, want: http.StatusBadRequest},
+		{name: "unknown sender", body: `{"fromID": 9, "message": "hi"}`, want: http.StatusNotFound},
+		{name: "unknown group", body: `{"fromID": 1, "group": "family", "message": "hi"}`, want: http.StatusNotFound},
+		// the sender is the only member left
+		{name: "only the sender", body: `{"fromID": 4, "group": "solo", "message": "hi"}`, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := do(t, router, http.MethodPost, "/broadcast", tt.body); code != tt.want {
+				t.Errorf("POST /broadcast = %d %s, want %d", code, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcastHandlerRecipients(t *testing.T) {
+	router := newTestRouter()
+	producer := newTestProducer(t)
+	router.POST("/broadcast", broadcastHandler(producer, groupUsers(), newTestLimiter(producer)))
+
+	tests := []struct {
+		name string
+		body string
+		// wantTo are the recipients in order, the sender is skipped
+		wantTo []string
+	}{
+		{name: "group", body: `{"fromID": 2, "group": "work", "message": "hi"}`, wantTo: []string{`"toID":3`}},
+		{name: "everybody", body: `{"fromID": 1, "message": "hi"}`, wantTo: []string{`"toID":2`, `"toID":3`, `"toID":4`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// no broker: every delivery fails after the message timeout
+			code, body := do(t, router, http.MethodPost, "/broadcast", tt.body)
+			if code != http.StatusMultiStatus {
+				t.Fatalf("POST /broadcast = %d %s, want 207", code, body)
+			}
+			if !strings.Contains(body, `"broadcast_id":"`) || strings.Count(body, `"toID"`) != len(tt.wantTo) {
+				t.Errorf("answer = %s, want a broadcast id and %d deliveries", body, len(tt.wantTo))
+			}
+			for _, to := range tt.wantTo {
+				if !strings.Contains(body, to) {
+					t.Errorf("answer = %s, want a delivery with %s", body, to)
+				}
+			}
+		})
+	}
+}
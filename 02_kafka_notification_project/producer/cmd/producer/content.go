@@ -0,0 +1,87 @@
+package main
+
+import (
+	"config"
+	"fmt"
+	"net/http"
+	"producer/pkg/models"
+	"schema"
+	"templates"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Composer turns the template or the structured fields of a send request
+// into the content of one recipient's notification.
+type Composer struct {
+	catalog *templates.Catalog
+	// render is the default mode, send or client
+	render string
+}
+
+func newComposer(cfg config.TemplatesConfig) (*Composer, error) {
+	catalog, err := templates.Load(cfg.File, cfg.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
+	return &Composer{catalog: catalog, render: cfg.Render}, nil
+}
+
+func (req sendRequest) structured() bool {
+	return req.Title != "" || req.Body != "" || req.ActionURL != "" || req.Priority != ""
+}
+
+// compose returns the message and the content of the notification from
+// from to to. Templates are always rendered, in the recipient's locale, to
+// check the variables and to fill the message older clients show; in client
+// mode the content stays raw for the consumer API.
+func (c *Composer) compose(req sendRequest, from, to models.User) (string, *schema.Content, error) {
+	if req.Template == "" && !req.structured() {
+		return req.Message, nil, nil
+	}
+
+	render := c.render
+	if req.Render != "" {
+		render = req.Render
+	}
+	if render != config.RenderSend && render != config.RenderClient {
+		return "", nil, fmt.Errorf("%w: render must be %s or %s", ErrInvalidSendRequest, config.RenderSend, config.RenderClient)
+	}
+
+	raw := schema.Content{
+		Template:  req.Template,
+		Variables: req.Variables,
+		Title:     req.Title,
+		Body:      req.Body,
+		ActionURL: req.ActionURL,
+		Priority:  req.Priority,
+		// structured fields without a template are final
+		Rendered: req.Template == "",
+	}
+	rendered, err := c.catalog.Render(raw, from, to, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidSendRequest, err)
+	}
+
+	message := req.Message
+	if message == "" {
+		message = rendered.Body
+	}
+	if message == "" {
+		message = rendered.Title
+	}
+	if render == config.RenderClient {
+		return message, &raw, nil
+	}
+	return message, &rendered, nil
+}
+
+// templatesHandler lists the templates, so clients know what they can send.
+func templatesHandler(composer *Composer) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{
+			"templates": composer.catalog.Templates(),
+			"render":    composer.render,
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"config"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"producer/pkg/models"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestComposer has the built in templates and renders on send.
+func newTestComposer() *Composer {
+	composer, err := newComposer(config.Default().Templates)
+	if err != nil {
+		panic(err)
+	}
+	return composer
+}
+
+func TestCompose(t *testing.T) {
+	emma := models.User{ID: 1, Name: "Emma"}
+	lena := models.User{ID: 4, Name: "Lena", Locale: "fr"}
+	mention := map[string]string{"excerpt": "see you", "url": "/posts/7"}
+
+	tests := []struct {
+		name        string
+		req         sendRequest
+		wantMessage string
+		wantRaw     bool
+		wantTitle   string
+		wantErr     bool
+	}{
+		{name: "plain", req: sendRequest{Message: "hi"}, wantMessage: "hi"},
+		{
+			name:        "template in the recipient's locale",
+			req:         sendRequest{Template: "friend_request"},
+			wantMessage: "Emma souhaite devenir votre ami.",
+			wantTitle:   "Nouvelle demande d'ami",
+		},
+		{
+			name:        "message over the rendered body",
+			req:         sendRequest{Template: "mention", Variables: mention, Message: "Emma mentioned you"},
+			wantMessage: "Emma mentioned you",
+			wantTitle:   "Emma vous a mentionné",
+		},
+		{
+			name:        "client render",
+			req:         sendRequest{Template: "friend_request", Render: config.RenderClient},
+			wantMessage: "Emma souhaite devenir votre ami.",
+			wantRaw:     true,
+		},
+		{
+			name:        "structured without a template",
+			req:         sendRequest{Title: "Deploy done"},
+			wantMessage: "Deploy done",
+			wantTitle:   "Deploy done",
+		},
+		{name: "unknown render", req: sendRequest{Template: "friend_request", Render: "later"}, wantErr: true},
+		{name: "unknown template", req: sendRequest{Template: "invoice"}, wantErr: true},
+		{name: "missing variable", req: sendRequest{Template: "mention"}, wantErr: true},
+		{name: "unsafe action url", req: sendRequest{Body: "click", ActionURL: "javascript:alert(1)"}, wantErr: true},
+		{name: "unknown priority", req: sendRequest{Body: "hi", Priority: "loud"}, wantErr: true},
+	}
+	composer := newTestComposer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, content, err := composer.compose(tt.req, emma, lena)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSendRequest) {
+					t.Errorf("compose = %v, want ErrInvalidSendRequest", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", message, tt.wantMessage)
+			}
+			switch {
+			case tt.req.Template == "" && !tt.req.structured():
+				if content != nil {
+					t.Errorf("content = %+v, want none", content)
+				}
+			case tt.wantRaw:
+				if content.Rendered || content.Title != "" || content.Template != tt.req.Template {
+					t.Errorf("content = %+v, want the raw template", content)
+				}
+			default:
+				if !content.Rendered || content.Title != tt.wantTitle {
+					t.Errorf("content = %+v, want rendered with title %q", content, tt.wantTitle)
+				}
+			}
+		})
+	}
+}
+
+func TestGetSendRequestFormVariables(t *testing.T) {
+	var req sendRequest
+	router := gin.New()
+	router.POST("/send", func(ctx *gin.Context) {
+		req, _ = getSendRequest(ctx)
+	})
+	form := url.Values{"fromID": {"1"}, "toID": {"2"}, "template": {"mention"}, "variables[excerpt]": {"see you"}, "variables[url]": {"/posts/7"}}
+	r := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	if want := map[string]string{"excerpt": "see you", "url": "/posts/7"}; req.Template != "mention" || !reflect.DeepEqual(req.Variables, want) {
+		t.Errorf("getSendRequest = %+v, want the mention variables", req)
+	}
+}
+
+func TestSendTemplateValidation(t *testing.T) {
+	// nothing is produced when the content is invalid
+	router := newTestRouter()
+	router.POST("/send", sendMessageHandler(nil, testUsers(), newTestComposer(), newTestLimiter(nil)))
+	router.POST("/send/batch", sendBatchHandler(nil, testUsers(), newTestComposer(), newTestLimiter(nil)))
+
+	for path, body := range map[string]string{
+		"/send":       `{"fromID": 1, "toID": 2, "template": "invoice"}`,
+		"/send/batch": `{"items": [{"fromID": 1, "toID": 2, "message": "hi"}, {"fromID": 1, "toID": 3, "template": "mention"}]}`,
+	} {
+		if code, response := do(t, router, http.MethodPost, path, body); code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d %s, want 400", path, code, response)
+		}
+	}
+}
+
+func TestTemplatesHandler(t *testing.T) {
+	router := newTestRouter()
+	router.GET("/templates", templatesHandler(newTestComposer()))
+
+	code, body := do(t, router, http.MethodGet, "/templates", "")
+	var response struct {
+		Templates []struct {
+			Name string `json:"name"`
+		} `json:"templates"`
+		Render string `json:"render"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || len(response.Templates) != 2 || response.Templates[0].Name != "friend_request" || response.Render != config.RenderSend {
+		t.Errorf("GET /templates = %d %s, want the built in templates", code, body)
+	}
+}
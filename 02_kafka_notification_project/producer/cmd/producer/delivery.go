@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"producer/pkg/models"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	// DeliveryUnknown means we gave up waiting, the message may still reach the broker
+	DeliveryUnknown = "unknown"
+)
+
+// deliveryReport is what the broker told us about one notification.
+type deliveryReport struct {
+	ToID      int    `json:"toID"`
+	Status    string `json:"status"`
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// produceAndWait sends the notifications and waits up to timeout for their
+// delivery reports. Reports come back in the order of notifications, the
+// second value is how many were not delivered.
+func produceAndWait(producer *Producer, notifications []models.Notification, timeout time.Duration) ([]deliveryReport, int) {
+	reports := make([]deliveryReport, len(notifications))
+	deliveryChan := make(chan kafka.Event, len(notifications))
+
+	pending := 0
+	for i, notification := range notifications {
+		reports[i].ToID = notification.To.ID
+		// the opaque value tells us which report a delivery event belongs to
+		if err := sendKafKaMessage(producer, notification, deliveryChan, i); err != nil {
+			recordDeliveryError(producer.topic, err)
+			reports[i].Status = DeliveryFailed
+			reports[i].Error = err.Error()
+			continue
+		}
+		pending++
+	}
+
+	deadline := time.After(timeout)
+	for pending > 0 {
+		select {
+		case e := <-deliveryChan:
+			msg, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			pending--
+			recordDelivery(msg)
+
+			i := msg.Opaque.(int)
+			if msg.TopicPartition.Error != nil {
+				reports[i].Status = DeliveryFailed
+				reports[i].Error = msg.TopicPartition.Error.Error()
+				continue
+			}
+			partition := msg.TopicPartition.Partition
+			offset := int64(msg.TopicPartition.Offset)
+			reports[i].Status = DeliveryDelivered
+			reports[i].Partition = &partition
+			reports[i].Offset = &offset
+		case <-deadline:
+			producer.awaitLate(deliveryChan, pending)
+			pending = 0
+		}
+	}
+
+	failed := 0
+	for i := range reports {
+		if reports[i].Status == "" {
+			reports[i].Status = DeliveryUnknown
+			reports[i].Error = "timed out waiting for delivery report"
+		}
+		if reports[i].Status != DeliveryDelivered {
+			failed++
+		}
+	}
+	return reports, failed
+}
+
+// awaitLate keeps reading the delivery reports a request stopped waiting
+// for, so their failures still get logged, on shutdown too.
+func (p *Producer) awaitLate(deliveryChan chan kafka.Event, pending int) {
+	p.late.Add(1)
+	go func() {
+		defer p.late.Done()
+		for pending > 0 {
+			if msg, ok := (<-deliveryChan).(*kafka.Message); ok {
+				pending--
+				recordDelivery(msg)
+				logDeliveryFailure(msg)
+			}
+		}
+	}()
+}
+
+func logDeliveryFailure(msg *kafka.Message) {
+	if msg.TopicPartition.Error != nil {
+		log.Printf("delivery failed for key %s: %v\n", msg.Key, msg.TopicPartition.Error)
+	}
+}
+
+// drainProducerEvents logs what lands on producer.Events(): delivery reports
+// of messages produced without a delivery channel and client level errors.
+// Nobody reading it would eventually block the producer.
+func drainProducerEvents(producer *kafka.Producer) {
+	for e := range producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			recordDelivery(ev)
+			logDeliveryFailure(ev)
+		case kafka.Error:
+			log.Printf("kafka producer error: %v\n", ev)
+		}
+	}
+}
+
+// Shutdown gives the queued messages up to timeout to reach the brokers,
+// purges the rest and closes the producer. It returns how many messages were
+// not delivered, each of them is logged with its key.
+func (p *Producer) Shutdown(timeout time.Duration) int {
+	undelivered := p.Flush(int(timeout.Milliseconds()))
+	if undelivered > 0 {
+		p.Purge(kafka.PurgeQueue | kafka.PurgeInFlight | kafka.PurgeNonBlocking)
+		// serves the delivery reports of the purged messages
+		p.Flush(int(time.Second.Milliseconds()))
+	}
+
+	lateDone := make(chan struct{})
+	go func() {
+		p.late.Wait()
+		close(lateDone)
+	}()
+	select {
+	case <-lateDone:
+	case <-time.After(time.Second):
+		log.Println("gave up waiting for the last delivery reports")
+	}
+
+	p.Close()
+	return undelivered
+}
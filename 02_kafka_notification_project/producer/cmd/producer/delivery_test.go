@@ -0,0 +1,39 @@
+package main
+
+import (
+	"producer/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestProduceAndWait(t *testing.T) {
+	notifications := []models.Notification{
+		{From: models.User{ID: 1}, To: models.User{ID: 2}},
+		{From: models.User{ID: 1}, To: models.User{ID: 3}},
+	}
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    string
+	}{
+		// the test producer gives up on a message after 300ms
+		{name: "broker unreachable", timeout: 5 * time.Second, want: DeliveryFailed},
+		{name: "gave up waiting", timeout: 50 * time.Millisecond, want: DeliveryUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports, failed := produceAndWait(newTestProducer(t), notifications, tt.timeout)
+			if failed != len(notifications) {
+				t.Errorf("failed = %d, want %d", failed, len(notifications))
+			}
+			for i, report := range reports {
+				if report.ToID != notifications[i].To.ID || report.Status != tt.want || report.Error == "" {
+					t.Errorf("report %d = %+v, want %s for user %d", i, report, tt.want, notifications[i].To.ID)
+				}
+				if report.Partition != nil || report.Offset != nil {
+					t.Errorf("report %d has a partition or offset without delivery", i)
+				}
+			}
+		})
+	}
+}
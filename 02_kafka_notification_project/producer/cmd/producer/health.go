@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/gin-gonic/gin"
+)
+
+// HealthCheckTimeout bounds the metadata request of a single /readyz call.
+const HealthCheckTimeout = 3 * time.Second
+
+// Health answers /readyz: the brokers serve metadata for the notifications
+// topic and the producer queue is not backed up.
+type Health struct {
+	producer *Producer
+	maxQueue int
+}
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type brokersCheck struct {
+	checkResult
+	Brokers    int   `json:"brokers"`
+	Partitions []int `json:"partitions"`
+	// Leaderless partitions can't take writes until a new leader is elected
+	Leaderless []int `json:"leaderless_partitions"`
+}
+
+type queueCheck struct {
+	checkResult
+	Depth int `json:"depth"`
+	Max   int `json:"max"`
+}
+
+func (h *Health) checkBrokers() brokersCheck {
+	check := brokersCheck{Partitions: []int{}, Leaderless: []int{}}
+	topic := h.producer.topic
+	metadata, err := h.producer.GetMetadata(&topic, false, int(HealthCheckTimeout.Milliseconds()))
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Brokers = len(metadata.Brokers)
+
+	topicMetadata, ok := metadata.Topics[topic]
+	if !ok {
+		check.Error = fmt.Sprintf("no metadata for topic %s", topic)
+		return check
+	}
+	if topicMetadata.Error.Code() != kafka.ErrNoError {
+		check.Error = topicMetadata.Error.Error()
+		return check
+	}
+	for _, partition := range topicMetadata.Partitions {
+		check.Partitions = append(check.Partitions, int(partition.ID))
+		if partition.Leader < 0 {
+			check.Leaderless = append(check.Leaderless, int(partition.ID))
+		}
+	}
+	sort.Ints(check.Partitions)
+	sort.Ints(check.Leaderless)
+
+	if len(check.Partitions) == 0 {
+		check.Error = fmt.Sprintf("topic %s has no partitions", topic)
+		return check
+	}
+	if len(check.Leaderless) == len(check.Partitions) {
+		check.Error = fmt.Sprintf("no partition of %s has a leader", topic)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+func (h *Health) checkQueue() queueCheck {
+	// messages waiting to be sent plus the ones waiting for their acks
+	check := queueCheck{Depth: h.producer.Len(), Max: h.maxQueue}
+	if check.Depth >= check.Max {
+		check.Error = fmt.Sprintf("%d messages queued, the brokers are not keeping up", check.Depth)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// healthzHandler is the liveness probe, it only tells the process serves HTTP.
+func healthzHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func readyzHandler(health *Health) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		brokers := health.checkBrokers()
+		queue := health.checkQueue()
+
+		status, code := "ready", http.StatusOK
+		if !brokers.OK || !queue.OK {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+		ctx.JSON(code, gin.H{
+			"status": status,
+			"checks": gin.H{
+				"brokers": brokers,
+				"queue":   queue,
+			},
+		})
+	}
+}
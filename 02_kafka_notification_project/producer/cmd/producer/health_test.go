@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"producer/pkg/models"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealthz(t *testing.T) {
+	router := gin.New()
+	router.GET("/healthz", healthzHandler())
+	if code, body := do(t, router, http.MethodGet, "/healthz", ""); code != http.StatusOK {
+		t.Errorf("GET /healthz = %d %s, want 200", code, body)
+	}
+}
+
+func TestCheckQueue(t *testing.T) {
+	producer := newTestProducer(t)
+	// Len counts the unread client events too
+	go drainProducerEvents(producer.Producer)
+	health := &Health{producer: producer, maxQueue: 50}
+	if check := health.checkQueue(); !check.OK {
+		t.Errorf("empty queue = %+v, want ok", check)
+	}
+
+	// the messages wait for a broker that never answers
+	for i := 0; i < 50; i++ {
+		notification := models.Notification{From: models.User{ID: 1}, To: models.User{ID: 2}}
+		if err := sendKafKaMessage(producer, notification, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if check := health.checkQueue(); check.OK || check.Depth < 50 {
+		t.Errorf("backed up queue = %+v, want a failure", check)
+	}
+}
+
+func TestReadyzWithoutBrokers(t *testing.T) {
+	producer := newTestProducer(t)
+	go drainProducerEvents(producer.Producer)
+	router := gin.New()
+	router.GET("/readyz", readyzHandler(&Health{producer: producer, maxQueue: 10}))
+
+	code, body := do(t, router, http.MethodGet, "/readyz", "")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /readyz = %d %s, want 503", code, body)
+	}
+	if !strings.Contains(body, `"brokers":{"ok":false`) || !strings.Contains(body, `"queue":{"ok":true`) {
+		t.Errorf("checks = %s, want only the brokers failing", body)
+	}
+}
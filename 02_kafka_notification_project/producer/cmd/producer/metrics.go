@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	notificationsProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_produced_total",
+		Help: "Notifications acknowledged by the brokers.",
+	}, []string{"topic"})
+	deliveryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_delivery_errors_total",
+		Help: "Notifications that never reached the brokers, by kafka error code.",
+	}, []string{"topic", "error"})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_rate_limited_total",
+		Help: "Send requests turned down with a 429, by the limit they hit.",
+	}, []string{"limit"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests, sends include waiting for the delivery reports.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// registerQueueDepth exports the producer queue, the same number /readyz checks.
+func registerQueueDepth(producer *Producer) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "notifications_producer_queue_depth",
+		Help: "Messages waiting to be sent or acknowledged.",
+	}, func() float64 {
+		return float64(producer.Len())
+	}))
+}
+
+// recordDelivery counts the delivery report of a message.
+func recordDelivery(msg *kafka.Message) {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	if msg.TopicPartition.Error != nil {
+		recordDeliveryError(topic, msg.TopicPartition.Error)
+		return
+	}
+	notificationsProduced.WithLabelValues(topic).Inc()
+}
+
+// recordDeliveryError counts a message that failed, either in its delivery
+// report or before it could be queued (encoding, full queue).
+func recordDeliveryError(topic string, err error) {
+	code := "local"
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		code = kafkaErr.Code().String()
+	}
+	deliveryErrors.WithLabelValues(topic, code).Inc()
+}
+
+// httpMetrics times every request, labelled with the route pattern so
+// /users/:userID stays one series whatever the user.
+func httpMetrics() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.
+			WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
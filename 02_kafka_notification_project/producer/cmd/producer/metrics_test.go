@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/gin-gonic/gin"
+)
+
+// scrape returns what Prometheus would read from /metrics.
+func scrape(t *testing.T) string {
+	t.Helper()
+	router := gin.New()
+	router.GET("/metrics", metricsHandler())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestRecordDelivery(t *testing.T) {
+	// the counters are global, start from none when the test runs again
+	notificationsProduced.Reset()
+	deliveryErrors.Reset()
+	topic := "metrics-test"
+	delivered := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	failed := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Error: kafka.NewError(kafka.ErrMsgTimedOut, "timed out", false)}}
+
+	recordDelivery(delivered)
+	recordDelivery(delivered)
+	recordDelivery(failed)
+	recordDeliveryError(topic, errors.New("failed to encode notification"))
+
+	text := scrape(t)
+	for _, line := range []string{
+		`notifications_produced_total{topic="metrics-test"} 2`,
+		`notifications_delivery_errors_total{error="` + kafka.ErrMsgTimedOut.String() + `",topic="metrics-test"} 1`,
+		`notifications_delivery_errors_total{error="local",topic="metrics-test"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics miss %q", line)
+		}
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	httpRequestDuration.Reset()
+	router := gin.New()
+	router.Use(httpMetrics())
+	router.GET("/users/:userID", func(ctx *gin.Context) {
+		ctx.Status(http.StatusNoContent)
+	})
+	for _, path := range []string{"/users/1", "/users/2", "/nowhere"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	text := scrape(t)
+	for _, line := range []string{
+		`http_request_duration_seconds_count{method="GET",route="/users/:userID",status="204"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics miss %q", line)
+		}
+	}
+}
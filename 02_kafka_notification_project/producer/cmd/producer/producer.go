@@ -1,114 +1,286 @@
 package main
 
 import (
-	"encoding/json"
+	"auth"
+	"config"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"producer/pkg/directory"
 	"producer/pkg/models"
+	"schema"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	ProducePort        = ":8083"
-	KafkaServerAddress = "localhost:9094"
+	// MaxRecipients caps the fan-out of a single notification
+	MaxRecipients = 100
 )
 
-var ErruserNotFoundInProducer = errors.New("user not found")
+var ErrInvalidSendRequest = errors.New("invalid send request")
 
-func findByUserID(id int, users []models.User) (models.User, error) {
-	for _, user := range users {
-		if user.ID == id {
-			return user, nil
-		}
+// defaultUsers seed an empty user directory.
+var defaultUsers = []models.User{
+	{ID: 1, Name: "Emma", Groups: []string{"friends"}},
+	{ID: 2, Name: "Bruno", Groups: []string{"friends", "work"}, Locale: "pt-BR"},
+	{ID: 3, Name: "Rick", Groups: []string{"work"}},
+	{ID: 4, Name: "Lena", Groups: []string{"friends"}, Locale: "fr"},
+}
+
+func openUserDirectory(cfg config.Config, producer *kafka.Producer) (directory.UserDirectory, error) {
+	var users directory.UserDirectory
+	var err error
+
+	dir := cfg.Producer.UserDirectory
+	switch dir.Backend {
+	case "memory":
+		users = directory.NewMemoryDirectory()
+	case "file":
+		users, err = directory.OpenFileDirectory(dir.File, dir.ReloadInterval)
+	case "kafka":
+		users, err = directory.OpenKafkaDirectory(producer, kafkaClientConfig(cfg.Kafka), cfg.Topics.Users, dir.Timeout)
+	default:
+		err = fmt.Errorf("unknown user directory backend %q", dir.Backend)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return models.User{}, ErruserNotFoundInProducer
+	if err := directory.Seed(users, defaultUsers); err != nil {
+		users.Close()
+		return nil, err
+	}
+	return users, nil
 }
 
-func getIDFromRequest(formValue string, ctx *gin.Context) (int, error) {
-	id, err := strconv.Atoi(ctx.PostForm(formValue))
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse ID from form value %s: %w", formValue, err)
+// sendRequest is the body of POST /send, either JSON or form fields.
+type sendRequest struct {
+	FromID  int    `json:"fromID" form:"fromID"`
+	ToID    int    `json:"toID" form:"toID"`
+	ToIDs   []int  `json:"toIDs" form:"toIDs"`
+	Message string `json:"message" form:"message"`
+
+	// Template and its Variables, or Title, Body, ActionURL and Priority,
+	// make a structured notification, Message is then optional
+	Template  string            `json:"template" form:"template"`
+	Variables map[string]string `json:"variables" form:"variables"`
+	Title     string            `json:"title" form:"title"`
+	Body      string            `json:"body" form:"body"`
+	ActionURL string            `json:"action_url" form:"action_url"`
+	Priority  string            `json:"priority" form:"priority"`
+	// Render overrides templates.render for this request: send or client
+	Render string `json:"render" form:"render"`
+}
+
+// recipients merges toID and toIDs, without duplicates.
+func (req sendRequest) recipients() []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, id := range append([]int{req.ToID}, req.ToIDs...) {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func getSendRequest(ctx *gin.Context) (sendRequest, error) {
+	var req sendRequest
+	// picks the JSON or form binding from the Content-Type
+	if err := ctx.ShouldBind(&req); err != nil {
+		return req, fmt.Errorf("failed to parse request: %w", err)
+	}
+	// the form binding doesn't fill maps, forms send variables[name]=value
+	if req.Variables == nil && ctx.ContentType() != gin.MIMEJSON {
+		if variables, ok := ctx.GetPostFormMap("variables"); ok {
+			req.Variables = variables
+		}
 	}
-	return id, nil
+	return req, nil
 }
 
-func setupProducer() (*kafka.Producer, error) {
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers":  KafkaServerAddress,
-		"enable.idempotence": true,
-		"acks":               "all",
-		"retries":            10,
-	})
+// buildNotifications resolves the users of a request, one notification per recipient.
+func buildNotifications(users directory.UserDirectory, composer *Composer, req sendRequest) ([]models.Notification, error) {
+	if req.FromID <= 0 {
+		return nil, fmt.Errorf("%w: fromID is required", ErrInvalidSendRequest)
+	}
+
+	toIDs := req.recipients()
+	if len(toIDs) == 0 {
+		return nil, fmt.Errorf("%w: toID or toIDs is required", ErrInvalidSendRequest)
+	}
+	if len(toIDs) > MaxRecipients {
+		return nil, fmt.Errorf("%w: at most %d recipients per notification", ErrInvalidSendRequest, MaxRecipients)
+	}
 
+	fromUser, err := users.Get(req.FromID)
 	if err != nil {
 		return nil, err
 	}
 
-	return producer, nil
+	notifications := make([]models.Notification, 0, len(toIDs))
+	for _, toID := range toIDs {
+		toUser, err := users.Get(toID)
+		if err != nil {
+			return nil, err
+		}
+		message, content, err := composer.compose(req, fromUser, toUser)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, models.Notification{
+			From:    fromUser,
+			To:      toUser,
+			Message: message,
+			Content: content,
+		})
+	}
+	return notifications, nil
 }
 
-func sendKafKaMessage(producer *kafka.Producer, user []models.User, ctx *gin.Context, fromID, toID int) error {
-	message := ctx.PostForm("message")
+// Producer is the kafka producer plus where and how notifications are written.
+type Producer struct {
+	*kafka.Producer
+	topic           string
+	format          schema.Format
+	deliveryTimeout time.Duration
+	// queueWait is how long a produce waits for room in a full queue
+	queueWait time.Duration
 
-	fromUser, err := findByUserID(fromID, user)
+	// late tracks the requests that gave up on their delivery reports
+	late sync.WaitGroup
+}
+
+// kafkaClientConfig holds the connection settings shared by every kafka client.
+func kafkaClientConfig(cfg config.KafkaConfig) kafka.ConfigMap {
+	clientConfig := kafka.ConfigMap{
+		"bootstrap.servers": strings.Join(cfg.Brokers, ","),
+		"security.protocol": cfg.SecurityProtocol(),
+	}
+	if cfg.TLS.Enabled {
+		if cfg.TLS.CAFile != "" {
+			clientConfig["ssl.ca.location"] = cfg.TLS.CAFile
+		}
+		if cfg.TLS.CertFile != "" {
+			clientConfig["ssl.certificate.location"] = cfg.TLS.CertFile
+			clientConfig["ssl.key.location"] = cfg.TLS.KeyFile
+		}
+		if cfg.TLS.InsecureSkipVerify {
+			clientConfig["enable.ssl.certificate.verification"] = false
+		}
+	}
+	if cfg.SASL.Mechanism != "" {
+		clientConfig["sasl.mechanisms"] = cfg.SASL.Mechanism
+		clientConfig["sasl.username"] = cfg.SASL.Username
+		clientConfig["sasl.password"] = cfg.SASL.Password
+	}
+	return clientConfig
+}
+
+func setupProducer(cfg config.Config) (*Producer, error) {
+	format, err := schema.ParseFormat(cfg.Producer.WireFormat)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	toUser, err := findByUserID(toID, user)
+	producerConfig := kafkaClientConfig(cfg.Kafka)
+	producerConfig["enable.idempotence"] = cfg.Producer.EnableIdempotence
+	producerConfig["acks"] = cfg.Producer.Acks
+	producerConfig["retries"] = cfg.Producer.Retries
+	producerConfig["linger.ms"] = int(cfg.Producer.Linger.Milliseconds())
+	producerConfig["compression.type"] = cfg.Producer.Compression
+	// the consumers find the instance holding a user by hashing the key the same way
+	producerConfig["partitioner"] = "consistent_random"
+
+	producer, err := kafka.NewProducer(&producerConfig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	notification := models.Notification{
-		From:    fromUser,
-		To:      toUser,
-		Message: message,
+	return &Producer{
+		Producer:        producer,
+		topic:           cfg.Topics.Notifications,
+		format:          format,
+		deliveryTimeout: cfg.Producer.DeliveryTimeout,
+		queueWait:       cfg.Producer.RateLimit.MaxWait,
+	}, nil
+}
+
+func sendKafKaMessage(producer *Producer, notification models.Notification, deliveryChan chan kafka.Event, opaque interface{}) error {
+	envelope, err := schema.NewEnvelope(notification)
+	if err != nil {
+		return fmt.Errorf("failed to create envelope: %w", err)
 	}
 
-	notificationJSON, err := json.Marshal(notification)
+	value, err := schema.Encode(envelope, producer.format)
 	if err != nil {
-		return fmt.Errorf("failed to marshal notification: %w", err)
+		return fmt.Errorf("failed to encode notification: %w", err)
 	}
 
-	topic := "notifications"
-	err = producer.Produce(&kafka.Message{
+	var headers []kafka.Header
+	for key, value := range producer.format.Headers() {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+
+	topic := producer.topic
+	msg := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{
 			Topic:     &topic,
 			Partition: kafka.PartitionAny,
 		},
-		Value: notificationJSON,
-		Key:   []byte(strconv.Itoa(toUser.ID)),
-	}, nil)
+		Value:   value,
+		Key:     []byte(strconv.Itoa(notification.To.ID)),
+		Headers: headers,
+		Opaque:  opaque,
+	}
 
-	return err
+	// the queue drains as the brokers ack, wait for room rather than fail
+	deadline := time.Now().Add(producer.queueWait)
+	for {
+		err = producer.Produce(msg, deliveryChan)
+		var kafkaErr kafka.Error
+		if !errors.As(err, &kafkaErr) || kafkaErr.Code() != kafka.ErrQueueFull || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(QueueFullBackoff)
+	}
 }
 
-func sendMessageHandler(producer *kafka.Producer, users []models.User) gin.HandlerFunc {
+func sendMessageHandler(producer *Producer, users directory.UserDirectory, composer *Composer, limiter *Limiter) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		fromID, err := getIDFromRequest("fromID", ctx)
+		req, err := getSendRequest(ctx)
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 			return
 		}
-
-		toID, err := getIDFromRequest("toID", ctx)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		if err := bindSender(ctx, &req.FromID); err != nil {
+			forbidden(ctx, err)
 			return
 		}
 
-		err = sendKafKaMessage(producer, users, ctx, fromID, toID)
-		if errors.Is(err, ErruserNotFoundInProducer) {
+		notifications, err := buildNotifications(users, composer, req)
+		if errors.Is(err, directory.ErrUserNotFound) {
 			ctx.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
 			return
 		}
+		if errors.Is(err, ErrInvalidSendRequest) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
 
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -116,33 +288,120 @@ func sendMessageHandler(producer *kafka.Producer, users []models.User) gin.Handl
 			})
 			return
 		}
+		if !limitSend(ctx, limiter, notifications) {
+			return
+		}
+
+		reports, failed := produceAndWait(producer, notifications, producer.deliveryTimeout)
+		if failed > 0 {
+			// report the first broker error, the per recipient details are in deliveries
+			var message string
+			for _, report := range reports {
+				if report.Error != "" {
+					message = report.Error
+					break
+				}
+			}
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{
+				"message":    message,
+				"deliveries": reports,
+			})
+			return
+		}
 
-		ctx.JSON(http.StatusOK, gin.H{
-			"message": "Notification sent successfully\n",
-		})
+		response := gin.H{
+			"message":    "Notification sent successfully\n",
+			"deliveries": reports,
+		}
+		if len(reports) == 1 {
+			response["partition"] = reports[0].Partition
+			response["offset"] = reports[0].Offset
+		}
+		ctx.JSON(http.StatusOK, response)
 	}
 }
 
 func main() {
-	users := []models.User{
-		{ID: 1, Name: "Emma"},
-		{ID: 2, Name: "Bruno"},
-		{ID: 3, Name: "Rick"},
-		{ID: 4, Name: "Lena"},
+	cfg, err := config.Load(config.Producer, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-	producer, err := setupProducer()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	producer, err := setupProducer(cfg)
 	if err != nil {
 		log.Fatalf("failed to initialize producer: %v", err)
 	}
-	defer producer.Close()
+	go drainProducerEvents(producer.Producer)
+
+	users, err := openUserDirectory(cfg, producer.Producer)
+	if err != nil {
+		producer.Close()
+		log.Fatalf("failed to open user directory: %v", err)
+	}
+
+	composer, err := newComposer(cfg.Templates)
+	if err != nil {
+		users.Close()
+		producer.Close()
+		log.Fatalf("failed to load templates: %v", err)
+	}
+
+	registerQueueDepth(producer)
 
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
-	router.POST("/send", sendMessageHandler(producer, users))
+	router.Use(httpMetrics())
+	router.GET("/metrics", metricsHandler())
+	router.GET("/healthz", healthzHandler())
+	router.GET("/readyz", readyzHandler(&Health{producer: producer, maxQueue: cfg.Producer.ReadyMaxQueue}))
 
-	fmt.Printf("Kafka PRODUCER: started at http://localhost%s\n", ProducePort)
+	authenticators := auth.New(cfg.Auth)
+	if authenticators == nil {
+		log.Println("auth is disabled, anyone can send as any user")
+	}
+	api := router.Group("", auth.Middleware(authenticators))
+	limiter := newLimiter(cfg.Producer, producer)
+	api.POST("/send", sendMessageHandler(producer, users, composer, limiter))
+	api.POST("/send/batch", sendBatchHandler(producer, users, composer, limiter))
+	api.POST("/broadcast", broadcastHandler(producer, users, limiter))
+	api.GET("/templates", templatesHandler(composer))
+	registerUserRoutes(api, users)
+
+	server := &http.Server{
+		Addr:    cfg.Producer.HTTPAddr,
+		Handler: router,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Kafka PRODUCER: listening on %s\n", cfg.Producer.HTTPAddr)
+		serverErr <- server.ListenAndServe()
+	}()
 
-	if err := router.Run(ProducePort); err != nil {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		log.Printf("received %s, shutting down producer...", s)
+	case err := <-serverErr:
 		log.Printf("failed to run the server: %v", err)
 	}
+
+	// stop accepting requests and let the running ones get their delivery reports
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Producer.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("some requests did not finish in time: %v", err)
+	}
+
+	if err := users.Close(); err != nil {
+		log.Printf("failed to close user directory: %v", err)
+	}
+	if undelivered := producer.Shutdown(cfg.Producer.FlushTimeout); undelivered > 0 {
+		log.Printf("%d messages were not delivered before shutdown", undelivered)
+	} else {
+		log.Println("all messages delivered, producer stopped")
+	}
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"config"
+	"producer/pkg/models"
+	"schema"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+func TestSendKafkaMessageWritesEnvelope(t *testing.T) {
+	notification := models.Notification{
+		From:    models.User{ID: 1, Name: "Emma"},
+		To:      models.User{ID: 2, Name: "Bruno"},
+		Message: "hi",
+	}
+
+	for _, format := range []schema.Format{schema.FormatJSON, schema.FormatAvro} {
+		t.Run(string(format), func(t *testing.T) {
+			producer := newTestProducer(t)
+			producer.format = format
+
+			// the failed delivery hands the message back, as it was produced
+			deliveryChan := make(chan kafka.Event, 1)
+			if err := sendKafKaMessage(producer, notification, deliveryChan, nil); err != nil {
+				t.Fatal(err)
+			}
+			var msg *kafka.Message
+			select {
+			case event := <-deliveryChan:
+				msg = event.(*kafka.Message)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no delivery report")
+			}
+
+			if *msg.TopicPartition.Topic != "notifications" || string(msg.Key) != "2" {
+				t.Errorf("message went to %s with key %q, want notifications and the recipient", *msg.TopicPartition.Topic, msg.Key)
+			}
+			headers := map[string]string{}
+			for _, header := range msg.Headers {
+				headers[header.Key] = string(header.Value)
+			}
+			for key, want := range format.Headers() {
+				if headers[key] != want {
+					t.Errorf("header %s = %q, want %q", key, headers[key], want)
+				}
+			}
+
+			env, err := schema.Decode(msg.Value, headers[schema.HeaderContentType])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.SchemaVersion != schema.SchemaVersion || env.EventID == "" || env.Payload.Message != "hi" || env.Payload.To.ID != 2 {
+				t.Errorf("envelope = %+v", env)
+			}
+		})
+	}
+}
+
+func TestKafkaClientConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		kafka config.KafkaConfig
+		want  kafka.ConfigMap
+	}{
+		{
+			name:  "plaintext",
+			kafka: config.KafkaConfig{Brokers: []string{"a:9092", "b:9092"}},
+			want:  kafka.ConfigMap{"bootstrap.servers": "a:9092,b:9092", "security.protocol": "PLAINTEXT"},
+		},
+		{
+			name: "tls and sasl",
+			kafka: config.KafkaConfig{
+				Brokers: []string{"a:9093"},
+				TLS:     config.TLSConfig{Enabled: true, CAFile: "ca.pem", CertFile: "cert.pem", KeyFile: "key.pem", InsecureSkipVerify: true},
+				SASL:    config.SASLConfig{Mechanism: config.SASLScramSHA512, Username: "user", Password: "secret"},
+			},
+			want: kafka.ConfigMap{
+				"bootstrap.servers":                   "a:9093",
+				"security.protocol":                   "SASL_SSL",
+				"ssl.ca.location":                     "ca.pem",
+				"ssl.certificate.location":            "cert.pem",
+				"ssl.key.location":                    "key.pem",
+				"enable.ssl.certificate.verification": false,
+				"sasl.mechanisms":                     config.SASLScramSHA512,
+				"sasl.username":                       "user",
+				"sasl.password":                       "secret",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := kafkaClientConfig(tt.kafka)
+			if len(got) != len(tt.want) {
+				t.Errorf("kafkaClientConfig = %v, want %v", got, tt.want)
+			}
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetupProducer(t *testing.T) {
+	cfg := config.Default()
+	cfg.Kafka.Brokers = []string{"127.0.0.1:1"}
+	cfg.Producer.WireFormat = "avro"
+	producer, err := setupProducer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+	if producer.topic != cfg.Topics.Notifications || producer.format != schema.FormatAvro || producer.deliveryTimeout != cfg.Producer.DeliveryTimeout {
+		t.Errorf("producer = %+v, want the configured topic, format and timeout", producer)
+	}
+
+	cfg.Producer.WireFormat = "xml"
+	if _, err := setupProducer(cfg); err == nil {
+		t.Error("setupProducer with an unknown wire format succeeded")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"auth"
+	"config"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"producer/pkg/models"
+	"producer/pkg/ratelimit"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// QueueFullBackoff is how often a produce is retried while the producer queue is full.
+const QueueFullBackoff = 10 * time.Millisecond
+
+// RateLimitedError is a request over a limit, RetryAfter is when it would go through.
+type RateLimitedError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s rate limit exceeded, retry in %s", e.Limit, e.RetryAfter.Round(time.Millisecond))
+}
+
+// TooLargeError is a request needing more tokens than a bucket ever holds,
+// retrying can't help: it must be split.
+type TooLargeError struct {
+	Limit string
+	N     int
+	Burst int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("request needs %d %s tokens at once, the limit allows %d: split it into smaller requests", e.N, e.Limit, e.Burst)
+}
+
+// Limiter protects the recipients and the brokers from floods: token
+// buckets per sender and per recipient, sized by the caller's role, and a
+// global cap on the notifications produced plus room in the producer queue.
+type Limiter struct {
+	cfg        config.RateLimitConfig
+	senders    *ratelimit.Buckets
+	recipients *ratelimit.Buckets
+	global     *rate.Limiter
+	producer   *Producer
+	maxQueue   int
+}
+
+func newLimiter(cfg config.ProducerConfig, producer *Producer) *Limiter {
+	l := &Limiter{
+		cfg:        cfg.RateLimit,
+		senders:    ratelimit.NewBuckets(),
+		recipients: ratelimit.NewBuckets(),
+		producer:   producer,
+		maxQueue:   cfg.ReadyMaxQueue,
+	}
+	if cfg.RateLimit.GlobalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(cfg.RateLimit.GlobalRate), cfg.RateLimit.GlobalBurst)
+	}
+	return l
+}
+
+// roleLimits are the most generous limits of the principal's listed roles,
+// the sender and the recipient ones compared apart: a role may raise one and
+// not the other. The role is the one the recipient limits come from, the
+// recipient buckets are per role. Without auth everyone is the anonymous
+// admin, it gets the default limits.
+func (l *Limiter) roleLimits(principal auth.Principal) (string, config.RoleLimits) {
+	role, limits := config.DefaultRole, l.cfg.Roles[config.DefaultRole]
+	if principal.Anonymous() {
+		return role, limits
+	}
+	for _, candidate := range principal.Roles {
+		found, ok := l.cfg.Roles[candidate]
+		if !ok {
+			continue
+		}
+		if more(found.SenderRate, limits.SenderRate) {
+			limits.SenderRate, limits.SenderBurst = found.SenderRate, found.SenderBurst
+		}
+		if more(found.RecipientRate, limits.RecipientRate) {
+			role = candidate
+			limits.RecipientRate, limits.RecipientBurst = found.RecipientRate, found.RecipientBurst
+		}
+	}
+	return role, limits
+}
+
+// more compares rates where 0 is unlimited.
+func more(a, b float64) bool {
+	return b > 0 && (a == 0 || a > b)
+}
+
+// Allow takes the sender and recipient tokens of notifications, all or none.
+// The tokens taken are given back with Cancel when the request is turned
+// down later on.
+func (l *Limiter) Allow(principal auth.Principal, notifications []models.Notification) (ratelimit.Taken, error) {
+	if !l.cfg.Enabled || len(notifications) == 0 {
+		return ratelimit.Taken{}, nil
+	}
+	role, limits := l.roleLimits(principal)
+
+	perSender := make(map[int]int)
+	perRecipient := make(map[int]int)
+	for _, notification := range notifications {
+		perSender[notification.From.ID]++
+		perRecipient[notification.To.ID]++
+	}
+
+	var takes []ratelimit.Take
+	sender := ratelimit.Limit{Rate: limits.SenderRate, Burst: limits.SenderBurst}
+	for fromID, n := range perSender {
+		// a service key sends as many users, it is limited as a whole. Without
+		// auth the claimed sender is all we know of the caller.
+		key := principal.Subject
+		if principal.Anonymous() {
+			key += "/" + strconv.Itoa(fromID)
+		}
+		take := ratelimit.Take{Buckets: l.senders, Key: key, Limit: sender, N: n}
+		if take.OverBurst() {
+			return ratelimit.Taken{}, &TooLargeError{Limit: "sender", N: n, Burst: sender.Burst}
+		}
+		takes = append(takes, take)
+	}
+	recipient := ratelimit.Limit{Rate: limits.RecipientRate, Burst: limits.RecipientBurst}
+	for toID, n := range perRecipient {
+		key := role + "/" + strconv.Itoa(toID)
+		take := ratelimit.Take{Buckets: l.recipients, Key: key, Limit: recipient, N: n}
+		if take.OverBurst() {
+			return ratelimit.Taken{}, &TooLargeError{Limit: "recipient", N: n, Burst: recipient.Burst}
+		}
+		takes = append(takes, take)
+	}
+
+	taken, retryAfter, ok := ratelimit.TakeAll(takes...)
+	if !ok {
+		rateLimited.WithLabelValues("sender_recipient").Inc()
+		return ratelimit.Taken{}, &RateLimitedError{Limit: "sender or recipient", RetryAfter: retryAfter}
+	}
+	return taken, nil
+}
+
+// Admit waits for n notifications to fit under the global cap and in the
+// producer queue, up to max wait. Past that the caller should back off. A
+// request bigger than the whole queue goes once the queue is empty.
+func (l *Limiter) Admit(ctx context.Context, n int) error {
+	ctx, cancel := context.WithTimeout(ctx, l.cfg.MaxWait)
+	defer cancel()
+
+	if l.global != nil {
+		// a broadcast bigger than the burst takes the whole bucket
+		reservation := l.global.ReserveN(time.Now(), min(n, l.global.Burst()))
+		delay := reservation.Delay()
+		deadline, _ := ctx.Deadline()
+		if time.Now().Add(delay).After(deadline) {
+			reservation.Cancel()
+			rateLimited.WithLabelValues("global").Inc()
+			return &RateLimitedError{Limit: "global", RetryAfter: delay}
+		}
+		if err := sleepCtx(ctx, delay); err != nil {
+			reservation.Cancel()
+			return err
+		}
+	}
+
+	// the brokers are not keeping up, hold the request until the queue drains
+	for queued := l.producer.Len(); queued > 0 && queued+n > l.maxQueue; queued = l.producer.Len() {
+		if err := sleepCtx(ctx, QueueFullBackoff); err != nil {
+			rateLimited.WithLabelValues("queue_full").Inc()
+			return &RateLimitedError{Limit: "producer queue", RetryAfter: time.Second}
+		}
+	}
+	return nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limitSend applies every limit to notifications, false when the request
+// was turned down and the response already written.
+func limitSend(ctx *gin.Context, limiter *Limiter, notifications []models.Notification) bool {
+	principal, _ := auth.FromContext(ctx)
+	var limited *RateLimitedError
+	var tooLarge *TooLargeError
+	taken, err := limiter.Allow(principal, notifications)
+	if errors.As(err, &tooLarge) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": tooLarge.Error()})
+		return false
+	}
+	if errors.As(err, &limited) {
+		tooManyRequests(ctx, limited)
+		return false
+	}
+	if err := limiter.Admit(ctx.Request.Context(), len(notifications)); err != nil {
+		// the request doesn't go, neither do its sender and recipient tokens
+		taken.Cancel()
+		if errors.As(err, &limited) {
+			tooManyRequests(ctx, limited)
+			return false
+		}
+		// the client went away while waiting
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+		return false
+	}
+	return true
+}
+
+// tooManyRequests answers 429 with the seconds to wait in Retry-After.
+func tooManyRequests(ctx *gin.Context, err *RateLimitedError) {
+	seconds := max(int(math.Ceil(err.RetryAfter.Seconds())), 1)
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{
+		"message":     err.Error(),
+		"retry_after": seconds,
+	})
+}
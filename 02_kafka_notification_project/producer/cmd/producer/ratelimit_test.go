@@ -0,0 +1,288 @@
+package main
+
+import (
+	"auth"
+	"config"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"producer/pkg/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(producer *Producer) *Limiter {
+	return newLimiter(config.Default().Producer, producer)
+}
+
+// smallLimits allow 3 notifications per sender and per recipient.
+func smallLimits() config.ProducerConfig {
+	cfg := config.Default().Producer
+	cfg.RateLimit.Roles = map[string]config.RoleLimits{
+		config.DefaultRole: {SenderRate: 0.1, SenderBurst: 3, RecipientRate: 0.1, RecipientBurst: 3},
+		"partner":          {SenderRate: 1, SenderBurst: 5, RecipientRate: 0.1, RecipientBurst: 1},
+		auth.RoleAdmin:     {RecipientRate: 0.2, RecipientBurst: 4},
+	}
+	cfg.RateLimit.MaxWait = 50 * time.Millisecond
+	return cfg
+}
+
+func notificationsTo(fromID int, toIDs ...int) []models.Notification {
+	var notifications []models.Notification
+	for _, toID := range toIDs {
+		notifications = append(notifications, models.Notification{From: models.User{ID: fromID}, To: models.User{ID: toID}})
+	}
+	return notifications
+}
+
+func TestRoleLimits(t *testing.T) {
+	l := newLimiter(smallLimits(), nil)
+	defaults := smallLimits().RateLimit.Roles[config.DefaultRole]
+	tests := []struct {
+		principal  auth.Principal
+		wantRole   string
+		wantLimits config.RoleLimits
+	}{
+		{auth.Principal{}, config.DefaultRole, defaults},
+		{auth.Principal{Roles: []string{"unknown"}}, config.DefaultRole, defaults},
+		// partners send more, their recipient limits are below the default ones
+		{
+			auth.Principal{Roles: []string{"partner"}},
+			config.DefaultRole,
+			config.RoleLimits{SenderRate: 1, SenderBurst: 5, RecipientRate: 0.1, RecipientBurst: 3},
+		},
+		// admins send without limit, the most generous
+		{
+			auth.Principal{Roles: []string{"partner", auth.RoleAdmin}},
+			auth.RoleAdmin,
+			config.RoleLimits{RecipientRate: 0.2, RecipientBurst: 4},
+		},
+		// without auth everyone is an admin, and gets the default limits
+		{auth.Principal{Roles: []string{auth.RoleAdmin}, Method: "none"}, config.DefaultRole, defaults},
+	}
+	for _, tt := range tests {
+		if role, limits := l.roleLimits(tt.principal); role != tt.wantRole || limits != tt.wantLimits {
+			t.Errorf("roleLimits(%+v) = %s %+v, want %s %+v", tt.principal, role, limits, tt.wantRole, tt.wantLimits)
+		}
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	emma := auth.Principal{Subject: "1", UserID: 1}
+	bruno := auth.Principal{Subject: "2", UserID: 2}
+	service := auth.Principal{Subject: "mailer", Roles: []string{auth.RoleAdmin}}
+
+	t.Run("sender", func(t *testing.T) {
+		l := newLimiter(smallLimits(), nil)
+		if _, err := l.Allow(emma, notificationsTo(1, 2, 3, 3)); err != nil {
+			t.Fatalf("Allow within the burst = %v", err)
+		}
+		var limited *RateLimitedError
+		if _, err := l.Allow(emma, notificationsTo(1, 4)); !errors.As(err, &limited) || limited.RetryAfter <= 0 {
+			t.Errorf("Allow over the sender burst = %v, want a RateLimitedError", err)
+		}
+		// every sender has their own bucket
+		if _, err := l.Allow(bruno, notificationsTo(2, 4)); err != nil {
+			t.Errorf("Allow for another sender = %v", err)
+		}
+	})
+
+	t.Run("recipient", func(t *testing.T) {
+		l := newLimiter(smallLimits(), nil)
+		for _, from := range []auth.Principal{emma, bruno} {
+			if _, err := l.Allow(from, notificationsTo(from.UserID, 3)); err != nil {
+				t.Fatalf("Allow within the recipient burst = %v", err)
+			}
+		}
+		if _, err := l.Allow(emma, notificationsTo(1, 3, 4)); err != nil {
+			t.Fatalf("Allow of the last recipient token = %v", err)
+		}
+		// rick has no token left, the whole request is turned down
+		if _, err := l.Allow(bruno, notificationsTo(2, 4, 3)); err == nil {
+			t.Error("Allow over the recipient burst = nil, want an error")
+		}
+		if _, err := l.Allow(bruno, notificationsTo(2, 4)); err != nil {
+			t.Errorf("Allow after a rejected request = %v, want the tokens back", err)
+		}
+	})
+
+	t.Run("service", func(t *testing.T) {
+		l := newLimiter(smallLimits(), nil)
+		// the admin role has its own recipient buckets
+		if _, err := l.Allow(service, notificationsTo(1, 3, 3, 3, 3)); err != nil {
+			t.Errorf("Allow for a service = %v", err)
+		}
+		if _, err := l.Allow(service, notificationsTo(2, 3)); err == nil {
+			t.Error("Allow over the admin recipient burst = nil, want an error")
+		}
+		if _, err := l.Allow(emma, notificationsTo(1, 3, 3, 3)); err != nil {
+			t.Errorf("Allow for a user after the service = %v, want their own buckets", err)
+		}
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		l := newLimiter(smallLimits(), nil)
+		anonymous := auth.Principal{Subject: "anonymous", Roles: []string{auth.RoleAdmin}, Method: "none"}
+		if _, err := l.Allow(anonymous, notificationsTo(1, 2, 3, 4)); err != nil {
+			t.Fatalf("Allow within the default burst = %v", err)
+		}
+		if _, err := l.Allow(anonymous, notificationsTo(1, 5)); err == nil {
+			t.Error("Allow over the default sender burst = nil, want an error")
+		}
+		// the claimed sender is all there is to tell callers apart
+		if _, err := l.Allow(anonymous, notificationsTo(2, 5)); err != nil {
+			t.Errorf("Allow for another claimed sender = %v", err)
+		}
+	})
+
+	t.Run("over the burst", func(t *testing.T) {
+		l := newLimiter(smallLimits(), nil)
+		var tooLarge *TooLargeError
+		// waiting can't help, the request has to be split
+		if _, err := l.Allow(emma, notificationsTo(1, 2, 3, 4, 5)); !errors.As(err, &tooLarge) || tooLarge.Limit != "sender" || tooLarge.Burst != 3 {
+			t.Errorf("Allow of 4 notifications from a sender = %v, want a sender TooLargeError", err)
+		}
+		if _, err := l.Allow(service, notificationsTo(1, 3, 3, 3, 3, 3)); !errors.As(err, &tooLarge) || tooLarge.Limit != "recipient" {
+			t.Errorf("Allow of 5 notifications to a recipient = %v, want a recipient TooLargeError", err)
+		}
+		if _, err := l.Allow(emma, notificationsTo(1, 2, 3, 4)); err != nil {
+			t.Errorf("Allow after a request too large = %v, want nothing taken", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		l := newLimiter(smallLimits(), nil)
+		taken, err := l.Allow(emma, notificationsTo(1, 2, 3, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken.Cancel()
+		if _, err := l.Allow(emma, notificationsTo(1, 2, 3, 4)); err != nil {
+			t.Errorf("Allow after Cancel = %v, want the tokens back", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := smallLimits()
+		cfg.RateLimit.Enabled = false
+		l := newLimiter(cfg, nil)
+		for i := 0; i < 10; i++ {
+			if _, err := l.Allow(emma, notificationsTo(1, 2)); err != nil {
+				t.Fatalf("Allow with rate limits disabled = %v", err)
+			}
+		}
+	})
+}
+
+func TestLimiterAdmit(t *testing.T) {
+	t.Run("global", func(t *testing.T) {
+		cfg := smallLimits()
+		cfg.RateLimit.GlobalRate = 1
+		cfg.RateLimit.GlobalBurst = 3
+		l := newLimiter(cfg, newTestProducer(t))
+
+		// bigger than the burst: takes the whole bucket
+		if err := l.Admit(context.Background(), 5); err != nil {
+			t.Fatalf("Admit = %v", err)
+		}
+		var limited *RateLimitedError
+		if err := l.Admit(context.Background(), 1); !errors.As(err, &limited) || limited.Limit != "global" {
+			t.Errorf("Admit with the global bucket empty = %v, want the global limit", err)
+		}
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		producer := newTestProducer(t)
+		go drainProducerEvents(producer.Producer)
+		cfg := smallLimits()
+		cfg.ReadyMaxQueue = 3
+		l := newLimiter(cfg, producer)
+		for i := 0; i < 3; i++ {
+			if err := sendKafKaMessage(producer, models.Notification{To: models.User{ID: 1}}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var limited *RateLimitedError
+		if err := l.Admit(context.Background(), 1); !errors.As(err, &limited) || limited.Limit != "producer queue" {
+			t.Errorf("Admit with a full queue = %v, want the queue limit", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := l.Admit(ctx, 1); !errors.As(err, &limited) {
+			t.Errorf("Admit of a canceled request = %v, want a RateLimitedError", err)
+		}
+	})
+
+	t.Run("bigger than the queue", func(t *testing.T) {
+		producer := newTestProducer(t)
+		go drainProducerEvents(producer.Producer)
+		cfg := smallLimits()
+		cfg.ReadyMaxQueue = 3
+		l := newLimiter(cfg, producer)
+		// it would never fit, it goes once the queue is empty
+		if err := l.Admit(context.Background(), 5); err != nil {
+			t.Errorf("Admit of more than the queue holds on an empty queue = %v", err)
+		}
+	})
+}
+
+func TestSendRateLimited(t *testing.T) {
+	producer := newTestProducer(t)
+	go drainProducerEvents(producer.Producer)
+	router := newTestRouter(testAPIKeys())
+	router.POST("/send", sendMessageHandler(producer, testUsers(), newTestComposer(), newLimiter(smallLimits(), producer)))
+
+	for i := 0; i < 3; i++ {
+		// no broker, the delivery fails but the tokens are taken
+		if code, body := doAs(t, router, emmaKey, http.MethodPost, "/send", `{"toID": 2, "message": "hi"}`); code == http.StatusTooManyRequests {
+			t.Fatalf("POST /send within the burst = %d %s", code, body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{"toID": 2, "message": "hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(auth.HeaderAPIKey, emmaKey)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("POST /send over the burst = %d %s, want 429 with Retry-After", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSendTooLarge(t *testing.T) {
+	router := newTestRouter(testAPIKeys())
+	router.POST("/send/batch", sendBatchHandler(nil, testUsers(), newTestComposer(), newLimiter(smallLimits(), nil)))
+
+	body := `{"items": [{"toID": 2, "message": "1"}, {"toID": 2, "message": "2"}, {"toID": 2, "message": "3"}, {"toID": 2, "message": "4"}]}`
+	code, response := doAs(t, router, emmaKey, http.MethodPost, "/send/batch", body)
+	if code != http.StatusRequestEntityTooLarge || !strings.Contains(response, "split") {
+		t.Errorf("POST /send/batch over the burst = %d %s, want 413 asking to split it", code, response)
+	}
+}
+
+func TestSendRefundsWhenNotAdmitted(t *testing.T) {
+	producer := newTestProducer(t)
+	go drainProducerEvents(producer.Producer)
+	cfg := smallLimits()
+	// one notification, then the global cap holds everyone back
+	cfg.RateLimit.GlobalRate = 0.001
+	cfg.RateLimit.GlobalBurst = 1
+	limiter := newLimiter(cfg, producer)
+	router := newTestRouter(testAPIKeys())
+	router.POST("/send", sendMessageHandler(producer, testUsers(), newTestComposer(), limiter))
+
+	for i := 0; i < 4; i++ {
+		code, body := doAs(t, router, emmaKey, http.MethodPost, "/send", `{"toID": 2, "message": "hi"}`)
+		if i > 0 && code != http.StatusTooManyRequests {
+			t.Fatalf("POST /send past the global cap = %d %s, want 429", code, body)
+		}
+	}
+	// the requests held back by the global cap gave emma's and bruno's tokens back
+	emma := auth.Principal{Subject: "1", UserID: 1}
+	if _, err := limiter.Allow(emma, notificationsTo(1, 2, 2)); err != nil {
+		t.Errorf("Allow after requests the global cap turned down = %v, want their tokens back", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"producer/pkg/directory"
+	"producer/pkg/models"
+	"schema"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+func testUsers() *directory.MemoryDirectory {
+	return directory.NewMemoryDirectory(
+		models.User{ID: 1, Name: "Emma"},
+		models.User{ID: 2, Name: "Bruno"},
+		models.User{ID: 3, Name: "Rick"},
+	)
+}
+
+// newTestProducer is a producer without a reachable broker: messages are
+// queued, and their delivery fails after the message timeout.
+func newTestProducer(t *testing.T) *Producer {
+	t.Helper()
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  "127.0.0.1:1",
+		"message.timeout.ms": 300,
+		"log_level":          0,
+		// hand the whole message back with its delivery report
+		"go.delivery.report.fields": "all",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(producer.Close)
+	return &Producer{
+		Producer:        producer,
+		topic:           "notifications",
+		format:          schema.FormatJSON,
+		deliveryTimeout: 5 * time.Second,
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	tests := []struct {
+		req  sendRequest
+		want []int
+	}{
+		{sendRequest{ToID: 2}, []int{2}},
+		{sendRequest{ToIDs: []int{3, 2}}, []int{3, 2}},
+		{sendRequest{ToID: 2, ToIDs: []int{3, 2, 3}}, []int{2, 3}},
+		{sendRequest{}, nil},
+	}
+	for _, tt := range tests {
+		if got := tt.req.recipients(); !slices.Equal(got, tt.want) {
+			t.Errorf("%+v.recipients() = %v, want %v", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestBuildNotifications(t *testing.T) {
+	many := make([]int, MaxRecipients+1)
+	for i := range many {
+		many[i] = i + 1
+	}
+	tests := []struct {
+		name    string
+		req     sendRequest
+		wantTo  []int
+		wantErr error
+	}{
+		{name: "one", req: sendRequest{FromID: 1, ToID: 2, Message: "hi"}, wantTo: []int{2}},
+		{name: "several", req: sendRequest{FromID: 1, ToIDs: []int{2, 3}, Message: "hi"}, wantTo: []int{2, 3}},
+		{name: "no sender", req: sendRequest{ToID: 2}, wantErr: ErrInvalidSendRequest},
+		{name: "no recipient", req: sendRequest{FromID: 1}, wantErr: ErrInvalidSendRequest},
+		{name: "too many recipients", req: sendRequest{FromID: 1, ToIDs: many}, wantErr: ErrInvalidSendRequest},
+		{name: "unknown sender", req: sendRequest{FromID: 9, ToID: 2}, wantErr: directory.ErrUserNotFound},
+		{name: "unknown recipient", req: sendRequest{FromID: 1, ToIDs: []int{2, 9}}, wantErr: directory.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifications, err := buildNotifications(testUsers(), newTestComposer(), tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			var to []int
+			for _, n := range notifications {
+				if n.From.Name != "Emma" || n.Message != tt.req.Message {
+					t.Errorf("notification %+v", n)
+				}
+				to = append(to, n.To.ID)
+			}
+			if !slices.Equal(to, tt.wantTo) {
+				t.Errorf("recipients = %v, want %v", to, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestSendMessageHandler(t *testing.T) {
+	router := newTestRouter()
+	producer := newTestProducer(t)
+	router.POST("/send", sendMessageHandler(producer, testUsers(), newTestComposer(), newTestLimiter(producer)))
+
+	form := url.Values{"fromID": {"1"}, "toID": {"2"}, "message": {"hi"}}.Encode()
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		// no broker, so a valid request waits for its delivery to fail
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: form, want: http.StatusServiceUnavailable},
+		{name: "json", contentType: "application/json", body: `{"fromID": 1, "toIDs": [2, 3], "message": "hi"}`, want: http.StatusServiceUnavailable},
+		{name: "bad json", contentType: "application/json", body: `{"fromID": "one"}`, want: http.StatusBadRequest},
+		{name: "no recipient", contentType: "application/json", body: `{"fromID": 1, "message": "hi"}`, want: http.StatusBadRequest},
+		{name: "unknown user", contentType: "application/json", body: `{"fromID": 1, "toID": 9}`, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/send", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("POST /send = %d %s, want %d", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSendBatchHandlerValidation(t *testing.T) {
+	// nothing is produced when the batch is rejected
+	router := newTestRouter()
+	router.POST("/send/batch", sendBatchHandler(nil, testUsers(), newTestComposer(), newTestLimiter(nil)))
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "empty", body: `{"items": []}`, want: http.StatusBadRequest},
+		{name: "not json", body: `items`, want: http.StatusBadRequest},
+		{name: "one bad item", body: `{"items": [{"fromID": 1, "toID": 2}, {"fromID": 1, "toID": 9}]}`, want: http.StatusBadRequest},
+		{name: "too many", body: `{"items": [` + strings.Repeat(`{"fromID": 1, "toID": 2},`, MaxBatchItems) + `{"fromID": 1, "toID": 2}]}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := do(t, router, http.MethodPost, "/send/batch", tt.body)
+			if code != tt.want {
+				t.Errorf("POST /send/batch = %d %s, want %d", code, body, tt.want)
+			}
+		})
+	}
+
+	// the index of every bad item is reported
+	_, body := do(t, router, http.MethodPost, "/send/batch", `{"items": [{"fromID": 1}, {"fromID": 1, "toID": 2}, {"toID": 2}]}`)
+	if !strings.Contains(body, `"index":0`) || !strings.Contains(body, `"index":2`) || strings.Contains(body, `"index":1`) {
+		t.Errorf("errors = %s, want items 0 and 2", body)
+	}
+}
+
+func TestSendBatchReportsFailedDeliveries(t *testing.T) {
+	router := newTestRouter()
+	producer := newTestProducer(t)
+	router.POST("/send/batch", sendBatchHandler(producer, testUsers(), newTestComposer(), newTestLimiter(producer)))
+
+	// no broker: every delivery fails after the message timeout
+	code, body := do(t, router, http.MethodPost, "/send/batch", `{"items": [{"fromID": 1, "toIDs": [2, 3]}, {"fromID": 2, "toID": 1}]}`)
+	if code != http.StatusMultiStatus {
+		t.Fatalf("POST /send/batch = %d %s, want 207", code, body)
+	}
+	if !strings.Contains(body, `"failed":3`) || !strings.Contains(body, `"sent":0`) {
+		t.Errorf("answer = %s, want 3 failed", body)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"producer/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestProducerShutdown(t *testing.T) {
+	notification := models.Notification{From: models.User{ID: 1}, To: models.User{ID: 2}}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// the test producer gives up on a message after 300ms, which counts as handled
+		wantUndelivered int
+	}{
+		{name: "flushed", timeout: 5 * time.Second, wantUndelivered: 0},
+		{name: "purged", timeout: 50 * time.Millisecond, wantUndelivered: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer := newTestProducer(t)
+			go drainProducerEvents(producer.Producer)
+			for i := 0; i < 3; i++ {
+				if err := sendKafKaMessage(producer, notification, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			start := time.Now()
+			// Flush also counts the client events still queued, so purged
+			// messages are a lower bound
+			got := producer.Shutdown(tt.timeout)
+			if (tt.wantUndelivered == 0 && got != 0) || got < tt.wantUndelivered {
+				t.Errorf("Shutdown = %d undelivered, want %d", got, tt.wantUndelivered)
+			}
+			if elapsed := time.Since(start); elapsed > tt.timeout+3*time.Second {
+				t.Errorf("Shutdown took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestShutdownWaitsForLateReports(t *testing.T) {
+	producer := newTestProducer(t)
+	go drainProducerEvents(producer.Producer)
+	notifications := []models.Notification{{From: models.User{ID: 1}, To: models.User{ID: 2}}}
+
+	// the request stops waiting long before the delivery fails
+	if reports, _ := produceAndWait(producer, notifications, 10*time.Millisecond); reports[0].Status != DeliveryUnknown {
+		t.Fatalf("report = %+v, want unknown", reports[0])
+	}
+
+	producer.Shutdown(5 * time.Second)
+	lateDone := make(chan struct{})
+	go func() {
+		producer.late.Wait()
+		close(lateDone)
+	}()
+	select {
+	case <-lateDone:
+	case <-time.After(time.Second):
+		t.Error("Shutdown returned before the late delivery report was read")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"auth"
+	"errors"
+	"net/http"
+	"producer/pkg/directory"
+	"producer/pkg/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerUserRoutes lets any authenticated caller read the directory, only
+// admins change it.
+func registerUserRoutes(router gin.IRouter, users directory.UserDirectory) {
+	admin := auth.RequireRole(auth.RoleAdmin)
+	router.GET("/users", listUsersHandler(users))
+	router.POST("/users", admin, createUserHandler(users))
+	router.GET("/users/:userID", getUserHandler(users))
+	router.PUT("/users/:userID", admin, updateUserHandler(users))
+	router.DELETE("/users/:userID", admin, deleteUserHandler(users))
+	router.GET("/groups", listGroupsHandler(users))
+	router.GET("/groups/:group", groupMembersHandler(users))
+}
+
+func getUserIDParam(ctx *gin.Context) (int, error) {
+	id, err := strconv.Atoi(ctx.Param("userID"))
+	if err != nil {
+		return 0, errors.New("user ID must be an integer")
+	}
+	return id, nil
+}
+
+// directoryErrorStatus maps UserDirectory errors to HTTP status codes.
+func directoryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, directory.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, directory.ErrUserExists):
+		return http.StatusConflict
+	case errors.Is(err, directory.ErrInvalidUser):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func listUsersHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		list, err := users.List()
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"users": list})
+	}
+}
+
+func getUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := getUserIDParam(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		user, err := users.Get(id)
+		if err != nil {
+			ctx.JSON(directoryErrorStatus(err), gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, user)
+	}
+}
+
+func createUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var user models.User
+		if err := ctx.ShouldBindJSON(&user); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if err := users.Create(user); err != nil {
+			ctx.JSON(directoryErrorStatus(err), gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusCreated, user)
+	}
+}
+
+func updateUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := getUserIDParam(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		var user models.User
+		if err := ctx.ShouldBindJSON(&user); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		// the path wins over whatever ID is in the body
+		user.ID = id
+
+		if err := users.Update(user); err != nil {
+			ctx.JSON(directoryErrorStatus(err), gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, user)
+	}
+}
+
+func deleteUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := getUserIDParam(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if err := users.Delete(id); err != nil {
+			ctx.JSON(directoryErrorStatus(err), gin.H{"message": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func listGroupsHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		groups, err := directory.Groups(users)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"groups": groups})
+	}
+}
+
+func groupMembersHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		group := ctx.Param("group")
+		members, err := directory.Members(users, group)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		if len(members) == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"group": group, "members": members})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"producer/pkg/directory"
+	"producer/pkg/models"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// do sends a request and returns the status and the raw answer.
+func do(t *testing.T, router http.Handler, method, path, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestUserRoutes(t *testing.T) {
+	router := newTestRouter()
+	users := directory.NewMemoryDirectory(models.User{ID: 1, Name: "Emma"})
+	registerUserRoutes(router, users)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodGet, "/users/1", "", http.StatusOK},
+		{http.MethodGet, "/users/2", "", http.StatusNotFound},
+		{http.MethodGet, "/users/emma", "", http.StatusBadRequest},
+		{http.MethodPost, "/users", `{"id": 2, "name": "Bruno"}`, http.StatusCreated},
+		{http.MethodPost, "/users", `{"id": 2, "name": "Bruno"}`, http.StatusConflict},
+		{http.MethodPost, "/users", `{"id": 3}`, http.StatusBadRequest},
+		{http.MethodPost, "/users", `{"id": "3"`, http.StatusBadRequest},
+		// the id of the path wins over the body
+		{http.MethodPut, "/users/2", `{"id": 5, "name": "Bruno B."}`, http.StatusOK},
+		{http.MethodPut, "/users/9", `{"name": "Nine"}`, http.StatusNotFound},
+		{http.MethodDelete, "/users/1", "", http.StatusNoContent},
+		{http.MethodDelete, "/users/1", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code, body := do(t, router, tt.method, tt.path, tt.body); code != tt.want {
+			t.Errorf("%s %s = %d %s, want %d", tt.method, tt.path, code, body, tt.want)
+		}
+	}
+
+	code, body := do(t, router, http.MethodGet, "/users", "")
+	var response struct {
+		Users []models.User `json:"users"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /users = %d %s", code, body)
+	}
+	if len(response.Users) != 1 || response.Users[0].ID != 2 || response.Users[0].Name != "Bruno B." {
+		t.Errorf("users = %v, want only Bruno B.", response.Users)
+	}
+}
+
+func TestGroupRoutes(t *testing.T) {
+	router := newTestRouter()
+	users := directory.NewMemoryDirectory(
+		models.User{ID: 1, Name: "Emma", Groups: []string{"friends"}},
+		models.User{ID: 2, Name: "Bruno", Groups: []string{"friends", "work"}},
+	)
+	registerUserRoutes(router, users)
+
+	tests := []struct {
+		path string
+		want int
+		// wantBody is a piece of the answer
+		wantBody string
+	}{
+		{"/groups", http.StatusOK, `"groups":{"friends":2,"work":1}`},
+		{"/groups/work", http.StatusOK, `"members":[{"id":2,"name":"Bruno","groups":["friends","work"]}]`},
+		{"/groups/unknown", http.StatusNotFound, "Group not found"},
+	}
+	for _, tt := range tests {
+		code, body := do(t, router, http.MethodGet, tt.path, "")
+		if code != tt.want || !strings.Contains(body, tt.wantBody) {
+			t.Errorf("GET %s = %d %s, want %d with %s", tt.path, code, body, tt.want, tt.wantBody)
+		}
+	}
+
+	// groups are validated with the user
+	if code, body := do(t, router, http.MethodPost, "/users", `{"id": 3, "name": "Rick", "groups": ["work", "work"]}`); code != http.StatusBadRequest {
+		t.Errorf("POST /users with a duplicate group = %d %s, want 400", code, body)
+	}
+}
@@ -0,0 +1,108 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"producer/pkg/models"
+	"slices"
+	"sort"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrInvalidUser  = errors.New("invalid user")
+)
+
+// UserDirectory is where the producer looks up senders and recipients.
+type UserDirectory interface {
+	Get(id int) (models.User, error)
+	List() ([]models.User, error)
+	Create(user models.User) error
+	Update(user models.User) error
+	Delete(id int) error
+	Close() error
+}
+
+func Validate(user models.User) error {
+	if user.ID <= 0 {
+		return fmt.Errorf("%w: id must be positive", ErrInvalidUser)
+	}
+	if user.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidUser)
+	}
+
+	seen := make(map[string]bool, len(user.Groups))
+	for _, group := range user.Groups {
+		if group == "" {
+			return fmt.Errorf("%w: group names can't be empty", ErrInvalidUser)
+		}
+		if seen[group] {
+			return fmt.Errorf("%w: duplicate group %q", ErrInvalidUser, group)
+		}
+		seen[group] = true
+	}
+	return nil
+}
+
+// Members returns the users of a group, or every user when group is empty.
+func Members(dir UserDirectory, group string) ([]models.User, error) {
+	users, err := dir.List()
+	if err != nil {
+		return nil, err
+	}
+	if group == "" {
+		return users, nil
+	}
+
+	var members []models.User
+	for _, user := range users {
+		if slices.Contains(user.Groups, group) {
+			members = append(members, user)
+		}
+	}
+	return members, nil
+}
+
+// Groups returns every group with its number of members.
+func Groups(dir UserDirectory) (map[string]int, error) {
+	users, err := dir.List()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]int)
+	for _, user := range users {
+		for _, group := range user.Groups {
+			groups[group]++
+		}
+	}
+	return groups, nil
+}
+
+// Seed creates the given users when the directory is still empty.
+func Seed(dir UserDirectory, users []models.User) error {
+	existing, err := dir.List()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	for _, user := range users {
+		if err := dir.Create(user); err != nil && !errors.Is(err, ErrUserExists) {
+			return fmt.Errorf("failed to seed user %d: %w", user.ID, err)
+		}
+	}
+	return nil
+}
+
+func sortedUsers(users map[int]models.User) []models.User {
+	list := make([]models.User, 0, len(users))
+	for _, user := range users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,148 @@
+package directory
+
+import (
+	"errors"
+	"producer/pkg/models"
+	"slices"
+	"testing"
+)
+
+// backends runs fn against the directories that need no broker.
+func backends(t *testing.T, fn func(t *testing.T, dir UserDirectory)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryDirectory())
+	})
+	for _, name := range []string{"users.json", "users.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			fd, err := OpenFileDirectory(t.TempDir()+"/"+name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fd.Close()
+			fn(t, fd)
+		})
+	}
+}
+
+func userIDs(users []models.User) []int {
+	ids := []int{}
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+func TestDirectory(t *testing.T) {
+	backends(t, func(t *testing.T, dir UserDirectory) {
+		steps := []struct {
+			name    string
+			do      func() error
+			wantErr error
+		}{
+			{name: "create", do: func() error { return dir.Create(models.User{ID: 2, Name: "Bruno"}) }},
+			{name: "create another", do: func() error { return dir.Create(models.User{ID: 1, Name: "Emma"}) }},
+			{name: "create twice", do: func() error { return dir.Create(models.User{ID: 1, Name: "Emma"}) }, wantErr: ErrUserExists},
+			{name: "create without name", do: func() error { return dir.Create(models.User{ID: 3}) }, wantErr: ErrInvalidUser},
+			{name: "create with a bad id", do: func() error { return dir.Create(models.User{ID: 0, Name: "Zero"}) }, wantErr: ErrInvalidUser},
+			{name: "update", do: func() error { return dir.Update(models.User{ID: 2, Name: "Bruno B."}) }},
+			{name: "update unknown", do: func() error { return dir.Update(models.User{ID: 9, Name: "Nine"}) }, wantErr: ErrUserNotFound},
+			{name: "create then delete", do: func() error {
+				if err := dir.Create(models.User{ID: 4, Name: "Four"}); err != nil {
+					return err
+				}
+				return dir.Delete(4)
+			}},
+			{name: "delete unknown", do: func() error { return dir.Delete(4) }, wantErr: ErrUserNotFound},
+		}
+		for _, step := range steps {
+			if err := step.do(); !errors.Is(err, step.wantErr) {
+				t.Fatalf("%s: error = %v, want %v", step.name, err, step.wantErr)
+			}
+		}
+
+		list, err := dir.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(userIDs(list), []int{1, 2}) {
+			t.Errorf("List = %v, want users 1 and 2 in order", list)
+		}
+		if user, err := dir.Get(2); err != nil || user.Name != "Bruno B." {
+			t.Errorf("Get(2) = %v, %v, want the updated name", user, err)
+		}
+		if _, err := dir.Get(4); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Get(4) = %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestSeed(t *testing.T) {
+	seed := []models.User{{ID: 1, Name: "Emma"}, {ID: 2, Name: "Bruno"}}
+
+	dir := NewMemoryDirectory()
+	if err := Seed(dir, seed); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := dir.List(); len(list) != 2 {
+		t.Errorf("seeded %v, want 2 users", list)
+	}
+
+	// a directory that already has users is left alone
+	dir = NewMemoryDirectory(models.User{ID: 7, Name: "Seven"})
+	if err := Seed(dir, seed); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := dir.List(); !slices.Equal(userIDs(list), []int{7}) {
+		t.Errorf("List = %v, want only user 7", list)
+	}
+
+	if err := Seed(NewMemoryDirectory(), []models.User{{ID: 1}}); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("Seed of an invalid user = %v, want ErrInvalidUser", err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	invalid := []models.User{
+		{ID: 1, Name: "Emma", Groups: []string{""}},
+		{ID: 1, Name: "Emma", Groups: []string{"work", "work"}},
+	}
+	for _, user := range invalid {
+		if err := Validate(user); !errors.Is(err, ErrInvalidUser) {
+			t.Errorf("Validate(%+v) = %v, want ErrInvalidUser", user, err)
+		}
+	}
+
+	dir := NewMemoryDirectory(
+		models.User{ID: 1, Name: "Emma", Groups: []string{"friends"}},
+		models.User{ID: 2, Name: "Bruno", Groups: []string{"friends", "work"}},
+		models.User{ID: 3, Name: "Rick"},
+	)
+
+	members := []struct {
+		group string
+		want  []int
+	}{
+		{"friends", []int{1, 2}},
+		{"work", []int{2}},
+		{"unknown", []int{}},
+		// no group means everybody
+		{"", []int{1, 2, 3}},
+	}
+	for _, tt := range members {
+		got, err := Members(dir, tt.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(userIDs(got), tt.want) {
+			t.Errorf("Members(%q) = %v, want %v", tt.group, userIDs(got), tt.want)
+		}
+	}
+
+	groups, err := Groups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups["friends"] != 2 || groups["work"] != 1 {
+		t.Errorf("Groups = %v, want friends: 2, work: 1", groups)
+	}
+}
@@ -0,0 +1,234 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"producer/pkg/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+const DefaultReloadInterval = 2 * time.Second
+
+// FileDirectory keeps the users in a JSON or YAML file (picked by the file
+// extension). The file is polled and reloaded when someone edits it, so
+// users can be managed without restarting the producer.
+type FileDirectory struct {
+	path  string
+	cache *MemoryDirectory
+
+	// mu serializes our own writes with reloads
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func OpenFileDirectory(path string, reloadInterval time.Duration) (*FileDirectory, error) {
+	if reloadInterval <= 0 {
+		reloadInterval = DefaultReloadInterval
+	}
+
+	fd := &FileDirectory{
+		path:  path,
+		cache: NewMemoryDirectory(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := fd.write(map[int]models.User{}); err != nil {
+			return nil, err
+		}
+	}
+	if err := fd.reload(); err != nil {
+		return nil, err
+	}
+
+	go fd.watch(reloadInterval)
+	return fd, nil
+}
+
+func (fd *FileDirectory) isYAML() bool {
+	ext := strings.ToLower(filepath.Ext(fd.path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func (fd *FileDirectory) watch(interval time.Duration) {
+	defer close(fd.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fd.stop:
+			return
+		case <-ticker.C:
+			if err := fd.reload(); err != nil {
+				// keep serving the last good version
+				log.Printf("user directory: failed to reload %s: %v\n", fd.path, err)
+			}
+		}
+	}
+}
+
+// reload reads the file if it changed since we last saw it.
+func (fd *FileDirectory) reload() error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	info, err := os.Stat(fd.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(fd.modTime) && info.Size() == fd.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(fd.path)
+	if err != nil {
+		return err
+	}
+
+	var list []models.User
+	if fd.isYAML() {
+		err = yaml.Unmarshal(data, &list)
+	} else {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", fd.path, err)
+	}
+
+	users := make(map[int]models.User, len(list))
+	for _, user := range list {
+		if err := Validate(user); err != nil {
+			return fmt.Errorf("user %d in %s: %w", user.ID, fd.path, err)
+		}
+		if _, ok := users[user.ID]; ok {
+			return fmt.Errorf("user %d in %s: %w", user.ID, fd.path, ErrUserExists)
+		}
+		users[user.ID] = user
+	}
+
+	fd.cache.replace(users)
+	fd.modTime = info.ModTime()
+	fd.size = info.Size()
+	log.Printf("user directory: loaded %d users from %s\n", len(users), fd.path)
+	return nil
+}
+
+// write replaces the file atomically. The caller must hold fd.mu
+// (or be the only one using fd yet).
+func (fd *FileDirectory) write(users map[int]models.User) error {
+	list := sortedUsers(users)
+
+	var data []byte
+	var err error
+	if fd.isYAML() {
+		data, err = yaml.Marshal(list)
+	} else {
+		data, err = json.MarshalIndent(list, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode users: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fd.path), filepath.Base(fd.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", fd.path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", fd.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fd.path, err)
+	}
+	if err := os.Rename(tmp.Name(), fd.path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fd.path, err)
+	}
+
+	info, err := os.Stat(fd.path)
+	if err != nil {
+		return err
+	}
+	fd.cache.replace(users)
+	fd.modTime = info.ModTime()
+	fd.size = info.Size()
+	return nil
+}
+
+// update applies fn to a copy of the users and persists the result.
+func (fd *FileDirectory) update(fn func(users map[int]models.User) error) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	users := fd.cache.snapshot()
+	if err := fn(users); err != nil {
+		return err
+	}
+	return fd.write(users)
+}
+
+func (fd *FileDirectory) Get(id int) (models.User, error) {
+	return fd.cache.Get(id)
+}
+
+func (fd *FileDirectory) List() ([]models.User, error) {
+	return fd.cache.List()
+}
+
+func (fd *FileDirectory) Create(user models.User) error {
+	if err := Validate(user); err != nil {
+		return err
+	}
+	return fd.update(func(users map[int]models.User) error {
+		if _, ok := users[user.ID]; ok {
+			return ErrUserExists
+		}
+		users[user.ID] = user
+		return nil
+	})
+}
+
+func (fd *FileDirectory) Update(user models.User) error {
+	if err := Validate(user); err != nil {
+		return err
+	}
+	return fd.update(func(users map[int]models.User) error {
+		if _, ok := users[user.ID]; !ok {
+			return ErrUserNotFound
+		}
+		users[user.ID] = user
+		return nil
+	})
+}
+
+func (fd *FileDirectory) Delete(id int) error {
+	return fd.update(func(users map[int]models.User) error {
+		if _, ok := users[id]; !ok {
+			return ErrUserNotFound
+		}
+		delete(users, id)
+		return nil
+	})
+}
+
+func (fd *FileDirectory) Close() error {
+	close(fd.stop)
+	<-fd.done
+	return nil
+}
@@ -0,0 +1,84 @@
+package directory
+
+import (
+	"os"
+	"path/filepath"
+	"producer/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestFileDirectoryPersists(t *testing.T) {
+	for _, name := range []string{"users.json", "users.yml"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			fd, err := OpenFileDirectory(path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fd.Create(models.User{ID: 1, Name: "Emma"}); err != nil {
+				t.Fatal(err)
+			}
+			fd.Close()
+
+			fd, err = OpenFileDirectory(path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fd.Close()
+			if user, err := fd.Get(1); err != nil || user.Name != "Emma" {
+				t.Errorf("Get(1) after reopening = %v, %v", user, err)
+			}
+		})
+	}
+}
+
+func TestFileDirectoryReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// want is the name of user 1 after the reload, the old one is kept
+		// when the edit is broken
+		want    string
+		wantErr bool
+	}{
+		{name: "edited", content: `[{"id": 1, "name": "Emma W."}]`, want: "Emma W."},
+		{name: "not json", content: `[{"id": 1,`, want: "Emma", wantErr: true},
+		{name: "invalid user", content: `[{"id": 1, "name": ""}]`, want: "Emma", wantErr: true},
+		{name: "duplicate id", content: `[{"id": 1, "name": "A"}, {"id": 1, "name": "B"}]`, want: "Emma", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			if err := os.WriteFile(path, []byte(`[{"id": 1, "name": "Emma"}]`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			fd, err := OpenFileDirectory(path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fd.Close()
+
+			// someone edits the file while we run
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := fd.reload(); (err != nil) != tt.wantErr {
+				t.Errorf("reload() = %v, want error %v", err, tt.wantErr)
+			}
+			if user, _ := fd.Get(1); user.Name != tt.want {
+				t.Errorf("Get(1) = %v, want name %q", user, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileDirectoryRejectsBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(`{`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileDirectory(path, time.Hour); err == nil {
+		t.Error("OpenFileDirectory of a broken file succeeded")
+	}
+}
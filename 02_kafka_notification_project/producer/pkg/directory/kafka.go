@@ -0,0 +1,310 @@
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"producer/pkg/models"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+const (
+	DefaultUsersTopic = "users"
+	pollTimeout       = 500 * time.Millisecond
+)
+
+// KafkaDirectory keeps the users in a compacted topic: the key is the user
+// ID, the value the JSON user and an empty value (tombstone) deletes it.
+// Every producer instance reads the whole topic into memory on start and
+// keeps following it, so users created on one instance show up on all.
+type KafkaDirectory struct {
+	topic    string
+	producer *kafka.Producer
+	consumer *kafka.Consumer
+	cache    *MemoryDirectory
+
+	// writeMu serializes our own writes so the exists checks hold
+	writeMu sync.Mutex
+	// applied is the offset of the last record applied per user, our own
+	// writes included: follow skips the older records still coming back
+	applied map[int]kafka.Offset
+	timeout time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenKafkaDirectory reads the users with a consumer built from clientConfig,
+// the connection settings (brokers, TLS, SASL) shared with the producer.
+func OpenKafkaDirectory(producer *kafka.Producer, clientConfig kafka.ConfigMap, topic string, timeout time.Duration) (*KafkaDirectory, error) {
+	if err := ensureCompactedTopic(producer, topic, timeout); err != nil {
+		return nil, err
+	}
+
+	consumerConfig := kafka.ConfigMap{}
+	for key, value := range clientConfig {
+		consumerConfig[key] = value
+	}
+	// we assign the partitions ourselves and never commit, the group id is only required by the client
+	consumerConfig["group.id"] = "user-directory-reader"
+	consumerConfig["enable.auto.commit"] = false
+	consumerConfig["auto.offset.reset"] = "earliest"
+	// restore stops at the end of the partitions, the last offsets may be
+	// gone (compacted tombstones) so reaching them can't tell
+	consumerConfig["enable.partition.eof"] = true
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user directory consumer: %w", err)
+	}
+
+	kd := &KafkaDirectory{
+		topic:    topic,
+		producer: producer,
+		consumer: consumer,
+		cache:    NewMemoryDirectory(),
+		applied:  make(map[int]kafka.Offset),
+		timeout:  timeout,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := kd.restore(); err != nil {
+		consumer.Close()
+		return nil, err
+	}
+
+	go kd.follow()
+	return kd, nil
+}
+
+func ensureCompactedTopic(producer *kafka.Producer, topic string, timeout time.Duration) error {
+	admin, err := kafka.NewAdminClientFromProducer(producer)
+	if err != nil {
+		return fmt.Errorf("failed to create admin client: %w", err)
+	}
+	defer admin.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results, err := admin.CreateTopics(ctx, []kafka.TopicSpecification{{
+		Topic:         topic,
+		NumPartitions: 1,
+		// the broker default, a single broker dev cluster can't hold 3 replicas
+		ReplicationFactor: -1,
+		Config:            map[string]string{"cleanup.policy": "compact"},
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to create topic %s: %w", topic, err)
+	}
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError && result.Error.Code() != kafka.ErrTopicAlreadyExists {
+			return fmt.Errorf("failed to create topic %s: %w", topic, result.Error)
+		}
+	}
+	return nil
+}
+
+// restore reads the topic from the beginning up to the current end.
+func (kd *KafkaDirectory) restore() error {
+	metadata, err := kd.consumer.GetMetadata(&kd.topic, false, int(kd.timeout.Milliseconds()))
+	if err != nil {
+		return fmt.Errorf("failed to get metadata for %s: %w", kd.topic, err)
+	}
+
+	var partitions []kafka.TopicPartition
+	remaining := make(map[int32]int64)
+	for _, p := range metadata.Topics[kd.topic].Partitions {
+		partitions = append(partitions, kafka.TopicPartition{Topic: &kd.topic, Partition: p.ID, Offset: kafka.OffsetBeginning})
+
+		low, high, err := kd.consumer.QueryWatermarkOffsets(kd.topic, p.ID, int(kd.timeout.Milliseconds()))
+		if err != nil {
+			return fmt.Errorf("failed to get offsets for %s/%d: %w", kd.topic, p.ID, err)
+		}
+		if high > low {
+			remaining[p.ID] = high
+		}
+	}
+
+	if err := kd.consumer.Assign(partitions); err != nil {
+		return fmt.Errorf("failed to assign %s: %w", kd.topic, err)
+	}
+
+	deadline := time.Now().Add(kd.timeout)
+	for len(remaining) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out restoring users from %s", kd.topic)
+		}
+
+		switch e := kd.consumer.Poll(int(pollTimeout.Milliseconds())).(type) {
+		case *kafka.Message:
+			if e.TopicPartition.Error != nil {
+				return fmt.Errorf("failed to restore users from %s: %w", kd.topic, e.TopicPartition.Error)
+			}
+			kd.apply(e)
+		case kafka.PartitionEOF:
+			delete(remaining, e.Partition)
+		case kafka.Error:
+			if e.IsFatal() {
+				return fmt.Errorf("failed to restore users from %s: %w", kd.topic, e)
+			}
+		}
+
+		// the position is past the last record read, done when that is the end
+		positions, err := kd.consumer.Position(partitions)
+		if err != nil {
+			return fmt.Errorf("failed to get the position in %s: %w", kd.topic, err)
+		}
+		for _, position := range positions {
+			if high, ok := remaining[position.Partition]; ok && position.Offset >= 0 && int64(position.Offset) >= high {
+				delete(remaining, position.Partition)
+			}
+		}
+	}
+
+	users, _ := kd.cache.List()
+	log.Printf("user directory: restored %d users from topic %s\n", len(users), kd.topic)
+	return nil
+}
+
+// apply puts a record read from the topic in the cache, unless a newer
+// write of the user was applied already.
+func (kd *KafkaDirectory) apply(msg *kafka.Message) {
+	id, err := strconv.Atoi(string(msg.Key))
+	if err != nil {
+		log.Printf("user directory: skipping record with invalid key %q\n", msg.Key)
+		return
+	}
+	if last, ok := kd.applied[id]; ok && msg.TopicPartition.Offset <= last {
+		return
+	}
+	kd.applied[id] = msg.TopicPartition.Offset
+
+	if len(msg.Value) == 0 {
+		kd.cache.remove(id)
+		return
+	}
+
+	var user models.User
+	if err := json.Unmarshal(msg.Value, &user); err != nil {
+		log.Printf("user directory: skipping invalid user %d: %v\n", id, err)
+		return
+	}
+	kd.cache.set(user)
+}
+
+// follow keeps applying changes made by other instances.
+func (kd *KafkaDirectory) follow() {
+	defer close(kd.done)
+
+	for {
+		select {
+		case <-kd.stop:
+			return
+		default:
+		}
+
+		msg, err := kd.consumer.ReadMessage(pollTimeout)
+		if err != nil {
+			if kafkaErr, ok := err.(kafka.Error); ok && kafkaErr.IsTimeout() {
+				continue
+			}
+			log.Printf("user directory: read error (retrying): %v\n", err)
+			continue
+		}
+
+		kd.writeMu.Lock()
+		kd.apply(msg)
+		kd.writeMu.Unlock()
+	}
+}
+
+// publish writes one record and waits for the broker to acknowledge it. The
+// record is applied as if follow read it, so an older record coming back
+// later can't undo it. The caller holds writeMu.
+func (kd *KafkaDirectory) publish(id int, value []byte) error {
+	deliveryChan := make(chan kafka.Event, 1)
+	err := kd.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &kd.topic, Partition: kafka.PartitionAny},
+		Key:            []byte(strconv.Itoa(id)),
+		Value:          value,
+	}, deliveryChan)
+	if err != nil {
+		return fmt.Errorf("failed to produce user %d: %w", id, err)
+	}
+
+	select {
+	case e := <-deliveryChan:
+		msg := e.(*kafka.Message)
+		if msg.TopicPartition.Error != nil {
+			return fmt.Errorf("failed to deliver user %d: %w", id, msg.TopicPartition.Error)
+		}
+		kd.apply(msg)
+		return nil
+	case <-time.After(kd.timeout):
+		return fmt.Errorf("timed out delivering user %d", id)
+	}
+}
+
+func (kd *KafkaDirectory) put(user models.User, mustExist bool) error {
+	if err := Validate(user); err != nil {
+		return err
+	}
+
+	kd.writeMu.Lock()
+	defer kd.writeMu.Unlock()
+
+	_, err := kd.cache.Get(user.ID)
+	exists := !errors.Is(err, ErrUserNotFound)
+	if mustExist && !exists {
+		return ErrUserNotFound
+	}
+	if !mustExist && exists {
+		return ErrUserExists
+	}
+
+	value, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user: %w", err)
+	}
+	// applied right away, we don't wait for follow to read it back
+	return kd.publish(user.ID, value)
+}
+
+func (kd *KafkaDirectory) Get(id int) (models.User, error) {
+	return kd.cache.Get(id)
+}
+
+func (kd *KafkaDirectory) List() ([]models.User, error) {
+	return kd.cache.List()
+}
+
+func (kd *KafkaDirectory) Create(user models.User) error {
+	return kd.put(user, false)
+}
+
+func (kd *KafkaDirectory) Update(user models.User) error {
+	return kd.put(user, true)
+}
+
+func (kd *KafkaDirectory) Delete(id int) error {
+	kd.writeMu.Lock()
+	defer kd.writeMu.Unlock()
+
+	if _, err := kd.cache.Get(id); err != nil {
+		return err
+	}
+	return kd.publish(id, nil)
+}
+
+func (kd *KafkaDirectory) Close() error {
+	close(kd.stop)
+	<-kd.done
+	return kd.consumer.Close()
+}
@@ -0,0 +1,49 @@
+package directory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// record is the user directory record of id at offset, a tombstone when
+// value is empty.
+func record(id string, offset kafka.Offset, value string) *kafka.Message {
+	topic := DefaultUsersTopic
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: offset},
+		Key:            []byte(id),
+	}
+	if value != "" {
+		msg.Value = []byte(value)
+	}
+	return msg
+}
+
+func TestKafkaDirectoryApply(t *testing.T) {
+	kd := &KafkaDirectory{cache: NewMemoryDirectory(), applied: make(map[int]kafka.Offset)}
+
+	kd.apply(record("1", 3, `{"id":1,"name":"Emma"}`))
+	kd.apply(record("not-a-number", 4, `{"id":2,"name":"Bruno"}`))
+	kd.apply(record("2", 5, `{not json`))
+	if user, err := kd.cache.Get(1); err != nil || user.Name != "Emma" {
+		t.Fatalf("Get(1) = %+v, %v, want Emma", user, err)
+	}
+	if _, err := kd.cache.Get(2); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get(2) = %v, want the invalid records skipped", err)
+	}
+
+	// our own write, then the older records of the user coming back
+	kd.apply(record("1", 10, `{"id":1,"name":"Emma B."}`))
+	kd.apply(record("1", 3, `{"id":1,"name":"Emma"}`))
+	kd.apply(record("1", 7, ""))
+	if user, err := kd.cache.Get(1); err != nil || user.Name != "Emma B." {
+		t.Errorf("Get(1) = %+v, %v, want the newest write kept", user, err)
+	}
+
+	kd.apply(record("1", 11, ""))
+	if _, err := kd.cache.Get(1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get(1) after a tombstone = %v, want ErrUserNotFound", err)
+	}
+}
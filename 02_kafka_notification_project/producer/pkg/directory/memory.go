@@ -0,0 +1,113 @@
+package directory
+
+import (
+	"producer/pkg/models"
+	"sync"
+)
+
+// MemoryDirectory keeps the users in a map, lookups are O(1).
+type MemoryDirectory struct {
+	mu    sync.RWMutex
+	users map[int]models.User
+}
+
+func NewMemoryDirectory(users ...models.User) *MemoryDirectory {
+	md := &MemoryDirectory{users: make(map[int]models.User, len(users))}
+	for _, user := range users {
+		md.users[user.ID] = user
+	}
+	return md
+}
+
+func (md *MemoryDirectory) Get(id int) (models.User, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	user, ok := md.users[id]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (md *MemoryDirectory) List() ([]models.User, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return sortedUsers(md.users), nil
+}
+
+func (md *MemoryDirectory) Create(user models.User) error {
+	if err := Validate(user); err != nil {
+		return err
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.users[user.ID]; ok {
+		return ErrUserExists
+	}
+	md.users[user.ID] = user
+	return nil
+}
+
+func (md *MemoryDirectory) Update(user models.User) error {
+	if err := Validate(user); err != nil {
+		return err
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.users[user.ID]; !ok {
+		return ErrUserNotFound
+	}
+	md.users[user.ID] = user
+	return nil
+}
+
+func (md *MemoryDirectory) Delete(id int) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(md.users, id)
+	return nil
+}
+
+func (md *MemoryDirectory) snapshot() map[int]models.User {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	users := make(map[int]models.User, len(md.users))
+	for id, user := range md.users {
+		users[id] = user
+	}
+	return users
+}
+
+// replace swaps the whole content, used by the file and Kafka directories.
+func (md *MemoryDirectory) replace(users map[int]models.User) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.users = users
+}
+
+// set and remove skip the checks, used to apply changes that already happened elsewhere.
+func (md *MemoryDirectory) set(user models.User) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.users[user.ID] = user
+}
+
+func (md *MemoryDirectory) remove(id int) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	delete(md.users, id)
+}
+
+func (md *MemoryDirectory) Close() error {
+	return nil
+}
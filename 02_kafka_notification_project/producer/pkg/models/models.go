@@ -1,12 +1,10 @@
 package models
 
-type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-}
+import "schema"
 
-type Notification struct {
-	From    User   `json:"from"`
-	To      User   `json:"to"`
-	Message string `json:"message"`
-}
+// The wire types live in the shared schema module, these aliases keep the
+// producer code reading as before.
+type (
+	User         = schema.User
+	Notification = schema.Notification
+)
@@ -0,0 +1,134 @@
+// Package ratelimit keeps one token bucket per key, like a sender or a
+// recipient, and takes tokens from several buckets at once.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limit is a token bucket: Rate tokens per second, up to Burst at once.
+// A zero Rate means no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// Buckets are the token buckets of one kind of key. Idle buckets are full
+// again, so they are dropped once they could not be told apart from new ones.
+type Buckets struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func NewBuckets() *Buckets {
+	return &Buckets{buckets: make(map[string]*bucket)}
+}
+
+func (b *Buckets) get(key string, limit Limit, now time.Time) *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.lastPrune) > time.Minute {
+		b.prune(now)
+	}
+	found, ok := b.buckets[key]
+	if !ok || found.limiter.Limit() != rate.Limit(limit.Rate) || found.limiter.Burst() != limit.Burst {
+		found = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		b.buckets[key] = found
+	}
+	found.lastUsed = now
+	return found.limiter
+}
+
+func (b *Buckets) prune(now time.Time) {
+	for key, found := range b.buckets {
+		// the time an empty bucket takes to refill
+		refill := time.Duration(float64(found.limiter.Burst()) / float64(found.limiter.Limit()) * float64(time.Second))
+		if now.Sub(found.lastUsed) > refill {
+			delete(b.buckets, key)
+		}
+	}
+	b.lastPrune = now
+}
+
+func (b *Buckets) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buckets)
+}
+
+// Take is n tokens from the bucket of Key.
+type Take struct {
+	Buckets *Buckets
+	Key     string
+	Limit   Limit
+	N       int
+}
+
+// OverBurst tells whether the take needs more tokens than its bucket ever
+// holds, it can't go through however long it waits.
+func (t Take) OverBurst() bool {
+	return !t.Limit.Unlimited() && t.N > t.Limit.Burst
+}
+
+// Taken are the tokens a TakeAll took, Cancel gives them back.
+type Taken struct {
+	reservations []*rate.Reservation
+	// at is when they were taken, a reservation canceled past its time is
+	// considered used
+	at time.Time
+}
+
+// Cancel returns the tokens, for a request turned down after TakeAll.
+func (t Taken) Cancel() {
+	for _, reservation := range t.reservations {
+		reservation.CancelAt(t.at)
+	}
+}
+
+// TakeAll takes the tokens of every Take, or none of them: when a bucket is
+// short it returns false and how long until all of them could be taken.
+func TakeAll(takes ...Take) (Taken, time.Duration, bool) {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	var wait time.Duration
+	ok := true
+	for _, take := range takes {
+		if take.Limit.Unlimited() || take.N == 0 {
+			continue
+		}
+		limiter := take.Buckets.get(take.Key, take.Limit, now)
+		reservation := limiter.ReserveN(now, take.N)
+		if !reservation.OK() {
+			// more than the burst, this can never go through
+			ok = false
+			wait = max(wait, time.Duration(float64(take.N)/take.Limit.Rate*float64(time.Second)))
+			continue
+		}
+		reservations = append(reservations, reservation)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			ok = false
+			wait = max(wait, delay)
+		}
+	}
+	taken := Taken{reservations: reservations, at: now}
+	if !ok {
+		// give the tokens back, the request is rejected
+		taken.Cancel()
+		return Taken{}, wait, false
+	}
+	return taken, wait, true
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeAll(t *testing.T) {
+	senders, recipients := NewBuckets(), NewBuckets()
+	sender := Limit{Rate: 1, Burst: 5}
+	recipient := Limit{Rate: 1, Burst: 2}
+
+	if _, _, ok := TakeAll(Take{senders, "emma", sender, 3}, Take{recipients, "bruno", recipient, 2}); !ok {
+		t.Fatal("TakeAll within the bursts = false, want true")
+	}
+	// bruno's bucket is empty: nothing is taken from emma's
+	_, wait, ok := TakeAll(Take{senders, "emma", sender, 2}, Take{recipients, "bruno", recipient, 1})
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("TakeAll with an empty bucket = %s, %v, want false and about a second to wait", wait, ok)
+	}
+	if _, _, ok := TakeAll(Take{senders, "emma", sender, 2}, Take{recipients, "rick", recipient, 1}); !ok {
+		t.Error("emma's tokens were taken by a rejected request")
+	}
+
+	// unlimited and empty takes always go through
+	for i := 0; i < 10; i++ {
+		if _, _, ok := TakeAll(Take{senders, "admin", Limit{}, 100}, Take{recipients, "bruno", recipient, 0}); !ok {
+			t.Fatal("TakeAll without a limit = false, want true")
+		}
+	}
+	if senders.Len() != 1 || recipients.Len() != 2 {
+		t.Errorf("buckets = %d senders and %d recipients, want no bucket for the unlimited ones", senders.Len(), recipients.Len())
+	}
+}
+
+func TestTakenCancel(t *testing.T) {
+	senders := NewBuckets()
+	sender := Limit{Rate: 0.1, Burst: 3}
+
+	taken, _, ok := TakeAll(Take{senders, "emma", sender, 3})
+	if !ok {
+		t.Fatal("TakeAll within the burst = false, want true")
+	}
+	// the request was turned down further on
+	taken.Cancel()
+	if _, _, ok := TakeAll(Take{senders, "emma", sender, 3}); !ok {
+		t.Error("TakeAll after Cancel = false, want the tokens back")
+	}
+	// nothing was taken, nothing to give back
+	Taken{}.Cancel()
+}
+
+func TestOverBurst(t *testing.T) {
+	tests := []struct {
+		take Take
+		want bool
+	}{
+		{Take{Limit: Limit{Rate: 1, Burst: 3}, N: 3}, false},
+		{Take{Limit: Limit{Rate: 1, Burst: 3}, N: 4}, true},
+		{Take{Limit: Limit{}, N: 1000}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.take.OverBurst(); got != tt.want {
+			t.Errorf("%d tokens of %+v OverBurst = %v, want %v", tt.take.N, tt.take.Limit, got, tt.want)
+		}
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	b := NewBuckets()
+	now := time.Now()
+	limit := Limit{Rate: 1, Burst: 10}
+
+	first := b.get("emma", limit, now)
+	if b.get("emma", limit, now) != first {
+		t.Error("get returned a new bucket for the same limit")
+	}
+	// a config change starts over
+	if b.get("emma", Limit{Rate: 2, Burst: 10}, now) == first {
+		t.Error("get kept the bucket of the old limit")
+	}
+
+	// buckets idle for longer than they take to refill are dropped
+	b.get("bruno", Limit{Rate: 1, Burst: 100}, now.Add(5*time.Second))
+	b.get("rick", limit, now.Add(61*time.Second))
+	if b.Len() != 2 {
+		t.Errorf("Len after pruning = %d, want bruno and rick", b.Len())
+	}
+}
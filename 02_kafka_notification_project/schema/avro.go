@@ -0,0 +1,98 @@
+package schema
+
+import "github.com/hamba/avro/v2"
+
+// envelopeSchemaV1 is the Avro schema of Envelope version 1.
+const envelopeSchemaV1 = `{
+  "type": "record",
+  "name": "NotificationEnvelope",
+  "namespace": "notifications",
+  "fields": [
+    {"name": "schema_version", "type": "int"},
+    {"name": "event_id", "type": "string"},
+    {"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "type", "type": "string"},
+    {"name": "payload", "type": {
+      "type": "record",
+      "name": "Notification",
+      "fields": [
+        {"name": "from", "type": {
+          "type": "record",
+          "name": "User",
+          "fields": [
+            {"name": "id", "type": "int"},
+            {"name": "name", "type": "string"},
+            {"name": "groups", "type": {"type": "array", "items": "string"}, "default": []}
+          ]
+        }},
+        {"name": "to", "type": "User"},
+        {"name": "message", "type": "string"},
+        {"name": "broadcast_id", "type": "string", "default": ""},
+        {"name": "group", "type": "string", "default": ""}
+      ]
+    }}
+  ]
+}`
+
+// envelopeSchemaV2 adds the user locale and the structured content.
+const envelopeSchemaV2 = `{
+  "type": "record",
+  "name": "NotificationEnvelope",
+  "namespace": "notifications",
+  "fields": [
+    {"name": "schema_version", "type": "int"},
+    {"name": "event_id", "type": "string"},
+    {"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "type", "type": "string"},
+    {"name": "payload", "type": {
+      "type": "record",
+      "name": "Notification",
+      "fields": [
+        {"name": "from", "type": {
+          "type": "record",
+          "name": "User",
+          "fields": [
+            {"name": "id", "type": "int"},
+            {"name": "name", "type": "string"},
+            {"name": "groups", "type": {"type": "array", "items": "string"}, "default": []},
+            {"name": "locale", "type": "string", "default": ""}
+          ]
+        }},
+        {"name": "to", "type": "User"},
+        {"name": "message", "type": "string"},
+        {"name": "broadcast_id", "type": "string", "default": ""},
+        {"name": "group", "type": "string", "default": ""},
+        {"name": "content", "type": ["null", {
+          "type": "record",
+          "name": "Content",
+          "fields": [
+            {"name": "template", "type": "string", "default": ""},
+            {"name": "locale", "type": "string", "default": ""},
+            {"name": "variables", "type": {"type": "map", "values": "string"}, "default": {}},
+            {"name": "rendered", "type": "boolean", "default": false},
+            {"name": "title", "type": "string", "default": ""},
+            {"name": "body", "type": "string", "default": ""},
+            {"name": "action_url", "type": "string", "default": ""},
+            {"name": "priority", "type": "string", "default": ""}
+          ]
+        }], "default": null}
+      ]
+    }}
+  ]
+}`
+
+var (
+	envelopeAvroV1 = avro.MustParse(envelopeSchemaV1)
+	envelopeAvroV2 = avro.MustParse(envelopeSchemaV2)
+)
+
+// envelopeAvro is the schema of every version we read, by version.
+var envelopeAvro = map[int]avro.Schema{
+	1: envelopeAvroV1,
+	2: envelopeAvroV2,
+}
+
+// EnvelopeAvroSchema returns the schema, e.g. to register it in a schema registry.
+func EnvelopeAvroSchema() string {
+	return envelopeAvro[SchemaVersion].String()
+}
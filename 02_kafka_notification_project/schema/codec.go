@@ -0,0 +1,134 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hamba/avro/v2"
+)
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatAvro Format = "avro"
+)
+
+// Kafka headers set next to every encoded envelope.
+const (
+	HeaderContentType   = "content-type"
+	HeaderSchemaVersion = "schema-version"
+
+	ContentTypeJSON = "application/json"
+	ContentTypeAvro = "application/avro"
+)
+
+var (
+	ErrUnknownFormat      = errors.New("unknown wire format")
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+func (f Format) ContentType() string {
+	if f == FormatAvro {
+		return ContentTypeAvro
+	}
+	return ContentTypeJSON
+}
+
+func ParseFormat(value string) (Format, error) {
+	switch Format(value) {
+	case FormatJSON, FormatAvro:
+		return Format(value), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownFormat, value)
+	}
+}
+
+// Headers returns the Kafka headers describing an envelope in format f.
+func (f Format) Headers() map[string]string {
+	return map[string]string{
+		HeaderContentType:   f.ContentType(),
+		HeaderSchemaVersion: strconv.Itoa(SchemaVersion),
+	}
+}
+
+func Encode(env Envelope, format Format) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(env)
+	case FormatAvro:
+		return avro.Marshal(envelopeAvro[SchemaVersion], env)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+}
+
+// Decode reads an envelope given the content-type header of its record.
+//
+// Records without a content type are JSON, and JSON without a schema version
+// is a bare Notification written before the envelope existed. Those come
+// back wrapped in an envelope with LegacyVersion, so consumers can read old
+// and new records side by side during a rollout.
+func Decode(data []byte, contentType string) (Envelope, error) {
+	switch contentType {
+	case ContentTypeAvro:
+		// every version starts with schema_version, an avro int is a zigzag varint
+		version, n := binary.Varint(data)
+		if n <= 0 {
+			return Envelope{}, fmt.Errorf("failed to decode avro envelope: no schema version")
+		}
+		writerSchema, ok := envelopeAvro[int(version)]
+		if !ok {
+			return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+		}
+		var env Envelope
+		if err := avro.Unmarshal(writerSchema, data, &env); err != nil {
+			return Envelope{}, fmt.Errorf("failed to decode avro envelope: %w", err)
+		}
+		return env, checkVersion(env)
+	case "", ContentTypeJSON:
+		return decodeJSON(data)
+	default:
+		return Envelope{}, fmt.Errorf("%w: content type %q", ErrUnknownFormat, contentType)
+	}
+}
+
+func decodeJSON(data []byte) (Envelope, error) {
+	var probe struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return Envelope{}, fmt.Errorf("failed to decode json: %w", err)
+	}
+
+	if probe.SchemaVersion == nil {
+		var notification Notification
+		if err := json.Unmarshal(data, &notification); err != nil {
+			return Envelope{}, fmt.Errorf("failed to decode legacy notification: %w", err)
+		}
+		return Envelope{
+			SchemaVersion: LegacyVersion,
+			Type:          TypeNotification,
+			Payload:       notification,
+		}, nil
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, fmt.Errorf("failed to decode json envelope: %w", err)
+	}
+	return env, checkVersion(env)
+}
+
+func checkVersion(env Envelope) error {
+	if env.SchemaVersion < 1 || env.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.SchemaVersion)
+	}
+	if env.Type != TypeNotification {
+		return fmt.Errorf("%w: unknown type %q", ErrUnsupportedVersion, env.Type)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+)
+
+func testNotification() Notification {
+	return Notification{
+		From:        User{ID: 1, Name: "Emma", Groups: []string{"friends"}},
+		To:          User{ID: 2, Name: "Bruno", Groups: []string{"friends", "work"}, Locale: "pt-BR"},
+		Message:     "hi",
+		BroadcastID: "b1",
+		Group:       "friends",
+		Content: &Content{
+			Template:  "mention",
+			Locale:    "pt",
+			Variables: map[string]string{"excerpt": "hi"},
+			Rendered:  true,
+			Title:     "Emma mencionou você",
+			Body:      "Emma mencionou você: \"hi\"",
+			ActionURL: "/posts/1",
+			Priority:  PriorityHigh,
+		},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, format := range []Format{FormatJSON, FormatAvro} {
+		if got, err := ParseFormat(string(format)); err != nil || got != format {
+			t.Errorf("ParseFormat(%q) = %q, %v", format, got, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("ParseFormat(xml) = %v, want ErrUnknownFormat", err)
+	}
+
+	headers := FormatAvro.Headers()
+	if headers[HeaderContentType] != ContentTypeAvro || headers[HeaderSchemaVersion] != strconv.Itoa(SchemaVersion) {
+		t.Errorf("avro headers = %v", headers)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	env, err := NewEnvelope(testNotification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.SchemaVersion != SchemaVersion || env.Type != TypeNotification || len(env.EventID) != 32 {
+		t.Fatalf("NewEnvelope = %+v", env)
+	}
+
+	for _, format := range []Format{FormatJSON, FormatAvro} {
+		t.Run(string(format), func(t *testing.T) {
+			data, err := Encode(env, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(data, format.ContentType())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.CreatedAt.Equal(env.CreatedAt) {
+				t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, env.CreatedAt)
+			}
+			got.CreatedAt = env.CreatedAt
+			if !reflect.DeepEqual(got, env) {
+				t.Errorf("Decode = %+v, want %+v", got, env)
+			}
+		})
+	}
+
+	if _, err := Encode(env, "xml"); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Encode(xml) = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		wantVersion int
+		wantMessage string
+		wantErr     error
+	}{
+		{
+			name:        "legacy notification",
+			data:        `{"from": {"id": 1, "name": "Emma"}, "to": {"id": 2, "name": "Bruno"}, "message": "old"}`,
+			wantVersion: LegacyVersion,
+			wantMessage: "old",
+		},
+		{
+			name:        "envelope",
+			data:        `{"schema_version": 1, "type": "notification", "payload": {"message": "new"}}`,
+			contentType: ContentTypeJSON,
+			wantVersion: 1,
+			wantMessage: "new",
+		},
+		{name: "newer version", data: `{"schema_version": 3, "type": "notification"}`, wantErr: ErrUnsupportedVersion},
+		{name: "version zero", data: `{"schema_version": 0, "type": "notification"}`, wantErr: ErrUnsupportedVersion},
+		{name: "unknown type", data: `{"schema_version": 1, "type": "invoice"}`, wantErr: ErrUnsupportedVersion},
+		{name: "unknown content type", data: `{}`, contentType: "text/xml", wantErr: ErrUnknownFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := Decode([]byte(tt.data), tt.contentType)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if env.SchemaVersion != tt.wantVersion || env.Type != TypeNotification || env.Payload.Message != tt.wantMessage {
+				t.Errorf("Decode = %+v, want version %d with %q", env, tt.wantVersion, tt.wantMessage)
+			}
+		})
+	}
+
+	for _, data := range []string{`not json`, `{"schema_version": "1"}`} {
+		if _, err := Decode([]byte(data), ContentTypeJSON); err == nil {
+			t.Errorf("Decode(%s) succeeded", data)
+		}
+	}
+	if _, err := Decode([]byte{0xff}, ContentTypeAvro); err == nil {
+		t.Error("Decode of broken avro succeeded")
+	}
+}
+
+func TestDecodeAvroV1(t *testing.T) {
+	// what producers wrote before version 2, without locale and content
+	v1 := Envelope{
+		SchemaVersion: 1,
+		EventID:       "e1",
+		CreatedAt:     time.UnixMilli(1700000000000),
+		Type:          TypeNotification,
+		Payload: Notification{
+			From:    User{ID: 1, Name: "Emma"},
+			To:      User{ID: 2, Name: "Bruno"},
+			Message: "hi",
+		},
+	}
+	data, err := avro.Marshal(envelopeAvroV1, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(data, ContentTypeAvro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(v1.CreatedAt) {
+		t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, v1.CreatedAt)
+	}
+	got.CreatedAt = v1.CreatedAt
+	if !reflect.DeepEqual(got, v1) {
+		t.Errorf("Decode = %+v, want %+v", got, v1)
+	}
+
+	newer, err := avro.Marshal(envelopeAvroV2, Envelope{SchemaVersion: 3, Type: TypeNotification})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(newer, ContentTypeAvro); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Decode of avro version 3 = %v, want ErrUnsupportedVersion", err)
+	}
+}
@@ -0,0 +1,44 @@
+package schema
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// SchemaVersion is the envelope version this module writes. Version 2
+	// added the user locale and the structured content, consumers must be
+	// upgraded before the producers start writing it.
+	SchemaVersion = 2
+	// LegacyVersion marks a bare notification from before the envelope existed.
+	LegacyVersion = 0
+
+	TypeNotification = "notification"
+)
+
+// Envelope wraps every notification on the wire.
+type Envelope struct {
+	SchemaVersion int          `json:"schema_version" avro:"schema_version"`
+	EventID       string       `json:"event_id" avro:"event_id"`
+	CreatedAt     time.Time    `json:"created_at" avro:"created_at"`
+	Type          string       `json:"type" avro:"type"`
+	Payload       Notification `json:"payload" avro:"payload"`
+}
+
+// NewEnvelope wraps a notification with a fresh event ID.
+func NewEnvelope(notification Notification) (Envelope, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		SchemaVersion: SchemaVersion,
+		EventID:       hex.EncodeToString(id),
+		// avro keeps milliseconds, so both formats carry the same value
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+		Type:      TypeNotification,
+		Payload:   notification,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package schema
+
+// User is who sends and receives notifications.
+type User struct {
+	ID   int    `json:"id" yaml:"id" avro:"id"`
+	Name string `json:"name" yaml:"name" avro:"name"`
+	// Groups are the channels the user receives broadcasts for
+	Groups []string `json:"groups,omitempty" yaml:"groups,omitempty" avro:"groups"`
+	// Locale picks the language of templated notifications, like "fr" or "pt-BR"
+	Locale string `json:"locale,omitempty" yaml:"locale,omitempty" avro:"locale"`
+}
+
+// Notification priorities, clients decide how loud each one is.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+// Content is the structured part of a notification. It is either rendered,
+// Title, Body and ActionURL are final, or raw: the Template, Locale and
+// Variables are kept for the consumer API to render per client.
+type Content struct {
+	Template  string            `json:"template,omitempty" avro:"template"`
+	Locale    string            `json:"locale,omitempty" avro:"locale"`
+	Variables map[string]string `json:"variables,omitempty" avro:"variables"`
+	Rendered  bool              `json:"rendered" avro:"rendered"`
+
+	Title     string `json:"title,omitempty" avro:"title"`
+	Body      string `json:"body,omitempty" avro:"body"`
+	ActionURL string `json:"action_url,omitempty" avro:"action_url"`
+	Priority  string `json:"priority,omitempty" avro:"priority"`
+}
+
+// Notification is the payload the producer sends to one recipient.
+type Notification struct {
+	From    User   `json:"from" avro:"from"`
+	To      User   `json:"to" avro:"to"`
+	Message string `json:"message" avro:"message"`
+	// BroadcastID is shared by all copies of one broadcast, Group is empty
+	// when it went to all users
+	BroadcastID string `json:"broadcast_id,omitempty" avro:"broadcast_id"`
+	Group       string `json:"group,omitempty" avro:"group"`
+	// Content is nil for plain text notifications. Message is always set, for
+	// raw content it is rendered in the recipient's locale for older clients
+	Content *Content `json:"content,omitempty" avro:"content"`
+}
@@ -0,0 +1,30 @@
+package templates
+
+import "schema"
+
+// Builtin are the templates every deployment has.
+func Builtin() []Template {
+	return []Template{
+		{
+			Name:     "friend_request",
+			Priority: schema.PriorityNormal,
+			Locales: map[string]Texts{
+				"en": {Title: "New friend request", Body: "{{.from}} wants to be your friend.", ActionURL: "/users/{{.from_id}}"},
+				"fr": {Title: "Nouvelle demande d'ami", Body: "{{.from}} souhaite devenir votre ami.", ActionURL: "/users/{{.from_id}}"},
+				"es": {Title: "Nueva solicitud de amistad", Body: "{{.from}} quiere ser tu amigo.", ActionURL: "/users/{{.from_id}}"},
+				"pt": {Title: "Novo pedido de amizade", Body: "{{.from}} quer ser seu amigo.", ActionURL: "/users/{{.from_id}}"},
+			},
+		},
+		{
+			// needs the excerpt and url variables
+			Name:     "mention",
+			Priority: schema.PriorityHigh,
+			Locales: map[string]Texts{
+				"en": {Title: "{{.from}} mentioned you", Body: "{{.from}} mentioned you: \"{{.excerpt}}\"", ActionURL: "{{.url}}"},
+				"fr": {Title: "{{.from}} vous a mentionné", Body: "{{.from}} vous a mentionné : « {{.excerpt}} »", ActionURL: "{{.url}}"},
+				"es": {Title: "{{.from}} te mencionó", Body: "{{.from}} te mencionó: \"{{.excerpt}}\"", ActionURL: "{{.url}}"},
+				"pt": {Title: "{{.from}} mencionou você", Body: "{{.from}} mencionou você: \"{{.excerpt}}\"", ActionURL: "{{.url}}"},
+			},
+		},
+	}
+}
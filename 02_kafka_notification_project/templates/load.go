@@ -0,0 +1,31 @@
+package templates
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-yaml"
+)
+
+type file struct {
+	Templates []Template `yaml:"templates"`
+}
+
+// Load builds the catalog of the built in templates plus the ones of path,
+// a YAML or JSON file with a templates list. An empty path only has the
+// built in ones.
+func Load(path, defaultLocale string) (*Catalog, error) {
+	templates := Builtin()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read templates: %w", err)
+		}
+		var f file
+		if err := yaml.UnmarshalWithOptions(data, &f, yaml.DisallowUnknownField()); err != nil {
+			return nil, fmt.Errorf("failed to parse templates %s: %w", path, err)
+		}
+		templates = append(templates, f.Templates...)
+	}
+	return NewCatalog(defaultLocale, templates...)
+}
@@ -0,0 +1,56 @@
+package templates
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTemplates(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "templates.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	catalog, err := Load("", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := catalog.Names(); !reflect.DeepEqual(names, []string{"friend_request", "mention"}) {
+		t.Errorf("Names = %v, want the built in templates", names)
+	}
+
+	path := writeTemplates(t, `
+templates:
+  - name: deploy
+    priority: low
+    locales:
+      en:
+        title: "{{.service}} deployed"
+        body: "{{.from}} deployed {{.service}}."
+`)
+	catalog, err = Load(path, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := catalog.Names(); !reflect.DeepEqual(names, []string{"deploy", "friend_request", "mention"}) {
+		t.Errorf("Names = %v, want deploy and the built in templates", names)
+	}
+
+	for name, data := range map[string]string{
+		"unknown field":     "templates:\n  - name: deploy\n    color: red\n",
+		"no default locale": "templates:\n  - name: deploy\n    locales:\n      fr:\n        title: salut\n",
+	} {
+		if _, err := Load(writeTemplates(t, data), "en"); err == nil {
+			t.Errorf("Load with %s = nil error, want one", name)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), "en"); err == nil {
+		t.Error("Load of a missing file = nil error, want one")
+	}
+}
@@ -0,0 +1,209 @@
+// Package templates renders named notification templates, like
+// friend_request or mention, in the locale of the recipient or the client.
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"schema"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	ErrUnknownTemplate = errors.New("unknown template")
+	ErrInvalidContent  = errors.New("invalid content")
+)
+
+// Priorities a notification can have, empty means normal.
+var Priorities = []string{schema.PriorityLow, schema.PriorityNormal, schema.PriorityHigh, schema.PriorityUrgent}
+
+// Texts are the parts of a template in one locale, Go text/template syntax
+// over the variables: {{.from}} sent you a friend request.
+type Texts struct {
+	Title     string `json:"title" yaml:"title"`
+	Body      string `json:"body" yaml:"body"`
+	ActionURL string `json:"action_url" yaml:"action_url"`
+}
+
+type Template struct {
+	Name     string `json:"name" yaml:"name"`
+	Priority string `json:"priority" yaml:"priority"`
+	// Locales maps a locale, like "en" or "pt-BR", to its texts
+	Locales map[string]Texts `json:"locales" yaml:"locales"`
+}
+
+type compiledTexts struct {
+	title, body, actionURL *template.Template
+}
+
+type compiled struct {
+	Template
+	locales map[string]compiledTexts
+}
+
+// Catalog holds the templates by name.
+type Catalog struct {
+	defaultLocale string
+	templates     map[string]*compiled
+}
+
+// NewCatalog compiles the templates, a later template replaces an earlier
+// one with the same name. Every template needs the default locale.
+func NewCatalog(defaultLocale string, templates ...Template) (*Catalog, error) {
+	c := &Catalog{defaultLocale: defaultLocale, templates: make(map[string]*compiled)}
+	for _, t := range templates {
+		if t.Name == "" {
+			return nil, errors.New("a template has no name")
+		}
+		if t.Priority != "" && !slices.Contains(Priorities, t.Priority) {
+			return nil, fmt.Errorf("template %s: unknown priority %q", t.Name, t.Priority)
+		}
+		if _, ok := t.Locales[defaultLocale]; !ok {
+			return nil, fmt.Errorf("template %s: no texts for the default locale %s", t.Name, defaultLocale)
+		}
+
+		found := &compiled{Template: t, locales: make(map[string]compiledTexts)}
+		for locale, texts := range t.Locales {
+			var parsed compiledTexts
+			var err error
+			name := t.Name + "/" + locale
+			parse := func(part, text string) *template.Template {
+				if err != nil {
+					return nil
+				}
+				var tmpl *template.Template
+				// a missing variable is an error rather than "<no value>"
+				tmpl, err = template.New(name + "/" + part).Option("missingkey=error").Parse(text)
+				return tmpl
+			}
+			parsed.title = parse("title", texts.Title)
+			parsed.body = parse("body", texts.Body)
+			parsed.actionURL = parse("action_url", texts.ActionURL)
+			if err != nil {
+				return nil, fmt.Errorf("template %s: %w", name, err)
+			}
+			found.locales[strings.ToLower(locale)] = parsed
+		}
+		c.templates[t.Name] = found
+	}
+	return c, nil
+}
+
+// Names lists the templates, for error messages and the API.
+func (c *Catalog) Names() []string {
+	names := make([]string, 0, len(c.templates))
+	for name := range c.templates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Templates returns the definitions, sorted by name.
+func (c *Catalog) Templates() []Template {
+	list := make([]Template, 0, len(c.templates))
+	for _, name := range c.Names() {
+		list = append(list, c.templates[name].Template)
+	}
+	return list
+}
+
+// locale picks the first of the candidates the template has, trying "pt"
+// for "pt-BR", and falls back to the default locale.
+func (c *Catalog) locale(t *compiled, candidates ...string) string {
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(strings.ReplaceAll(candidate, "_", "-"))
+		if candidate == "" {
+			continue
+		}
+		if _, ok := t.locales[candidate]; ok {
+			return candidate
+		}
+		if language, _, ok := strings.Cut(candidate, "-"); ok {
+			if _, ok := t.locales[language]; ok {
+				return language
+			}
+		}
+	}
+	return strings.ToLower(c.defaultLocale)
+}
+
+// Render turns raw content into rendered content. The locale asked for wins
+// over the one stored in the content, then the recipient's. from, to and
+// from_id are always available to the templates. Content that is already
+// rendered only gets checked.
+func (c *Catalog) Render(content schema.Content, from, to schema.User, locale string) (schema.Content, error) {
+	if content.Rendered || content.Template == "" {
+		content.Rendered = true
+		return content, Check(content)
+	}
+	t, ok := c.templates[content.Template]
+	if !ok {
+		return content, fmt.Errorf("%w %q, known: %s", ErrUnknownTemplate, content.Template, strings.Join(c.Names(), ", "))
+	}
+
+	variables := make(map[string]string, len(content.Variables)+3)
+	for name, value := range content.Variables {
+		variables[name] = value
+	}
+	variables["from"] = from.Name
+	variables["from_id"] = strconv.Itoa(from.ID)
+	variables["to"] = to.Name
+
+	chosen := c.locale(t, locale, content.Locale, to.Locale)
+	texts := t.locales[chosen]
+	execute := func(tmpl *template.Template) (string, error) {
+		var out strings.Builder
+		if err := tmpl.Execute(&out, variables); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidContent, err)
+		}
+		return out.String(), nil
+	}
+
+	rendered := schema.Content{
+		Template:  content.Template,
+		Locale:    chosen,
+		Variables: content.Variables,
+		Rendered:  true,
+		Priority:  content.Priority,
+	}
+	if rendered.Priority == "" {
+		rendered.Priority = t.Priority
+	}
+	var err error
+	if rendered.Title, err = execute(texts.title); err != nil {
+		return content, err
+	}
+	if rendered.Body, err = execute(texts.body); err != nil {
+		return content, err
+	}
+	if rendered.ActionURL, err = execute(texts.actionURL); err != nil {
+		return content, err
+	}
+	return rendered, Check(rendered)
+}
+
+// Check validates rendered content: some text, a known priority and an
+// action URL that is relative or http(s), never javascript: and the like.
+func Check(content schema.Content) error {
+	if content.Title == "" && content.Body == "" {
+		return fmt.Errorf("%w: title or body is required", ErrInvalidContent)
+	}
+	if content.Priority != "" && !slices.Contains(Priorities, content.Priority) {
+		return fmt.Errorf("%w: priority must be one of %s, got %q", ErrInvalidContent, strings.Join(Priorities, ", "), content.Priority)
+	}
+	if content.ActionURL != "" {
+		action, err := url.Parse(content.ActionURL)
+		if err != nil {
+			return fmt.Errorf("%w: action_url: %v", ErrInvalidContent, err)
+		}
+		if action.Scheme != "" && action.Scheme != "http" && action.Scheme != "https" {
+			return fmt.Errorf("%w: action_url must be relative or http(s), got scheme %q", ErrInvalidContent, action.Scheme)
+		}
+	}
+	return nil
+}
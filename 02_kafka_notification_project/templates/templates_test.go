@@ -0,0 +1,193 @@
+package templates
+
+import (
+	"errors"
+	"reflect"
+	"schema"
+	"strings"
+	"testing"
+)
+
+var (
+	emma  = schema.User{ID: 1, Name: "Emma"}
+	bruno = schema.User{ID: 2, Name: "Bruno", Locale: "pt-BR"}
+	lena  = schema.User{ID: 4, Name: "Lena", Locale: "fr"}
+)
+
+func builtinCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	catalog, err := NewCatalog("en", Builtin()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func TestNewCatalog(t *testing.T) {
+	en := map[string]Texts{"en": {Title: "hi"}}
+	tests := []struct {
+		name     string
+		template Template
+		wantErr  string
+	}{
+		{name: "no name", template: Template{Locales: en}, wantErr: "no name"},
+		{name: "unknown priority", template: Template{Name: "t", Priority: "loud", Locales: en}, wantErr: "unknown priority"},
+		{name: "no default locale", template: Template{Name: "t", Locales: map[string]Texts{"fr": {Title: "salut"}}}, wantErr: "default locale"},
+		{name: "broken text", template: Template{Name: "t", Locales: map[string]Texts{"en": {Body: "{{.from"}}}, wantErr: "t/en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCatalog("en", tt.template); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewCatalog = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a later template replaces the built in one
+	custom := Template{Name: "mention", Locales: map[string]Texts{"en": {Title: "ping"}}}
+	catalog, err := NewCatalog("en", append(Builtin(), custom)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := catalog.Names(); !reflect.DeepEqual(names, []string{"friend_request", "mention"}) {
+		t.Errorf("Names = %v, want both built in templates", names)
+	}
+	if list := catalog.Templates(); len(list) != 2 || list[1].Locales["en"].Title != "ping" {
+		t.Errorf("Templates = %+v, want the custom mention", list)
+	}
+}
+
+func TestRender(t *testing.T) {
+	catalog := builtinCatalog(t)
+	mention := schema.Content{Template: "mention", Variables: map[string]string{"excerpt": "see you", "url": "/posts/7"}}
+
+	tests := []struct {
+		name       string
+		content    schema.Content
+		to         schema.User
+		locale     string
+		wantLocale string
+		wantTitle  string
+		wantBody   string
+		wantURL    string
+	}{
+		{
+			name:       "default locale",
+			content:    schema.Content{Template: "friend_request"},
+			to:         emma,
+			wantLocale: "en",
+			wantTitle:  "New friend request",
+			wantBody:   "Emma wants to be your friend.",
+			wantURL:    "/users/1",
+		},
+		{
+			name:       "recipient language of a region",
+			content:    mention,
+			to:         bruno,
+			wantLocale: "pt",
+			wantTitle:  "Emma mencionou você",
+			wantBody:   `Emma mencionou você: "see you"`,
+			wantURL:    "/posts/7",
+		},
+		{
+			name:       "stored locale over the recipient's",
+			content:    schema.Content{Template: "friend_request", Locale: "es"},
+			to:         lena,
+			wantLocale: "es",
+			wantTitle:  "Nueva solicitud de amistad",
+			wantBody:   "Emma quiere ser tu amigo.",
+			wantURL:    "/users/1",
+		},
+		{
+			name:       "asked locale over the stored one",
+			content:    schema.Content{Template: "friend_request", Locale: "es"},
+			to:         lena,
+			locale:     "fr_FR",
+			wantLocale: "fr",
+			wantTitle:  "Nouvelle demande d'ami",
+			wantBody:   "Emma souhaite devenir votre ami.",
+			wantURL:    "/users/1",
+		},
+		{
+			name:       "unknown locale",
+			content:    schema.Content{Template: "friend_request"},
+			to:         schema.User{ID: 5, Name: "Kai", Locale: "de"},
+			wantLocale: "en",
+			wantTitle:  "New friend request",
+			wantBody:   "Emma wants to be your friend.",
+			wantURL:    "/users/1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := catalog.Render(tt.content, emma, tt.to, tt.locale)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Rendered || got.Locale != tt.wantLocale || got.Title != tt.wantTitle || got.Body != tt.wantBody || got.ActionURL != tt.wantURL {
+				t.Errorf("Render = %+v, want %s: %q, %q, %q", got, tt.wantLocale, tt.wantTitle, tt.wantBody, tt.wantURL)
+			}
+			if got.Template != tt.content.Template || !reflect.DeepEqual(got.Variables, tt.content.Variables) {
+				t.Errorf("Render = %+v, want the template and variables kept", got)
+			}
+		})
+	}
+
+	t.Run("priority", func(t *testing.T) {
+		got, err := catalog.Render(mention, emma, bruno, "")
+		if err != nil || got.Priority != schema.PriorityHigh {
+			t.Errorf("Render = %+v, %v, want the template's priority", got, err)
+		}
+		urgent := mention
+		urgent.Priority = schema.PriorityUrgent
+		if got, err := catalog.Render(urgent, emma, bruno, ""); err != nil || got.Priority != schema.PriorityUrgent {
+			t.Errorf("Render = %+v, %v, want the sender's priority", got, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := catalog.Render(schema.Content{Template: "invoice"}, emma, bruno, ""); !errors.Is(err, ErrUnknownTemplate) {
+			t.Errorf("Render of an unknown template = %v, want ErrUnknownTemplate", err)
+		}
+		missing := schema.Content{Template: "mention", Variables: map[string]string{"excerpt": "see you"}}
+		if _, err := catalog.Render(missing, emma, bruno, ""); !errors.Is(err, ErrInvalidContent) {
+			t.Errorf("Render without the url variable = %v, want ErrInvalidContent", err)
+		}
+		script := schema.Content{Template: "mention", Variables: map[string]string{"excerpt": "see you", "url": "javascript:alert(1)"}}
+		if _, err := catalog.Render(script, emma, bruno, ""); !errors.Is(err, ErrInvalidContent) {
+			t.Errorf("Render to a javascript url = %v, want ErrInvalidContent", err)
+		}
+	})
+
+	t.Run("already rendered", func(t *testing.T) {
+		content := schema.Content{Title: "Deploy done", Body: "{{.from}} stays as is"}
+		got, err := catalog.Render(content, emma, bruno, "")
+		if err != nil || !got.Rendered || got.Body != content.Body {
+			t.Errorf("Render = %+v, %v, want the content only checked", got, err)
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		content schema.Content
+		valid   bool
+	}{
+		{schema.Content{Title: "hi"}, true},
+		{schema.Content{Body: "hi", Priority: schema.PriorityLow, ActionURL: "/users/1"}, true},
+		{schema.Content{Body: "hi", ActionURL: "https://example.com/x"}, true},
+		{schema.Content{}, false},
+		{schema.Content{Body: "hi", Priority: "loud"}, false},
+		{schema.Content{Body: "hi", ActionURL: "javascript:alert(1)"}, false},
+		{schema.Content{Body: "hi", ActionURL: "http://%zz"}, false},
+	}
+	for _, tt := range tests {
+		err := Check(tt.content)
+		if tt.valid && err != nil {
+			t.Errorf("Check(%+v) = %v, want valid", tt.content, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidContent) {
+			t.Errorf("Check(%+v) = %v, want ErrInvalidContent", tt.content, err)
+		}
+	}
+}